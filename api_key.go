@@ -0,0 +1,364 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUTH_ERROR              = "AuthError"
+	FORBIDDEN_ERROR         = "ForbiddenError"
+	API_KEY_HEADER          = "X-API-Key"
+	API_KEY_ID_PARAM        = "key_id"
+	API_KEY_EXPIRES_PARAM   = "expires"
+	API_KEY_SIGNATURE_PARAM = "signature"
+	ALL_APPLICATIONS        = "*"
+	API_KEY_QUERY           = "SELECT id, key_id, key_hash, description, app_names, scopes, created_at FROM prospects.api_keys WHERE key_id = $1 AND is_active = TRUE"
+	API_KEYS_CHANNEL        = "prospects_api_keys"
+	MAX_SIGNATURE_WINDOW    = 15 * time.Minute
+)
+
+var (
+	ErrMissingApiKey    = errors.New("API key required")
+	ErrInvalidApiKey    = errors.New("Invalid API key")
+	ErrExpiredSignature = errors.New("Signed request expired")
+)
+
+type ApiScope int
+
+const (
+	SubmitScope ApiScope = 1 << iota
+	ReadScope
+	AdminScope
+)
+
+func (scope ApiScope) String() string {
+	var scopes []string
+
+	if scope&SubmitScope != 0 {
+		scopes = append(scopes, "submit")
+	}
+
+	if scope&ReadScope != 0 {
+		scopes = append(scopes, "read")
+	}
+
+	if scope&AdminScope != 0 {
+		scopes = append(scopes, "admin")
+	}
+
+	return strings.Join(scopes, ",")
+}
+
+func ParseApiScopes(scopesStr string) (ApiScope, error) {
+	var scope ApiScope
+
+	for _, scopeStr := range strings.Split(strings.Trim(scopesStr, "{}"), ",") {
+		switch strings.TrimSpace(scopeStr) {
+		case "submit":
+			scope |= SubmitScope
+			break
+		case "read":
+			scope |= ReadScope
+			break
+		case "admin":
+			scope |= AdminScope
+			break
+		case "":
+			break
+		default:
+			return scope, fmt.Errorf("Invalid scope \"%s\" specified", scopeStr)
+		}
+	}
+
+	return scope, nil
+}
+
+type ApiKey struct {
+	Id          int64
+	KeyId       string
+	Description string
+	AppNames    []string
+	Scopes      ApiScope
+	CreatedAt   time.Time
+}
+
+// Admin keys implicitly carry every scope
+func (apiKey ApiKey) HasScope(scope ApiScope) bool {
+	return apiKey.Scopes&AdminScope != 0 || apiKey.Scopes&scope == scope
+}
+
+func (apiKey ApiKey) AllowsApp(appName string) bool {
+	for _, keyAppName := range apiKey.AppNames {
+		if keyAppName == ALL_APPLICATIONS || keyAppName == appName {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (apiKey ApiKey) AllowsAllApps() bool {
+	return apiKey.AllowsApp(ALL_APPLICATIONS)
+}
+
+// Keys are handed out as "<key id>.<secret>".  Only the key id and a hash of the full key are stored.
+func GenerateApiKey() (string, string, error) {
+	keyIdBytes := make([]byte, 8)
+	secretBytes := make([]byte, 24)
+
+	_, err := rand.Read(keyIdBytes)
+	if nil != err {
+		return "", "", err
+	}
+
+	_, err = rand.Read(secretBytes)
+	if nil != err {
+		return "", "", err
+	}
+
+	keyId := hex.EncodeToString(keyIdBytes)
+	return keyId, keyId + "." + hex.EncodeToString(secretBytes), nil
+}
+
+func HashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func GetApiKeyId(key string) string {
+	return strings.SplitN(key, ".", 2)[0]
+}
+
+// The signing key is an HMAC of the key's hash under the server's signing secret, so the hashes in
+// the api_keys table aren't enough to sign requests
+func getApiKeySigningKey(signingSecret string, keyHash string) []byte {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(keyHash))
+	return mac.Sum(nil)
+}
+
+// Every query string parameter but the signature is signed, sorted by name so their order doesn't matter
+func getCanonicalQuery(values url.Values) string {
+	canonicalValues := make(url.Values)
+	for name, value := range values {
+		if name != API_KEY_SIGNATURE_PARAM {
+			canonicalValues[name] = value
+		}
+	}
+
+	return canonicalValues.Encode()
+}
+
+func getBodyHash(body []byte) string {
+	hash := sha256.Sum256(body)
+	return hex.EncodeToString(hash[:])
+}
+
+func getApiKeySignature(signingKey []byte, method string, path string, canonicalQuery string, bodyHash string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(method + "\n" + path + "\n" + canonicalQuery + "\n" + bodyHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type bodyHashContextKey struct{}
+
+// HashRequestBody reads the body, up to limit bytes, and puts it back for later handlers.  Its hash
+// is kept in the returned request's context, where Authenticate checks signed requests against it.
+func HashRequestBody(res http.ResponseWriter, req *http.Request, limit int64) (*http.Request, error) {
+	var body []byte
+	if nil != req.Body {
+		var err error
+		body, err = io.ReadAll(http.MaxBytesReader(res, req.Body, limit))
+		if nil != err {
+			return req, err
+		}
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return req.WithContext(context.WithValue(req.Context(), bodyHashContextKey{}, getBodyHash(body))), nil
+}
+
+// Produces the query string, with the given parameters, for callers that can't set the API key header.
+// The signature covers the method, path, query string and body.
+func SignApiKeyRequest(key string, signingSecret string, method string, path string, query url.Values, body []byte, expires time.Time) string {
+	values := make(url.Values)
+	for name, value := range query {
+		values[name] = value
+	}
+
+	values.Set(API_KEY_ID_PARAM, GetApiKeyId(key))
+	values.Set(API_KEY_EXPIRES_PARAM, strconv.FormatInt(expires.Unix(), 10))
+	values.Del(API_KEY_SIGNATURE_PARAM)
+
+	signature := getApiKeySignature(getApiKeySigningKey(signingSecret, HashApiKey(key)), method, path, getCanonicalQuery(values), getBodyHash(body))
+	return values.Encode() + "&" + API_KEY_SIGNATURE_PARAM + "=" + signature
+}
+
+func GetApiKey(db *sql.DB, keyId string) (*ApiKey, string, error) {
+	var (
+		apiKey      ApiKey
+		keyHash     string
+		description sql.NullString
+		appNames    string
+		scopes      string
+	)
+
+	err := db.QueryRow(API_KEY_QUERY, keyId).Scan(&apiKey.Id, &apiKey.KeyId, &keyHash, &description, &appNames, &scopes, &apiKey.CreatedAt)
+	if nil != err {
+		return nil, "", err
+	}
+
+	apiKey.Description = description.String
+	apiKey.AppNames = strings.Split(strings.Trim(appNames, "{}"), ",")
+	apiKey.Scopes, err = ParseApiScopes(scopes)
+
+	return &apiKey, keyHash, err
+}
+
+type cachedApiKey struct {
+	apiKey   *ApiKey
+	keyHash  string
+	cachedAt time.Time
+}
+
+// Signed requests are refused without a signing secret
+type ApiKeyAuthenticator struct {
+	Db            *sql.DB
+	CacheDuration time.Duration
+	SigningSecret string
+	cache         map[string]cachedApiKey
+	mutex         sync.Mutex
+}
+
+func NewApiKeyAuthenticator(db *sql.DB, cacheDuration time.Duration, signingSecret string) *ApiKeyAuthenticator {
+	apiKeyAuthenticator := new(ApiKeyAuthenticator)
+
+	apiKeyAuthenticator.Db = db
+	apiKeyAuthenticator.CacheDuration = cacheDuration
+	apiKeyAuthenticator.SigningSecret = signingSecret
+	apiKeyAuthenticator.cache = make(map[string]cachedApiKey)
+
+	return apiKeyAuthenticator
+}
+
+// Evict drops a key from the cache so its next use is checked against the database
+func (apiKeyAuthenticator *ApiKeyAuthenticator) Evict(keyId string) {
+	apiKeyAuthenticator.mutex.Lock()
+	delete(apiKeyAuthenticator.cache, keyId)
+	apiKeyAuthenticator.mutex.Unlock()
+}
+
+// Listen evicts a key on every notification sent to API_KEYS_CHANNEL, which the prospects.api_keys
+// trigger sends when a key is revoked or changed.  The whole cache is cleared after the listener
+// reconnects since notifications may have been missed.
+func (apiKeyAuthenticator *ApiKeyAuthenticator) Listen(dbCredentials DatabaseCredentials) (*pq.Listener, error) {
+	return listenForNotifications(dbCredentials, API_KEYS_CHANNEL, func(notification *pq.Notification) {
+		if nil != notification {
+			slog.Info("API key changed, evicting it from the cache", "key_id", notification.Extra)
+			apiKeyAuthenticator.Evict(notification.Extra)
+			return
+		}
+
+		slog.Info("API keys listener reconnected, clearing the cache")
+		apiKeyAuthenticator.mutex.Lock()
+		apiKeyAuthenticator.cache = make(map[string]cachedApiKey)
+		apiKeyAuthenticator.mutex.Unlock()
+	})
+}
+
+func (apiKeyAuthenticator *ApiKeyAuthenticator) lookup(keyId string) (*ApiKey, string, error) {
+	apiKeyAuthenticator.mutex.Lock()
+	cached, exists := apiKeyAuthenticator.cache[keyId]
+	apiKeyAuthenticator.mutex.Unlock()
+
+	if exists && time.Since(cached.cachedAt) < apiKeyAuthenticator.CacheDuration {
+		return cached.apiKey, cached.keyHash, nil
+	}
+
+	apiKey, keyHash, err := GetApiKey(apiKeyAuthenticator.Db, keyId)
+	if sql.ErrNoRows == err {
+		return nil, "", ErrInvalidApiKey
+	} else if nil != err {
+		return nil, "", err
+	}
+
+	apiKeyAuthenticator.mutex.Lock()
+	apiKeyAuthenticator.cache[keyId] = cachedApiKey{apiKey, keyHash, time.Now()}
+	apiKeyAuthenticator.mutex.Unlock()
+
+	return apiKey, keyHash, nil
+}
+
+// Authenticates either the API key header or signed query string parameters
+func (apiKeyAuthenticator *ApiKeyAuthenticator) Authenticate(req *http.Request) (*ApiKey, error) {
+	if key := req.Header.Get(API_KEY_HEADER); len(key) > 0 {
+		apiKey, keyHash, err := apiKeyAuthenticator.lookup(GetApiKeyId(key))
+		if nil != err {
+			return nil, err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(HashApiKey(key)), []byte(keyHash)) != 1 {
+			return nil, ErrInvalidApiKey
+		}
+
+		return apiKey, nil
+	}
+
+	values := req.URL.Query()
+	keyId := values.Get(API_KEY_ID_PARAM)
+	expiresStr := values.Get(API_KEY_EXPIRES_PARAM)
+	signature := values.Get(API_KEY_SIGNATURE_PARAM)
+
+	if len(keyId) == 0 || len(expiresStr) == 0 || len(signature) == 0 {
+		return nil, ErrMissingApiKey
+	} else if len(apiKeyAuthenticator.SigningSecret) == 0 {
+		return nil, ErrInvalidApiKey
+	}
+
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if nil != err {
+		return nil, ErrInvalidApiKey
+	}
+
+	expiresAt := time.Unix(expires, 0)
+	if time.Now().After(expiresAt) || time.Until(expiresAt) > MAX_SIGNATURE_WINDOW {
+		return nil, ErrExpiredSignature
+	}
+
+	apiKey, keyHash, err := apiKeyAuthenticator.lookup(keyId)
+	if nil != err {
+		return nil, err
+	}
+
+	//Requests whose body wasn't hashed, like the read API's, are signed with an empty body
+	bodyHash, hashed := req.Context().Value(bodyHashContextKey{}).(string)
+	if !hashed {
+		bodyHash = getBodyHash(nil)
+	}
+
+	signingKey := getApiKeySigningKey(apiKeyAuthenticator.SigningSecret, keyHash)
+	expectedSignature := getApiKeySignature(signingKey, req.Method, req.URL.Path, getCanonicalQuery(values), bodyHash)
+	if !hmac.Equal([]byte(signature), []byte(expectedSignature)) {
+		return nil, ErrInvalidApiKey
+	}
+
+	return apiKey, nil
+}
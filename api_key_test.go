@@ -0,0 +1,184 @@
+package common
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_API_KEY        = "3f2a9c0d1b7e4a55.0123456789abcdef0123456789abcdef0123456789abcdef"
+	TEST_SIGNING_SECRET = "test signing secret"
+)
+
+func newTestApiKeyAuthenticator(signingSecret string) *ApiKeyAuthenticator {
+	apiKeyAuthenticator := NewApiKeyAuthenticator(nil, time.Hour, signingSecret)
+	apiKey := &ApiKey{Id: 1, KeyId: GetApiKeyId(TEST_API_KEY), AppNames: []string{TEST_APP_NAME}, Scopes: SubmitScope | ReadScope}
+	apiKeyAuthenticator.cache[apiKey.KeyId] = cachedApiKey{apiKey, HashApiKey(TEST_API_KEY), time.Now()}
+	return apiKeyAuthenticator
+}
+
+func newTestSignedRequest(t *testing.T, method string, path string, query string, body string) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path+"?"+query, strings.NewReader(body))
+	req, err := HashRequestBody(httptest.NewRecorder(), req, 1024)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestApiKeyAuthenticateHeader(t *testing.T) {
+	apiKeyAuthenticator := newTestApiKeyAuthenticator(TEST_SIGNING_SECRET)
+
+	tests := []struct {
+		name string
+		key  string
+		err  error
+	}{
+		{"valid", TEST_API_KEY, nil},
+		{"wrong secret", GetApiKeyId(TEST_API_KEY) + ".0000", ErrInvalidApiKey},
+		{"missing", "", ErrMissingApiKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/leads", nil)
+			if len(test.key) > 0 {
+				req.Header.Set(API_KEY_HEADER, test.key)
+			}
+
+			apiKey, err := apiKeyAuthenticator.Authenticate(req)
+			if err != test.err {
+				t.Fatalf("Authenticate error = %v, want %v", err, test.err)
+			} else if nil == err && apiKey.KeyId != GetApiKeyId(TEST_API_KEY) {
+				t.Errorf("Authenticate key id = %s, want %s", apiKey.KeyId, GetApiKeyId(TEST_API_KEY))
+			}
+		})
+	}
+}
+
+func TestApiKeyAuthenticateSigned(t *testing.T) {
+	body := `{"appname": "tremont", "leadsource": "landing"}`
+	query := url.Values{"app_name": []string{TEST_APP_NAME}}
+	expires := time.Now().Add(5 * time.Minute)
+	signed := SignApiKeyRequest(TEST_API_KEY, TEST_SIGNING_SECRET, http.MethodPost, "/prospects", query, []byte(body), expires)
+
+	tests := []struct {
+		name          string
+		signingSecret string
+		method        string
+		path          string
+		query         string
+		body          string
+		err           error
+	}{
+		{"valid", TEST_SIGNING_SECRET, http.MethodPost, "/prospects", signed, body, nil},
+		{"other method", TEST_SIGNING_SECRET, http.MethodPut, "/prospects", signed, body, ErrInvalidApiKey},
+		{"other path", TEST_SIGNING_SECRET, http.MethodPost, "/prospects/batch", signed, body, ErrInvalidApiKey},
+		{"other body", TEST_SIGNING_SECRET, http.MethodPost, "/prospects", signed, `{"appname": "laconia", "leadsource": "landing"}`, ErrInvalidApiKey},
+		{"empty body", TEST_SIGNING_SECRET, http.MethodPost, "/prospects", signed, "", ErrInvalidApiKey},
+		{"other query", TEST_SIGNING_SECRET, http.MethodPost, "/prospects", strings.Replace(signed, TEST_APP_NAME, "laconia", 1), body, ErrInvalidApiKey},
+		{"added parameter", TEST_SIGNING_SECRET, http.MethodPost, "/prospects", signed + "&limit=1", body, ErrInvalidApiKey},
+		{"other signing secret", "other secret", http.MethodPost, "/prospects", signed, body, ErrInvalidApiKey},
+		{"no signing secret", "", http.MethodPost, "/prospects", signed, body, ErrInvalidApiKey},
+		{"missing signature", TEST_SIGNING_SECRET, http.MethodPost, "/prospects", "app_name=tremont&key_id=3f2a9c0d1b7e4a55&expires=1", body, ErrMissingApiKey},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			apiKeyAuthenticator := newTestApiKeyAuthenticator(test.signingSecret)
+			req := newTestSignedRequest(t, test.method, test.path, test.query, test.body)
+
+			_, err := apiKeyAuthenticator.Authenticate(req)
+			if err != test.err {
+				t.Errorf("Authenticate error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestApiKeyAuthenticateSignedExpiry(t *testing.T) {
+	apiKeyAuthenticator := newTestApiKeyAuthenticator(TEST_SIGNING_SECRET)
+
+	tests := []struct {
+		name    string
+		expires time.Time
+		err     error
+	}{
+		{"within window", time.Now().Add(MAX_SIGNATURE_WINDOW - time.Minute), nil},
+		{"expired", time.Now().Add(-time.Second), ErrExpiredSignature},
+		{"beyond window", time.Now().Add(MAX_SIGNATURE_WINDOW + time.Minute), ErrExpiredSignature},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed := SignApiKeyRequest(TEST_API_KEY, TEST_SIGNING_SECRET, http.MethodGet, "/leads", nil, nil, test.expires)
+
+			//Requests without a hashed body, like the read API's, are signed with an empty one
+			req := httptest.NewRequest(http.MethodGet, "/leads?"+signed, nil)
+
+			_, err := apiKeyAuthenticator.Authenticate(req)
+			if err != test.err {
+				t.Errorf("Authenticate error = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestHashRequestBody(t *testing.T) {
+	body := strings.Repeat("x", 16)
+
+	req, err := HashRequestBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/prospects", strings.NewReader(body)), 16)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	//The body is still there for binding
+	read, err := io.ReadAll(req.Body)
+	if nil != err || string(read) != body {
+		t.Errorf("body after hashing = %q, %v, want %q", read, err, body)
+	}
+
+	_, err = HashRequestBody(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/prospects", strings.NewReader(body+"x")), 16)
+	if nil == err {
+		t.Error("HashRequestBody over the limit succeeded")
+	}
+}
+
+func TestApiKeyAuthenticatorEvict(t *testing.T) {
+	apiKeyAuthenticator := newTestApiKeyAuthenticator(TEST_SIGNING_SECRET)
+	keyId := GetApiKeyId(TEST_API_KEY)
+
+	apiKeyAuthenticator.Evict("unknown")
+	if _, exists := apiKeyAuthenticator.cache[keyId]; !exists {
+		t.Fatal("Evicting another key id removed the cached key")
+	}
+
+	apiKeyAuthenticator.Evict(keyId)
+	if _, exists := apiKeyAuthenticator.cache[keyId]; exists {
+		t.Error("Evicted key is still cached")
+	}
+}
+
+func TestSignApiKeyRequestExpires(t *testing.T) {
+	expires := time.Unix(1700000000, 0)
+	values, err := url.ParseQuery(SignApiKeyRequest(TEST_API_KEY, TEST_SIGNING_SECRET, http.MethodGet, "/leads", url.Values{API_KEY_SIGNATURE_PARAM: []string{"stale"}}, nil, expires))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if values.Get(API_KEY_EXPIRES_PARAM) != strconv.FormatInt(expires.Unix(), 10) {
+		t.Errorf("expires = %s, want %d", values.Get(API_KEY_EXPIRES_PARAM), expires.Unix())
+	} else if values.Get(API_KEY_ID_PARAM) != GetApiKeyId(TEST_API_KEY) {
+		t.Errorf("key id = %s, want %s", values.Get(API_KEY_ID_PARAM), GetApiKeyId(TEST_API_KEY))
+	} else if len(values[API_KEY_SIGNATURE_PARAM]) != 1 || values.Get(API_KEY_SIGNATURE_PARAM) == "stale" {
+		t.Errorf("signature = %q, want one fresh signature", values[API_KEY_SIGNATURE_PARAM])
+	}
+}
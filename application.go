@@ -0,0 +1,302 @@
+package common
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	APPLICATIONS_QUERY   = "SELECT app_name, string_size_limit, feedback_size_limit, array_to_string(lead_sources, ','), array_to_string(allowed_origins, ','), verify_redirect_url, botdetect_field_location, botdetect_field_name, botdetect_field_value, botdetect_must_match, botdetect_play_coy, botdetect_threshold, botdetect_shadow, origin_mismatch, ip_rate_limit, ip_rate_burst, lead_rate_limit, lead_rate_burst, pow_required, phone_region FROM prospects.applications WHERE is_active = TRUE"
+	APPLICATIONS_CHANNEL = "prospects_applications"
+)
+
+// OriginMismatch is what happens to a submission from an origin the application doesn't allow
+type OriginMismatch int
+
+const (
+	RejectOrigin OriginMismatch = 1 << iota
+	FlagOrigin
+)
+
+func (originMismatch OriginMismatch) String() string {
+	switch originMismatch {
+	case RejectOrigin:
+		return "reject"
+	case FlagOrigin:
+		return "flag"
+	default:
+		return "unknown"
+	}
+}
+
+// Application holds the settings of one application name.  Settings left NULL in
+// prospects.applications take the server wide defaults.
+type Application struct {
+	AppName           string
+	Registered        bool
+	StringSizeLimit   int
+	FeedbackSizeLimit int
+	LeadSources       map[string]bool
+	AllowedOrigins    []string
+	VerifyRedirectUrl string
+	BotDetection      BotDetection
+	OriginMismatch    OriginMismatch
+	IpRateLimit       RateLimit
+	LeadRateLimit     RateLimit
+	ProofOfWork       bool
+	//Region national phone numbers are parsed in, inferred from the submission when empty
+	PhoneRegion string
+}
+
+// AllowsLeadSource is true when the application doesn't restrict lead sources or lists this one
+func (application Application) AllowsLeadSource(leadSource string) bool {
+	return nil == application.LeadSources || application.LeadSources[leadSource]
+}
+
+// AllowsOrigin is true when the application doesn't restrict origins or lists this one.  Origins
+// are compared without case and a trailing slash.
+func (application Application) AllowsOrigin(origin string) bool {
+	if len(application.AllowedOrigins) == 0 {
+		return true
+	}
+
+	origin = strings.TrimSuffix(origin, "/")
+	for _, allowedOrigin := range application.AllowedOrigins {
+		if strings.EqualFold(origin, strings.TrimSuffix(allowedOrigin, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ApplicationRegistry caches prospects.applications and reloads it when notified of a change
+type ApplicationRegistry struct {
+	Db           *sql.DB
+	Defaults     Application
+	applications map[string]Application
+	mutex        sync.RWMutex
+}
+
+func NewApplicationRegistry(db *sql.DB, defaults Application) *ApplicationRegistry {
+	applicationRegistry := new(ApplicationRegistry)
+
+	applicationRegistry.Db = db
+	applicationRegistry.Defaults = defaults
+	applicationRegistry.applications = make(map[string]Application)
+
+	return applicationRegistry
+}
+
+func splitArray(arrayStr sql.NullString) []string {
+	if !arrayStr.Valid || len(arrayStr.String) == 0 {
+		return nil
+	}
+
+	return strings.Split(arrayStr.String, ",")
+}
+
+func (applicationRegistry *ApplicationRegistry) scanApplication(rows *sql.Rows) (Application, error) {
+	var (
+		stringSizeLimit        sql.NullInt64
+		feedbackSizeLimit      sql.NullInt64
+		leadSources            sql.NullString
+		allowedOrigins         sql.NullString
+		verifyRedirectUrl      sql.NullString
+		botDetectFieldLocation sql.NullString
+		botDetectFieldName     sql.NullString
+		botDetectFieldValue    sql.NullString
+		botDetectMustMatch     sql.NullBool
+		botDetectPlayCoy       sql.NullBool
+		botDetectThreshold     sql.NullFloat64
+		botDetectShadow        sql.NullBool
+		originMismatch         sql.NullString
+		ipRateLimit            sql.NullInt64
+		ipRateBurst            sql.NullInt64
+		leadRateLimit          sql.NullInt64
+		leadRateBurst          sql.NullInt64
+		powRequired            sql.NullBool
+		phoneRegion            sql.NullString
+	)
+
+	application := applicationRegistry.Defaults
+	application.Registered = true
+
+	err := rows.Scan(&application.AppName, &stringSizeLimit, &feedbackSizeLimit, &leadSources, &allowedOrigins, &verifyRedirectUrl,
+		&botDetectFieldLocation, &botDetectFieldName, &botDetectFieldValue, &botDetectMustMatch, &botDetectPlayCoy, &botDetectThreshold, &botDetectShadow, &originMismatch,
+		&ipRateLimit, &ipRateBurst, &leadRateLimit, &leadRateBurst, &powRequired, &phoneRegion)
+	if nil != err {
+		return application, err
+	}
+
+	if stringSizeLimit.Valid {
+		application.StringSizeLimit = int(stringSizeLimit.Int64)
+	}
+
+	if feedbackSizeLimit.Valid {
+		application.FeedbackSizeLimit = int(feedbackSizeLimit.Int64)
+	}
+
+	if leadSourcesArr := splitArray(leadSources); nil != leadSourcesArr {
+		application.LeadSources = make(map[string]bool)
+		for _, leadSource := range leadSourcesArr {
+			application.LeadSources[leadSource] = true
+		}
+	}
+
+	if allowedOriginsArr := splitArray(allowedOrigins); nil != allowedOriginsArr {
+		application.AllowedOrigins = allowedOriginsArr
+	}
+
+	if verifyRedirectUrl.Valid {
+		application.VerifyRedirectUrl = verifyRedirectUrl.String
+	}
+
+	if botDetectFieldLocation.Valid && botDetectFieldLocation.String == "header" {
+		application.BotDetection.FieldLocation = Header
+	} else if botDetectFieldLocation.Valid {
+		application.BotDetection.FieldLocation = Body
+	}
+
+	if botDetectFieldName.Valid {
+		application.BotDetection.FieldName = botDetectFieldName.String
+	}
+
+	if botDetectFieldValue.Valid {
+		application.BotDetection.FieldValue = botDetectFieldValue.String
+	}
+
+	if botDetectMustMatch.Valid {
+		application.BotDetection.MustMatch = botDetectMustMatch.Bool
+	}
+
+	if botDetectPlayCoy.Valid {
+		application.BotDetection.PlayCoy = botDetectPlayCoy.Bool
+	}
+
+	if botDetectThreshold.Valid {
+		application.BotDetection.Threshold = botDetectThreshold.Float64
+	}
+
+	if botDetectShadow.Valid {
+		application.BotDetection.Shadow = botDetectShadow.Bool
+	}
+
+	if originMismatch.Valid && originMismatch.String == "flag" {
+		application.OriginMismatch = FlagOrigin
+	} else if originMismatch.Valid {
+		application.OriginMismatch = RejectOrigin
+	}
+
+	if ipRateLimit.Valid {
+		application.IpRateLimit.PerMinute = int(ipRateLimit.Int64)
+	}
+
+	if ipRateBurst.Valid {
+		application.IpRateLimit.Burst = int(ipRateBurst.Int64)
+	}
+
+	if leadRateLimit.Valid {
+		application.LeadRateLimit.PerMinute = int(leadRateLimit.Int64)
+	}
+
+	if leadRateBurst.Valid {
+		application.LeadRateLimit.Burst = int(leadRateBurst.Int64)
+	}
+
+	if powRequired.Valid {
+		application.ProofOfWork = powRequired.Bool
+	}
+
+	if phoneRegion.Valid {
+		application.PhoneRegion = phoneRegion.String
+	}
+
+	return application, nil
+}
+
+// Load replaces every cached application.  On error the previous applications are kept.
+func (applicationRegistry *ApplicationRegistry) Load() error {
+	rows, err := applicationRegistry.Db.Query(APPLICATIONS_QUERY)
+	if nil != err {
+		return err
+	}
+
+	defer rows.Close()
+
+	applications := make(map[string]Application)
+	for rows.Next() {
+		application, err := applicationRegistry.scanApplication(rows)
+		if nil != err {
+			return err
+		}
+
+		applications[application.AppName] = application
+	}
+
+	err = rows.Err()
+	if nil != err {
+		return err
+	}
+
+	applicationRegistry.mutex.Lock()
+	applicationRegistry.applications = applications
+	applicationRegistry.mutex.Unlock()
+
+	slog.Info("Loaded applications", "count", len(applications))
+
+	return nil
+}
+
+// Get returns the application's settings, or the defaults when it isn't registered
+func (applicationRegistry *ApplicationRegistry) Get(appName string) Application {
+	applicationRegistry.mutex.RLock()
+	application, exists := applicationRegistry.applications[appName]
+	applicationRegistry.mutex.RUnlock()
+
+	if !exists {
+		application = applicationRegistry.Defaults
+		application.AppName = appName
+	}
+
+	return application
+}
+
+// Applications returns every registered application ordered by name
+func (applicationRegistry *ApplicationRegistry) Applications() []Application {
+	applicationRegistry.mutex.RLock()
+	applications := make([]Application, 0, len(applicationRegistry.applications))
+	for _, application := range applicationRegistry.applications {
+		applications = append(applications, application)
+	}
+	applicationRegistry.mutex.RUnlock()
+
+	sort.Slice(applications, func(i, j int) bool {
+		return applications[i].AppName < applications[j].AppName
+	})
+
+	return applications
+}
+
+// Listen reloads the applications on every notification sent to APPLICATIONS_CHANNEL, which the
+// prospects.applications trigger sends on any change.  Applications are also reloaded after the
+// listener reconnects since notifications may have been missed.
+func (applicationRegistry *ApplicationRegistry) Listen(dbCredentials DatabaseCredentials) (*pq.Listener, error) {
+	return listenForNotifications(dbCredentials, APPLICATIONS_CHANNEL, func(notification *pq.Notification) {
+		//A nil notification means the connection was re-established
+		if nil != notification {
+			slog.Info("Application changed, reloading applications", "app_name", notification.Extra)
+		} else {
+			slog.Info("Applications listener reconnected, reloading applications")
+		}
+
+		err := applicationRegistry.Load()
+		if nil != err {
+			slog.Error("Error reloading applications", "error", err)
+		}
+	})
+}
@@ -1,107 +1,536 @@
 package common
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
 	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type ProcessFunction func([]interface{}, *sync.WaitGroup)
+// ProcessFunction handles a batch and returns one error per item, nil for items that succeeded.
+// A nil slice means every item succeeded.
+type ProcessFunction[T any] func(context.Context, []T) []error
+type EncodeFunction[T any] func(T) ([]byte, error)
+type DecodeFunction[T any] func([]byte) (T, error)
 
-type BatchProcessor struct {
-	ProcessFunc     ProcessFunction
+// DeadLetterFunction receives items that failed permanently or exhausted their retries.  It returns an
+// error when the item couldn't be kept, leaving a spooled item in the spool.
+type DeadLetterFunction[T any] func(context.Context, T, error) error
+
+// PermanentError marks an item error that retrying won't fix, such as a constraint violation
+type PermanentError struct {
+	Err error
+}
+
+func (permanentError PermanentError) Error() string {
+	return permanentError.Err.Error()
+}
+
+func (permanentError PermanentError) Unwrap() error {
+	return permanentError.Err
+}
+
+func Permanent(err error) error {
+	if nil == err {
+		return nil
+	}
+
+	return PermanentError{err}
+}
+
+func IsPermanent(err error) bool {
+	var permanentError PermanentError
+	return errors.As(err, &permanentError)
+}
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 10 * time.Second, Multiplier: 2}
+
+// Backoff returns how long to wait before the given retry, starting at attempt 1
+func (retryPolicy RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(retryPolicy.InitialBackoff) * math.Pow(retryPolicy.Multiplier, float64(attempt-1))
+	if retryPolicy.MaxBackoff > 0 && backoff > float64(retryPolicy.MaxBackoff) {
+		return retryPolicy.MaxBackoff
+	}
+
+	return time.Duration(backoff)
+}
+
+type BatchProcessor[T any] struct {
+	ProcessFunc     ProcessFunction[T]
 	ProcessInterval time.Duration
+	MaxBatchSize    int
+	MaxLatency      time.Duration
 	ThreadCount     int
-	Events          chan interface{}
-	Running         bool
+	Events          chan T
 	WaitGroup       sync.WaitGroup
+	RetryPolicy     RetryPolicy
+	DeadLetterFunc  DeadLetterFunction[T]
+	Spool           *Spool
+	EncodeFunc      EncodeFunction[T]
+	DecodeFunc      DecodeFunction[T]
+	FlushObserver   func(int)
+	collected       int64
+	running         atomic.Bool
+	spooled         int
+	spoolMutex      sync.Mutex
+	spoolPending    chan bool
+	spoolFull       chan bool
+	stop            chan bool
+	stopOnce        sync.Once
+	cancel          context.CancelFunc
 }
 
-func NewBatchProcessor(processFunc ProcessFunction, requestQueueSize int, processInterval int, threadCount int) *BatchProcessor {
-	batchProcessor := new(BatchProcessor)
+// A max batch size or max latency of zero disables that flush trigger, leaving only the process interval
+func NewBatchProcessor[T any](processFunc ProcessFunction[T], requestQueueSize int, processInterval int, threadCount int, maxBatchSize int, maxLatency time.Duration) *BatchProcessor[T] {
+	batchProcessor := new(BatchProcessor[T])
 
-	batchProcessor.Events = make(chan interface{}, requestQueueSize)
+	batchProcessor.Events = make(chan T, requestQueueSize)
 	batchProcessor.ProcessInterval = time.Duration(processInterval)
+	batchProcessor.MaxBatchSize = maxBatchSize
+	batchProcessor.MaxLatency = maxLatency
 	batchProcessor.ThreadCount = threadCount
 	batchProcessor.ProcessFunc = processFunc
+	batchProcessor.RetryPolicy = DefaultRetryPolicy
+	batchProcessor.spoolPending = make(chan bool, 1)
+	batchProcessor.spoolFull = make(chan bool, 1)
+	batchProcessor.stop = make(chan bool)
 
 	return batchProcessor
 }
 
-func (batchProcessor *BatchProcessor) AddEvent(event interface{}) {
+// EnableSpool makes the spool, rather than the in memory channel, the queue of events.
+// Events are encoded into the spool by AddEvent and decoded again when processed.
+func (batchProcessor *BatchProcessor[T]) EnableSpool(spool *Spool, encodeFunc EncodeFunction[T], decodeFunc DecodeFunction[T]) {
+	batchProcessor.Spool = spool
+	batchProcessor.EncodeFunc = encodeFunc
+	batchProcessor.DecodeFunc = decodeFunc
+}
+
+// EnableDeadLetter sets the retry policy and where items go once they fail for good
+func (batchProcessor *BatchProcessor[T]) EnableDeadLetter(retryPolicy RetryPolicy, deadLetterFunc DeadLetterFunction[T]) {
+	batchProcessor.RetryPolicy = retryPolicy
+	batchProcessor.DeadLetterFunc = deadLetterFunc
+}
+
+func notify(channel chan bool) {
+	select {
+	case channel <- true:
+	default:
+	}
+}
+
+func (batchProcessor *BatchProcessor[T]) AddEvent(event T) error {
+	if nil != batchProcessor.Spool {
+		record, err := batchProcessor.EncodeFunc(event)
+		if nil != err {
+			return err
+		}
+
+		err = batchProcessor.Spool.Append(record)
+		if nil != err {
+			return err
+		}
+
+		//Wake the processing thread to start the latency deadline or flush a full batch
+		batchProcessor.spoolMutex.Lock()
+		batchProcessor.spooled++
+		spooled := batchProcessor.spooled
+		batchProcessor.spoolMutex.Unlock()
+
+		if spooled == 1 {
+			notify(batchProcessor.spoolPending)
+		}
+
+		if batchProcessor.MaxBatchSize > 0 && spooled >= batchProcessor.MaxBatchSize {
+			notify(batchProcessor.spoolFull)
+		}
+
+		return nil
+	}
+
 	batchProcessor.Events <- event
+	return nil
+}
+
+// QueueDepth is the number of events waiting for the next flush
+func (batchProcessor *BatchProcessor[T]) QueueDepth() int {
+	if nil != batchProcessor.Spool {
+		batchProcessor.spoolMutex.Lock()
+		defer batchProcessor.spoolMutex.Unlock()
+
+		return batchProcessor.spooled
+	}
+
+	return len(batchProcessor.Events) + int(atomic.LoadInt64(&batchProcessor.collected))
+}
+
+// QueueCapacity is the most events that can wait for a flush, or zero when spooled to disk
+func (batchProcessor *BatchProcessor[T]) QueueCapacity() int {
+	if nil != batchProcessor.Spool {
+		return 0
+	}
+
+	return cap(batchProcessor.Events)
 }
 
-func (batchProcessor *BatchProcessor) Stop() {
-	batchProcessor.Running = false
+// Running is true from Start until Stop or Close, and is safe to read from request handlers
+func (batchProcessor *BatchProcessor[T]) Running() bool {
+	return batchProcessor.running.Load()
+}
+
+// Stop returns once the processing thread has flushed every queued event
+func (batchProcessor *BatchProcessor[T]) Stop() {
+	batchProcessor.running.Store(false)
+	batchProcessor.stopOnce.Do(func() {
+		close(batchProcessor.stop)
+	})
 	batchProcessor.WaitGroup.Wait()
+
+	if nil != batchProcessor.cancel {
+		batchProcessor.cancel()
+	}
 }
 
-func (batchProcessor *BatchProcessor) Start() {
-	go batchProcessor.process()
+// Close closes the events channel and returns once everything queued has been flushed.
+// Nothing may call AddEvent after Close.
+func (batchProcessor *BatchProcessor[T]) Close() {
+	batchProcessor.running.Store(false)
+	close(batchProcessor.Events)
+	batchProcessor.WaitGroup.Wait()
+
+	if nil != batchProcessor.cancel {
+		batchProcessor.cancel()
+	}
 }
 
-func (batchProcessor *BatchProcessor) process() {
-	log.Print("Started batch writing thread")
+// The context is handed to every process and dead letter call.  Cancelling it abandons pending retries.
+func (batchProcessor *BatchProcessor[T]) Start(ctx context.Context) {
+	ctx, batchProcessor.cancel = context.WithCancel(ctx)
 
-	batchProcessor.Running = true
+	batchProcessor.running.Store(true)
 	batchProcessor.WaitGroup.Add(1)
+	go batchProcessor.process(ctx)
+}
+
+func (batchProcessor *BatchProcessor[T]) process(ctx context.Context) {
+	Logger(ctx).Info("Started batch writing thread")
+
 	defer batchProcessor.WaitGroup.Done()
 
-	for batchProcessor.Running {
-		time.Sleep(batchProcessor.ProcessInterval * time.Second)
+	ticker := time.NewTicker(batchProcessor.ProcessInterval * time.Second)
+	defer ticker.Stop()
 
-		var elements []interface{}
-		processing := true
-		for processing {
+	//Deadline for the oldest unflushed event, only armed while events are pending
+	deadline := time.NewTimer(batchProcessor.MaxLatency)
+	deadline.Stop()
+	defer deadline.Stop()
+	armed := false
+
+	armDeadline := func() {
+		if batchProcessor.MaxLatency > 0 && !armed {
+			deadline.Reset(batchProcessor.MaxLatency)
+			armed = true
+		}
+	}
+
+	disarmDeadline := func() {
+		if armed && !deadline.Stop() {
 			select {
-			case event, ok := <-batchProcessor.Events:
-				if ok {
+			case <-deadline.C:
+			default:
+			}
+		}
+		armed = false
+	}
+
+	var elements []T
+	flush := func() {
+		disarmDeadline()
+
+		if nil != batchProcessor.Spool {
+			batchProcessor.processSpool(ctx)
+		} else if len(elements) > 0 {
+			batchProcessor.dispatch(ctx, elements, &batchProcessor.WaitGroup)
+			elements = nil
+			atomic.StoreInt64(&batchProcessor.collected, 0)
+		}
+	}
+
+	//Replay anything spooled by a previous run before accepting new work
+	if nil != batchProcessor.Spool {
+		flush()
+	}
+
+	for {
+		select {
+		case event, ok := <-batchProcessor.Events:
+			if !ok {
+				Logger(ctx).Info("Select channel closed")
+				batchProcessor.running.Store(false)
+				flush()
+				Logger(ctx).Info("Stopped batch writing thread")
+				return
+			}
+
+			elements = append(elements, event)
+			atomic.StoreInt64(&batchProcessor.collected, int64(len(elements)))
+			armDeadline()
+
+			if batchProcessor.MaxBatchSize > 0 && len(elements) >= batchProcessor.MaxBatchSize {
+				flush()
+			}
+		case <-batchProcessor.spoolPending:
+			armDeadline()
+		case <-batchProcessor.spoolFull:
+			flush()
+		case <-deadline.C:
+			armed = false
+			flush()
+		case <-ticker.C:
+			flush()
+		case <-batchProcessor.stop:
+			//Drain whatever was queued before stopping
+			for draining := true; draining; {
+				select {
+				case event := <-batchProcessor.Events:
 					elements = append(elements, event)
-					break
-				} else {
-					log.Print("Select channel closed")
-					processing = false
-					batchProcessor.Running = false
-					break
+				default:
+					draining = false
 				}
-			default:
-				processing = false
-				break
 			}
+
+			flush()
+			Logger(ctx).Info("Stopped batch writing thread")
+			return
 		}
+	}
+}
+
+// Segments are only removed once every record has been committed, dead lettered or quarantined.  A
+// segment with records left over is rewritten with just those and kept for the next flush, along
+// with the segments after it.  Damaged and undecodable records can never be processed, so they are
+// quarantined rather than holding up their segment or being lost with it.
+func (batchProcessor *BatchProcessor[T]) processSpool(ctx context.Context) {
+	batchProcessor.spoolMutex.Lock()
+	batchProcessor.spooled = 0
+	batchProcessor.spoolMutex.Unlock()
 
-		if len(elements) <= 0 {
-			continue
+	logger := Logger(ctx)
+	err := batchProcessor.Spool.Rotate()
+	if nil != err {
+		logger.Error("Error rotating spool", "error", err)
+	}
+
+	segments, err := batchProcessor.Spool.Segments()
+	if nil != err {
+		logger.Error("Error listing spool segments", "error", err)
+		return
+	}
+
+	for _, segment := range segments {
+		records, quarantined, err := batchProcessor.Spool.ReadSegment(segment)
+		if nil != err {
+			logger.Error("Error reading spool segment", "segment", segment, "error", err)
+			return
 		}
 
-		log.Printf("Retrieved %d values.  Processing with %d connections", len(elements), batchProcessor.ThreadCount)
+		var (
+			elements       []T
+			elementRecords [][]byte
+		)
 
-		sliceSize := int(math.Floor(float64(len(elements) / batchProcessor.ThreadCount)))
-		remainder := len(elements) % batchProcessor.ThreadCount
-		start := 0
-		end := 0
+		for _, record := range records {
+			element, err := batchProcessor.DecodeFunc(record)
+			if nil != err {
+				logger.Error("Error decoding record from spool segment, quarantining it", "segment", segment, "error", err)
 
-		for iter := 0; iter < batchProcessor.ThreadCount; iter++ {
-			var leftover int
-			if remainder > 0 {
-				leftover = 1
-				remainder--
-			} else {
-				leftover = 0
+				var framed bytes.Buffer
+				writeRecord(&framed, record)
+				quarantined = append(quarantined, framed.Bytes()...)
+				continue
+			}
+
+			elements = append(elements, element)
+			elementRecords = append(elementRecords, record)
+		}
+
+		if len(quarantined) > 0 {
+			err = batchProcessor.Spool.Quarantine(segment, quarantined)
+			if nil != err {
+				logger.Error("Error quarantining damaged records of spool segment", "segment", segment, "bytes", len(quarantined), "error", err)
+				return
+			}
+
+			logger.Warn("Quarantined damaged records of spool segment", "segment", segment, "bytes", len(quarantined))
+		}
+
+		var results []error
+		if len(elements) > 0 {
+			var waitGroup sync.WaitGroup
+			results = batchProcessor.dispatch(ctx, elements, &waitGroup)
+			waitGroup.Wait()
+		}
+
+		var remaining [][]byte
+		for index, err := range results {
+			if nil != err {
+				remaining = append(remaining, elementRecords[index])
+			}
+		}
+
+		if len(remaining) == 0 {
+			err = batchProcessor.Spool.RemoveSegment(segment)
+		} else if len(remaining) < len(records) || len(quarantined) > 0 {
+			err = batchProcessor.Spool.ReplaceSegment(segment, remaining)
+		}
+
+		if nil != err {
+			logger.Error("Error removing processed records from spool segment", "segment", segment, "error", err)
+			return
+		}
+
+		if len(remaining) > 0 {
+			logger.Info("Keeping records in spool segment for the next flush", "segment", segment, "remaining", len(remaining), "records", len(records))
+			return
+		}
+	}
+}
+
+// The returned slice has an error for each element that was neither committed nor dead lettered,
+// and is only complete once the wait group is done
+func (batchProcessor *BatchProcessor[T]) dispatch(ctx context.Context, elements []T, waitGroup *sync.WaitGroup) []error {
+	Logger(ctx).Info("Retrieved values.  Processing", "count", len(elements), "connections", batchProcessor.ThreadCount)
+
+	if nil != batchProcessor.FlushObserver {
+		batchProcessor.FlushObserver(len(elements))
+	}
+
+	results := make([]error, len(elements))
+	sliceSize := int(math.Floor(float64(len(elements) / batchProcessor.ThreadCount)))
+	remainder := len(elements) % batchProcessor.ThreadCount
+	start := 0
+	end := 0
+
+	for iter := 0; iter < batchProcessor.ThreadCount; iter++ {
+		var leftover int
+		if remainder > 0 {
+			leftover = 1
+			remainder--
+		} else {
+			leftover = 0
+		}
+
+		end += sliceSize + leftover
+
+		if start == end {
+			break
+		}
+
+		waitGroup.Add(1)
+		go func(batch []T, batchResults []error) {
+			defer waitGroup.Done()
+			copy(batchResults, batchProcessor.processWithRetry(ctx, batch))
+		}(elements[start:end], results[start:end])
+
+		start = end
+	}
+
+	return results
+}
+
+// Retries only the failed items of a batch, backing off between attempts.  Returns an error for
+// each item that is left for the spool to retry.
+func (batchProcessor *BatchProcessor[T]) processWithRetry(ctx context.Context, batch []T) []error {
+	results := make([]error, len(batch))
+
+	pending := make([]int, len(batch))
+	for index := range pending {
+		pending[index] = index
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		items := make([]T, len(pending))
+		for index, batchIndex := range pending {
+			items[index] = batch[batchIndex]
+		}
+
+		itemErrors := batchProcessor.ProcessFunc(ctx, items)
+		if len(itemErrors) != 0 && len(itemErrors) != len(items) {
+			Logger(ctx).Warn("Process function returned the wrong number of errors", "errors", len(itemErrors), "items", len(items))
+		}
+
+		var retries []int
+		var lastErr error
+		for index, batchIndex := range pending {
+			var err error
+			if index < len(itemErrors) {
+				err = itemErrors[index]
 			}
 
-			end += sliceSize + leftover
+			if nil == err {
+				continue
+			}
 
-			if start == end {
-				break
+			lastErr = err
+			if nil != ctx.Err() && nil != batchProcessor.Spool {
+				//Left in the spool for the next run
+				results[batchIndex] = err
+			} else if IsPermanent(err) || attempt >= batchProcessor.RetryPolicy.MaxAttempts || nil != ctx.Err() {
+				results[batchIndex] = batchProcessor.deadLetter(ctx, batch[batchIndex], err)
+			} else {
+				retries = append(retries, batchIndex)
 			}
+		}
+
+		if len(retries) == 0 {
+			return results
+		}
+
+		backoff := batchProcessor.RetryPolicy.Backoff(attempt)
+		Logger(ctx).Warn("Retrying failed items", "count", len(retries), "backoff", backoff, "attempt", attempt, "error", lastErr)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
 
-			batchProcessor.WaitGroup.Add(1)
-			go batchProcessor.ProcessFunc(elements[start:end], &batchProcessor.WaitGroup)
+		pending = retries
+	}
 
-			start = end
+	return results
+}
+
+// Returns nil once the item is handed off, otherwise the error it stays in the spool for.  Without a
+// dead letter function only items that can't succeed, or aren't spooled, are dropped.
+func (batchProcessor *BatchProcessor[T]) deadLetter(ctx context.Context, item T, err error) error {
+	if nil == batchProcessor.DeadLetterFunc {
+		if nil != batchProcessor.Spool && !IsPermanent(err) {
+			return err
 		}
+
+		Logger(ctx).Error("Dropping failed item", "item", item, "error", err)
+		return nil
 	}
+
+	deadLetterErr := batchProcessor.DeadLetterFunc(ctx, item, err)
+	if nil != deadLetterErr {
+		if nil != batchProcessor.Spool {
+			Logger(ctx).Error("Error dead lettering item, keeping it in the spool", "item", item, "error", err, "dead_letter_error", deadLetterErr)
+		} else {
+			Logger(ctx).Error("Error dead lettering item, dropping it", "item", item, "error", err, "dead_letter_error", deadLetterErr)
+		}
+		return deadLetterErr
+	}
+
+	return nil
 }
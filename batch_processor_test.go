@@ -0,0 +1,284 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var errTestOutage = errors.New("database unavailable")
+
+func encodeTestEvent(event string) ([]byte, error) {
+	return []byte(event), nil
+}
+
+func decodeTestEvent(record []byte) (string, error) {
+	return string(record), nil
+}
+
+// Fails the events in the map with their error, every time they're processed
+func getTestProcessFunc(failures map[string]error) ProcessFunction[string] {
+	return func(ctx context.Context, events []string) []error {
+		itemErrors := make([]error, len(events))
+		for index, event := range events {
+			itemErrors[index] = failures[event]
+		}
+		return itemErrors
+	}
+}
+
+func getSpooledEvents(t *testing.T, spool *Spool) []string {
+	t.Helper()
+
+	segments, err := spool.Segments()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var events []string
+	for _, segment := range segments {
+		records, _, err := spool.ReadSegment(segment)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		for _, record := range records {
+			events = append(events, string(record))
+		}
+	}
+
+	sort.Strings(events)
+	return events
+}
+
+func TestProcessSpoolKeepsUnprocessedRecords(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  map[string]error
+		remaining []string
+	}{
+		{"all committed", nil, nil},
+		{"outage", map[string]error{"a": errTestOutage, "b": errTestOutage, "c": errTestOutage}, []string{"a", "b", "c"}},
+		{"one retryable failure", map[string]error{"b": errTestOutage}, []string{"b"}},
+		{"permanent failure dropped", map[string]error{"b": Permanent(errTestOutage)}, nil},
+		{"mixed failures", map[string]error{"a": Permanent(errTestOutage), "c": errTestOutage}, []string{"c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, 1<<20)
+
+			batchProcessor := NewBatchProcessor(getTestProcessFunc(test.failures), 10, 1, 2, 0, 0)
+			batchProcessor.EnableSpool(spool, encodeTestEvent, decodeTestEvent)
+			batchProcessor.EnableDeadLetter(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, Multiplier: 1}, nil)
+
+			for _, event := range []string{"a", "b", "c"} {
+				err := batchProcessor.AddEvent(event)
+				if nil != err {
+					t.Fatal(err)
+				}
+			}
+
+			batchProcessor.processSpool(context.Background())
+
+			remaining := getSpooledEvents(t, spool)
+			if !reflect.DeepEqual(remaining, test.remaining) {
+				t.Errorf("spool holds %q after processing, want %q", remaining, test.remaining)
+			}
+		})
+	}
+}
+
+func TestProcessSpoolKeepsRecordsDeadLetterFailed(t *testing.T) {
+	tests := []struct {
+		name          string
+		deadLetterErr error
+		remaining     []string
+	}{
+		{"dead lettered", nil, nil},
+		{"dead letter failed", errTestOutage, []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, 1<<20)
+
+			var deadLettered []string
+			deadLetterFunc := func(ctx context.Context, event string, err error) error {
+				deadLettered = append(deadLettered, event)
+				return test.deadLetterErr
+			}
+
+			failures := map[string]error{"a": Permanent(errTestOutage), "b": errTestOutage}
+			batchProcessor := NewBatchProcessor(getTestProcessFunc(failures), 10, 1, 1, 0, 0)
+			batchProcessor.EnableSpool(spool, encodeTestEvent, decodeTestEvent)
+			batchProcessor.EnableDeadLetter(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1}, deadLetterFunc)
+
+			for _, event := range []string{"a", "b", "c"} {
+				err := batchProcessor.AddEvent(event)
+				if nil != err {
+					t.Fatal(err)
+				}
+			}
+
+			batchProcessor.processSpool(context.Background())
+
+			if !reflect.DeepEqual(deadLettered, []string{"a", "b"}) {
+				t.Errorf("dead lettered %q, want [a b]", deadLettered)
+			}
+
+			if remaining := getSpooledEvents(t, spool); !reflect.DeepEqual(remaining, test.remaining) {
+				t.Errorf("spool holds %q after processing, want %q", remaining, test.remaining)
+			}
+		})
+	}
+}
+
+func TestProcessSpoolStopsAtKeptSegment(t *testing.T) {
+	spool := newTestSpool(t, 1)
+
+	processed := make(map[string]int)
+	processFunc := func(ctx context.Context, events []string) []error {
+		itemErrors := make([]error, len(events))
+		for index, event := range events {
+			processed[event]++
+			if event == "a" {
+				itemErrors[index] = errTestOutage
+			}
+		}
+		return itemErrors
+	}
+
+	batchProcessor := NewBatchProcessor(processFunc, 10, 1, 1, 0, 0)
+	batchProcessor.EnableSpool(spool, encodeTestEvent, decodeTestEvent)
+	batchProcessor.EnableDeadLetter(RetryPolicy{MaxAttempts: 1}, nil)
+
+	for _, event := range []string{"a", "b"} {
+		err := batchProcessor.AddEvent(event)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	batchProcessor.processSpool(context.Background())
+
+	if processed["b"] != 0 {
+		t.Errorf("segment after a kept segment was processed %d times, want 0", processed["b"])
+	}
+
+	if remaining := getSpooledEvents(t, spool); !reflect.DeepEqual(remaining, []string{"a", "b"}) {
+		t.Errorf("spool holds %q after processing, want [a b]", remaining)
+	}
+}
+
+func TestProcessSpoolQuarantinesDamagedRecords(t *testing.T) {
+	corrupted := getFramedRecord([]byte("b"))
+	corrupted[len(corrupted)-1] ^= 0xff
+	undecodable := getFramedRecord([]byte("undecodable"))
+
+	tests := []struct {
+		name      string
+		failures  map[string]error
+		remaining []string
+	}{
+		{"others committed", nil, nil},
+		{"others kept", map[string]error{"d": errTestOutage}, []string{"d"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, 1<<20)
+
+			contents := bytes.Join([][]byte{getFramedRecord([]byte("a")), corrupted, undecodable, getFramedRecord([]byte("d"))}, nil)
+			err := os.WriteFile(spool.segmentPath(1), contents, 0600)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			var processed []string
+			processFunc := func(ctx context.Context, events []string) []error {
+				processed = append(processed, events...)
+				return getTestProcessFunc(test.failures)(ctx, events)
+			}
+
+			decodeFunc := func(record []byte) (string, error) {
+				if string(record) == "undecodable" {
+					return "", errors.New("undecodable record")
+				}
+				return string(record), nil
+			}
+
+			batchProcessor := NewBatchProcessor(processFunc, 10, 1, 1, 0, 0)
+			batchProcessor.EnableSpool(spool, encodeTestEvent, decodeFunc)
+			batchProcessor.EnableDeadLetter(RetryPolicy{MaxAttempts: 1}, nil)
+
+			batchProcessor.processSpool(context.Background())
+
+			sort.Strings(processed)
+			if !reflect.DeepEqual(processed, []string{"a", "d"}) {
+				t.Errorf("processed %q, want [a d]", processed)
+			}
+
+			if remaining := getSpooledEvents(t, spool); !reflect.DeepEqual(remaining, test.remaining) {
+				t.Errorf("spool holds %q after processing, want %q", remaining, test.remaining)
+			}
+
+			quarantined, err := os.ReadFile(spool.quarantinePath(1))
+			if nil != err {
+				t.Fatal(err)
+			} else if expected := append(append([]byte{}, corrupted...), undecodable...); !bytes.Equal(quarantined, expected) {
+				t.Errorf("quarantine file holds %x, want %x", quarantined, expected)
+			}
+		})
+	}
+}
+
+func TestBatchProcessorRunning(t *testing.T) {
+	batchProcessor := NewBatchProcessor(getTestProcessFunc(nil), 10, 1, 1, 0, 0)
+	if batchProcessor.Running() {
+		t.Error("Running() before Start = true, want false")
+	}
+
+	batchProcessor.Start(context.Background())
+
+	//Read concurrently with Stop, as the readiness check and request handlers do
+	done := make(chan bool)
+	go func() {
+		for batchProcessor.Running() {
+		}
+		close(done)
+	}()
+
+	batchProcessor.Stop()
+	<-done
+
+	if batchProcessor.Running() {
+		t.Error("Running() after Stop = true, want false")
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	retryPolicy := RetryPolicy{MaxAttempts: 5, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+
+	tests := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+	}
+
+	for _, test := range tests {
+		if backoff := retryPolicy.Backoff(test.attempt); backoff != test.backoff {
+			t.Errorf("Backoff(%d) = %s, want %s", test.attempt, backoff, test.backoff)
+		}
+	}
+}
@@ -1,11 +1,26 @@
 package common
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	BOT_ERROR = "BotError"
+	BOT_ERROR                 = "BotError"
+	ACCEPT_LANGUAGE_HEADER    = "Accept-Language"
+	HONEYPOT_DETECTOR         = "honeypot"
+	FILL_TIME_DETECTOR        = "fill_time"
+	USER_AGENT_DETECTOR       = "user_agent"
+	ACCEPT_LANGUAGE_DETECTOR  = "accept_language"
+	VELOCITY_DETECTOR         = "velocity"
+	DISPOSABLE_EMAIL_DETECTOR = "disposable_email"
 )
 
 type RequestLocation int
@@ -22,31 +37,270 @@ const (
 	Last
 )
 
+// BotSignals is what detectors may look at.  Trusted submissions come from api key holders rather
+// than browsers, so detectors of browser behaviour skip them.  A batch carries many prospects in
+// one body without any form fields, so detectors of form fields skip it.
+type BotSignals struct {
+	Request   *http.Request
+	AppName   string
+	Email     string
+	IpAddress string
+	Trusted   bool
+	Batch     bool
+}
+
+// BotReason is a detector's contribution to a submission's score
+type BotReason struct {
+	Detector string
+	Score    float64
+	Detail   string
+}
+
+func (botReason BotReason) String() string {
+	return fmt.Sprintf("%s %.2f: %s", botReason.Detector, botReason.Score, botReason.Detail)
+}
+
+// BotDetector scores one signal.  A score of zero means the detector found nothing.
+type BotDetector interface {
+	Detect(signals BotSignals) (float64, string)
+	Name() string
+}
+
+type BotVerdict struct {
+	Score   float64
+	Reasons []BotReason
+	IsBot   bool
+}
+
+func (botVerdict BotVerdict) ReasonsString() string {
+	var reasons []string
+	for _, reason := range botVerdict.Reasons {
+		reasons = append(reasons, reason.String())
+	}
+
+	return strings.Join(reasons, "; ")
+}
+
+// BotDetection adds the scores of the honeypot field and the other detectors, and submissions
+// scoring at least the threshold are bots.  The honeypot settings may differ per application so
+// its detector is built from them rather than kept with the others.
 type BotDetection struct {
 	FieldLocation RequestLocation
 	FieldName     string
 	FieldValue    string
 	MustMatch     bool
 	PlayCoy       bool
+	Shadow        bool
+	HoneypotScore float64
+	Threshold     float64
+	Detectors     []BotDetector
+}
+
+func (botDetection BotDetection) Evaluate(signals BotSignals) BotVerdict {
+	var botVerdict BotVerdict
+
+	honeypot := HoneypotDetector{botDetection.FieldLocation, botDetection.FieldName, botDetection.FieldValue, botDetection.MustMatch, botDetection.HoneypotScore}
+	detectors := append([]BotDetector{honeypot}, botDetection.Detectors...)
+
+	for _, detector := range detectors {
+		score, detail := detector.Detect(signals)
+		if score > 0 {
+			botVerdict.Score += score
+			botVerdict.Reasons = append(botVerdict.Reasons, BotReason{detector.Name(), score, detail})
+		}
+	}
+
+	botVerdict.IsBot = botVerdict.Score > 0 && botVerdict.Score >= botDetection.Threshold
+
+	return botVerdict
+}
+
+// HoneypotDetector checks a field humans don't see or that a script on the page sets
+type HoneypotDetector struct {
+	FieldLocation RequestLocation
+	FieldName     string
+	FieldValue    string
+	MustMatch     bool
+	Score         float64
 }
 
-func (botDetection BotDetection) IsBot(req *http.Request) bool {
+func (honeypotDetector HoneypotDetector) Name() string {
+	return HONEYPOT_DETECTOR
+}
+
+func (honeypotDetector HoneypotDetector) Detect(signals BotSignals) (float64, string) {
 	var botField string
 
-	switch botDetection.FieldLocation {
+	switch honeypotDetector.FieldLocation {
 	case Header:
-		botField = req.Header.Get(botDetection.FieldName)
+		botField = signals.Request.Header.Get(honeypotDetector.FieldName)
 		break
 	case Body:
-		botField = req.FormValue(botDetection.FieldName)
+		if signals.Batch {
+			return 0, ""
+		}
+		botField = signals.Request.FormValue(honeypotDetector.FieldName)
 		break
 	}
 
-	if botDetection.MustMatch && botDetection.FieldValue == botField {
-		return false
-	} else if !botDetection.MustMatch && botDetection.FieldValue != botField {
-		return false
+	if honeypotDetector.MustMatch && honeypotDetector.FieldValue == botField {
+		return 0, ""
+	} else if !honeypotDetector.MustMatch && honeypotDetector.FieldValue != botField {
+		return 0, ""
+	}
+
+	return honeypotDetector.Score, fmt.Sprintf("field %s was \"%s\"", honeypotDetector.FieldName, botField)
+}
+
+// SignRenderTimestamp gives the value pages put in the render timestamp field when rendering a
+// form, "<unix seconds>.<hex HMAC-SHA256 of the seconds>"
+func SignRenderTimestamp(secret string, renderedAt time.Time) string {
+	timestamp := strconv.FormatInt(renderedAt.Unix(), 10)
+	return timestamp + "." + signRenderTimestamp(secret, timestamp)
+}
+
+func signRenderTimestamp(secret string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// FillTimeDetector scores forms submitted sooner after rendering than a person could fill them,
+// or without a valid render timestamp
+type FillTimeDetector struct {
+	FieldName   string
+	Secret      string
+	MinFillTime time.Duration
+	Score       float64
+}
+
+func (fillTimeDetector FillTimeDetector) Name() string {
+	return FILL_TIME_DETECTOR
+}
+
+func (fillTimeDetector FillTimeDetector) Detect(signals BotSignals) (float64, string) {
+	if signals.Trusted || signals.Batch {
+		return 0, ""
+	}
+
+	value := signals.Request.FormValue(fillTimeDetector.FieldName)
+	parts := strings.Split(value, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signRenderTimestamp(fillTimeDetector.Secret, parts[0]))) {
+		return fillTimeDetector.Score, fmt.Sprintf("missing or invalid %s", fillTimeDetector.FieldName)
+	}
+
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if nil != err {
+		return fillTimeDetector.Score, fmt.Sprintf("invalid %s", fillTimeDetector.FieldName)
+	}
+
+	fillTime := time.Since(time.Unix(seconds, 0))
+	if fillTime < fillTimeDetector.MinFillTime {
+		return fillTimeDetector.Score, fmt.Sprintf("filled in %s", fillTime.Round(time.Millisecond))
+	}
+
+	return 0, ""
+}
+
+// UserAgentDetector scores user agents matching any pattern, or no user agent at all
+type UserAgentDetector struct {
+	Patterns []*regexp.Regexp
+	Score    float64
+}
+
+func (userAgentDetector UserAgentDetector) Name() string {
+	return USER_AGENT_DETECTOR
+}
+
+func (userAgentDetector UserAgentDetector) Detect(signals BotSignals) (float64, string) {
+	if signals.Trusted {
+		return 0, ""
+	}
+
+	userAgent := signals.Request.UserAgent()
+	if len(userAgent) == 0 {
+		return userAgentDetector.Score, "no user agent"
+	}
+
+	for _, pattern := range userAgentDetector.Patterns {
+		if pattern.MatchString(userAgent) {
+			return userAgentDetector.Score, fmt.Sprintf("user agent matched %s", pattern)
+		}
+	}
+
+	return 0, ""
+}
+
+// AcceptLanguageDetector scores requests without the Accept-Language header every browser sends
+type AcceptLanguageDetector struct {
+	Score float64
+}
+
+func (acceptLanguageDetector AcceptLanguageDetector) Name() string {
+	return ACCEPT_LANGUAGE_DETECTOR
+}
+
+func (acceptLanguageDetector AcceptLanguageDetector) Detect(signals BotSignals) (float64, string) {
+	if signals.Trusted || len(signals.Request.Header.Get(ACCEPT_LANGUAGE_HEADER)) > 0 {
+		return 0, ""
+	}
+
+	return acceptLanguageDetector.Score, "no Accept-Language header"
+}
+
+// VelocityDetector scores ip addresses submitting faster than the rate limit allows.  Unlike rate
+// limiting the submission isn't refused by this alone.
+type VelocityDetector struct {
+	RateLimiter RateLimiter
+	RateLimit   RateLimit
+	Score       float64
+}
+
+func (velocityDetector VelocityDetector) Name() string {
+	return VELOCITY_DETECTOR
+}
+
+func (velocityDetector VelocityDetector) Detect(signals BotSignals) (float64, string) {
+	if len(signals.IpAddress) == 0 {
+		return 0, ""
+	}
+
+	taken, _, err := velocityDetector.RateLimiter.Take(signals.IpAddress, velocityDetector.RateLimit)
+	if nil != err || taken {
+		return 0, ""
+	}
+
+	return velocityDetector.Score, fmt.Sprintf("more than %d submissions a minute", velocityDetector.RateLimit.PerMinute)
+}
+
+// DisposableEmailDetector scores email addresses at throwaway mail domains, or their subdomains
+type DisposableEmailDetector struct {
+	Domains map[string]bool
+	Score   float64
+}
+
+func (disposableEmailDetector DisposableEmailDetector) Name() string {
+	return DISPOSABLE_EMAIL_DETECTOR
+}
+
+func (disposableEmailDetector DisposableEmailDetector) Detect(signals BotSignals) (float64, string) {
+	at := strings.LastIndex(signals.Email, "@")
+	if at < 0 {
+		return 0, ""
+	}
+
+	domain := strings.ToLower(signals.Email[at+1:])
+	for len(domain) > 0 {
+		if disposableEmailDetector.Domains[domain] {
+			return disposableEmailDetector.Score, fmt.Sprintf("disposable email domain %s", domain)
+		}
+
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			break
+		}
+		domain = domain[dot+1:]
 	}
 
-	return true
+	return 0, ""
 }
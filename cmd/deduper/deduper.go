@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	UNMATCHED_QUERY       = "SELECT id, email, phone_number, phone_e164, first_name, last_name, zip_code FROM prospects.leads WHERE person_id IS NULL AND suspected_bot = FALSE ORDER BY id ASC LIMIT $1"
+	CANDIDATES_QUERY      = "SELECT leads.person_id, leads.id, lead_match_keys.match_rule, lead_match_keys.full_name, persons.is_manual FROM prospects.lead_match_keys JOIN prospects.leads ON leads.id = lead_match_keys.lead_row_id JOIN prospects.persons ON persons.id = leads.person_id WHERE (lead_match_keys.match_rule = 'email' AND lead_match_keys.match_key = $1) OR (lead_match_keys.match_rule = 'phone' AND lead_match_keys.match_key = $2) OR (lead_match_keys.match_rule = 'name_zip' AND lead_match_keys.match_key = $3)"
+	INSERT_PERSON_QUERY   = "INSERT INTO prospects.persons(is_manual, created_at, updated_at) VALUES($1, $2, $3) RETURNING id"
+	ASSIGN_PERSON_QUERY   = "UPDATE prospects.leads SET person_id = $1, updated_at = $2 WHERE id = $3"
+	MOVE_PERSON_QUERY     = "UPDATE prospects.leads SET person_id = $1, updated_at = $2 WHERE person_id = $3 RETURNING id"
+	MERGED_PERSON_QUERY   = "UPDATE prospects.persons SET merged_into = $1, updated_at = $2 WHERE id = $3"
+	INSERT_KEY_QUERY      = "INSERT INTO prospects.lead_match_keys(lead_row_id, match_rule, match_key, full_name, created_at) VALUES($1, $2, $3, $4, $5) ON CONFLICT (lead_row_id, match_rule) DO NOTHING"
+	INSERT_DECISION_QUERY = "INSERT INTO prospects.merge_decisions(lead_row_id, person_id, previous_person_id, matched_id, match_rule, similarity, created_at) VALUES($1, $2, $3, $4, $5, $6, $7)"
+)
+
+type UnmatchedLead struct {
+	Id        int64
+	MatchKeys MatchKeys
+}
+
+// Match is an already matched lead sharing a key with the lead being matched
+type Match struct {
+	PersonId   int64
+	MatchedId  int64
+	Rule       MatchRule
+	Similarity float64
+	IsManual   bool
+}
+
+type DeduperConfig struct {
+	ProcessAmt     int     `config:"PROCESS_AMT" flag:"process_amt" default:"1000" min:"1" usage:"Amount of unmatched leads to process"`
+	NameSimilarity float64 `config:"NAME_SIMILARITY" default:"0.92" min:"0" max:"1" usage:"Jaro-Winkler similarity of first and last name required to match within a zip code"`
+	PhoneRegion    string  `config:"PHONE_REGION" default:"US" usage:"Region phone numbers of leads added before they were parsed at submission are parsed in"`
+	Database       common.DatabaseConfig
+	Log            common.LogConfig
+}
+
+func (config DeduperConfig) Validate() error {
+	if !common.IsPhoneRegion(config.PhoneRegion) {
+		return fmt.Errorf("PHONE_REGION %s is not a known region", config.PhoneRegion)
+	}
+
+	return nil
+}
+
+func getUnmatchedLeads(db *sql.DB, processAmt int, phoneRegion string) ([]UnmatchedLead, error) {
+	rows, err := db.Query(UNMATCHED_QUERY, processAmt)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var unmatchedLeads []UnmatchedLead
+	for rows.Next() {
+		var (
+			unmatchedLead UnmatchedLead
+			email         sql.NullString
+			phoneNumber   sql.NullString
+			phoneE164     sql.NullString
+			firstName     sql.NullString
+			lastName      sql.NullString
+			zipCode       sql.NullString
+		)
+
+		err = rows.Scan(&unmatchedLead.Id, &email, &phoneNumber, &phoneE164, &firstName, &lastName, &zipCode)
+		if nil != err {
+			return nil, err
+		}
+
+		unmatchedLead.MatchKeys = getMatchKeys(email.String, phoneNumber.String, phoneE164.String, firstName.String, lastName.String, zipCode.String, phoneRegion)
+		unmatchedLeads = append(unmatchedLeads, unmatchedLead)
+	}
+
+	return unmatchedLeads, rows.Err()
+}
+
+// Best match for each person sharing a key, names within the zip code must be similar enough.  The
+// most trusted match comes first.
+func getMatches(transaction *sql.Tx, matchKeys MatchKeys, nameSimilarity float64) ([]Match, error) {
+	rows, err := transaction.Query(CANDIDATES_QUERY, matchKeys.Email, matchKeys.Phone, matchKeys.ZipCode)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bestMatches := make(map[int64]Match)
+	for rows.Next() {
+		var (
+			match    Match
+			rule     string
+			fullName sql.NullString
+		)
+
+		err = rows.Scan(&match.PersonId, &match.MatchedId, &rule, &fullName, &match.IsManual)
+		if nil != err {
+			return nil, err
+		}
+
+		match.Rule = getMatchRule(rule)
+		if match.Rule == NameZipMatch {
+			match.Similarity = getSimilarity(matchKeys.FullName, fullName.String)
+			if match.Similarity < nameSimilarity {
+				continue
+			}
+		}
+
+		if bestMatch, exists := bestMatches[match.PersonId]; !exists || match.Rule < bestMatch.Rule {
+			bestMatches[match.PersonId] = match
+		}
+	}
+
+	err = rows.Err()
+	if nil != err {
+		return nil, err
+	}
+
+	matches := make([]Match, 0, len(bestMatches))
+	for _, match := range bestMatches {
+		matches = append(matches, match)
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Rule != matches[j].Rule {
+			return matches[i].Rule < matches[j].Rule
+		}
+		return matches[i].PersonId < matches[j].PersonId
+	})
+
+	return matches, nil
+}
+
+func recordDecision(transaction *sql.Tx, leadRowId int64, personId int64, previousPersonId int64, matchedId int64, rule MatchRule, similarity float64) error {
+	var (
+		previousPersonIdVal sql.NullInt64
+		matchedIdVal        sql.NullInt64
+		similarityVal       sql.NullFloat64
+	)
+
+	if previousPersonId > 0 {
+		previousPersonIdVal = sql.NullInt64{previousPersonId, true}
+	}
+
+	if matchedId > 0 {
+		matchedIdVal = sql.NullInt64{matchedId, true}
+	}
+
+	if rule == NameZipMatch {
+		similarityVal = sql.NullFloat64{similarity, true}
+	}
+
+	_, err := transaction.Exec(INSERT_DECISION_QUERY, leadRowId, personId, previousPersonIdVal, matchedIdVal, rule.String(), similarityVal, time.Now())
+	return err
+}
+
+// Moves every lead of one person to another, recording a decision for each
+func movePerson(transaction *sql.Tx, fromPersonId int64, toPersonId int64, matchedId int64, rule MatchRule, similarity float64) (int, error) {
+	rows, err := transaction.Query(MOVE_PERSON_QUERY, toPersonId, time.Now(), fromPersonId)
+	if nil != err {
+		return 0, err
+	}
+
+	var leadRowIds []int64
+	for rows.Next() {
+		var leadRowId int64
+		err = rows.Scan(&leadRowId)
+		if nil != err {
+			rows.Close()
+			return 0, err
+		}
+		leadRowIds = append(leadRowIds, leadRowId)
+	}
+
+	rows.Close()
+	err = rows.Err()
+	if nil != err {
+		return 0, err
+	}
+
+	for _, leadRowId := range leadRowIds {
+		err = recordDecision(transaction, leadRowId, toPersonId, fromPersonId, matchedId, rule, similarity)
+		if nil != err {
+			return 0, err
+		}
+	}
+
+	_, err = transaction.Exec(MERGED_PERSON_QUERY, toPersonId, time.Now(), fromPersonId)
+	return len(leadRowIds), err
+}
+
+func insertPerson(transaction *sql.Tx, isManual bool) (int64, error) {
+	var personId int64
+	err := transaction.QueryRow(INSERT_PERSON_QUERY, isManual, time.Now(), time.Now()).Scan(&personId)
+	return personId, err
+}
+
+// Assigns the lead to the person it matches best, or a new person.  A lead matching several people
+// links them, so they are merged unless one of them was changed by hand.
+func matchLead(db *sql.DB, unmatchedLead UnmatchedLead, nameSimilarity float64) (int64, MatchRule, error) {
+	transaction, err := db.Begin()
+	if nil != err {
+		return 0, 0, err
+	}
+
+	defer transaction.Rollback()
+
+	matches, err := getMatches(transaction, unmatchedLead.MatchKeys, nameSimilarity)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	var match Match
+	if len(matches) == 0 {
+		match.Rule = NewPerson
+		match.PersonId, err = insertPerson(transaction, false)
+		if nil != err {
+			return 0, 0, err
+		}
+	} else {
+		match = matches[0]
+
+		isManual := false
+		for _, otherMatch := range matches {
+			isManual = isManual || otherMatch.IsManual
+		}
+
+		for _, otherMatch := range matches[1:] {
+			if isManual {
+				slog.Info("Not merging people changed by hand", "lead_row_id", unmatchedLead.Id, "person_id", match.PersonId, "other_person_id", otherMatch.PersonId)
+				continue
+			}
+
+			count, err := movePerson(transaction, otherMatch.PersonId, match.PersonId, otherMatch.MatchedId, otherMatch.Rule, otherMatch.Similarity)
+			if nil != err {
+				return 0, 0, err
+			}
+
+			slog.Info("Merged people", "person_id", match.PersonId, "other_person_id", otherMatch.PersonId, "match_rule", otherMatch.Rule.String(), "leads", count)
+		}
+	}
+
+	_, err = transaction.Exec(ASSIGN_PERSON_QUERY, match.PersonId, time.Now(), unmatchedLead.Id)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	err = recordDecision(transaction, unmatchedLead.Id, match.PersonId, 0, match.MatchedId, match.Rule, match.Similarity)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	matchKeys := unmatchedLead.MatchKeys
+	for _, key := range []struct {
+		rule     MatchRule
+		value    string
+		fullName string
+	}{{EmailMatch, matchKeys.Email, ""}, {PhoneMatch, matchKeys.Phone, ""}, {NameZipMatch, matchKeys.ZipCode, matchKeys.FullName}} {
+		if len(key.value) == 0 {
+			continue
+		}
+
+		var fullName sql.NullString
+		if len(key.fullName) > 0 {
+			fullName = sql.NullString{key.fullName, true}
+		}
+
+		_, err = transaction.Exec(INSERT_KEY_QUERY, unmatchedLead.Id, key.rule.String(), key.value, fullName, time.Now())
+		if nil != err {
+			return 0, 0, err
+		}
+	}
+
+	return match.PersonId, match.Rule, transaction.Commit()
+}
+
+// Each lead is matched in its own transaction so later leads in the batch see earlier ones
+func process(db *sql.DB, config DeduperConfig) {
+	unmatchedLeads, err := getUnmatchedLeads(db, config.ProcessAmt, config.PhoneRegion)
+	if nil != err {
+		log.Fatal(err)
+	} else {
+		log.Printf("Successfully fetched %d unmatched leads", len(unmatchedLeads))
+	}
+
+	counts := make(map[MatchRule]int)
+	for _, unmatchedLead := range unmatchedLeads {
+		personId, rule, err := matchLead(db, unmatchedLead, config.NameSimilarity)
+		if nil != err {
+			slog.Error("Error matching lead", "lead_row_id", unmatchedLead.Id, "error", err)
+			continue
+		}
+
+		slog.Debug("Matched lead", "lead_row_id", unmatchedLead.Id, "person_id", personId, "match_rule", rule.String())
+		counts[rule]++
+	}
+
+	log.Printf("Matched %d leads, %d new people, %d by email, %d by phone and %d by name and zip code", len(unmatchedLeads), counts[NewPerson], counts[EmailMatch], counts[PhoneMatch], counts[NameZipMatch])
+}
+
+func main() {
+	var config DeduperConfig
+	args := common.MustLoadConfig("deduper", &config)
+	common.SetupLogging("deduper", config.Log)
+
+	//Database connection
+	log.Print("Enabling database connectivity")
+
+	db := config.Database.GetCredentials().GetDatabase()
+	defer db.Close()
+
+	if len(args) == 0 {
+		process(db, config)
+		return
+	}
+
+	switch args[0] {
+	case "merge":
+		runMergeCommand(db, args[1:])
+		break
+	case "unmerge":
+		runUnmergeCommand(db, args[1:])
+		break
+	case "list":
+		runListCommand(db, args[1:])
+		break
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: %s [merge|unmerge|list] [options]\n", os.Args[0])
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const TEST_DRIVER = "dedupertest"
+
+// A database/sql driver that answers queries starting with a prefix with its rows, and any other
+// query with the next id, remembering what it was asked so people can be matched without Postgres
+type testDatabase struct {
+	mutex     sync.Mutex
+	queries   []string
+	queryArgs [][]driver.Value
+	nextId    int64
+	rows      map[string][][]driver.Value
+}
+
+type testDriver struct{}
+type testConn struct{ database *testDatabase }
+type testStmt struct {
+	database *testDatabase
+	query    string
+}
+type testRows struct {
+	rows [][]driver.Value
+}
+
+var testDatabases = make(map[string]*testDatabase)
+var testDatabasesMutex sync.Mutex
+
+func init() {
+	sql.Register(TEST_DRIVER, testDriver{})
+}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testDatabasesMutex.Lock()
+	defer testDatabasesMutex.Unlock()
+	return testConn{testDatabases[name]}, nil
+}
+
+func (conn testConn) Prepare(query string) (driver.Stmt, error) {
+	return testStmt{conn.database, query}, nil
+}
+
+func (conn testConn) Close() error {
+	return nil
+}
+
+func (conn testConn) Begin() (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn testConn) Commit() error {
+	return nil
+}
+
+func (conn testConn) Rollback() error {
+	return nil
+}
+
+func (stmt testStmt) Close() error {
+	return nil
+}
+
+func (stmt testStmt) NumInput() int {
+	return -1
+}
+
+func (stmt testStmt) run(args []driver.Value) *testRows {
+	stmt.database.mutex.Lock()
+	defer stmt.database.mutex.Unlock()
+
+	stmt.database.queries = append(stmt.database.queries, stmt.query)
+	stmt.database.queryArgs = append(stmt.database.queryArgs, args)
+
+	for prefix, rows := range stmt.database.rows {
+		if strings.HasPrefix(stmt.query, prefix) {
+			return &testRows{rows}
+		}
+	}
+
+	stmt.database.nextId++
+	return &testRows{[][]driver.Value{{stmt.database.nextId}}}
+}
+
+func (stmt testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	stmt.run(args)
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.run(args), nil
+}
+
+func (rows *testRows) Columns() []string {
+	if len(rows.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(rows.rows[0]))
+}
+
+func (rows *testRows) Close() error {
+	return nil
+}
+
+func (rows *testRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+// The arguments of every query starting with prefix
+func (database *testDatabase) allArgs(prefix string) [][]driver.Value {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	var allArgs [][]driver.Value
+	for index, query := range database.queries {
+		if strings.HasPrefix(query, prefix) {
+			allArgs = append(allArgs, database.queryArgs[index])
+		}
+	}
+	return allArgs
+}
+
+func newTestDatabase(t *testing.T, rows map[string][][]driver.Value) (*sql.DB, *testDatabase) {
+	t.Helper()
+
+	//Ids handed out for new people start after the ones the test uses
+	database := &testDatabase{nextId: 100, rows: rows}
+	testDatabasesMutex.Lock()
+	testDatabases[t.Name()] = database
+	testDatabasesMutex.Unlock()
+
+	db, err := sql.Open(TEST_DRIVER, t.Name())
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db, database
+}
+
+func TestMatchLead(t *testing.T) {
+	const leadRowId = 31337
+
+	matchKeys := MatchKeys{Email: "lothosziggy@gmail.com", Phone: "+14155552671", ZipCode: "94110", FullName: "lothos ziggy"}
+
+	tests := []struct {
+		name       string
+		candidates [][]driver.Value
+		personId   int64
+		rule       MatchRule
+		merged     []int64
+	}{
+		{"new person", nil, 101, NewPerson, nil},
+		{"email", [][]driver.Value{{int64(7), int64(31330), "email", nil, false}}, 7, EmailMatch, nil},
+		{"most trusted rule of a person", [][]driver.Value{{int64(7), int64(31323), "name_zip", "lothos ziggy", false}, {int64(7), int64(31330), "email", nil, false}}, 7, EmailMatch, nil},
+		{"similar name", [][]driver.Value{{int64(7), int64(31330), "name_zip", "lothos zigy", false}}, 7, NameZipMatch, nil},
+		{"dissimilar name", [][]driver.Value{{int64(7), int64(31330), "name_zip", "laconia tremont", false}}, 101, NewPerson, nil},
+		{"linked people", [][]driver.Value{{int64(9), int64(31323), "phone", nil, false}, {int64(7), int64(31330), "email", nil, false}, {int64(8), int64(31316), "name_zip", "lothos ziggy", false}}, 7, EmailMatch, []int64{9, 8}},
+		{"linked people changed by hand", [][]driver.Value{{int64(9), int64(31323), "phone", nil, true}, {int64(7), int64(31330), "email", nil, false}}, 7, EmailMatch, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, database := newTestDatabase(t, map[string][][]driver.Value{
+				CANDIDATES_QUERY:  test.candidates,
+				MOVE_PERSON_QUERY: {{int64(31323)}},
+			})
+
+			personId, rule, err := matchLead(db, UnmatchedLead{leadRowId, matchKeys}, 0.92)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if personId != test.personId || rule != test.rule {
+				t.Errorf("matchLead() = %d, %s, want %d, %s", personId, rule, test.personId, test.rule)
+			}
+
+			if assigned := database.allArgs(ASSIGN_PERSON_QUERY); len(assigned) != 1 || assigned[0][0] != test.personId || assigned[0][2] != int64(leadRowId) {
+				t.Errorf("assigned %v, want lead %d assigned to person %d", assigned, leadRowId, test.personId)
+			}
+
+			var merged []int64
+			for _, args := range database.allArgs(MERGED_PERSON_QUERY) {
+				if args[0] != test.personId {
+					t.Errorf("person %v merged into %v, want %d", args[2], args[0], test.personId)
+				}
+				merged = append(merged, args[2].(int64))
+			}
+			if fmt.Sprint(merged) != fmt.Sprint(test.merged) {
+				t.Errorf("merged people %v, want %v", merged, test.merged)
+			}
+
+			//A decision for the lead, and for each lead moved with a merged person
+			if decisions := database.allArgs(INSERT_DECISION_QUERY); len(decisions) != 1+len(test.merged) {
+				t.Errorf("recorded %d decisions, want %d", len(decisions), 1+len(test.merged))
+			}
+
+			if keys := database.allArgs(INSERT_KEY_QUERY); len(keys) != 3 {
+				t.Errorf("recorded %d match keys, want 3", len(keys))
+			}
+		})
+	}
+}
+
+func TestMatchLeadSkipsMissingKeys(t *testing.T) {
+	db, database := newTestDatabase(t, map[string][][]driver.Value{CANDIDATES_QUERY: nil})
+
+	_, _, err := matchLead(db, UnmatchedLead{31337, MatchKeys{Phone: "+14155552671"}}, 0.92)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	keys := database.allArgs(INSERT_KEY_QUERY)
+	if len(keys) != 1 || keys[0][1] != PhoneMatch.String() || keys[0][2] != "+14155552671" {
+		t.Errorf("recorded match keys %v, want only the phone number", keys)
+	}
+}
+
+func TestMergePersons(t *testing.T) {
+	tests := []struct {
+		name       string
+		mergedInto driver.Value
+		from       int64
+		into       int64
+		err        string
+	}{
+		{"merge", nil, 9, 7, ""},
+		{"into itself", nil, 7, 7, "Person 7 can't be merged into itself"},
+		{"merged away", int64(3), 9, 7, "Person 9 was merged into person 3"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, database := newTestDatabase(t, map[string][][]driver.Value{
+				PERSON_QUERY:      {{test.mergedInto}},
+				MOVE_PERSON_QUERY: {{int64(31323)}, {int64(31330)}},
+			})
+
+			count, err := mergePersons(db, test.from, test.into)
+			if len(test.err) > 0 {
+				if nil == err || err.Error() != test.err {
+					t.Errorf("mergePersons() error = %v, want %q", err, test.err)
+				}
+				return
+			} else if nil != err {
+				t.Fatal(err)
+			}
+
+			if count != 2 {
+				t.Errorf("mergePersons() = %d, want 2", count)
+			}
+
+			//Both people are left alone by the deduper from now on
+			if manual := database.allArgs(MANUAL_PERSON_QUERY); len(manual) != 2 {
+				t.Errorf("marked %d people as changed by hand, want 2", len(manual))
+			}
+
+			for _, args := range database.allArgs(INSERT_DECISION_QUERY) {
+				if args[4] != ManualMerge.String() {
+					t.Errorf("decision rule = %v, want %s", args[4], ManualMerge)
+				}
+			}
+		})
+	}
+}
+
+func TestUnmergeLeads(t *testing.T) {
+	db, database := newTestDatabase(t, map[string][][]driver.Value{
+		UNMERGE_LEADS_QUERY: {{int64(31330), int64(7)}, {int64(31337), int64(7)}},
+	})
+
+	personId, count, err := unmergeLeads(db, 0, "0f8fad5b-d9cb-469f-a165-70867728950e")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if personId != 101 || count != 2 {
+		t.Errorf("unmergeLeads() = %d, %d, want 101, 2", personId, count)
+	}
+
+	//The new person is changed by hand too
+	if people := database.allArgs(INSERT_PERSON_QUERY); len(people) != 1 || people[0][0] != true {
+		t.Errorf("inserted people %v, want one changed by hand", people)
+	}
+
+	for _, args := range database.allArgs(INSERT_DECISION_QUERY) {
+		if args[1] != personId || args[2] != int64(7) || args[4] != ManualUnmerge.String() {
+			t.Errorf("decision = %v, want person %d unmerged from person 7", args, personId)
+		}
+	}
+}
+
+func TestUnmergeLeadsNotMatched(t *testing.T) {
+	db, _ := newTestDatabase(t, map[string][][]driver.Value{UNMERGE_LEADS_QUERY: nil})
+
+	_, _, err := unmergeLeads(db, 31337, "")
+	if nil == err {
+		t.Error("unmergeLeads() error = nil, want no matched leads")
+	}
+}
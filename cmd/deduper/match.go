@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"strings"
+	"unicode"
+)
+
+const (
+	ZIP_PREFIX_SIZE = 5
+	WINKLER_PREFIX  = 4
+	WINKLER_SCALE   = 0.1
+)
+
+// MatchRule is the reason a lead was assigned to a person.  Automatic rules are ordered by how
+// much they are trusted.
+type MatchRule int
+
+const (
+	NewPerson MatchRule = 1 << iota
+	EmailMatch
+	PhoneMatch
+	NameZipMatch
+	ManualMerge
+	ManualUnmerge
+)
+
+func (matchRule MatchRule) String() string {
+	switch matchRule {
+	case NewPerson:
+		return "new"
+	case EmailMatch:
+		return "email"
+	case PhoneMatch:
+		return "phone"
+	case NameZipMatch:
+		return "name_zip"
+	case ManualMerge:
+		return "merge"
+	case ManualUnmerge:
+		return "unmerge"
+	default:
+		return "unknown"
+	}
+}
+
+func getMatchRule(matchRuleStr string) MatchRule {
+	for _, matchRule := range []MatchRule{NewPerson, EmailMatch, PhoneMatch, NameZipMatch, ManualMerge, ManualUnmerge} {
+		if matchRule.String() == matchRuleStr {
+			return matchRule
+		}
+	}
+
+	return 0
+}
+
+// MatchKeys are the normalized values a lead is matched on, empty when the lead doesn't have one
+type MatchKeys struct {
+	Email    string
+	Phone    string
+	ZipCode  string
+	FullName string
+}
+
+func getMatchKeys(email string, phoneNumber string, phoneE164 string, firstName string, lastName string, zipCode string, phoneRegion string) MatchKeys {
+	var matchKeys MatchKeys
+
+	matchKeys.Email = getEmailKey(email)
+	matchKeys.Phone = getPhoneKey(phoneNumber, phoneE164, zipCode, phoneRegion)
+
+	//Names are only compared within a zip code, and need both parts to say much
+	firstName = getNameKey(firstName)
+	lastName = getNameKey(lastName)
+	zipCode = getZipKey(zipCode)
+	if len(firstName) > 0 && len(lastName) > 0 && len(zipCode) > 0 {
+		matchKeys.ZipCode = zipCode
+		matchKeys.FullName = firstName + " " + lastName
+	}
+
+	return matchKeys
+}
+
+// The canonical address, so addresses delivered to the same mailbox match
+func getEmailKey(email string) string {
+	canonicalEmail, err := common.GetCanonicalEmail(email)
+	if nil != err {
+		return ""
+	}
+
+	return canonicalEmail
+}
+
+// The E.164 form parsed at submission.  Leads added before then are parsed in the region of their
+// zip code, otherwise PHONE_REGION.
+func getPhoneKey(phoneNumber string, phoneE164 string, zipCode string, phoneRegion string) string {
+	if len(phoneE164) > 0 {
+		return phoneE164
+	}
+
+	if region := common.GetRegionFromZipCode(zipCode); len(region) > 0 {
+		phoneRegion = region
+	}
+
+	parsedPhoneNumber, err := common.ParsePhoneNumber(phoneNumber, phoneRegion)
+	if nil != err {
+		return ""
+	}
+
+	return parsedPhoneNumber.E164()
+}
+
+// Lower case letters with single spaces between words
+func getNameKey(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(char rune) bool {
+		return !unicode.IsLetter(char)
+	})
+
+	return strings.Join(words, " ")
+}
+
+// Upper case without spaces or dashes, US ZIP+4 codes are cut to the first five digits
+func getZipKey(zipCode string) string {
+	zipCode = strings.ToUpper(strings.Map(func(char rune) rune {
+		if unicode.IsSpace(char) || char == '-' {
+			return -1
+		}
+		return char
+	}, zipCode))
+
+	isDigits := len(zipCode) > 0 && strings.IndexFunc(zipCode, func(char rune) bool { return char < '0' || char > '9' }) < 0
+	if isDigits && len(zipCode) == 9 {
+		return zipCode[:ZIP_PREFIX_SIZE]
+	}
+
+	return zipCode
+}
+
+// Jaro-Winkler similarity between 0 and 1, which forgives typos and favours a common prefix
+func getSimilarity(first string, second string) float64 {
+	firstRunes := []rune(first)
+	secondRunes := []rune(second)
+
+	if len(firstRunes) == 0 && len(secondRunes) == 0 {
+		return 1
+	} else if len(firstRunes) == 0 || len(secondRunes) == 0 {
+		return 0
+	}
+
+	matchDistance := max(len(firstRunes), len(secondRunes))/2 - 1
+	if matchDistance < 0 {
+		matchDistance = 0
+	}
+
+	firstMatched := make([]bool, len(firstRunes))
+	secondMatched := make([]bool, len(secondRunes))
+
+	matches := 0
+	for i := range firstRunes {
+		start := max(0, i-matchDistance)
+		end := min(len(secondRunes), i+matchDistance+1)
+		for j := start; j < end; j++ {
+			if !secondMatched[j] && firstRunes[i] == secondRunes[j] {
+				firstMatched[i] = true
+				secondMatched[j] = true
+				matches++
+				break
+			}
+		}
+	}
+
+	if matches == 0 {
+		return 0
+	}
+
+	//Matched characters out of order count as half a transposition each
+	transpositions := 0
+	j := 0
+	for i := range firstRunes {
+		if !firstMatched[i] {
+			continue
+		}
+		for !secondMatched[j] {
+			j++
+		}
+		if firstRunes[i] != secondRunes[j] {
+			transpositions++
+		}
+		j++
+	}
+
+	matchCount := float64(matches)
+	jaro := (matchCount/float64(len(firstRunes)) + matchCount/float64(len(secondRunes)) + (matchCount-float64(transpositions)/2)/matchCount) / 3
+
+	prefix := 0
+	for prefix < min(WINKLER_PREFIX, len(firstRunes), len(secondRunes)) && firstRunes[prefix] == secondRunes[prefix] {
+		prefix++
+	}
+
+	return jaro + float64(prefix)*WINKLER_SCALE*(1-jaro)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestGetMatchKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		email       string
+		phoneNumber string
+		phoneE164   string
+		firstName   string
+		lastName    string
+		zipCode     string
+		expected    MatchKeys
+	}{
+		{"empty", "", "", "", "", "", "", MatchKeys{}},
+		{"canonical email", "Lothos.Ziggy+tremont@GMail.com", "", "", "", "", "", MatchKeys{Email: "lothosziggy@gmail.com"}},
+		{"invalid email", "lothos", "", "", "", "", "", MatchKeys{}},
+		{"parsed phone number", "", "(415) 555-2671", "+14155552671", "", "", "", MatchKeys{Phone: "+14155552671"}},
+		{"phone number in the default region", "", "(415) 555-2671", "", "", "", "", MatchKeys{Phone: "+14155552671"}},
+		{"phone number in the zip code's region", "", "07911 123456", "", "", "", "SW1A 1AA", MatchKeys{Phone: "+447911123456"}},
+		{"invalid phone number", "", "555-CALL-NOW", "", "", "", "", MatchKeys{}},
+		{"name and zip code", "", "", "", " Lothos ", "O'Ziggy-Tremont", "94110-1234", MatchKeys{ZipCode: "94110", FullName: "lothos o ziggy tremont"}},
+		{"name without zip code", "", "", "", "Lothos", "Ziggy", "", MatchKeys{}},
+		{"first name only", "", "", "", "Lothos", "", "94110", MatchKeys{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matchKeys := getMatchKeys(test.email, test.phoneNumber, test.phoneE164, test.firstName, test.lastName, test.zipCode, "US")
+			if matchKeys != test.expected {
+				t.Errorf("getMatchKeys() = %+v, want %+v", matchKeys, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetZipKey(t *testing.T) {
+	tests := []struct {
+		zipCode  string
+		expected string
+	}{
+		{"94110", "94110"},
+		{"94110-1234", "94110"},
+		{"941101234", "94110"},
+		{"sw1a 1aa", "SW1A1AA"},
+		{"1234-567", "1234567"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if zipKey := getZipKey(test.zipCode); zipKey != test.expected {
+			t.Errorf("getZipKey(%q) = %q, want %q", test.zipCode, zipKey, test.expected)
+		}
+	}
+}
+
+func TestGetSimilarity(t *testing.T) {
+	tests := []struct {
+		first    string
+		second   string
+		expected float64
+	}{
+		{"", "", 1},
+		{"lothos", "", 0},
+		{"lothos", "lothos", 1},
+		{"martha", "marhta", 0.9611},
+		{"dwayne", "duane", 0.84},
+		{"dixon", "dicksonx", 0.8133},
+		{"abc", "xyz", 0},
+		//Runes rather than bytes
+		{"zoë", "zoe", 0.8222},
+	}
+
+	for _, test := range tests {
+		similarity := getSimilarity(test.first, test.second)
+		if math.Abs(similarity-test.expected) > 0.0001 {
+			t.Errorf("getSimilarity(%q, %q) = %.4f, want %.4f", test.first, test.second, similarity, test.expected)
+		}
+
+		if reversed := getSimilarity(test.second, test.first); math.Abs(reversed-similarity) > 1e-9 {
+			t.Errorf("getSimilarity(%q, %q) = %.4f, want %.4f as in the other order", test.second, test.first, reversed, similarity)
+		}
+	}
+}
+
+func TestGetMatchRule(t *testing.T) {
+	for _, matchRule := range []MatchRule{NewPerson, EmailMatch, PhoneMatch, NameZipMatch, ManualMerge, ManualUnmerge} {
+		if parsed := getMatchRule(matchRule.String()); parsed != matchRule {
+			t.Errorf("getMatchRule(%q) = %d, want %d", matchRule, parsed, matchRule)
+		}
+	}
+
+	if matchRule := getMatchRule("soundex"); matchRule != 0 {
+		t.Errorf("getMatchRule(\"soundex\") = %d, want 0", matchRule)
+	}
+
+	//Automatic rules are ordered by trust
+	if !(EmailMatch < PhoneMatch && PhoneMatch < NameZipMatch) {
+		t.Error("match rules aren't ordered email, phone, name and zip code")
+	}
+}
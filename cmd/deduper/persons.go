@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	PERSON_QUERY         = "SELECT merged_into FROM prospects.persons WHERE id = $1"
+	MANUAL_PERSON_QUERY  = "UPDATE prospects.persons SET is_manual = TRUE, updated_at = $1 WHERE id = $2"
+	UNMERGE_LEADS_QUERY  = "SELECT id, person_id FROM prospects.leads WHERE person_id IS NOT NULL AND (id = $1 OR lead_id::VARCHAR = $2) ORDER BY id ASC"
+	PERSON_OF_LEAD_QUERY = "SELECT person_id FROM prospects.leads WHERE id = $1 AND person_id IS NOT NULL"
+	PERSON_LEADS_QUERY   = "SELECT leads.id, leads.lead_id, leads.app_name, COALESCE(leads.email, ''), COALESCE(leads.phone_number, ''), COALESCE(leads.first_name, ''), COALESCE(leads.last_name, ''), COALESCE(leads.zip_code, ''), COALESCE(decision.match_rule::VARCHAR, ''), decision.matched_id FROM prospects.leads LEFT JOIN LATERAL (SELECT match_rule, matched_id FROM prospects.merge_decisions WHERE lead_row_id = leads.id ORDER BY id DESC LIMIT 1) AS decision ON TRUE WHERE leads.person_id = $1 ORDER BY leads.id ASC"
+)
+
+// A person leads can be moved to, one that exists and wasn't merged away
+func checkPerson(transaction *sql.Tx, personId int64) error {
+	var mergedInto sql.NullInt64
+	err := transaction.QueryRow(PERSON_QUERY, personId).Scan(&mergedInto)
+	if sql.ErrNoRows == err {
+		return fmt.Errorf("Person %d not found", personId)
+	} else if nil != err {
+		return err
+	} else if mergedInto.Valid {
+		return fmt.Errorf("Person %d was merged into person %d", personId, mergedInto.Int64)
+	}
+
+	return nil
+}
+
+// Moves every lead of one person to another.  Both are marked as changed by hand so the deduper
+// leaves them as they are.
+func mergePersons(db *sql.DB, fromPersonId int64, toPersonId int64) (int, error) {
+	if fromPersonId == toPersonId {
+		return 0, fmt.Errorf("Person %d can't be merged into itself", fromPersonId)
+	}
+
+	transaction, err := db.Begin()
+	if nil != err {
+		return 0, err
+	}
+
+	defer transaction.Rollback()
+
+	for _, personId := range []int64{fromPersonId, toPersonId} {
+		err = checkPerson(transaction, personId)
+		if nil != err {
+			return 0, err
+		}
+
+		_, err = transaction.Exec(MANUAL_PERSON_QUERY, time.Now(), personId)
+		if nil != err {
+			return 0, err
+		}
+	}
+
+	count, err := movePerson(transaction, fromPersonId, toPersonId, 0, ManualMerge, 0)
+	if nil != err {
+		return 0, err
+	}
+
+	return count, transaction.Commit()
+}
+
+// Moves a leads row, or every row of a lead id, to a new person.  The new and previous people are
+// marked as changed by hand so the deduper doesn't merge them again.
+func unmergeLeads(db *sql.DB, leadRowId int64, leadId string) (int64, int, error) {
+	transaction, err := db.Begin()
+	if nil != err {
+		return 0, 0, err
+	}
+
+	defer transaction.Rollback()
+
+	rows, err := transaction.Query(UNMERGE_LEADS_QUERY, leadRowId, leadId)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	previousPersonIds := make(map[int64]int64)
+	var leadRowIds []int64
+	for rows.Next() {
+		var id, personId int64
+		err = rows.Scan(&id, &personId)
+		if nil != err {
+			rows.Close()
+			return 0, 0, err
+		}
+
+		leadRowIds = append(leadRowIds, id)
+		previousPersonIds[id] = personId
+	}
+
+	rows.Close()
+	err = rows.Err()
+	if nil != err {
+		return 0, 0, err
+	} else if len(leadRowIds) == 0 {
+		return 0, 0, fmt.Errorf("No matched leads found")
+	}
+
+	personId, err := insertPerson(transaction, true)
+	if nil != err {
+		return 0, 0, err
+	}
+
+	for _, id := range leadRowIds {
+		_, err = transaction.Exec(ASSIGN_PERSON_QUERY, personId, time.Now(), id)
+		if nil != err {
+			return 0, 0, err
+		}
+
+		_, err = transaction.Exec(MANUAL_PERSON_QUERY, time.Now(), previousPersonIds[id])
+		if nil != err {
+			return 0, 0, err
+		}
+
+		err = recordDecision(transaction, id, personId, previousPersonIds[id], 0, ManualUnmerge, 0)
+		if nil != err {
+			return 0, 0, err
+		}
+	}
+
+	return personId, len(leadRowIds), transaction.Commit()
+}
+
+func runMergeCommand(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	personId := flags.Int64("person_id", 0, "Person whose leads are moved")
+	into := flags.Int64("into", 0, "Person the leads are moved to")
+	flags.Parse(args)
+
+	if *personId <= 0 || *into <= 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s merge -person_id <id> -into <id>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	count, err := mergePersons(db, *personId, *into)
+	if nil != err {
+		log.Fatal(err)
+	}
+
+	log.Printf("Merged person %d into person %d, moving %d leads", *personId, *into, count)
+}
+
+func runUnmergeCommand(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("unmerge", flag.ExitOnError)
+	id := flags.Int64("id", 0, "Id of a single leads row to move to a new person")
+	leadId := flags.String("lead_id", "", "Lead id whose rows are moved to a new person")
+	flags.Parse(args)
+
+	if (*id > 0) == (len(*leadId) > 0) {
+		fmt.Fprintf(os.Stderr, "Usage: %s unmerge -id <id> | -lead_id <uuid>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	personId, count, err := unmergeLeads(db, *id, *leadId)
+	if nil != err {
+		log.Fatal(err)
+	}
+
+	log.Printf("Moved %d leads to new person %d", count, personId)
+}
+
+func runListCommand(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	personId := flags.Int64("person_id", 0, "Person whose leads are listed")
+	id := flags.Int64("id", 0, "Id of a leads row whose person's leads are listed")
+	flags.Parse(args)
+
+	if *personId <= 0 && *id > 0 {
+		err := db.QueryRow(PERSON_OF_LEAD_QUERY, *id).Scan(personId)
+		if sql.ErrNoRows == err {
+			log.Fatalf("Lead %d not found or not matched yet", *id)
+		} else if nil != err {
+			log.Fatal(err)
+		}
+	}
+
+	if *personId <= 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s list -person_id <id> | -id <id>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	rows, err := db.Query(PERSON_LEADS_QUERY, *personId)
+	if nil != err {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	counter := 0
+	for rows.Next() {
+		var (
+			leadRowId                                                int64
+			leadId, appName, email, phoneNumber, firstName, lastName string
+			zipCode, matchRule                                       string
+			matchedId                                                sql.NullInt64
+		)
+
+		err = rows.Scan(&leadRowId, &leadId, &appName, &email, &phoneNumber, &firstName, &lastName, &zipCode, &matchRule, &matchedId)
+		if nil != err {
+			log.Fatal(err)
+		}
+
+		matched := ""
+		if matchedId.Valid {
+			matched = fmt.Sprintf(" matched %d", matchedId.Int64)
+		}
+
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s %s\t%s\t%s%s\n", leadRowId, leadId, appName, email, phoneNumber, firstName, lastName, zipCode, matchRule, matched)
+		counter++
+	}
+
+	err = rows.Err()
+	if nil != err {
+		log.Fatal(err)
+	}
+
+	log.Printf("Person %d has %d leads", *personId, counter)
+}
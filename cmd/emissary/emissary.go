@@ -10,17 +10,15 @@ import (
 	"github.com/satori/go.uuid"
 	"log"
 	"net/mail"
-	"os"
 	"regexp"
-	"strconv"
 	"time"
 )
 
 const (
-	QUERY           = "INSERT INTO prospects.leads(lead_id, app_name, lead_source, email, user_agent, miscellaneous, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;"
+	QUERY           = "INSERT INTO prospects.leads(lead_id, app_name, lead_source, email, email_canonical, user_agent, miscellaneous, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;"
 	GET_IMAP_MARKER = "SELECT marker FROM prospects.imap_markers WHERE app_name = $1"
 	SET_IMAP_MARKER = "INSERT INTO prospects.imap_markers (app_name, marker, updated_at) VALUES($1, $2, $3) ON CONFLICT (app_name) DO UPDATE SET marker = prospects.imap_markers.marker + $2, updated_at = $3"
-	EMAIL_REGEX     = "[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+"
+	EMAIL_REGEX     = "[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+[.][A-Za-z]+"
 	RFC822          = "RFC822"
 )
 
@@ -237,7 +235,12 @@ func addNewProspects(prospects []common.Prospect, appName string, db *sql.DB) er
 			miscellaneous = sql.NullString{prospect.Miscellaneous, true}
 		}
 
-		err = statement.QueryRow(prospect.LeadId, prospect.AppName, prospect.LeadSource, prospect.Email, userAgent, miscellaneous, time.Now(), time.Now()).Scan(&unused)
+		var emailCanonical sql.NullString
+		if canonicalEmail, err := common.GetCanonicalEmail(prospect.Email); nil == err {
+			emailCanonical = sql.NullString{canonicalEmail, true}
+		}
+
+		err = statement.QueryRow(prospect.LeadId, prospect.AppName, prospect.LeadSource, prospect.Email, emailCanonical, userAgent, miscellaneous, time.Now(), time.Now()).Scan(&unused)
 		if nil != err {
 			log.Print(err)
 		}
@@ -263,75 +266,37 @@ func addNewProspects(prospects []common.Prospect, appName string, db *sql.DB) er
 	return nil
 }
 
-func main() {
-	//Get application name
-	appName := os.Getenv("APPLICATION_NAME")
-	if len(appName) > 0 {
-		log.Printf("Application name: %s", appName)
-	} else {
-		log.Fatal("APPLICATION_NAME variable NOT set")
-	}
-
-	//IMAPS server connection
-	imapsHost := os.Getenv("IMAPS_HOST")
-	imapsUser := os.Getenv("IMAPS_USER")
-	imapsPassword := os.Getenv("IMAPS_PASSWORD")
-	imapsMailbox := common.GetenvWithDefault("IMAPS_MAILBOX", "INBOX")
-
-	if len(imapsHost) <= 0 {
-		log.Fatal("IMAPS_HOST is NOT set")
-	}
-
-	if len(imapsUser) <= 0 {
-		log.Fatal("IMAPS_USER is NOT set")
-	}
-
-	if len(imapsPassword) <= 0 {
-		log.Fatal("IMAPS_PASSWORD is NOT set")
-	}
+type EmissaryConfig struct {
+	AppName       string `config:"APPLICATION_NAME" required:"true"`
+	ImapsHost     string `config:"IMAPS_HOST" required:"true"`
+	ImapsUser     string `config:"IMAPS_USER" required:"true"`
+	ImapsPassword string `config:"IMAPS_PASSWORD" required:"true" secret:"true"`
+	ImapsMailbox  string `config:"IMAPS_MAILBOX" default:"INBOX"`
+	Database      common.DatabaseConfig
+	Log           common.LogConfig
+}
 
-	//Database connection
-	dbUrl := os.Getenv("DATABASE_URL")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	dbHost := common.GetenvWithDefault("DB_HOST", "localhost")
-	dbPort := common.GetenvWithDefault("DB_PORT", "5432")
-	dbMaxOpenConnsStr := common.GetenvWithDefault("DB_MAX_OPEN_CONNS", "10")
-	dbMaxIdleConnsStr := common.GetenvWithDefault("DB_MAX_IDLE_CONNS", "0")
-
-	dbMaxOpenConns, err := strconv.Atoi(dbMaxOpenConnsStr)
-	if nil != err {
-		dbMaxOpenConns = 10
-		log.Printf("Error setting database maximum open connections from value: %s. Default to %d", dbMaxOpenConnsStr, dbMaxOpenConns)
-		log.Print(err)
-	}
+func main() {
+	var config EmissaryConfig
+	common.MustLoadConfig("emissary", &config)
+	common.SetupLogging("emissary", config.Log)
 
-	dbMaxIdleConns, err := strconv.Atoi(dbMaxIdleConnsStr)
-	if nil != err {
-		dbMaxIdleConns = 0
-		log.Printf("Error setting database maximum idle connections from value: %s. Default to %d", dbMaxIdleConnsStr, dbMaxIdleConns)
-		log.Print(err)
-	}
+	log.Printf("Application name: %s", config.AppName)
 
 	//Get database connection
 	log.Print("Enabling database connectivity")
-	dbCredentials := common.DatabaseCredentials{common.DB_DRIVER, dbUrl, dbUser, dbPassword, dbName, dbHost, dbPort, dbMaxOpenConns, dbMaxIdleConns}
-	if !dbCredentials.IsValid() {
-		log.Fatalf("Database credentials NOT set correctly. %#v", dbCredentials)
-	}
-	db := dbCredentials.GetDatabase()
+	db := config.Database.GetCredentials().GetDatabase()
 	defer db.Close()
 
 	//Get latest e-mail messages
 	log.Print("Fetching latest e-mail messages")
-	prospects, err := getLatestMessages(imapsHost, imapsUser, imapsPassword, imapsMailbox, appName, db)
+	prospects, err := getLatestMessages(config.ImapsHost, config.ImapsUser, config.ImapsPassword, config.ImapsMailbox, config.AppName, db)
 	if nil != err {
 		log.Fatal(err)
 	}
 
 	//Add prospects from e-mail messages
-	err = addNewProspects(prospects, appName, db)
+	err = addNewProspects(prospects, config.AppName, db)
 	if nil != err {
 		log.Fatal(err)
 	}
@@ -3,12 +3,9 @@ package main
 import (
 	"bitbucket.org/padium/prospects"
 	"database/sql"
-	"flag"
 	_ "github.com/lib/pq"
 	"log"
-	"os"
 	"regexp"
-	"strconv"
 	"strings"
 	"time"
 )
@@ -77,71 +74,30 @@ func (urs *UpdateReplyStatus) Processed(templateData map[string]string, complete
 	}
 }
 
-func main() {
-	//SMTP server information
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPassword := os.Getenv("SMTP_PASSWORD")
-
-	if len(smtpHost) <= 0 {
-		log.Fatal("SMTP_HOST is NOT set")
-	}
-
-	if len(smtpUser) <= 0 {
-		log.Fatal("SMTP_USER is NOT set")
-	}
-
-	if len(smtpPassword) <= 0 {
-		log.Fatal("SMTP_PASSWORD is NOT set")
-	}
-
-	//Database connection
-	dbUrl := os.Getenv("DATABASE_URL")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	dbHost := common.GetenvWithDefault("DB_HOST", "localhost")
-	dbPort := common.GetenvWithDefault("DB_PORT", "5432")
-	dbMaxOpenConnsStr := common.GetenvWithDefault("DB_MAX_OPEN_CONNS", "10")
-	dbMaxIdleConnsStr := common.GetenvWithDefault("DB_MAX_IDLE_CONNS", "0")
-
-	dbMaxOpenConns, err := strconv.Atoi(dbMaxOpenConnsStr)
-	if nil != err {
-		dbMaxOpenConns = 10
-		log.Printf("Error setting database maximum open connections from value: %s. Default to %d", dbMaxOpenConnsStr, dbMaxOpenConns)
-		log.Print(err)
-	}
+type MailerConfig struct {
+	MailerName   string `config:"MAILER_NAME" flag:"mailer_name" required:"true" usage:"Name of mailer to process"`
+	ProcessAmt   int    `config:"PROCESS_AMT" flag:"process_amt" default:"3" min:"1" usage:"Amount of mails to process"`
+	SmtpHost     string `config:"SMTP_HOST" required:"true"`
+	SmtpUser     string `config:"SMTP_USER" required:"true"`
+	SmtpPassword string `config:"SMTP_PASSWORD" required:"true" secret:"true"`
+	Database     common.DatabaseConfig
+	Log          common.LogConfig
+}
 
-	dbMaxIdleConns, err := strconv.Atoi(dbMaxIdleConnsStr)
-	if nil != err {
-		dbMaxIdleConns = 0
-		log.Printf("Error setting database maximum idle connections from value: %s. Default to %d", dbMaxIdleConnsStr, dbMaxIdleConns)
-		log.Print(err)
-	}
+func main() {
+	var config MailerConfig
+	common.MustLoadConfig("mailer", &config)
+	common.SetupLogging("mailer", config.Log)
 
 	//Get database connection
 	log.Print("Enabling database connectivity")
-	dbCredentials := common.DatabaseCredentials{common.DB_DRIVER, dbUrl, dbUser, dbPassword, dbName, dbHost, dbPort, dbMaxOpenConns, dbMaxIdleConns}
-	if !dbCredentials.IsValid() {
-		log.Fatalf("Database credentials NOT set correctly. %#v", dbCredentials)
-	}
-	db := dbCredentials.GetDatabase()
+	db := config.Database.GetCredentials().GetDatabase()
 	defer db.Close()
 
-	//Command line arguments
-	mailerName := flag.String("mailer_name", "", "Name of mailer to process")
-	processAmt := flag.Int("process_amt", 3, "Amount of mails to process")
-	flag.Parse()
-
-	if len(*mailerName) <= 0 {
-		flag.Usage()
-		os.Exit(1)
-	}
-
 	//Mailer query
-	mailerQuery, err := getMailerQuery(db, *mailerName)
+	mailerQuery, err := getMailerQuery(db, config.MailerName)
 	if nil != err {
-		log.Printf("Could not retrieve mailer query data for %s", *mailerName)
+		log.Printf("Could not retrieve mailer query data for %s", config.MailerName)
 		log.Fatal(err)
 	}
 
@@ -157,7 +113,7 @@ func main() {
 
 	if limitRegex.MatchString(mailerQuery.GetEmailDataQuery) {
 		log.Print("Email data query has parameterized LIMIT clause.  Adding process amount")
-		dbParameters = append(dbParameters, *processAmt)
+		dbParameters = append(dbParameters, config.ProcessAmt)
 	} else {
 		log.Print("Query doesn't contain LIMIT statement.  Process amount ignored")
 	}
@@ -169,7 +125,7 @@ func main() {
 		emailSubjectFieldNames = append(emailSubjectFieldNames, emailSubjectFieldName)
 	}
 
-	dtm := common.DatabaseTemplateMailer{smtpHost, smtpUser, smtpPassword, mailerQuery.EmailSubject, emailSubjectFieldNames, mailerQuery.EmailTemplateUrl, mailerQuery.GetEmailDataQuery, dbParameters, mailerQuery.DestinationEmailFieldName, mailerQuery.SourceEmailAddress, db, urs}
+	dtm := common.DatabaseTemplateMailer{config.SmtpHost, config.SmtpUser, config.SmtpPassword, mailerQuery.EmailSubject, emailSubjectFieldNames, mailerQuery.EmailTemplateUrl, mailerQuery.GetEmailDataQuery, dbParameters, mailerQuery.DestinationEmailFieldName, mailerQuery.SourceEmailAddress, db, urs}
 
 	err = dtm.SendMail()
 	if nil != err {
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	INSERT_API_KEY_QUERY = "INSERT INTO prospects.api_keys(key_id, key_hash, description, app_names, scopes, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id"
+	LIST_API_KEYS_QUERY  = "SELECT id, key_id, description, app_names, scopes, is_active, created_at FROM prospects.api_keys ORDER BY id ASC"
+	REVOKE_API_KEY_QUERY = "UPDATE prospects.api_keys SET is_active = FALSE, updated_at = $1 WHERE key_id = $2 AND is_active = TRUE"
+	APP_NAME_REGEX       = "^([A-Za-z0-9_-]+|\\*)$"
+)
+
+var apiKeyAuthenticator *common.ApiKeyAuthenticator
+var apiKeyRequiredAppNames map[string]bool
+
+func isApiKeyRequired(appName string) bool {
+	return apiKeyRequiredAppNames != nil && (apiKeyRequiredAppNames[common.ALL_APPLICATIONS] || apiKeyRequiredAppNames[appName])
+}
+
+// Adds an auth error when a submission for the application must carry a key for it
+func validateSubmitApiKey(appName string, errors binding.Errors, req *http.Request) binding.Errors {
+	if !isApiKeyRequired(appName) {
+		return errors
+	}
+
+	apiKey, err := apiKeyAuthenticator.Authenticate(req)
+	if nil != err {
+		return addError(errors, []string{"apikey"}, common.AUTH_ERROR, err.Error())
+	}
+
+	if !apiKey.HasScope(common.SubmitScope) || !apiKey.AllowsApp(appName) {
+		message := fmt.Sprintf("API key %s may not submit prospects for appname \"%s\"", apiKey.KeyId, appName)
+		return addError(errors, []string{"apikey", "appname"}, common.FORBIDDEN_ERROR, message)
+	}
+
+	return errors
+}
+
+// Middleware that rejects requests without a key carrying the scope and maps the key for later handlers
+func requireApiScope(scope common.ApiScope) martini.Handler {
+	return func(context martini.Context, res http.ResponseWriter, req *http.Request) {
+		var response common.Response
+
+		apiKey, err := apiKeyAuthenticator.Authenticate(req)
+		if nil != err {
+			log.Printf("Unauthorized request for %s: %s", req.URL.Path, err)
+			response = common.Response{Code: http.StatusUnauthorized, Message: err.Error()}
+			res.Header().Set(WWW_AUTHENTICATE_HEADER, common.API_KEY_HEADER)
+		} else if !apiKey.HasScope(scope) {
+			log.Printf("API key %s missing scope %s for %s", apiKey.KeyId, scope, req.URL.Path)
+			response = common.Response{Code: http.StatusForbidden, Message: fmt.Sprintf("API key missing %s scope", scope)}
+		} else {
+			context.Map(apiKey)
+			return
+		}
+
+		response.RequestId = common.RequestIdFromContext(req.Context())
+		jsonStr, _ := json.Marshal(response)
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		res.WriteHeader(response.Code)
+		res.Write(jsonStr)
+	}
+}
+
+// Signed submissions cover the body, so it is hashed before binding reads it
+func hashSignedBody(context martini.Context, res http.ResponseWriter, req *http.Request) {
+	if !req.URL.Query().Has(common.API_KEY_SIGNATURE_PARAM) {
+		return
+	}
+
+	hashedReq, err := common.HashRequestBody(res, req, batchBodySizeLimit)
+	if nil == err {
+		context.Map(hashedReq)
+		return
+	}
+
+	common.Logger(req.Context()).Warn("Error reading signed request body", "error", err)
+	response := common.Response{Code: http.StatusBadRequest, Message: "Could not read request body"}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		response = common.Response{Code: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("Request body exceeds limit of %d bytes", batchBodySizeLimit)}
+	}
+
+	response.RequestId = common.RequestIdFromContext(req.Context())
+	jsonStr, _ := json.Marshal(response)
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	res.WriteHeader(response.Code)
+	res.Write(jsonStr)
+}
+
+func runApiKeyCommand(db *sql.DB, args []string, signingSecret string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s apikey create|list|revoke|sign [options]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet("apikey "+args[0], flag.ExitOnError)
+
+	switch args[0] {
+	case "create":
+		appNamesStr := flags.String("app_names", "", "Comma separated application names the key may act on, * for all")
+		scopesStr := flags.String("scopes", "submit", "Comma separated scopes: submit, read, admin")
+		description := flags.String("description", "", "Who or what the key is issued to")
+		flags.Parse(args[1:])
+
+		appNameRegex := regexp.MustCompile(APP_NAME_REGEX)
+		appNames := strings.Split(*appNamesStr, ",")
+		for _, appName := range appNames {
+			if !appNameRegex.MatchString(appName) {
+				log.Fatalf("Invalid application name \"%s\" specified", appName)
+			}
+		}
+
+		scopes, err := common.ParseApiScopes(*scopesStr)
+		if nil != err {
+			log.Fatal(err)
+		} else if scopes == 0 {
+			log.Fatal("At least one scope is required")
+		}
+
+		keyId, key, err := common.GenerateApiKey()
+		if nil != err {
+			log.Fatal(err)
+		}
+
+		var descriptionStr sql.NullString
+		if len(*description) > 0 {
+			descriptionStr = sql.NullString{*description, true}
+		}
+
+		var id int64
+		err = db.QueryRow(INSERT_API_KEY_QUERY, keyId, common.HashApiKey(key), descriptionStr, "{"+strings.Join(appNames, ",")+"}", "{"+scopes.String()+"}", time.Now(), time.Now()).Scan(&id)
+		if nil != err {
+			log.Fatal(err)
+		}
+
+		log.Printf("Created api key id %d for application names %s with scopes %s", id, *appNamesStr, scopes)
+		fmt.Println(key)
+		break
+	case "list":
+		flags.Parse(args[1:])
+
+		rows, err := db.Query(LIST_API_KEYS_QUERY)
+		if nil != err {
+			log.Fatal(err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				id          int64
+				keyId       string
+				description sql.NullString
+				appNames    string
+				scopes      string
+				isActive    bool
+				createdAt   time.Time
+			)
+
+			err = rows.Scan(&id, &keyId, &description, &appNames, &scopes, &isActive, &createdAt)
+			if nil != err {
+				log.Fatal(err)
+			}
+
+			fmt.Printf("%d\t%s\t%s\t%s\tactive=%t\t%s\t%s\n", id, keyId, strings.Trim(appNames, "{}"), strings.Trim(scopes, "{}"), isActive, createdAt.Format(time.RFC3339), description.String)
+		}
+		break
+	case "revoke":
+		keyId := flags.String("key_id", "", "Key id (prefix before the .) of the key to revoke")
+		flags.Parse(args[1:])
+
+		if len(*keyId) == 0 {
+			flags.Usage()
+			os.Exit(1)
+		}
+
+		result, err := db.Exec(REVOKE_API_KEY_QUERY, time.Now(), *keyId)
+		if nil != err {
+			log.Fatal(err)
+		}
+
+		count, _ := result.RowsAffected()
+		if count == 0 {
+			log.Fatalf("No active api key with key id %s", *keyId)
+		}
+
+		log.Printf("Revoked api key %s", *keyId)
+		break
+	case "sign":
+		key := flags.String("key", "", "Full api key to sign with")
+		method := flags.String("method", common.GET_METHOD, "HTTP method of the signed request")
+		path := flags.String("path", LEADS_URL, "URL path of the signed request")
+		query := flags.String("query", "", "Query string of the signed request, such as app_name=tremont&limit=100")
+		body := flags.String("body", "", "Body of the signed request, exactly as it will be sent")
+		expiresIn := flags.Duration("expires_in", 5*time.Minute, fmt.Sprintf("How long the signed request is valid for, at most %s", common.MAX_SIGNATURE_WINDOW))
+		flags.Parse(args[1:])
+
+		if len(*key) == 0 || *expiresIn > common.MAX_SIGNATURE_WINDOW {
+			flags.Usage()
+			os.Exit(1)
+		} else if len(signingSecret) == 0 {
+			log.Fatal("API_KEY_SIGNING_SECRET is required to sign requests")
+		}
+
+		values, err := url.ParseQuery(*query)
+		if nil != err {
+			log.Fatalf("Invalid query string \"%s\" specified", *query)
+		}
+
+		fmt.Printf("%s?%s\n", *path, common.SignApiKeyRequest(*key, signingSecret, *method, *path, values, []byte(*body), time.Now().Add(*expiresIn)))
+		break
+	default:
+		usage()
+	}
+}
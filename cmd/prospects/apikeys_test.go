@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql/driver"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_API_KEY        = "3f2a9c0d1b7e4a55.0123456789abcdef0123456789abcdef0123456789abcdef"
+	TEST_SIGNING_SECRET = "test signing secret"
+)
+
+func getTestSignedQuery(path string, body string) string {
+	return "?" + common.SignApiKeyRequest(TEST_API_KEY, TEST_SIGNING_SECRET, http.MethodPost, path, url.Values{}, []byte(body), time.Now().Add(time.Minute))
+}
+
+func TestSubmitApiKey(t *testing.T) {
+	body := getTestProspectJson("lothos@example.com")
+	otherBody := getTestProspectJson("ziggy@example.com")
+	unrequiredBody := strings.Replace(body, TEST_APP_NAME, "laconia", 1)
+
+	tests := []struct {
+		name    string
+		scopes  string
+		revoked bool
+		url     string
+		body    string
+		apiKey  string
+		code    int
+	}{
+		{"header", "{submit}", false, REQUEST_URL, body, TEST_API_KEY, http.StatusCreated},
+		{"missing", "{submit}", false, REQUEST_URL, body, "", http.StatusUnauthorized},
+		{"wrong header", "{submit}", false, REQUEST_URL, body, common.GetApiKeyId(TEST_API_KEY) + ".0000", http.StatusUnauthorized},
+		{"revoked", "{submit}", true, REQUEST_URL, body, TEST_API_KEY, http.StatusUnauthorized},
+		{"missing scope", "{read}", false, REQUEST_URL, body, TEST_API_KEY, http.StatusForbidden},
+		{"admin scope", "{admin}", false, REQUEST_URL, body, TEST_API_KEY, http.StatusCreated},
+		{"signed", "{submit}", false, REQUEST_URL + getTestSignedQuery(REQUEST_URL, body), body, "", http.StatusCreated},
+		{"signed for another body", "{submit}", false, REQUEST_URL + getTestSignedQuery(REQUEST_URL, otherBody), body, "", http.StatusUnauthorized},
+		{"signed for another path", "{submit}", false, REQUEST_URL + getTestSignedQuery(BATCH_REQUEST_URL, body), body, "", http.StatusUnauthorized},
+		{"not required", "{submit}", false, REQUEST_URL, unrequiredBody, "", http.StatusCreated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.ApiKeyRequiredApps = []string{TEST_APP_NAME}
+				config.ApiKeySigningSecret = TEST_SIGNING_SECRET
+			})
+
+			row := []driver.Value{int64(1), common.GetApiKeyId(TEST_API_KEY), common.HashApiKey(TEST_API_KEY), nil, "{" + TEST_APP_NAME + "}", test.scopes, time.Now()}
+			if test.revoked {
+				row = nil
+			}
+			database.rows = map[string][]driver.Value{"SELECT id, key_id, key_hash": row}
+
+			var headers map[string]string
+			if len(test.apiKey) > 0 {
+				headers = map[string]string{common.API_KEY_HEADER: test.apiKey}
+			}
+
+			recorder := doTestRequest(handler, http.MethodPost, test.url, JSON_CONTENT_TYPE, test.body, headers)
+			if recorder.Code != test.code {
+				t.Errorf("code = %d, want %d: %s", recorder.Code, test.code, recorder.Body)
+			}
+		})
+	}
+}
+
+func TestSubmitApiKeyBatch(t *testing.T) {
+	body := "[" + getTestProspectJson("lothos@example.com") + "," + getTestProspectJson("ziggy@example.com") + "]"
+
+	tests := []struct {
+		name  string
+		url   string
+		code  int
+		codes []int
+	}{
+		{"signed", BATCH_REQUEST_URL + getTestSignedQuery(BATCH_REQUEST_URL, body), http.StatusOK, []int{http.StatusCreated, http.StatusCreated}},
+		{"signed for another body", BATCH_REQUEST_URL + getTestSignedQuery(BATCH_REQUEST_URL, "[]"), http.StatusOK, []int{http.StatusUnauthorized, http.StatusUnauthorized}},
+		{"signed body over limit", BATCH_REQUEST_URL + getTestSignedQuery(BATCH_REQUEST_URL, body), http.StatusRequestEntityTooLarge, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.ApiKeyRequiredApps = []string{TEST_APP_NAME}
+				config.ApiKeySigningSecret = TEST_SIGNING_SECRET
+				if test.code == http.StatusRequestEntityTooLarge {
+					config.BatchBodySizeLimit = int64(len(body) - 1)
+				}
+			})
+			database.rows = map[string][]driver.Value{"SELECT id, key_id, key_hash": {int64(1), common.GetApiKeyId(TEST_API_KEY), common.HashApiKey(TEST_API_KEY), nil, "{*}", "{submit}", time.Now()}}
+
+			recorder := doTestRequest(handler, http.MethodPost, test.url, JSON_CONTENT_TYPE, body, nil)
+			if recorder.Code != test.code {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, test.code, recorder.Body)
+			}
+
+			codes := getTestBatchCodes(decodeTestBatchResponse(t, recorder.Body.String()))
+			if len(codes) != len(test.codes) {
+				t.Fatalf("item codes = %v, want %v", codes, test.codes)
+			}
+			for index, code := range codes {
+				if code != test.codes[index] {
+					t.Errorf("item %d code = %d, want %d", index, code, test.codes[index])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const (
+	SAVEPOINT_QUERY          = "SAVEPOINT prospect"
+	ROLLBACK_SAVEPOINT_QUERY = "ROLLBACK TO SAVEPOINT prospect"
+	RELEASE_SAVEPOINT_QUERY  = "RELEASE SAVEPOINT prospect"
+	NDJSON_MAX_LINE_SIZE     = 1024 * 1024
+)
+
+type BatchCreateHandler func(http.ResponseWriter, *http.Request) (int, string)
+
+type BatchItemResponse struct {
+	Index   int
+	Code    int
+	Message string
+	Id      int64          `json:",omitempty"`
+	Errors  binding.Errors `json:",omitempty"`
+}
+
+type BatchResponse struct {
+	Code      int
+	Message   string
+	RequestId string              `json:",omitempty"`
+	Results   []BatchItemResponse `json:",omitempty"`
+}
+
+var batchSizeLimit int
+var batchBodySizeLimit int64
+
+// Decoding stops one item past the batch size limit, so an oversized batch is refused without reading the rest of it
+func decodeProspectBatch(res http.ResponseWriter, req *http.Request) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+
+	if nil == req.Body {
+		return items, nil
+	}
+	defer req.Body.Close()
+
+	body := http.MaxBytesReader(res, req.Body, batchBodySizeLimit)
+
+	if strings.Contains(req.Header.Get(CONTENT_TYPE_HEADER), "ndjson") {
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), NDJSON_MAX_LINE_SIZE)
+
+		for len(items) <= batchSizeLimit && scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+
+			item := make(json.RawMessage, len(line))
+			copy(item, line)
+			items = append(items, item)
+		}
+
+		return items, scanner.Err()
+	}
+
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if nil != err {
+		return items, err
+	} else if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return items, fmt.Errorf("Batch is not a JSON array")
+	}
+
+	for len(items) <= batchSizeLimit && decoder.More() {
+		var item json.RawMessage
+		err = decoder.Decode(&item)
+		if nil != err {
+			return items, err
+		}
+		items = append(items, item)
+	}
+
+	if len(items) <= batchSizeLimit {
+		_, err = decoder.Token()
+	}
+
+	return items, err
+}
+
+// Mirrors the binding package's required tag check, which is only run by its middleware
+func validateRequired(prospect ProspectForm, errors binding.Errors) binding.Errors {
+	prospectType := reflect.TypeOf(prospect)
+	prospectValue := reflect.ValueOf(prospect)
+
+	for iter := 0; iter < prospectType.NumField(); iter++ {
+		field := prospectType.Field(iter)
+		if !strings.Contains(field.Tag.Get("binding"), "required") {
+			continue
+		}
+
+		if reflect.DeepEqual(prospectValue.Field(iter).Interface(), reflect.Zero(field.Type).Interface()) {
+			name := field.Name
+			if formName := field.Tag.Get("form"); formName != "" {
+				name = formName
+			}
+			errors = addError(errors, []string{name}, binding.RequiredError, "Required")
+		}
+	}
+
+	return errors
+}
+
+func addProspectWithSavepoint(db *sql.DB, transaction *sql.Tx, prospect *ProspectForm, statement *sql.Stmt) (int64, error) {
+	_, err := transaction.Exec(SAVEPOINT_QUERY)
+	if nil != err {
+		return 0, err
+	}
+
+	id, err := addProspect(db, prospect, statement)
+	if nil != err {
+		_, rollbackErr := transaction.Exec(ROLLBACK_SAVEPOINT_QUERY)
+		if nil != rollbackErr {
+			slog.Error("Error rolling back to savepoint", "error", rollbackErr)
+		}
+		return 0, err
+	}
+
+	_, err = transaction.Exec(RELEASE_SAVEPOINT_QUERY)
+	return id, err
+}
+
+func setupBatchHttpHandler(db *sql.DB) BatchCreateHandler {
+	return func(res http.ResponseWriter, req *http.Request) (int, string) {
+		req.Close = true
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		logger := common.Logger(req.Context())
+
+		writeResponse := func(response BatchResponse) (int, string) {
+			response.RequestId = common.RequestIdFromContext(req.Context())
+			jsonStr, _ := json.Marshal(response)
+			return response.Code, string(jsonStr)
+		}
+
+		contentType := req.Header.Get(CONTENT_TYPE_HEADER)
+		if !strings.Contains(contentType, "json") {
+			var errors binding.Errors
+			errors = addError(errors, []string{}, binding.ContentTypeError, "Unsupported Content-Type")
+			errorResponse := getErrorResponse(req.Context(), errors, "")
+			return writeResponse(BatchResponse{Code: errorResponse.Code, Message: errorResponse.Message})
+		}
+
+		items, err := decodeProspectBatch(res, req)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			responseStr := fmt.Sprintf("Batch body exceeds limit of %d bytes", batchBodySizeLimit)
+			logger.Warn(responseStr)
+			return writeResponse(BatchResponse{Code: http.StatusRequestEntityTooLarge, Message: responseStr})
+		} else if nil != err {
+			logger.Info("Error decoding batch", "error", err)
+			var errors binding.Errors
+			errors = addError(errors, []string{}, binding.DeserializationError, err.Error())
+			errorResponse := getErrorResponse(req.Context(), errors, "")
+			return writeResponse(BatchResponse{Code: errorResponse.Code, Message: errorResponse.Message})
+		}
+
+		if len(items) > batchSizeLimit {
+			responseStr := fmt.Sprintf("Batch size exceeds limit of %d", batchSizeLimit)
+			logger.Warn(responseStr, "count", len(items))
+			return writeResponse(BatchResponse{Code: http.StatusRequestEntityTooLarge, Message: responseStr})
+		}
+
+		if asyncRequest && !prospectBatchProcessor.Running() {
+			responseStr := "Could not add prospects due to server maintenance"
+			logger.Warn(responseStr)
+			return writeResponse(BatchResponse{Code: http.StatusServiceUnavailable, Message: responseStr})
+		}
+
+		logger.Info("Received batch of prospects", "count", len(items))
+
+		results := make([]BatchItemResponse, len(items))
+		prospects := make([]*ProspectForm, len(items))
+		ipAddress := processIpAddress(req)
+		var retryAfter time.Duration
+
+		//Request checks are run once for each application in the batch, not for every item
+		type requestCheck struct {
+			Errors     binding.Errors
+			BotVerdict common.BotVerdict
+		}
+		requestChecks := make(map[string]requestCheck)
+
+		setRateLimited := func(index int, prospect *ProspectForm, wait time.Duration) {
+			recordSubmission(prospect.AppName, prospect.LeadSource, RATE_LIMITED_OUTCOME)
+			rateLimitResponse := getRateLimitResponse(req.Context(), prospect.AppName, wait)
+			results[index].Code = rateLimitResponse.Code
+			results[index].Message = rateLimitResponse.Message
+			results[index].Id = rateLimitResponse.Id
+			if rateLimitResponse.Code == http.StatusTooManyRequests && wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+
+		for index, item := range items {
+			results[index].Index = index
+
+			var errors binding.Errors
+			prospect := new(ProspectForm)
+
+			err = json.Unmarshal(item, prospect)
+
+			//Every item uses up an ip address token, valid or not
+			if allowed, wait := takeIpRateLimit(req.Context(), prospect.AppName, ipAddress); !allowed {
+				setRateLimited(index, prospect, wait)
+				continue
+			}
+
+			if nil != err {
+				errors = addError(errors, []string{}, binding.DeserializationError, err.Error())
+			} else {
+				application := applications.Get(prospect.AppName)
+				errors = validateRequired(*prospect, errors)
+				errors = prospect.validateProspect(application, errors, req)
+
+				if len(errors) == 0 {
+					check, exists := requestChecks[prospect.AppName]
+					if !exists {
+						check.Errors = validateRequest(application, nil, req)
+						check.BotVerdict = evaluateBotDetection(application, req, "", true)
+						requestChecks[prospect.AppName] = check
+					}
+
+					errors = append(errors, check.Errors...)
+					errors = prospect.applyBotVerdict(application, check.BotVerdict, errors, req)
+					if nil != prospect.BotVerdict {
+						recordBotSubmission(db, req, prospect, *prospect.BotVerdict)
+					}
+				}
+			}
+
+			if len(errors) > 0 {
+				recordSubmission(prospect.AppName, prospect.LeadSource, getErrorOutcome(errors))
+				errorResponse := getErrorResponse(req.Context(), errors, prospect.AppName)
+				results[index].Code = errorResponse.Code
+				results[index].Message = errorResponse.Message
+				results[index].Id = errorResponse.Id
+				if !errors.Has(common.BOT_ERROR) {
+					results[index].Errors = errors
+				}
+				continue
+			}
+
+			if allowed, wait := takeLeadRateLimits(req.Context(), prospect); !allowed {
+				setRateLimited(index, prospect, wait)
+				continue
+			}
+
+			populateRequestFields(req, prospect)
+			prospects[index] = prospect
+		}
+
+		//The longest wait of any rate limited prospect
+		if retryAfter > 0 {
+			res.Header().Set(common.RETRY_AFTER_HEADER, getRetryAfterSeconds(retryAfter))
+		}
+
+		counter := 0
+
+		if asyncRequest {
+			for index, prospect := range prospects {
+				if nil == prospect {
+					continue
+				}
+
+				err = prospectBatchProcessor.AddEvent(prospect)
+				if nil != err {
+					logger.Error("Error queueing prospect", "prospect", prospect, "error", err)
+					results[index].Code = http.StatusInternalServerError
+					results[index].Message = "Could not add prospect due to server error"
+					recordSubmission(prospect.AppName, prospect.LeadSource, DB_ERROR_OUTCOME)
+					continue
+				}
+
+				recordSubmission(prospect.AppName, prospect.LeadSource, ACCEPTED_OUTCOME)
+				results[index].Code = http.StatusAccepted
+				results[index].Message = "Successfully added prospect"
+				counter++
+			}
+		} else {
+			counter = insertProspectBatch(req.Context(), db, prospects, results)
+
+			for index, prospect := range prospects {
+				if nil == prospect {
+					continue
+				} else if results[index].Code == http.StatusCreated {
+					recordSubmission(prospect.AppName, prospect.LeadSource, CREATED_OUTCOME)
+				} else {
+					recordSubmission(prospect.AppName, prospect.LeadSource, DB_ERROR_OUTCOME)
+				}
+			}
+		}
+
+		responseStr := fmt.Sprintf("Successfully added %d of %d prospects", counter, len(items))
+		logger.Info(responseStr)
+
+		return writeResponse(BatchResponse{Code: http.StatusOK, Message: responseStr, Results: results})
+	}
+}
+
+func insertProspectBatch(ctx context.Context, db *sql.DB, prospects []*ProspectForm, results []BatchItemResponse) int {
+	logger := common.Logger(ctx)
+	setServerError := func(index int) {
+		results[index].Code = http.StatusInternalServerError
+		results[index].Message = "Could not add prospect due to server error"
+		results[index].Id = 0
+	}
+
+	transaction, err := db.Begin()
+	if nil != err {
+		logger.Error("Error creating transaction", "error", err)
+		for index, prospect := range prospects {
+			if nil != prospect {
+				setServerError(index)
+			}
+		}
+		return 0
+	}
+
+	defer transaction.Rollback()
+	statement, err := transaction.Prepare(QUERY)
+	if nil != err {
+		logger.Error("Error preparing SQL statement", "error", err)
+		for index, prospect := range prospects {
+			if nil != prospect {
+				setServerError(index)
+			}
+		}
+		return 0
+	}
+
+	defer statement.Close()
+
+	counter := 0
+	for index, prospect := range prospects {
+		if nil == prospect {
+			continue
+		}
+
+		id, err := addProspectWithSavepoint(db, transaction, prospect, statement)
+		if nil != err {
+			logger.Error("Error processing prospect", "prospect", prospect, "error", err)
+			setServerError(index)
+			recordFailedLead(ctx, db, prospect, BatchInsert, err)
+			continue
+		}
+
+		results[index].Code = http.StatusCreated
+		results[index].Message = "Successfully added prospect"
+		results[index].Id = id
+		counter++
+	}
+
+	err = transaction.Commit()
+	if nil != err {
+		logger.Error("Error committing transaction", "error", err)
+		for index, prospect := range prospects {
+			if nil != prospect {
+				setServerError(index)
+				recordFailedLead(ctx, db, prospect, BatchInsert, err)
+			}
+		}
+		return 0
+	}
+
+	return counter
+}
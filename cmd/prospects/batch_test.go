@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const NDJSON_CONTENT_TYPE = "application/x-ndjson"
+
+func decodeTestBatchResponse(t *testing.T, body string) BatchResponse {
+	t.Helper()
+
+	var response BatchResponse
+	err := json.Unmarshal([]byte(body), &response)
+	if nil != err {
+		t.Fatalf("Error decoding batch response %s: %s", body, err)
+	}
+	return response
+}
+
+func getTestBatchCodes(response BatchResponse) []int {
+	codes := make([]int, len(response.Results))
+	for index, result := range response.Results {
+		codes[index] = result.Code
+	}
+	return codes
+}
+
+func TestBatchCreateProspects(t *testing.T) {
+	valid := getTestProspectJson("lothos@example.com")
+	invalid := getTestProspectJson("lothos")
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+		codes       []int
+	}{
+		{"json array", JSON_CONTENT_TYPE, "[" + valid + "," + invalid + "," + valid + "]", http.StatusOK, []int{http.StatusCreated, http.StatusBadRequest, http.StatusCreated}},
+		{"ndjson", NDJSON_CONTENT_TYPE, valid + "\n\n" + invalid + "\n" + valid + "\n", http.StatusOK, []int{http.StatusCreated, http.StatusBadRequest, http.StatusCreated}},
+		{"malformed item", JSON_CONTENT_TYPE, `[` + valid + `, {"appname": 1}]`, http.StatusOK, []int{http.StatusCreated, http.StatusBadRequest}},
+		{"at size limit", JSON_CONTENT_TYPE, "[" + strings.Repeat(valid+",", 3) + valid + "]", http.StatusOK, []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusCreated}},
+		{"over size limit", JSON_CONTENT_TYPE, "[" + strings.Repeat(valid+",", 4) + valid + "]", http.StatusRequestEntityTooLarge, nil},
+		{"ndjson over size limit", NDJSON_CONTENT_TYPE, strings.Repeat(valid+"\n", 5), http.StatusRequestEntityTooLarge, nil},
+		{"over size limit then malformed", JSON_CONTENT_TYPE, "[" + strings.Repeat(valid+",", 5) + "not json", http.StatusRequestEntityTooLarge, nil},
+		{"body over byte limit", JSON_CONTENT_TYPE, `[{"appname": "` + strings.Repeat("x", 2048) + `"}]`, http.StatusRequestEntityTooLarge, nil},
+		{"not an array", JSON_CONTENT_TYPE, valid, http.StatusBadRequest, nil},
+		{"unterminated array", JSON_CONTENT_TYPE, "[" + valid, http.StatusBadRequest, nil},
+		{"not json", "text/plain", valid, http.StatusUnsupportedMediaType, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.BatchSizeLimit = 4
+				config.BatchBodySizeLimit = 1024
+			})
+
+			recorder := doTestRequest(handler, http.MethodPost, BATCH_REQUEST_URL, test.contentType, test.body, nil)
+			if recorder.Code != test.code {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, test.code, recorder.Body)
+			}
+
+			response := decodeTestBatchResponse(t, recorder.Body.String())
+			codes := getTestBatchCodes(response)
+			if len(codes) != len(test.codes) {
+				t.Fatalf("item codes = %v, want %v", codes, test.codes)
+			}
+
+			created := 0
+			for index, code := range codes {
+				if code != test.codes[index] {
+					t.Errorf("item %d code = %d, want %d", index, code, test.codes[index])
+				}
+				if code == http.StatusCreated {
+					created++
+				}
+			}
+
+			if inserted := database.count("INSERT INTO prospects.leads"); inserted != created {
+				t.Errorf("inserted %d leads, want %d", inserted, created)
+			}
+		})
+	}
+}
+
+func TestBatchCreateProspectsRecordsFailedLeads(t *testing.T) {
+	body := "[" + getTestProspectJson("lothos@example.com") + "," + getTestProspectJson("ziggy@example.com") + "]"
+
+	tests := []struct {
+		name        string
+		failQueries []string
+		failCommit  bool
+		codes       []int
+	}{
+		{"insert failure", []string{"INSERT INTO prospects.leads"}, false, []int{http.StatusInternalServerError, http.StatusInternalServerError}},
+		{"commit failure", nil, true, []int{http.StatusInternalServerError, http.StatusInternalServerError}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, nil)
+			database.failQueries = test.failQueries
+			database.failCommit = test.failCommit
+
+			recorder := doTestRequest(handler, http.MethodPost, BATCH_REQUEST_URL, JSON_CONTENT_TYPE, body, nil)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+			}
+
+			response := decodeTestBatchResponse(t, recorder.Body.String())
+			for index, code := range getTestBatchCodes(response) {
+				if code != test.codes[index] {
+					t.Errorf("item %d code = %d, want %d", index, code, test.codes[index])
+				}
+			}
+
+			if failedLeads := database.count("INSERT INTO prospects.failed_leads"); failedLeads != len(test.codes) {
+				t.Errorf("recorded %d failed leads, want %d", failedLeads, len(test.codes))
+			}
+		})
+	}
+}
+
+func TestBatchCreateProspectsAsync(t *testing.T) {
+	handler, database := newTestServer(t, func(config *ProspectsConfig) {
+		config.AsyncRequest = true
+	})
+
+	var mutex sync.Mutex
+	var processed []*ProspectForm
+	processFunc := func(ctx context.Context, prospectBatch []*ProspectForm) []error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		processed = append(processed, prospectBatch...)
+		return nil
+	}
+
+	prospectBatchProcessor = common.NewBatchProcessor(processFunc, 10, 1, 1, 1, time.Millisecond)
+	body := "[" + getTestProspectJson("lothos@example.com") + "," + getTestProspectJson("lothos") + "]"
+
+	//Not started, as while shutting down
+	recorder := doTestRequest(handler, http.MethodPost, BATCH_REQUEST_URL, JSON_CONTENT_TYPE, body, nil)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("stopped code = %d, want %d: %s", recorder.Code, http.StatusServiceUnavailable, recorder.Body)
+	}
+
+	prospectBatchProcessor.Start(context.Background())
+	defer prospectBatchProcessor.Close()
+
+	recorder = doTestRequest(handler, http.MethodPost, BATCH_REQUEST_URL, JSON_CONTENT_TYPE, body, nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+
+	codes := getTestBatchCodes(decodeTestBatchResponse(t, recorder.Body.String()))
+	if len(codes) != 2 || codes[0] != http.StatusAccepted || codes[1] != http.StatusBadRequest {
+		t.Fatalf("item codes = %v, want [%d %d]", codes, http.StatusAccepted, http.StatusBadRequest)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		count := len(processed)
+		mutex.Unlock()
+
+		if count == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("processed %d prospects, want 1", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if inserted := database.count("INSERT INTO prospects.leads"); inserted != 0 {
+		t.Errorf("inserted %d leads directly, want 0", inserted)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"context"
+	"strconv"
+)
+
+var velocityRateLimiter = common.NewMemoryRateLimiter()
+
+// Detectors shared by every application, those with a zero score are left out
+func getBotDetectors(config ProspectsConfig) []common.BotDetector {
+	var botDetectors []common.BotDetector
+
+	if config.BotDetectMinFillTime > 0 && config.BotDetectFillTimeScore > 0 {
+		botDetectors = append(botDetectors, common.FillTimeDetector{config.BotDetectRenderFieldName, config.BotDetectRenderSecret, config.BotDetectMinFillTime, config.BotDetectFillTimeScore})
+	}
+
+	//Patterns were checked when the configuration loaded
+	userAgentPatterns, _ := config.GetUserAgentPatterns()
+	if config.BotDetectUserAgentScore > 0 {
+		botDetectors = append(botDetectors, common.UserAgentDetector{userAgentPatterns, config.BotDetectUserAgentScore})
+	}
+
+	if config.BotDetectAcceptLanguageScore > 0 {
+		botDetectors = append(botDetectors, common.AcceptLanguageDetector{config.BotDetectAcceptLanguageScore})
+	}
+
+	if config.BotDetectVelocity > 0 && config.BotDetectVelocityScore > 0 {
+		botDetectors = append(botDetectors, common.VelocityDetector{velocityRateLimiter, common.RateLimit{PerMinute: config.BotDetectVelocity}, config.BotDetectVelocityScore})
+	}
+
+	if config.FormToken && config.FormTokenScore > 0 {
+		botDetectors = append(botDetectors, common.FormTokenDetector{formTokens, config.FormTokenFieldName, config.FormTokenScore})
+	}
+
+	if len(config.BotDetectDisposableDomains) > 0 && config.BotDetectDisposableEmailScore > 0 {
+		botDetectors = append(botDetectors, common.DisposableEmailDetector{getStringSet(config.BotDetectDisposableDomains), config.BotDetectDisposableEmailScore})
+	}
+
+	return botDetectors
+}
+
+// Every contributing reason is logged and counted, including below the threshold, so detectors can
+// be tuned against what they would have caught
+func recordBotVerdict(ctx context.Context, appName string, botVerdict common.BotVerdict) {
+	if len(botVerdict.Reasons) == 0 {
+		return
+	}
+
+	if botVerdict.IsBot {
+		common.Logger(ctx).Warn("Robot detected", "app_name", appName, "score", botVerdict.Score, "reasons", botVerdict.ReasonsString())
+	} else {
+		common.Logger(ctx).Info("Robot signals below threshold", "app_name", appName, "score", botVerdict.Score, "reasons", botVerdict.ReasonsString())
+	}
+
+	if metricsEnabled {
+		for _, reason := range botVerdict.Reasons {
+			botSignalsCounter.Inc(getAppNameLabel(appName), reason.Detector, strconv.FormatBool(botVerdict.IsBot))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const (
+	TEST_USER_AGENT = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	// Position of suspected_bot in QUERY's arguments
+	SUSPECTED_BOT_ARG = 21
+)
+
+func getTestHoneypotJson(email string) string {
+	return strings.Replace(getTestProspectJson(email), "{", `{"spambot": "filled", `, 1)
+}
+
+func TestBotDetection(t *testing.T) {
+	browser := map[string]string{"User-Agent": TEST_USER_AGENT, common.ACCEPT_LANGUAGE_HEADER: "en-US"}
+	curl := map[string]string{"User-Agent": "curl/8.5.0"}
+	valid := getTestProspectJson("lothos@example.com")
+
+	tests := []struct {
+		name           string
+		configure      func(*ProspectsConfig)
+		headers        map[string]string
+		body           string
+		code           int
+		inserted       int
+		botSubmissions int
+	}{
+		{"human", nil, browser, valid, http.StatusCreated, 1, 0},
+		{"honeypot playing coy", nil, browser, getTestHoneypotJson("lothos@example.com"), http.StatusCreated, 0, 1},
+		{"honeypot rejected", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+		}, browser, getTestHoneypotJson("lothos@example.com"), http.StatusBadRequest, 0, 1},
+		{"honeypot in shadow", func(config *ProspectsConfig) {
+			config.BotDetectShadow = true
+		}, browser, getTestHoneypotJson("lothos@example.com"), http.StatusCreated, 1, 1},
+		{"honeypot header", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectFieldLocation = "header"
+			config.BotDetectFieldName = "X-Middle-Name"
+		}, map[string]string{"User-Agent": TEST_USER_AGENT, "X-Middle-Name": "filled"}, valid, http.StatusBadRequest, 0, 1},
+		{"scripted user agent", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectUserAgentScore = 1
+		}, curl, valid, http.StatusBadRequest, 0, 1},
+		{"no user agent", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectUserAgentScore = 1
+		}, nil, valid, http.StatusBadRequest, 0, 1},
+		{"browser user agent", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectUserAgentScore = 1
+		}, browser, valid, http.StatusCreated, 1, 0},
+		{"below threshold", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectUserAgentScore = 0.5
+		}, curl, valid, http.StatusCreated, 1, 0},
+		{"signals adding up", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectUserAgentScore = 0.5
+			config.BotDetectAcceptLanguageScore = 0.5
+		}, curl, valid, http.StatusBadRequest, 0, 1},
+		{"disposable email", func(config *ProspectsConfig) {
+			config.BotDetectPlayCoy = false
+			config.BotDetectDisposableEmailScore = 1
+		}, browser, getTestProspectJson("lothos@eu.mailinator.com"), http.StatusBadRequest, 0, 1},
+		{"disabled detectors", nil, curl, getTestProspectJson("lothos@mailinator.com"), http.StatusCreated, 1, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, test.configure)
+
+			recorder := doTestRequest(handler, http.MethodPost, REQUEST_URL, JSON_CONTENT_TYPE, test.body, test.headers)
+			if recorder.Code != test.code {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, test.code, recorder.Body)
+			}
+
+			if inserted := database.count("INSERT INTO prospects.leads"); inserted != test.inserted {
+				t.Errorf("inserted %d leads, want %d", inserted, test.inserted)
+			}
+
+			if botSubmissions := database.count("INSERT INTO prospects.bot_submissions"); botSubmissions != test.botSubmissions {
+				t.Errorf("recorded %d bot submissions, want %d", botSubmissions, test.botSubmissions)
+			}
+
+			//Only leads added in shadow mode are suspected
+			if args := database.lastArgs("INSERT INTO prospects.leads"); nil != args && args[SUSPECTED_BOT_ARG] != (test.botSubmissions > 0) {
+				t.Errorf("suspected_bot = %v, want %t", args[SUSPECTED_BOT_ARG], test.botSubmissions > 0)
+			}
+		})
+	}
+}
+
+func TestBotDetectionVelocity(t *testing.T) {
+	handler, database := newTestServer(t, func(config *ProspectsConfig) {
+		config.BotDetectPlayCoy = false
+		config.BotDetectVelocity = 1
+		config.BotDetectVelocityScore = 1
+	})
+
+	headers := map[string]string{"User-Agent": TEST_USER_AGENT}
+	for index, code := range []int{http.StatusCreated, http.StatusBadRequest} {
+		recorder := doTestRequest(handler, http.MethodPost, REQUEST_URL, JSON_CONTENT_TYPE, getTestProspectJson("lothos@example.com"), headers)
+		if recorder.Code != code {
+			t.Fatalf("submission %d code = %d, want %d: %s", index, recorder.Code, code, recorder.Body)
+		}
+	}
+
+	if botSubmissions := database.count("INSERT INTO prospects.bot_submissions"); botSubmissions != 1 {
+		t.Errorf("recorded %d bot submissions, want 1", botSubmissions)
+	}
+}
+
+func TestBotDetectionBatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		codes          []int
+		botSubmissions int
+	}{
+		//Batches have no form, so the honeypot in the body isn't checked
+		{"honeypot", map[string]string{"User-Agent": TEST_USER_AGENT}, []int{http.StatusCreated, http.StatusCreated}, 0},
+		{"scripted user agent", map[string]string{"User-Agent": "python-requests/2.31"}, []int{http.StatusBadRequest, http.StatusBadRequest}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.BotDetectPlayCoy = false
+				config.BotDetectUserAgentScore = 1
+			})
+
+			body := "[" + getTestHoneypotJson("lothos@example.com") + "," + getTestHoneypotJson("ziggy@example.com") + "]"
+			recorder := doTestRequest(handler, http.MethodPost, BATCH_REQUEST_URL, JSON_CONTENT_TYPE, body, test.headers)
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+			}
+
+			response := decodeTestBatchResponse(t, recorder.Body.String())
+			for index, code := range getTestBatchCodes(response) {
+				if code != test.codes[index] {
+					t.Errorf("item %d code = %d, want %d", index, code, test.codes[index])
+				}
+
+				//Why an item was taken for a robot isn't given away
+				if code == http.StatusBadRequest && len(response.Results[index].Errors) > 0 {
+					t.Errorf("item %d errors = %v, want none", index, response.Results[index].Errors)
+				}
+			}
+
+			if botSubmissions := database.count("INSERT INTO prospects.bot_submissions"); botSubmissions != test.botSubmissions {
+				t.Errorf("recorded %d bot submissions, want %d", botSubmissions, test.botSubmissions)
+			}
+		})
+	}
+}
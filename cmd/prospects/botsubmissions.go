@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	INSERT_BOT_SUBMISSION_QUERY = "INSERT INTO prospects.bot_submissions(lead_id, app_name, payload, headers, ip_address, score, detectors, reasons, is_shadow, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id"
+	BOT_SUBMISSIONS_QUERY       = "SELECT id, payload, score, array_to_string(detectors, ','), array_to_string(reasons, '; '), is_shadow, promoted_id, created_at FROM prospects.bot_submissions"
+	PROMOTED_QUERY              = "UPDATE prospects.bot_submissions SET promoted_id = $1, promoted_at = $2, updated_at = $3 WHERE id = $4 AND promoted_at IS NULL"
+	UNSUSPECT_LEAD_QUERY        = "UPDATE prospects.leads SET suspected_bot = FALSE, updated_at = $1 WHERE lead_id = $2 AND app_name = $3 AND suspected_bot = TRUE RETURNING id"
+	AUTHORIZATION_HEADER        = "Authorization"
+	COOKIE_HEADER               = "Cookie"
+)
+
+type BotSubmission struct {
+	Id         int64
+	Prospect   *ProspectForm
+	Score      float64
+	Detectors  string
+	Reasons    string
+	IsShadow   bool
+	PromotedId int64
+	CreatedAt  time.Time
+}
+
+// Credentials are left out of the stored headers, cookies are already kept in the payload
+func getBotSubmissionHeaders(req *http.Request) ([]byte, error) {
+	headers := make(http.Header)
+	for name, values := range req.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case common.API_KEY_HEADER, AUTHORIZATION_HEADER, COOKIE_HEADER:
+			continue
+		}
+		headers[name] = values
+	}
+
+	return json.Marshal(headers)
+}
+
+// Postgres array literal with every element quoted, reasons may hold commas and quotes
+func getArrayLiteral(values []string) string {
+	var elements []string
+	for _, value := range values {
+		value = strings.Replace(value, `\`, `\\`, -1)
+		value = strings.Replace(value, `"`, `\"`, -1)
+		elements = append(elements, `"`+value+`"`)
+	}
+
+	return "{" + strings.Join(elements, ",") + "}"
+}
+
+// Keeps a submission robot detection flagged, with the detectors that fired, so false positives
+// can be found and promoted into leads
+func recordBotSubmission(db *sql.DB, req *http.Request, prospect *ProspectForm, botVerdict common.BotVerdict) {
+	logger := common.Logger(req.Context())
+
+	payload, err := encodeProspect(prospect)
+	if nil != err {
+		logger.Error("Error encoding bot submission", "error", err)
+		return
+	}
+
+	headers, err := getBotSubmissionHeaders(req)
+	if nil != err {
+		logger.Error("Error encoding bot submission headers", "error", err)
+		return
+	}
+
+	var (
+		detectors []string
+		reasons   []string
+	)
+
+	for _, reason := range botVerdict.Reasons {
+		detectors = append(detectors, reason.Detector)
+		reasons = append(reasons, reason.String())
+	}
+
+	var leadId sql.NullString
+	if uuidRegex.MatchString(prospect.LeadId) {
+		leadId = sql.NullString{prospect.LeadId, true}
+	}
+
+	var ipAddress sql.NullString
+	if len(prospect.IpAddress) != 0 {
+		ipAddress = sql.NullString{prospect.IpAddress, true}
+	}
+
+	var id int64
+	err = db.QueryRow(INSERT_BOT_SUBMISSION_QUERY, leadId, prospect.AppName, string(payload), string(headers), ipAddress, botVerdict.Score,
+		getArrayLiteral(detectors), getArrayLiteral(reasons), prospect.SuspectedBot, time.Now(), time.Now()).Scan(&id)
+	if nil != err {
+		logger.Error("Error recording bot submission", "prospect", prospect, "error", err)
+		return
+	}
+
+	logger.Info("Recorded bot submission", "bot_submission_id", id, "shadow", prospect.SuspectedBot)
+}
+
+// Runs after binding, rather than from validation, so only submissions within the ip address's rate
+// limit are recorded
+func recordBotProspect(req *http.Request, prospect ProspectForm) {
+	if nil != prospect.BotVerdict {
+		recordBotSubmission(db, req, &prospect, *prospect.BotVerdict)
+	}
+}
+
+func getBotSubmissions(db *sql.DB, query string, args ...interface{}) ([]BotSubmission, error) {
+	rows, err := db.Query(BOT_SUBMISSIONS_QUERY+query, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var botSubmissions []BotSubmission
+	for rows.Next() {
+		var (
+			botSubmission BotSubmission
+			payload       string
+			promotedId    sql.NullInt64
+		)
+
+		err = rows.Scan(&botSubmission.Id, &payload, &botSubmission.Score, &botSubmission.Detectors, &botSubmission.Reasons, &botSubmission.IsShadow, &promotedId, &botSubmission.CreatedAt)
+		if nil != err {
+			return nil, err
+		}
+
+		botSubmission.Prospect, err = decodeProspect([]byte(payload))
+		if nil != err {
+			return nil, err
+		}
+
+		botSubmission.PromotedId = promotedId.Int64
+		botSubmissions = append(botSubmissions, botSubmission)
+	}
+
+	return botSubmissions, rows.Err()
+}
+
+// Shadow mode already added the lead, so it is only unmarked.  Otherwise the lead is inserted.
+func promoteBotSubmission(db *sql.DB, botSubmission BotSubmission) (int64, error) {
+	transaction, err := db.Begin()
+	if nil != err {
+		return 0, err
+	}
+
+	defer transaction.Rollback()
+
+	var id int64
+	if botSubmission.IsShadow {
+		err = transaction.QueryRow(UNSUSPECT_LEAD_QUERY, time.Now(), botSubmission.Prospect.LeadId, botSubmission.Prospect.AppName).Scan(&id)
+		if sql.ErrNoRows == err {
+			return 0, fmt.Errorf("No suspected bot lead found for lead id %s", botSubmission.Prospect.LeadId)
+		}
+	} else {
+		var statement *sql.Stmt
+		statement, err = transaction.Prepare(QUERY)
+		if nil != err {
+			return 0, err
+		}
+
+		defer statement.Close()
+
+		botSubmission.Prospect.SuspectedBot = false
+		id, err = addProspect(db, botSubmission.Prospect, statement)
+	}
+
+	if nil != err {
+		return 0, err
+	}
+
+	result, err := transaction.Exec(PROMOTED_QUERY, id, time.Now(), time.Now(), botSubmission.Id)
+	if nil != err {
+		return 0, err
+	}
+
+	count, _ := result.RowsAffected()
+	if count == 0 {
+		return 0, fmt.Errorf("Bot submission %d was already promoted", botSubmission.Id)
+	}
+
+	return id, transaction.Commit()
+}
+
+func runBotSubmissionsCommand(db *sql.DB, args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s botsubmissions list|promote [options]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet("botsubmissions "+args[0], flag.ExitOnError)
+	id := flags.Int64("id", 0, "Id of a single bot submission, otherwise every bot submission not yet promoted")
+	appName := flags.String("app_name", "", "Only bot submissions for the application name")
+	detector := flags.String("detector", "", "Only bot submissions the detector contributed to")
+	limit := flags.Int("limit", DEFAULT_PAGE_LIMIT, "Maximum number of bot submissions")
+	flags.Parse(args[1:])
+
+	var (
+		conditions []string
+		queryArgs  []interface{}
+	)
+
+	if *id > 0 {
+		queryArgs = append(queryArgs, *id)
+		conditions = append(conditions, fmt.Sprintf("id = $%d", len(queryArgs)))
+	} else {
+		conditions = append(conditions, "promoted_at IS NULL")
+	}
+
+	if len(*appName) > 0 {
+		queryArgs = append(queryArgs, *appName)
+		conditions = append(conditions, fmt.Sprintf("app_name = $%d", len(queryArgs)))
+	}
+
+	if len(*detector) > 0 {
+		queryArgs = append(queryArgs, *detector)
+		conditions = append(conditions, fmt.Sprintf("$%d = ANY(detectors)", len(queryArgs)))
+	}
+
+	queryArgs = append(queryArgs, *limit)
+	query := fmt.Sprintf(" WHERE %s ORDER BY id ASC LIMIT $%d", strings.Join(conditions, " AND "), len(queryArgs))
+
+	botSubmissions, err := getBotSubmissions(db, query, queryArgs...)
+	if nil != err {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, botSubmission := range botSubmissions {
+			fmt.Printf("%d\t%s\t%s\t%.2f\tshadow=%t\t%s\t%s\n", botSubmission.Id, botSubmission.CreatedAt.Format(time.RFC3339), botSubmission.Prospect.AppName, botSubmission.Score, botSubmission.IsShadow, botSubmission.Reasons, botSubmission.Prospect.LeadId)
+		}
+		break
+	case "promote":
+		counter := 0
+
+		for _, botSubmission := range botSubmissions {
+			if botSubmission.PromotedId > 0 {
+				fmt.Printf("%d\tpromoted\tlead id %d\n", botSubmission.Id, botSubmission.PromotedId)
+				continue
+			}
+
+			err = revalidateProspect(botSubmission.Prospect)
+			if nil != err {
+				fmt.Printf("%d\tinvalid\t%s\n", botSubmission.Id, err)
+				continue
+			}
+
+			leadId, err := promoteBotSubmission(db, botSubmission)
+			if nil != err {
+				fmt.Printf("%d\tfailed\t%s\n", botSubmission.Id, err)
+			} else {
+				fmt.Printf("%d\tpromoted\tlead id %d\n", botSubmission.Id, leadId)
+				counter++
+			}
+		}
+
+		log.Printf("Promoted %d of %d bot submissions", counter, len(botSubmissions))
+		break
+	default:
+		usage()
+	}
+}
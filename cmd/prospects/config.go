@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type ProspectsConfig struct {
+	Host       string `config:"HOST"`
+	Port       int    `config:"PORT" default:"3000" min:"1" max:"65535"`
+	MartiniEnv string `config:"MARTINI_ENV" default:"development"`
+
+	StringSizeLimit   int      `config:"STRING_SIZE_LIMIT" default:"500" min:"1"`
+	FeedbackSizeLimit int      `config:"FEEDBACK_SIZE_LIMIT" default:"3000" min:"1"`
+	BatchSizeLimit    int      `config:"BATCH_SIZE_LIMIT" default:"1000" min:"1"`
+	AppNames          []string `config:"APPLICATION_NAMES" usage:"Allowable application names, comma separated"`
+
+	BatchBodySizeLimit int64 `config:"BATCH_BODY_SIZE_LIMIT" default:"10485760" min:"1" usage:"Bytes read from a batch request body"`
+
+	BotDetectFieldLocation string `config:"BOTDETECT_FIELDLOCATION" default:"body" oneof:"header|body"`
+	BotDetectFieldName     string `config:"BOTDETECT_FIELDNAME" default:"spambot"`
+	BotDetectFieldValue    string `config:"BOTDETECT_FIELDVALUE"`
+	BotDetectMustMatch     bool   `config:"BOTDETECT_MUSTMATCH" default:"true"`
+	BotDetectPlayCoy       bool   `config:"BOTDETECT_PLAYCOY" default:"true"`
+
+	BotDetectShadow               bool          `config:"BOTDETECT_SHADOW" default:"false" usage:"Add robot submissions as suspected bots rather than discarding them"`
+	BotDetectThreshold            float64       `config:"BOTDETECT_THRESHOLD" default:"1" min:"0" usage:"Score at which a submission is a bot"`
+	BotDetectHoneypotScore        float64       `config:"BOTDETECT_HONEYPOT_SCORE" default:"1" min:"0"`
+	BotDetectRenderFieldName      string        `config:"BOTDETECT_RENDER_FIELDNAME" default:"rendered"`
+	BotDetectRenderSecret         string        `config:"BOTDETECT_RENDER_SECRET" secret:"true"`
+	BotDetectMinFillTime          time.Duration `config:"BOTDETECT_MIN_FILL_TIME" default:"0" unit:"s" min:"0" usage:"Shortest time to fill a form after rendering, 0 to disable"`
+	BotDetectFillTimeScore        float64       `config:"BOTDETECT_FILL_TIME_SCORE" default:"0.6" min:"0"`
+	BotDetectUserAgentPatterns    []string      `config:"BOTDETECT_USER_AGENT_PATTERNS" default:"curl,wget,python,go-http-client,java/,libwww,scrapy,headless,phantomjs,spider,crawl,bot/" usage:"Case insensitive user agent regular expressions, comma separated"`
+	BotDetectUserAgentScore       float64       `config:"BOTDETECT_USER_AGENT_SCORE" default:"0" min:"0" usage:"0 to disable"`
+	BotDetectAcceptLanguageScore  float64       `config:"BOTDETECT_ACCEPT_LANGUAGE_SCORE" default:"0" min:"0" usage:"0 to disable"`
+	BotDetectVelocity             int           `config:"BOTDETECT_VELOCITY" default:"0" min:"0" usage:"Submissions a minute per ip address before scoring, 0 to disable"`
+	BotDetectVelocityScore        float64       `config:"BOTDETECT_VELOCITY_SCORE" default:"0.5" min:"0"`
+	BotDetectDisposableDomains    []string      `config:"BOTDETECT_DISPOSABLE_DOMAINS" default:"mailinator.com,guerrillamail.com,sharklasers.com,10minutemail.com,temp-mail.org,yopmail.com,trashmail.com,getnada.com,dispostable.com,maildrop.cc,throwawaymail.com,fakeinbox.com,mailnesia.com,mintemail.com" usage:"Disposable email domains, comma separated"`
+	BotDetectDisposableEmailScore float64       `config:"BOTDETECT_DISPOSABLE_EMAIL_SCORE" default:"0" min:"0" usage:"0 to disable"`
+
+	FormToken          bool          `config:"FORM_TOKEN" default:"false" usage:"Issue signed form tokens and score submissions without one"`
+	FormTokenSecret    string        `config:"FORM_TOKEN_SECRET" secret:"true"`
+	FormTokenFieldName string        `config:"FORM_TOKEN_FIELDNAME" default:"formtoken"`
+	FormTokenMinAge    time.Duration `config:"FORM_TOKEN_MIN_AGE" default:"2" unit:"s" min:"0"`
+	FormTokenMaxAge    time.Duration `config:"FORM_TOKEN_MAX_AGE" default:"3600" unit:"s" min:"1"`
+	FormTokenScore     float64       `config:"FORM_TOKEN_SCORE" default:"1" min:"0"`
+	FormTokenStore     string        `config:"FORM_TOKEN_STORE" default:"memory" oneof:"memory|postgres"`
+
+	Pow              bool          `config:"POW" default:"false" usage:"Require browser submissions to solve a proof of work challenge, unless the application says otherwise"`
+	PowSecret        string        `config:"POW_SECRET" secret:"true"`
+	PowDifficulty    int           `config:"POW_DIFFICULTY" default:"16" min:"1" max:"64" usage:"Leading zero bits of the hash required at normal submission rates"`
+	PowMaxDifficulty int           `config:"POW_MAX_DIFFICULTY" default:"24" min:"1" max:"64"`
+	PowRateThreshold float64       `config:"POW_RATE_THRESHOLD" default:"5" min:"0" usage:"Submissions a minute per ip address before the difficulty grows a bit per doubling, 0 to never grow"`
+	PowMaxAge        time.Duration `config:"POW_MAX_AGE" default:"600" unit:"s" min:"1"`
+	PowStore         string        `config:"POW_STORE" default:"memory" oneof:"memory|postgres"`
+
+	RateLimitStore     string `config:"RATE_LIMIT_STORE" default:"memory" oneof:"memory|postgres"`
+	RateLimitIp        int    `config:"RATE_LIMIT_IP" default:"0" min:"0" usage:"Submissions a minute per ip address, 0 for no limit"`
+	RateLimitIpBurst   int    `config:"RATE_LIMIT_IP_BURST" default:"0" min:"0" usage:"Submissions allowed at once per ip address, 0 for a minute's worth"`
+	RateLimitLead      int    `config:"RATE_LIMIT_LEAD" default:"0" min:"0" usage:"Submissions a minute per lead id and per email, 0 for no limit"`
+	RateLimitLeadBurst int    `config:"RATE_LIMIT_LEAD_BURST" default:"0" min:"0" usage:"Submissions allowed at once per lead id and per email, 0 for a minute's worth"`
+
+	PhoneRegion string `config:"PHONE_REGION" default:"US" usage:"Region phone numbers without a country code are parsed in, when neither the application nor the submission says"`
+
+	IdempotencyStore string        `config:"IDEMPOTENCY_STORE" default:"memory" oneof:"memory|postgres"`
+	IdempotencyTtl   time.Duration `config:"IDEMPOTENCY_TTL" default:"86400" unit:"s" min:"1" usage:"Seconds a response is replayed for its idempotency key"`
+
+	GzipResponse         bool     `config:"GZIP_RESPONSE" default:"true"`
+	GzipCompressionLevel int      `config:"GZIP_COMPRESSION_LEVEL" default:"6" min:"1" max:"9"`
+	IpAddressLocation    string   `config:"IP_ADDRESS_LOCATION" default:"normal" oneof:"normal|xff_first|xff_last"`
+	AllowHeaders         []string `config:"ALLOW_HEADERS" usage:"Additional allowable header names, comma separated"`
+	SslRedirect          bool     `config:"SSL_REDIRECT" default:"false"`
+	AllowedOrigins       []string `config:"ALLOWED_ORIGINS" usage:"Origins allowed to submit for applications without their own, comma separated"`
+	OriginMismatch       string   `config:"ORIGIN_MISMATCH" default:"reject" oneof:"reject|flag"`
+
+	AsyncRequest            bool              `config:"ASYNC_REQUEST" default:"false"`
+	AsyncRequestSize        int               `config:"ASYNC_REQUEST_SIZE" default:"100000" min:"1"`
+	AsyncProcessInterval    int               `config:"ASYNC_PROCESS_INTERVAL" default:"5" min:"1" usage:"Seconds between asynchronous batch flushes"`
+	AsyncMaxBatchSize       int               `config:"ASYNC_MAX_BATCH_SIZE" default:"1000" min:"0"`
+	AsyncMaxLatency         time.Duration     `config:"ASYNC_MAX_LATENCY" default:"1000" unit:"ms" min:"0"`
+	AsyncSpoolDir           string            `config:"ASYNC_SPOOL_DIR"`
+	AsyncSpoolFsync         common.SyncPolicy `config:"ASYNC_SPOOL_FSYNC" default:"interval" usage:"always, interval or never"`
+	AsyncSpoolFsyncInterval time.Duration     `config:"ASYNC_SPOOL_FSYNC_INTERVAL" default:"1000" unit:"ms" min:"1"`
+	AsyncSpoolSegmentSize   int64             `config:"ASYNC_SPOOL_SEGMENT_SIZE" default:"16777216" min:"1"`
+	AsyncCopy               bool              `config:"ASYNC_COPY" default:"true"`
+	AsyncRetryMaxAttempts   int               `config:"ASYNC_RETRY_MAX_ATTEMPTS" default:"3" min:"1"`
+	AsyncRetryBackoff       time.Duration     `config:"ASYNC_RETRY_BACKOFF" default:"100" unit:"ms" min:"0"`
+	AsyncRetryMaxBackoff    time.Duration     `config:"ASYNC_RETRY_MAX_BACKOFF" default:"10000" unit:"ms" min:"0"`
+	FailedLeadsFile         string            `config:"FAILED_LEADS_FILE" usage:"Failed leads that can't be written to the failed_leads table are appended here"`
+
+	RobotsTxt              bool     `config:"ROBOTS_TXT" default:"false"`
+	SitemapXml             bool     `config:"SITEMAP_XML" default:"false"`
+	FaviconIco             bool     `config:"FAVICON_ICO" default:"false"`
+	VerifyLeadRedirectUrls []string `config:"VERIFY_LEAD_REDIRECT_URLS" usage:"Comma separated app_name|url pairs"`
+
+	ApiKeyCacheSeconds  time.Duration `config:"API_KEY_CACHE_SECONDS" default:"60" unit:"s" min:"0"`
+	ApiKeyRequiredApps  []string      `config:"API_KEY_REQUIRED_APPS" usage:"Application names requiring an api key, * for all"`
+	ApiKeySigningSecret string        `config:"API_KEY_SIGNING_SECRET" secret:"true" usage:"Signs api key request urls, which are refused when not set"`
+	ReadApi             bool          `config:"READ_API" default:"false"`
+	Metrics             bool          `config:"METRICS" default:"false"`
+	ReadyTimeout        time.Duration `config:"READY_TIMEOUT" default:"1000" unit:"ms" min:"1"`
+	ReadyQueueThreshold float64       `config:"READY_QUEUE_THRESHOLD" default:"0.9" min:"0" max:"1"`
+	ReadyDrainPeriod    time.Duration `config:"READY_DRAIN_PERIOD" default:"5" unit:"s" min:"0"`
+	ShutdownTimeout     time.Duration `config:"SHUTDOWN_TIMEOUT" default:"30" unit:"s" min:"1"`
+
+	Database common.DatabaseConfig
+	Log      common.LogConfig
+}
+
+func (config ProspectsConfig) Validate() error {
+	if config.ReadyQueueThreshold <= 0 {
+		return fmt.Errorf("READY_QUEUE_THRESHOLD must be greater than 0")
+	} else if config.AsyncRetryMaxBackoff < config.AsyncRetryBackoff {
+		return fmt.Errorf("ASYNC_RETRY_MAX_BACKOFF %s is less than ASYNC_RETRY_BACKOFF %s", config.AsyncRetryMaxBackoff, config.AsyncRetryBackoff)
+	}
+
+	if config.BotDetectMinFillTime > 0 && len(config.BotDetectRenderSecret) == 0 {
+		return fmt.Errorf("BOTDETECT_RENDER_SECRET is required with BOTDETECT_MIN_FILL_TIME")
+	} else if config.FormToken && len(config.FormTokenSecret) == 0 {
+		return fmt.Errorf("FORM_TOKEN_SECRET is required with FORM_TOKEN")
+	} else if config.FormTokenMaxAge <= config.FormTokenMinAge {
+		return fmt.Errorf("FORM_TOKEN_MAX_AGE %s is not more than FORM_TOKEN_MIN_AGE %s", config.FormTokenMaxAge, config.FormTokenMinAge)
+	} else if config.Pow && len(config.PowSecret) == 0 {
+		return fmt.Errorf("POW_SECRET is required with POW")
+	} else if config.PowMaxDifficulty < config.PowDifficulty {
+		return fmt.Errorf("POW_MAX_DIFFICULTY %d is less than POW_DIFFICULTY %d", config.PowMaxDifficulty, config.PowDifficulty)
+	} else if !common.IsPhoneRegion(config.PhoneRegion) {
+		return fmt.Errorf("PHONE_REGION %s is not a known region", config.PhoneRegion)
+	}
+
+	_, err := config.GetUserAgentPatterns()
+	if nil != err {
+		return err
+	}
+
+	_, err = config.GetVerifyLeadRedirectUrls()
+	return err
+}
+
+// User agent patterns match without case
+func (config ProspectsConfig) GetUserAgentPatterns() ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, pattern := range config.BotDetectUserAgentPatterns {
+		userAgentRegex, err := regexp.Compile("(?i)" + pattern)
+		if nil != err {
+			return nil, fmt.Errorf("BOTDETECT_USER_AGENT_PATTERNS entry %s is invalid: %s", pattern, err)
+		}
+		patterns = append(patterns, userAgentRegex)
+	}
+
+	return patterns, nil
+}
+
+func (config ProspectsConfig) GetAddr() string {
+	return fmt.Sprintf("%s:%d", config.Host, config.Port)
+}
+
+// Lead verification redirect urls are app_name|url pairs
+func (config ProspectsConfig) GetVerifyLeadRedirectUrls() (map[string]string, error) {
+	if len(config.VerifyLeadRedirectUrls) == 0 {
+		return nil, nil
+	}
+
+	verifyLeadRedirectUrls := make(map[string]string)
+	for _, verifyLeadRedirectUrl := range config.VerifyLeadRedirectUrls {
+		nvp := strings.Split(verifyLeadRedirectUrl, "|")
+		if len(nvp) != 2 {
+			return nil, fmt.Errorf("VERIFY_LEAD_REDIRECT_URLS entry %s is not app_name|url", verifyLeadRedirectUrl)
+		}
+
+		_, err := url.Parse(nvp[1])
+		if nil != err {
+			return nil, fmt.Errorf("VERIFY_LEAD_REDIRECT_URLS entry %s has an invalid url", verifyLeadRedirectUrl)
+		}
+
+		verifyLeadRedirectUrls[nvp[0]] = nvp[1]
+	}
+
+	return verifyLeadRedirectUrls, nil
+}
+
+func getStringSet(values []string) map[string]bool {
+	if len(values) == 0 {
+		return nil
+	}
+
+	set := make(map[string]bool)
+	for _, value := range values {
+		set[value] = true
+	}
+
+	return set
+}
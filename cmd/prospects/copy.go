@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"strconv"
+	"time"
+)
+
+var copyColumns = []string{"lead_id", "app_name", "email", "lead_source", "feedback", "referrer", "page_referrer", "first_name", "last_name", "phone_number", "dob", "gender", "zip_code", "language", "user_agent", "cookies", "geolocation", "ip_address", "miscellaneous", "suspicious_origin", "suspected_bot", "email_canonical", "phone_e164", "phone_country", "phone_line_type", "created_at", "updated_at"}
+
+var asyncCopy bool
+
+// COPY takes the geolocation as point text rather than the POINT(latitude, longitude) call in QUERY
+func getProspectCopyArgs(prospect *ProspectForm) []interface{} {
+	args := getProspectArgs(prospect)
+
+	var geolocation sql.NullString
+	latitude := args[16].(sql.NullFloat64)
+	longitude := args[17].(sql.NullFloat64)
+	if latitude.Valid && longitude.Valid {
+		geolocation = sql.NullString{fmt.Sprintf("(%s,%s)", strconv.FormatFloat(latitude.Float64, 'g', -1, 64), strconv.FormatFloat(longitude.Float64, 'g', -1, 64)), true}
+	}
+
+	return append(append(args[:16:16], geolocation), args[18:]...)
+}
+
+// Loads every prospect with a single COPY.  Any bad row fails the whole COPY, so nothing is
+// committed unless every row was accepted.
+func copyProspects(ctx context.Context, prospectBatch []*ProspectForm) error {
+	defer recordInsertLatency("copy", time.Now())
+
+	transaction, err := db.BeginTx(ctx, nil)
+	if nil != err {
+		return err
+	}
+
+	defer transaction.Rollback()
+	statement, err := transaction.Prepare(pq.CopyInSchema("prospects", "leads", copyColumns...))
+	if nil != err {
+		return err
+	}
+
+	for _, prospect := range prospectBatch {
+		_, err = statement.Exec(getProspectCopyArgs(prospect)...)
+		if nil != err {
+			statement.Close()
+			return err
+		}
+	}
+
+	//An empty exec flushes the buffered rows and reports any error from the server
+	_, err = statement.Exec()
+	if nil != err {
+		statement.Close()
+		return err
+	}
+
+	err = statement.Close()
+	if nil != err {
+		return err
+	}
+
+	err = transaction.Commit()
+	if nil == err {
+		log.Printf("Copied %d prospects", len(prospectBatch))
+	}
+
+	return err
+}
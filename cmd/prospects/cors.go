@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ORIGIN_HEADER            = "Origin"
+	VARY_HEADER              = "Vary"
+	ALLOW_ORIGIN_HEADER      = "Access-Control-Allow-Origin"
+	ALLOW_CREDENTIALS_HEADER = "Access-Control-Allow-Credentials"
+	ALLOW_METHODS_HEADER     = "Access-Control-Allow-Methods"
+	ALLOW_HEADERS_HEADER     = "Access-Control-Allow-Headers"
+	EXPOSE_HEADERS_HEADER    = "Access-Control-Expose-Headers"
+	REQUEST_METHOD_HEADER    = "Access-Control-Request-Method"
+	REQUEST_HEADERS_HEADER   = "Access-Control-Request-Headers"
+	ALL_ORIGINS              = "*"
+	OPTIONS_METHOD           = "OPTIONS"
+)
+
+type CorsOptions struct {
+	AllowMethods     []string
+	AllowHeaders     []string
+	ExposeHeaders    []string
+	AllowCredentials bool
+}
+
+// Applications a submission could be for.  Unregistered application names take the defaults, so
+// the defaults count unless every allowable application name is registered.
+func getCorsApplications() []common.Application {
+	corsApplications := applications.Applications()
+
+	registered := make(map[string]bool)
+	for _, application := range corsApplications {
+		registered[application.AppName] = true
+	}
+
+	usesDefaults := nil == appNames
+	for appName := range appNames {
+		usesDefaults = usesDefaults || !registered[appName]
+	}
+
+	if usesDefaults {
+		corsApplications = append(corsApplications, applications.Defaults)
+	}
+
+	return corsApplications
+}
+
+// Whether any application allows the origin, and whether origins are restricted at all.  The body
+// isn't sent with a preflight so the application isn't known until the submission is validated.
+func isOriginAllowed(origin string) (bool, bool) {
+	allowed := false
+	restricted := true
+
+	for _, application := range getCorsApplications() {
+		restricted = restricted && len(application.AllowedOrigins) > 0
+		allowed = allowed || application.AllowsOrigin(origin)
+	}
+
+	return allowed, restricted
+}
+
+// Header bot detection fields of every application have to be allowed for the honeypot to be sent
+func getAllowHeaders(allowHeaders []string) []string {
+	allowHeaders = append([]string(nil), allowHeaders...)
+
+	botDetections := []common.BotDetection{applications.Defaults.BotDetection}
+	for _, application := range applications.Applications() {
+		botDetections = append(botDetections, application.BotDetection)
+	}
+
+	for _, botDetection := range botDetections {
+		if botDetection.FieldLocation != common.Header {
+			continue
+		}
+
+		exists := false
+		for _, allowHeader := range allowHeaders {
+			exists = exists || strings.EqualFold(allowHeader, botDetection.FieldName)
+		}
+
+		if !exists {
+			allowHeaders = append(allowHeaders, botDetection.FieldName)
+		}
+	}
+
+	return allowHeaders
+}
+
+// Cross origin requests are checked against prospects.applications on every request so changes
+// apply without a restart.  Disallowed origins get no CORS headers, so browsers block them, and
+// submissions are checked against their own application when validated.
+func allowCors(options CorsOptions) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get(ORIGIN_HEADER)
+		if len(origin) == 0 {
+			return
+		}
+
+		allowOrigin := ALL_ORIGINS
+		if allowed, restricted := isOriginAllowed(origin); restricted {
+			res.Header().Add(VARY_HEADER, ORIGIN_HEADER)
+			if !allowed {
+				return
+			}
+			allowOrigin = origin
+		}
+
+		res.Header().Set(ALLOW_ORIGIN_HEADER, allowOrigin)
+		res.Header().Set(ALLOW_CREDENTIALS_HEADER, strconv.FormatBool(options.AllowCredentials))
+
+		if len(options.ExposeHeaders) > 0 {
+			res.Header().Set(EXPOSE_HEADERS_HEADER, strings.Join(options.ExposeHeaders, ","))
+		}
+
+		if req.Method == OPTIONS_METHOD && len(req.Header.Get(REQUEST_METHOD_HEADER)) > 0 {
+			res.Header().Set(ALLOW_METHODS_HEADER, strings.Join(options.AllowMethods, ","))
+			res.Header().Set(ALLOW_HEADERS_HEADER, strings.Join(getAllowHeaders(options.AllowHeaders), ","))
+			res.WriteHeader(http.StatusOK)
+		}
+	}
+}
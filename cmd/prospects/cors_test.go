@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql/driver"
+	"net/http"
+	"testing"
+)
+
+// Position of suspicious_origin in QUERY's arguments
+const SUSPICIOUS_ORIGIN_ARG = 20
+
+// Registers appName in prospects.applications with its own allowed origins and origin mismatch,
+// leaving every other setting NULL
+func registerTestApplication(t *testing.T, database *testDatabase, appName string, allowedOrigins string, originMismatch string) {
+	t.Helper()
+
+	row := make([]driver.Value, 20)
+	row[0] = appName
+	if len(allowedOrigins) > 0 {
+		row[4] = allowedOrigins
+	}
+	if len(originMismatch) > 0 {
+		row[13] = originMismatch
+	}
+
+	database.mutex.Lock()
+	if nil == database.rows {
+		database.rows = make(map[string][]driver.Value)
+	}
+	database.rows[common.APPLICATIONS_QUERY] = row
+	database.mutex.Unlock()
+
+	err := applications.Load()
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	const otherOrigin = "https://leapingwithlothos.com"
+
+	tests := []struct {
+		name           string
+		allowedOrigins []string
+		appNames       []string
+		registered     string
+		origin         string
+		allowOrigin    string
+		vary           bool
+	}{
+		{"any origin", nil, nil, "", TEST_ORIGIN, ALL_ORIGINS, false},
+		{"allowed origin", []string{TEST_ORIGIN}, nil, "", TEST_ORIGIN, TEST_ORIGIN, true},
+		{"allowed origin in another case", []string{"https://RidingWithZiggy.com/"}, nil, "", TEST_ORIGIN, TEST_ORIGIN, true},
+		{"disallowed origin", []string{TEST_ORIGIN}, nil, "", otherOrigin, "", true},
+		{"allowed by application", []string{TEST_ORIGIN}, nil, otherOrigin, otherOrigin, otherOrigin, true},
+		{"defaults unused", []string{TEST_ORIGIN}, []string{TEST_APP_NAME}, otherOrigin, TEST_ORIGIN, "", true},
+		{"unrestricted defaults", nil, nil, otherOrigin, TEST_ORIGIN, ALL_ORIGINS, false},
+		{"no origin", []string{TEST_ORIGIN}, nil, "", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.AllowedOrigins = test.allowedOrigins
+				config.AppNames = test.appNames
+			})
+			if len(test.registered) > 0 {
+				registerTestApplication(t, database, TEST_APP_NAME, test.registered, "")
+			}
+
+			var headers map[string]string
+			if len(test.origin) > 0 {
+				headers = map[string]string{ORIGIN_HEADER: test.origin, REQUEST_METHOD_HEADER: http.MethodPost}
+			}
+
+			recorder := doTestRequest(handler, OPTIONS_METHOD, REQUEST_URL, "", "", headers)
+
+			if allowOrigin := recorder.Header().Get(ALLOW_ORIGIN_HEADER); allowOrigin != test.allowOrigin {
+				t.Errorf("%s = %q, want %q", ALLOW_ORIGIN_HEADER, allowOrigin, test.allowOrigin)
+			}
+
+			if vary := recorder.Header().Get(VARY_HEADER) == ORIGIN_HEADER; vary != test.vary {
+				t.Errorf("varies by origin = %t, want %t", vary, test.vary)
+			}
+
+			allowMethods := recorder.Header().Get(ALLOW_METHODS_HEADER)
+			if len(test.allowOrigin) > 0 && (recorder.Code != http.StatusOK || allowMethods != "POST,GET,HEAD") {
+				t.Errorf("allowed preflight = %d with methods %q, want %d with POST,GET,HEAD", recorder.Code, allowMethods, http.StatusOK)
+			} else if len(test.allowOrigin) == 0 && len(allowMethods) > 0 {
+				t.Errorf("%s = %q for a refused preflight, want none", ALLOW_METHODS_HEADER, allowMethods)
+			}
+		})
+	}
+}
+
+func TestCorsPreflightAllowsHeaderBotDetectionField(t *testing.T) {
+	handler, _ := newTestServer(t, func(config *ProspectsConfig) {
+		config.BotDetectFieldLocation = "header"
+		config.BotDetectFieldName = "X-Middle-Name"
+	})
+
+	recorder := doTestRequest(handler, OPTIONS_METHOD, REQUEST_URL, "", "", map[string]string{ORIGIN_HEADER: TEST_ORIGIN, REQUEST_METHOD_HEADER: http.MethodPost})
+
+	allowHeaders := recorder.Header().Get(ALLOW_HEADERS_HEADER)
+	expected := ORIGIN_HEADER + "," + CONTENT_TYPE_HEADER + "," + common.API_KEY_HEADER + "," + common.REQUEST_ID_HEADER + "," + common.IDEMPOTENCY_KEY_HEADER + ",X-Middle-Name"
+	if allowHeaders != expected {
+		t.Errorf("%s = %q, want %q", ALLOW_HEADERS_HEADER, allowHeaders, expected)
+	}
+}
+
+func TestCorsSubmission(t *testing.T) {
+	const otherOrigin = "https://leapingwithlothos.com"
+
+	tests := []struct {
+		name             string
+		originMismatch   string
+		origin           string
+		code             int
+		allowOrigin      string
+		suspiciousOrigin driver.Value
+	}{
+		{"allowed origin", "", TEST_ORIGIN, http.StatusCreated, TEST_ORIGIN, nil},
+		{"no origin", "", "", http.StatusCreated, "", nil},
+		{"rejected origin", "reject", otherOrigin, http.StatusForbidden, "", nil},
+		{"flagged origin", "flag", otherOrigin, http.StatusCreated, "", otherOrigin},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			//Only the registered application, so its origins are the only ones allowed
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.AppNames = []string{TEST_APP_NAME}
+			})
+			registerTestApplication(t, database, TEST_APP_NAME, TEST_ORIGIN, test.originMismatch)
+
+			var headers map[string]string
+			if len(test.origin) > 0 {
+				headers = map[string]string{ORIGIN_HEADER: test.origin}
+			}
+
+			recorder := doTestRequest(handler, http.MethodPost, REQUEST_URL, JSON_CONTENT_TYPE, getTestProspectJson("lothos@example.com"), headers)
+			if recorder.Code != test.code {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, test.code, recorder.Body)
+			}
+
+			if allowOrigin := recorder.Header().Get(ALLOW_ORIGIN_HEADER); allowOrigin != test.allowOrigin {
+				t.Errorf("%s = %q, want %q", ALLOW_ORIGIN_HEADER, allowOrigin, test.allowOrigin)
+			}
+
+			if exposeHeaders := recorder.Header().Get(EXPOSE_HEADERS_HEADER); len(test.allowOrigin) > 0 && exposeHeaders != common.REQUEST_ID_HEADER+","+common.IDEMPOTENT_REPLAYED_HEADER {
+				t.Errorf("%s = %q, want the request id and replayed headers", EXPOSE_HEADERS_HEADER, exposeHeaders)
+			}
+
+			if args := database.lastArgs("INSERT INTO prospects.leads"); nil != args && args[SUSPICIOUS_ORIGIN_ARG] != test.suspiciousOrigin {
+				t.Errorf("suspicious_origin = %v, want %v", args[SUSPICIOUS_ORIGIN_ARG], test.suspiciousOrigin)
+			}
+		})
+	}
+}
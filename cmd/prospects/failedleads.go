@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	INSERT_FAILED_LEAD_QUERY = "INSERT INTO prospects.failed_leads(lead_id, app_name, payload, insert_path, error_code, error_message, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+	FAILED_LEADS_QUERY       = "SELECT id, payload, insert_path, error_code, error_message, replayed_id, created_at FROM prospects.failed_leads"
+	REPLAYED_LEAD_QUERY      = "UPDATE prospects.failed_leads SET replayed_id = $1, replayed_at = $2, updated_at = $3 WHERE id = $4 AND replayed_at IS NULL"
+)
+
+type InsertPath int
+
+const (
+	SyncInsert InsertPath = 1 << iota
+	BatchInsert
+	AsyncInsert
+)
+
+func (insertPath InsertPath) String() string {
+	switch insertPath {
+	case SyncInsert:
+		return "sync"
+	case BatchInsert:
+		return "batch"
+	case AsyncInsert:
+		return "async"
+	default:
+		return ""
+	}
+}
+
+type FailedLead struct {
+	Id           int64 `json:",omitempty"`
+	Prospect     *ProspectForm
+	InsertPath   string
+	ErrorCode    string `json:",omitempty"`
+	ErrorMessage string
+	ReplayedId   int64 `json:",omitempty"`
+	CreatedAt    time.Time
+}
+
+// Either the database or a transaction
+type rowQueryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var failedLeadsFile string
+var failedLeadsFileMutex sync.Mutex
+
+func getFailedLead(prospect *ProspectForm, insertPath InsertPath, insertErr error) FailedLead {
+	failedLead := FailedLead{Prospect: prospect, InsertPath: insertPath.String(), ErrorMessage: insertErr.Error(), CreatedAt: time.Now()}
+
+	var pqErr *pq.Error
+	if errors.As(insertErr, &pqErr) {
+		failedLead.ErrorCode = string(pqErr.Code)
+		failedLead.ErrorMessage = pqErr.Message
+		if len(pqErr.Detail) > 0 {
+			failedLead.ErrorMessage += ": " + pqErr.Detail
+		}
+	}
+
+	return failedLead
+}
+
+func insertFailedLead(queryer rowQueryer, failedLead FailedLead) (int64, error) {
+	payload, err := encodeProspect(failedLead.Prospect)
+	if nil != err {
+		return 0, err
+	}
+
+	var errorCode sql.NullString
+	if len(failedLead.ErrorCode) > 0 {
+		errorCode = sql.NullString{failedLead.ErrorCode, true}
+	}
+
+	var leadId sql.NullString
+	if uuidRegex.MatchString(failedLead.Prospect.LeadId) {
+		leadId = sql.NullString{failedLead.Prospect.LeadId, true}
+	}
+
+	var id int64
+	err = queryer.QueryRow(INSERT_FAILED_LEAD_QUERY, leadId, failedLead.Prospect.AppName, string(payload), failedLead.InsertPath, errorCode, failedLead.ErrorMessage, failedLead.CreatedAt, time.Now()).Scan(&id)
+	return id, err
+}
+
+// Appends the failed lead to FAILED_LEADS_FILE as a line of JSON, for when the database is what failed
+func appendFailedLeadFile(failedLead FailedLead) error {
+	if len(failedLeadsFile) == 0 {
+		return errors.New("No failed leads file set")
+	}
+
+	line, err := json.Marshal(failedLead)
+	if nil != err {
+		return err
+	}
+
+	failedLeadsFileMutex.Lock()
+	defer failedLeadsFileMutex.Unlock()
+
+	file, err := os.OpenFile(failedLeadsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if nil != err {
+		return err
+	}
+
+	_, err = file.Write(append(line, '\n'))
+	if nil == err {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if nil == err {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Keeps a prospect that could not be inserted so it can be fixed and replayed later.  When failed_leads
+// can't be written either, the prospect is appended to FAILED_LEADS_FILE.  Returns an error only when
+// the prospect was kept nowhere.
+func recordFailedLead(ctx context.Context, db *sql.DB, prospect *ProspectForm, insertPath InsertPath, insertErr error) error {
+	failedLead := getFailedLead(prospect, insertPath, insertErr)
+
+	id, err := insertFailedLead(db, failedLead)
+	if nil == err {
+		common.Logger(ctx).Info("Recorded failed prospect", "failed_lead_id", id)
+		return nil
+	}
+
+	common.Logger(ctx).Error("Error recording failed prospect", "prospect", prospect, "error", err)
+
+	fileErr := appendFailedLeadFile(failedLead)
+	if nil != fileErr {
+		common.Logger(ctx).Error("Error appending failed prospect to failed leads file", "prospect", prospect, "file", failedLeadsFile, "error", fileErr)
+		return err
+	}
+
+	common.Logger(ctx).Info("Appended failed prospect to failed leads file", "file", failedLeadsFile)
+	return nil
+}
+
+// A prospect that can't be recorded anywhere stays in the spool, when there is one
+func deadLetterProspect(ctx context.Context, prospect *ProspectForm, err error) error {
+	common.Logger(ctx).Error("Giving up on prospect", "prospect", prospect, "error", err)
+
+	return recordFailedLead(ctx, db, prospect, AsyncInsert, err)
+}
+
+// Inserts the failed leads appended to a failed leads file into failed_leads, all or none
+func importFailedLeadsFile(db *sql.DB, path string) (int, error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return 0, err
+	}
+	defer file.Close()
+
+	transaction, err := db.Begin()
+	if nil != err {
+		return 0, err
+	}
+	defer transaction.Rollback()
+
+	counter := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), NDJSON_MAX_LINE_SIZE)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var failedLead FailedLead
+		err = json.Unmarshal(scanner.Bytes(), &failedLead)
+		if nil != err {
+			return 0, fmt.Errorf("Line %d: %w", counter+1, err)
+		} else if nil == failedLead.Prospect {
+			return 0, fmt.Errorf("Line %d: no prospect", counter+1)
+		}
+
+		_, err = insertFailedLead(transaction, failedLead)
+		if nil != err {
+			return 0, fmt.Errorf("Line %d: %w", counter+1, err)
+		}
+		counter++
+	}
+
+	if err = scanner.Err(); nil != err {
+		return 0, err
+	}
+
+	return counter, transaction.Commit()
+}
+
+func getFailedLeads(db *sql.DB, query string, args ...interface{}) ([]FailedLead, error) {
+	rows, err := db.Query(FAILED_LEADS_QUERY+query, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failedLeads []FailedLead
+	for rows.Next() {
+		var (
+			failedLead FailedLead
+			payload    string
+			errorCode  sql.NullString
+			replayedId sql.NullInt64
+		)
+
+		err = rows.Scan(&failedLead.Id, &payload, &failedLead.InsertPath, &errorCode, &failedLead.ErrorMessage, &replayedId, &failedLead.CreatedAt)
+		if nil != err {
+			return nil, err
+		}
+
+		failedLead.Prospect, err = decodeProspect([]byte(payload))
+		if nil != err {
+			return nil, err
+		}
+
+		failedLead.ErrorCode = errorCode.String
+		failedLead.ReplayedId = replayedId.Int64
+		failedLeads = append(failedLeads, failedLead)
+	}
+
+	return failedLeads, rows.Err()
+}
+
+// Field validation of a stored prospect.  There is no request to authenticate or check for bots.
+func revalidateProspect(prospect *ProspectForm) error {
+	application := applications.Get(prospect.AppName)
+
+	validationErrors := validateRequired(*prospect, nil)
+	if len(validationErrors) == 0 {
+		validationErrors = prospect.validateSizeLimits(application, validationErrors)
+	}
+	if len(validationErrors) == 0 {
+		validationErrors = prospect.validateFields(application, validationErrors)
+		validationErrors = prospect.validatePhoneNumber(getPhoneRegion(application, prospect, nil), validationErrors)
+	}
+
+	if len(validationErrors) > 0 {
+		var messages []string
+		for _, validationError := range validationErrors {
+			messages = append(messages, validationError.Error())
+		}
+		return errors.New(strings.Join(messages, "; "))
+	}
+
+	return nil
+}
+
+// Inserts the failed lead into leads, committing only when replaying rather than checking
+func replayFailedLead(db *sql.DB, failedLead FailedLead, commit bool) (int64, error) {
+	transaction, err := db.Begin()
+	if nil != err {
+		return 0, err
+	}
+
+	defer transaction.Rollback()
+	statement, err := transaction.Prepare(QUERY)
+	if nil != err {
+		return 0, err
+	}
+
+	defer statement.Close()
+
+	id, err := addProspect(db, failedLead.Prospect, statement)
+	if nil != err || !commit {
+		return id, err
+	}
+
+	result, err := transaction.Exec(REPLAYED_LEAD_QUERY, id, time.Now(), time.Now(), failedLead.Id)
+	if nil != err {
+		return 0, err
+	}
+
+	count, _ := result.RowsAffected()
+	if count == 0 {
+		return 0, fmt.Errorf("Failed lead %d was already replayed", failedLead.Id)
+	}
+
+	return id, transaction.Commit()
+}
+
+func runFailedLeadsCommand(db *sql.DB, args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s failedleads list|revalidate|replay|import [options]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	if len(args) < 1 {
+		usage()
+	}
+
+	flags := flag.NewFlagSet("failedleads "+args[0], flag.ExitOnError)
+	id := flags.Int64("id", 0, "Id of a single failed lead, otherwise every failed lead not yet replayed")
+	appName := flags.String("app_name", "", "Only failed leads for the application name")
+	limit := flags.Int("limit", DEFAULT_PAGE_LIMIT, "Maximum number of failed leads")
+	path := flags.String("file", failedLeadsFile, "Failed leads file to import, moved aside from FAILED_LEADS_FILE first")
+	flags.Parse(args[1:])
+
+	if args[0] == "import" {
+		if len(*path) == 0 {
+			usage()
+		}
+
+		counter, err := importFailedLeadsFile(db, *path)
+		if nil != err {
+			log.Fatal(err)
+		}
+
+		log.Printf("Imported %d failed leads from %s", counter, *path)
+		return
+	}
+
+	var (
+		conditions []string
+		queryArgs  []interface{}
+	)
+
+	if *id > 0 {
+		queryArgs = append(queryArgs, *id)
+		conditions = append(conditions, fmt.Sprintf("id = $%d", len(queryArgs)))
+	} else {
+		conditions = append(conditions, "replayed_at IS NULL")
+	}
+
+	if len(*appName) > 0 {
+		queryArgs = append(queryArgs, *appName)
+		conditions = append(conditions, fmt.Sprintf("app_name = $%d", len(queryArgs)))
+	}
+
+	queryArgs = append(queryArgs, *limit)
+	query := fmt.Sprintf(" WHERE %s ORDER BY id ASC LIMIT $%d", strings.Join(conditions, " AND "), len(queryArgs))
+
+	failedLeads, err := getFailedLeads(db, query, queryArgs...)
+	if nil != err {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "list":
+		for _, failedLead := range failedLeads {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%s\n", failedLead.Id, failedLead.CreatedAt.Format(time.RFC3339), failedLead.Prospect.AppName, failedLead.InsertPath, failedLead.ErrorCode, failedLead.ErrorMessage, failedLead.Prospect.LeadId)
+		}
+		break
+	case "revalidate", "replay":
+		replay := args[0] == "replay"
+		counter := 0
+
+		for _, failedLead := range failedLeads {
+			if failedLead.ReplayedId > 0 {
+				fmt.Printf("%d\treplayed\tlead id %d\n", failedLead.Id, failedLead.ReplayedId)
+				continue
+			}
+
+			err = revalidateProspect(failedLead.Prospect)
+			if nil != err {
+				fmt.Printf("%d\tinvalid\t%s\n", failedLead.Id, err)
+				continue
+			}
+
+			leadId, err := replayFailedLead(db, failedLead, replay)
+			if nil != err {
+				fmt.Printf("%d\tfailed\t%s\n", failedLead.Id, err)
+			} else if replay {
+				fmt.Printf("%d\treplayed\tlead id %d\n", failedLead.Id, leadId)
+				counter++
+			} else {
+				fmt.Printf("%d\tvalid\n", failedLead.Id)
+				counter++
+			}
+		}
+
+		if replay {
+			log.Printf("Replayed %d of %d failed leads", counter, len(failedLeads))
+		} else {
+			log.Printf("%d of %d failed leads are valid", counter, len(failedLeads))
+		}
+		break
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	FORM_TOKEN_URL          = "/prospects/token"
+	FORM_TOKEN_PRUNE_PERIOD = 5 * time.Minute
+)
+
+type FormTokenResponse struct {
+	Code      int
+	Message   string
+	Token     string    `json:",omitempty"`
+	FieldName string    `json:",omitempty"`
+	ExpiresAt time.Time `json:",omitempty"`
+	RequestId string    `json:",omitempty"`
+}
+
+var formTokens *common.FormTokens
+var formTokenFieldName string
+
+// Issues a token for the appname query string parameter and the caller's ip address
+func getFormToken(res http.ResponseWriter, req *http.Request) (int, string) {
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	res.Header().Set(CACHE_CONTROL_HEADER, "no-store, no-cache, must-revalidate")
+
+	writeResponse := func(response FormTokenResponse) (int, string) {
+		response.RequestId = common.RequestIdFromContext(req.Context())
+		jsonStr, _ := json.Marshal(response)
+		return response.Code, string(jsonStr)
+	}
+
+	appName := req.URL.Query().Get("appname")
+	if len(appName) == 0 {
+		return writeResponse(FormTokenResponse{Code: http.StatusBadRequest, Message: "Missing required field(s): appname"})
+	} else if appNames != nil && !appNames[appName] && !applications.Get(appName).Registered {
+		return writeResponse(FormTokenResponse{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid appname \"%s\" specified", appName)})
+	}
+
+	token, expiresAt, err := formTokens.Issue(appName, processIpAddress(req))
+	if nil != err {
+		common.Logger(req.Context()).Error("Error issuing form token", "app_name", appName, "error", err)
+		return writeResponse(FormTokenResponse{Code: http.StatusInternalServerError, Message: "Could not issue form token due to server error"})
+	}
+
+	return writeResponse(FormTokenResponse{Code: http.StatusOK, Message: "Issued form token", Token: token, FieldName: formTokenFieldName, ExpiresAt: expiresAt})
+}
+
+// Nonces of expired tokens are removed periodically, an expired token is refused anyway
+func pruneFormTokens() {
+	for range time.Tick(FORM_TOKEN_PRUNE_PERIOD) {
+		err := formTokens.NonceStore.Prune()
+		if nil != err {
+			slog.Error("Error pruning used form tokens", "error", err)
+		}
+	}
+}
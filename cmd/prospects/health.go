@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	HEALTHZ_URL = "/healthz"
+	READYZ_URL  = "/readyz"
+)
+
+type HealthHandler func(http.ResponseWriter, *http.Request) (int, string)
+
+type ReadinessResponse struct {
+	Code           int
+	Message        string
+	Database       string
+	AsyncRunning   *bool    `json:",omitempty"`
+	QueueDepth     *int     `json:",omitempty"`
+	QueueCapacity  *int     `json:",omitempty"`
+	QueueFillRatio *float64 `json:",omitempty"`
+}
+
+var shuttingDown int32
+var readyTimeout time.Duration
+var readyQueueThreshold float64
+var readyDrainPeriod time.Duration
+
+// Marks the server not ready, then gives load balancers the drain period to stop sending traffic
+func drainReadiness() {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	if readyDrainPeriod > 0 {
+		slog.Info("Not ready, draining traffic", "drain_period", readyDrainPeriod)
+		time.Sleep(readyDrainPeriod)
+	}
+}
+
+func setupHealthHttpHandlers(db *sql.DB) (HealthHandler, HealthHandler) {
+	writeResponse := func(res http.ResponseWriter, response interface{}, code int) (int, string) {
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+		res.Header().Set(CACHE_CONTROL_HEADER, "no-store, no-cache, must-revalidate")
+		jsonStr, _ := json.Marshal(response)
+		return code, string(jsonStr)
+	}
+
+	//Liveness only says the process can still serve requests
+	healthz := func(res http.ResponseWriter, req *http.Request) (int, string) {
+		return writeResponse(res, common.Response{Code: http.StatusOK, Message: "OK"}, http.StatusOK)
+	}
+
+	readyz := func(res http.ResponseWriter, req *http.Request) (int, string) {
+		response := ReadinessResponse{Code: http.StatusOK, Message: "Ready", Database: "ok"}
+		var reasons []string
+
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			reasons = append(reasons, "shutting down")
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+		defer cancel()
+
+		err := db.PingContext(ctx)
+		if nil != err {
+			common.Logger(req.Context()).Error("Readiness database ping failed", "error", err)
+			response.Database = err.Error()
+			reasons = append(reasons, "database unavailable")
+		}
+
+		if asyncRequest && nil != prospectBatchProcessor {
+			running := prospectBatchProcessor.Running()
+			depth := prospectBatchProcessor.QueueDepth()
+			capacity := prospectBatchProcessor.QueueCapacity()
+
+			response.AsyncRunning = &running
+			response.QueueDepth = &depth
+			response.QueueCapacity = &capacity
+
+			if !running {
+				reasons = append(reasons, "batch processor stopped")
+			}
+
+			//Spooled queues are bounded by disk rather than a channel capacity
+			if capacity > 0 {
+				fillRatio := float64(depth) / float64(capacity)
+				response.QueueFillRatio = &fillRatio
+
+				if fillRatio >= readyQueueThreshold {
+					reasons = append(reasons, "queue full")
+				}
+			}
+		}
+
+		if len(reasons) > 0 {
+			response.Code = http.StatusServiceUnavailable
+			response.Message = "Not ready: " + strings.Join(reasons, ", ")
+		}
+
+		return writeResponse(res, response, response.Code)
+	}
+
+	return healthz, readyz
+}
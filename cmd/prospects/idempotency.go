@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	SUBMISSION_ID_FIELDNAME  = "submissionid"
+	IDEMPOTENCY_KEY_MAX_SIZE = 255
+	IDEMPOTENCY_PRUNE_PERIOD = 5 * time.Minute
+)
+
+var (
+	idempotencyStore common.IdempotencyStore
+	idempotencyTtl   time.Duration
+)
+
+// The Idempotency-Key header, otherwise the submissionid field.  Keys are kept per application so
+// clients of different applications can't collide.
+func getIdempotencyKey(req *http.Request) (string, string) {
+	key := req.Header.Get(common.IDEMPOTENCY_KEY_HEADER)
+	if len(key) == 0 {
+		key = req.FormValue(SUBMISSION_ID_FIELDNAME)
+	}
+
+	if len(key) == 0 {
+		return "", ""
+	}
+
+	return key, fmt.Sprintf("%s|%s", req.FormValue("appname"), key)
+}
+
+func writeIdempotentResponse(res http.ResponseWriter, req *http.Request, response common.Response) {
+	response.RequestId = common.RequestIdFromContext(req.Context())
+
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	res.WriteHeader(response.Code)
+
+	jsonStr, _ := json.Marshal(response)
+	res.Write(jsonStr)
+}
+
+// A retry still in progress elsewhere is told to come back rather than waited on
+func getIdempotencyConflictResponse(res http.ResponseWriter, req *http.Request) common.Response {
+	res.Header().Set(common.RETRY_AFTER_HEADER, getRetryAfterSeconds(time.Second))
+	responseStr := "A submission with this idempotency key is in progress"
+	common.Logger(req.Context()).Info(responseStr)
+	return common.Response{Code: http.StatusConflict, Message: responseStr}
+}
+
+// Runs before binding so a replay returns the original response without being validated again,
+// since form tokens and proof of work challenges can only be used once
+func replayIdempotentProspect(res http.ResponseWriter, req *http.Request) {
+	if isJsonRequest(req) {
+		exposeJsonFormValues(req)
+	}
+
+	key, storeKey := getIdempotencyKey(req)
+	if len(key) == 0 {
+		return
+	}
+
+	if len(key) > IDEMPOTENCY_KEY_MAX_SIZE {
+		responseStr := fmt.Sprintf("Idempotency key size %d is too large", len(key))
+		common.Logger(req.Context()).Info(responseStr)
+		writeIdempotentResponse(res, req, common.Response{Code: http.StatusBadRequest, Message: responseStr})
+		return
+	}
+
+	exists, response, err := idempotencyStore.Get(storeKey)
+	if nil != err {
+		common.Logger(req.Context()).Error("Error getting idempotency key, treating submission as new", "error", err)
+		return
+	} else if !exists {
+		return
+	}
+
+	if nil == response {
+		writeIdempotentResponse(res, req, getIdempotencyConflictResponse(res, req))
+		return
+	}
+
+	common.Logger(req.Context()).Info("Replaying response for idempotency key", "idempotency_key", key, "code", response.Code, "id", response.Id)
+	recordSubmission(req.FormValue("appname"), req.FormValue("leadsource"), REPLAYED_OUTCOME)
+
+	res.Header().Set(common.IDEMPOTENT_REPLAYED_HEADER, "true")
+	writeIdempotentResponse(res, req, *response)
+}
+
+// Claims the submission's idempotency key before it is added.  A response is returned when another
+// request got there first, in which case the prospect isn't added.
+func reserveIdempotencyKey(res http.ResponseWriter, req *http.Request) (string, *common.Response) {
+	_, storeKey := getIdempotencyKey(req)
+	if len(storeKey) == 0 {
+		return "", nil
+	}
+
+	reserved, response, err := idempotencyStore.Reserve(storeKey)
+	if nil != err {
+		common.Logger(req.Context()).Error("Error reserving idempotency key, adding prospect anyway", "error", err)
+		return "", nil
+	} else if reserved {
+		return storeKey, nil
+	}
+
+	if nil == response {
+		conflictResponse := getIdempotencyConflictResponse(res, req)
+		return "", &conflictResponse
+	}
+
+	res.Header().Set(common.IDEMPOTENT_REPLAYED_HEADER, "true")
+	return "", response
+}
+
+// Successful responses are kept for replays, anything else releases the key so the client can retry
+func completeIdempotencyKey(ctx context.Context, storeKey string, response common.Response) {
+	if len(storeKey) == 0 {
+		return
+	}
+
+	var err error
+	if response.Code >= http.StatusOK && response.Code < http.StatusMultipleChoices {
+		response.RequestId = ""
+		err = idempotencyStore.Complete(storeKey, response, time.Now().Add(idempotencyTtl))
+	} else {
+		err = idempotencyStore.Release(storeKey)
+	}
+
+	if nil != err {
+		common.Logger(ctx).Error("Error completing idempotency key", "error", err)
+	}
+}
+
+// Expired responses are removed periodically, an expired key is treated as new anyway
+func pruneIdempotencyKeys() {
+	for range time.Tick(IDEMPOTENCY_PRUNE_PERIOD) {
+		err := idempotencyStore.Prune()
+		if nil != err {
+			slog.Error("Error pruning idempotency keys", "error", err)
+		}
+	}
+}
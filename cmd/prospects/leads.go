@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LEADS_FROM_QUERY        = "FROM prospects.leads"
+	SNEEZERS_FROM_QUERY     = "FROM (SELECT id, lead_id, app_name, email, email_canonical, lead_source, feedback, NULL::VARCHAR AS referrer, NULL::VARCHAR AS page_referrer, first_name, last_name, phone_number, dob, gender, zip_code, language, user_agent, NULL::VARCHAR[] AS cookies, NULL::POINT AS geolocation, NULL::INET AS ip_address, miscellaneous, NULL::VARCHAR AS suspicious_origin, FALSE AS suspected_bot, NULL::VARCHAR AS phone_e164, NULL::VARCHAR AS phone_country, NULL::VARCHAR AS phone_line_type, was_processed, is_valid, replied_to, created_at, updated_at FROM prospects.person_sneezers) AS sneezers"
+	WWW_AUTHENTICATE_HEADER = "WWW-Authenticate"
+	DEFAULT_PAGE_LIMIT      = 100
+	MAX_PAGE_LIMIT          = 1000
+)
+
+type ReadHandler func(http.ResponseWriter, *http.Request, martini.Params, *common.ApiKey) (int, string)
+
+type LeadsResponse struct {
+	Code       int
+	Message    string
+	Prospects  []common.Prospect `json:",omitempty"`
+	NextCursor string            `json:",omitempty"`
+}
+
+var readApi bool
+
+func encodeCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeCursor(cursor string) (int64, error) {
+	idStr, err := base64.RawURLEncoding.DecodeString(cursor)
+	if nil != err {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(idStr), 10, 64)
+}
+
+// Builds a WHERE clause with positional parameters from the supported query string filters,
+// restricted to the application names the api key may read
+func buildLeadsFilter(values url.Values, apiKey *common.ApiKey) (string, []interface{}, int, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	for _, fieldName := range []string{"app_name", "lead_source", "lead_id"} {
+		if value := values.Get(fieldName); len(value) > 0 {
+			addCondition(fieldName+" = $%d", value)
+		}
+	}
+
+	if value := values.Get("lead_id"); len(value) > 0 && !uuidRegex.MatchString(value) {
+		return "", nil, 0, fmt.Errorf("Invalid uuid \"%s\" format specified", value)
+	}
+
+	if value := values.Get("lead_source"); len(value) > 0 && !leadSources[value] {
+		return "", nil, 0, fmt.Errorf("Invalid lead source \"%s\" specified", value)
+	}
+
+	if value := values.Get("app_name"); len(value) > 0 && !apiKey.AllowsApp(value) {
+		return "", nil, 0, fmt.Errorf("API key may not read appname \"%s\"", value)
+	} else if len(value) == 0 && !apiKey.AllowsAllApps() {
+		addCondition("app_name = ANY($%d)", "{"+strings.Join(apiKey.AppNames, ",")+"}")
+	}
+
+	for _, fieldName := range []string{"is_valid", "replied_to"} {
+		if value := values.Get(fieldName); len(value) > 0 {
+			boolValue, err := strconv.ParseBool(value)
+			if nil != err {
+				return "", nil, 0, fmt.Errorf("Invalid boolean \"%s\" specified for %s", value, fieldName)
+			}
+			addCondition(fieldName+" = $%d", boolValue)
+		}
+	}
+
+	if value := values.Get("created_after"); len(value) > 0 {
+		createdAfter, err := time.Parse(time.RFC3339, value)
+		if nil != err {
+			return "", nil, 0, fmt.Errorf("Invalid created_after \"%s\" specified", value)
+		}
+		addCondition("created_at >= $%d", createdAfter)
+	}
+
+	if value := values.Get("created_before"); len(value) > 0 {
+		createdBefore, err := time.Parse(time.RFC3339, value)
+		if nil != err {
+			return "", nil, 0, fmt.Errorf("Invalid created_before \"%s\" specified", value)
+		}
+		addCondition("created_at < $%d", createdBefore)
+	}
+
+	if value := values.Get("cursor"); len(value) > 0 {
+		cursor, err := decodeCursor(value)
+		if nil != err {
+			return "", nil, 0, fmt.Errorf("Invalid cursor \"%s\" specified", value)
+		}
+		addCondition("id < $%d", cursor)
+	}
+
+	limit := DEFAULT_PAGE_LIMIT
+	if value := values.Get("limit"); len(value) > 0 {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if nil != err || limit <= 0 || limit > MAX_PAGE_LIMIT {
+			return "", nil, 0, fmt.Errorf("Invalid limit \"%s\" specified, must be between 1 and %d", value, MAX_PAGE_LIMIT)
+		}
+	}
+
+	var where string
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	//Fetch one extra row to determine if another page exists
+	args = append(args, limit+1)
+	where += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	return where, args, limit, nil
+}
+
+func setupReadHttpHandlers(db *sql.DB) (ReadHandler, ReadHandler, ReadHandler, ReadHandler) {
+	writeResponse := func(response LeadsResponse) (int, string) {
+		jsonStr, _ := json.Marshal(response)
+		return response.Code, string(jsonStr)
+	}
+
+	listProspects := func(fromQuery string) ReadHandler {
+		return func(res http.ResponseWriter, req *http.Request, params martini.Params, apiKey *common.ApiKey) (int, string) {
+			res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+
+			where, args, limit, err := buildLeadsFilter(req.URL.Query(), apiKey)
+			if nil != err {
+				common.Logger(req.Context()).Info("Invalid leads filter", "error", err)
+				return writeResponse(LeadsResponse{Code: http.StatusBadRequest, Message: err.Error()})
+			}
+
+			prospects, err := common.GetFullProspects(db, fromQuery+where, args...)
+			if nil != err {
+				common.Logger(req.Context()).Error("Could not retrieve prospects", "error", err)
+				return writeResponse(LeadsResponse{Code: http.StatusInternalServerError, Message: "Could not retrieve prospects due to server error"})
+			}
+
+			response := LeadsResponse{Code: http.StatusOK, Message: "Successfully retrieved prospects"}
+			if len(prospects) > limit {
+				prospects = prospects[:limit]
+				response.NextCursor = encodeCursor(prospects[limit-1].Id)
+			}
+			response.Prospects = prospects
+
+			return writeResponse(response)
+		}
+	}
+
+	//Only return rows for application names the api key may read
+	filterByApiKey := func(prospects []common.Prospect, apiKey *common.ApiKey) []common.Prospect {
+		filtered := make([]common.Prospect, 0, len(prospects))
+		for _, prospect := range prospects {
+			if apiKey.AllowsApp(prospect.AppName) {
+				filtered = append(filtered, prospect)
+			}
+		}
+		return filtered
+	}
+
+	getLead := func(res http.ResponseWriter, req *http.Request, params martini.Params, apiKey *common.ApiKey) (int, string) {
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+
+		id, err := strconv.ParseInt(params["id"], 10, 64)
+		if nil != err {
+			responseStr := fmt.Sprintf("Invalid id \"%s\" specified", params["id"])
+			return writeResponse(LeadsResponse{Code: http.StatusBadRequest, Message: responseStr})
+		}
+
+		prospects, err := common.GetFullProspects(db, LEADS_FROM_QUERY+" WHERE id = $1", id)
+		prospects = filterByApiKey(prospects, apiKey)
+		if nil != err {
+			common.Logger(req.Context()).Error("Could not retrieve prospect", "id", id, "error", err)
+			return writeResponse(LeadsResponse{Code: http.StatusInternalServerError, Message: "Could not retrieve prospect due to server error"})
+		} else if len(prospects) == 0 {
+			responseStr := fmt.Sprintf("Prospect %d not found", id)
+			return writeResponse(LeadsResponse{Code: http.StatusNotFound, Message: responseStr})
+		}
+
+		return writeResponse(LeadsResponse{Code: http.StatusOK, Message: "Successfully retrieved prospect", Prospects: prospects})
+	}
+
+	getLeadsByLeadId := func(res http.ResponseWriter, req *http.Request, params martini.Params, apiKey *common.ApiKey) (int, string) {
+		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+
+		leadId := params["leadid"]
+		if !uuidRegex.MatchString(leadId) {
+			responseStr := fmt.Sprintf("Invalid uuid \"%s\" format specified", leadId)
+			return writeResponse(LeadsResponse{Code: http.StatusBadRequest, Message: responseStr})
+		}
+
+		prospects, err := common.GetFullProspects(db, LEADS_FROM_QUERY+" WHERE lead_id = $1 ORDER BY id ASC", leadId)
+		prospects = filterByApiKey(prospects, apiKey)
+		if nil != err {
+			common.Logger(req.Context()).Error("Could not retrieve prospects for lead id", "lead_id", leadId, "error", err)
+			return writeResponse(LeadsResponse{Code: http.StatusInternalServerError, Message: "Could not retrieve prospects due to server error"})
+		} else if len(prospects) == 0 {
+			responseStr := fmt.Sprintf("Lead id %s not found", leadId)
+			return writeResponse(LeadsResponse{Code: http.StatusNotFound, Message: responseStr})
+		}
+
+		return writeResponse(LeadsResponse{Code: http.StatusOK, Message: "Successfully retrieved prospects", Prospects: prospects})
+	}
+
+	return listProspects(LEADS_FROM_QUERY), getLead, getLeadsByLeadId, listProspects(SNEEZERS_FROM_QUERY)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetLead(t *testing.T) {
+	handler, database := newTestServer(t, func(config *ProspectsConfig) {
+		config.ReadApi = true
+	})
+
+	//Every column GetFullProspects selects, with robot detection and origin checks having flagged the lead
+	row := make([]driver.Value, 32)
+	row[0] = int64(31337)
+	row[1] = TEST_LEAD_ID
+	row[2] = TEST_APP_NAME
+	row[3] = "Lothos.Ziggy+tremont@gmail.com"
+	row[4] = "lothosziggy@gmail.com"
+	row[5] = "landing"
+	row[22] = "https://leapingwithlothos.com"
+	row[23] = true
+	row[27], row[28], row[29] = true, true, false
+	row[30], row[31] = time.Now(), time.Now()
+
+	database.rows = map[string][]driver.Value{
+		"SELECT id, key_id, key_hash":  {int64(1), common.GetApiKeyId(TEST_API_KEY), common.HashApiKey(TEST_API_KEY), nil, "{*}", "{read}", time.Now()},
+		"SELECT id, lead_id, app_name": row,
+	}
+
+	recorder := doTestRequest(handler, http.MethodGet, LEADS_URL+"/31337", "", "", map[string]string{common.API_KEY_HEADER: TEST_API_KEY})
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+
+	var response LeadsResponse
+	err := json.Unmarshal(recorder.Body.Bytes(), &response)
+	if nil != err {
+		t.Fatal(err)
+	} else if len(response.Prospects) != 1 {
+		t.Fatalf("returned %d prospects, want 1", len(response.Prospects))
+	}
+
+	prospect := response.Prospects[0]
+	if prospect.EmailCanonical != "lothosziggy@gmail.com" {
+		t.Errorf("EmailCanonical = %q, want lothosziggy@gmail.com", prospect.EmailCanonical)
+	}
+	if prospect.SuspiciousOrigin != "https://leapingwithlothos.com" {
+		t.Errorf("SuspiciousOrigin = %q, want https://leapingwithlothos.com", prospect.SuspiciousOrigin)
+	}
+	if !prospect.SuspectedBot {
+		t.Error("SuspectedBot = false, want true")
+	}
+}
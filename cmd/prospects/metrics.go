@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	METRICS_URL = "/metrics"
+
+	CREATED_OUTCOME          = "created"
+	ACCEPTED_OUTCOME         = "accepted"
+	VALIDATION_ERROR_OUTCOME = "validation_error"
+	BOT_DETECTED_OUTCOME     = "bot_detected"
+	UNAUTHORIZED_OUTCOME     = "unauthorized"
+	DB_ERROR_OUTCOME         = "db_error"
+	UNAVAILABLE_OUTCOME      = "unavailable"
+	RATE_LIMITED_OUTCOME     = "rate_limited"
+	REPLAYED_OUTCOME         = "replayed"
+
+	OTHER_LABEL = "other"
+	NONE_LABEL  = "none"
+)
+
+var metricsEnabled bool
+var metricsRegistry = common.NewMetricsRegistry()
+
+var (
+	submissionsCounter = common.NewCounterVec("prospects_submissions_total", "Prospect submissions by application name, lead source and outcome.", "app_name", "lead_source", "outcome")
+	requestLatency     = common.NewHistogramVec("prospects_http_request_duration_seconds", "HTTP request latency by route, method and status code.", common.DefaultLatencyBuckets, "route", "method", "code")
+	insertLatency      = common.NewHistogramVec("prospects_db_insert_duration_seconds", "Database insert latency of a single prospect, or of a whole batch for copy.", common.DefaultLatencyBuckets, "method")
+	botSignalsCounter  = common.NewCounterVec("prospects_bot_signals_total", "Bot detector signals by application name, detector and whether the submission was judged a bot.", "app_name", "detector", "is_bot")
+	flushSizes         = common.NewHistogramVec("prospects_async_flush_size", "Number of prospects in each asynchronous batch flush.", []float64{1, 10, 50, 100, 500, 1000, 5000, 10000, 50000})
+)
+
+// Label values from user input are limited to known values to keep the number of series bounded.
+// Without an allow-list every value is unknown.
+func metricLabel(value string, allowed map[string]bool) string {
+	if len(value) == 0 {
+		return NONE_LABEL
+	} else if !allowed[value] {
+		return OTHER_LABEL
+	}
+
+	return value
+}
+
+// Application names are known when in APPLICATION_NAMES or the applications table
+func getAppNameLabel(appName string) string {
+	if len(appName) > 0 && !appNames[appName] && nil != applications && applications.Get(appName).Registered {
+		return appName
+	}
+
+	return metricLabel(appName, appNames)
+}
+
+func recordSubmission(appName string, leadSource string, outcome string) {
+	if metricsEnabled {
+		submissionsCounter.Inc(getAppNameLabel(appName), metricLabel(leadSource, leadSources), outcome)
+	}
+}
+
+func recordInsertLatency(method string, start time.Time) {
+	if metricsEnabled {
+		insertLatency.Observe(time.Since(start).Seconds(), method)
+	}
+}
+
+func observeFlushSize(size int) {
+	flushSizes.Observe(float64(size))
+}
+
+func getErrorOutcome(errors binding.Errors) string {
+	for _, err := range errors {
+		switch err.Classification {
+		case common.BOT_ERROR, common.POW_ERROR:
+			return BOT_DETECTED_OUTCOME
+		case common.AUTH_ERROR, common.FORBIDDEN_ERROR:
+			return UNAUTHORIZED_OUTCOME
+		}
+	}
+
+	return VALIDATION_ERROR_OUTCOME
+}
+
+// Route patterns rather than paths, so ids in the url don't become labels
+func getRouteLabel(path string) string {
+	switch {
+	case path == REQUEST_URL, path == BATCH_REQUEST_URL, path == LEADS_URL, path == SNEEZERS_URL, path == VERIFY_URL,
+		path == ROBOTS_TXT_URL, path == SITEMAP_XML_URL, path == FAVICON_ICO_URL, path == METRICS_URL, path == HEALTHZ_URL, path == READYZ_URL, path == FORM_TOKEN_URL,
+		path == CHALLENGE_URL:
+		return path
+	case strings.HasPrefix(path, "/leads/lead_id/"):
+		return LEAD_ID_URL
+	case strings.HasPrefix(path, LEADS_URL+"/"):
+		return LEAD_URL
+	default:
+		return OTHER_LABEL
+	}
+}
+
+func requestMetrics(res http.ResponseWriter, req *http.Request, context martini.Context) {
+	start := time.Now()
+	context.Next()
+
+	status := res.(martini.ResponseWriter).Status()
+	requestLatency.Observe(time.Since(start).Seconds(), getRouteLabel(req.URL.Path), req.Method, strconv.Itoa(status))
+}
+
+func setupMetrics(db *sql.DB) {
+	metricsRegistry.Register(submissionsCounter)
+	metricsRegistry.Register(requestLatency)
+	metricsRegistry.Register(insertLatency)
+	metricsRegistry.Register(flushSizes)
+	metricsRegistry.Register(botSignalsCounter)
+
+	metricsRegistry.Register(common.NewGaugeFunc("prospects_async_queue_depth", "Prospects waiting for the next asynchronous batch flush.", func() float64 {
+		if nil == prospectBatchProcessor {
+			return 0
+		}
+		return float64(prospectBatchProcessor.QueueDepth())
+	}))
+
+	metricsRegistry.Register(common.NewGaugeFunc("prospects_db_max_open_connections", "Maximum number of open database connections.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	}))
+	metricsRegistry.Register(common.NewGaugeFunc("prospects_db_open_connections", "Open database connections, in use and idle.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	}))
+	metricsRegistry.Register(common.NewGaugeFunc("prospects_db_in_use_connections", "Database connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	}))
+	metricsRegistry.Register(common.NewGaugeFunc("prospects_db_idle_connections", "Idle database connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	}))
+	metricsRegistry.Register(common.NewCounterFunc("prospects_db_wait_count_total", "Times a database connection had to be waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	}))
+	metricsRegistry.Register(common.NewCounterFunc("prospects_db_wait_duration_seconds_total", "Total time spent waiting for database connections.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	}))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"net/http"
+)
+
+var defaultPhoneRegion string
+
+// Region national phone numbers are parsed in.  The application's comes first, then the region a
+// stored prospect was parsed in, then one inferred from the zip code, the language field or the
+// Accept-Language header, then PHONE_REGION.
+func getPhoneRegion(application common.Application, prospect *ProspectForm, req *http.Request) string {
+	if common.IsPhoneRegion(application.PhoneRegion) {
+		return application.PhoneRegion
+	} else if common.IsPhoneRegion(prospect.PhoneCountry) {
+		return prospect.PhoneCountry
+	}
+
+	if region := common.GetRegionFromZipCode(prospect.ZipCode); len(region) > 0 {
+		return region
+	} else if region := common.GetRegionFromLanguage(prospect.Language); len(region) > 0 {
+		return region
+	}
+
+	if nil != req {
+		if region := common.GetRegionFromLanguage(req.Header.Get(common.ACCEPT_LANGUAGE_HEADER)); len(region) > 0 {
+			return region
+		}
+	}
+
+	return defaultPhoneRegion
+}
+
+// Rejects phone numbers that can't be valid, otherwise keeps the number's E.164 form, country and
+// line type for the leads table and the validators
+func (prospect *ProspectForm) validatePhoneNumber(region string, errors binding.Errors) binding.Errors {
+	prospect.PhoneE164 = ""
+	prospect.PhoneCountry = ""
+	prospect.PhoneLineType = ""
+
+	if len(prospect.PhoneNumber) == 0 {
+		return errors
+	}
+
+	phoneNumber, err := common.ParsePhoneNumber(prospect.PhoneNumber, region)
+	if nil != err {
+		message := fmt.Sprintf("Invalid phone number \"%s\" specified.  %s.", prospect.PhoneNumber, err)
+		return addError(errors, []string{"phonenumber"}, binding.TypeError, message)
+	}
+
+	prospect.PhoneE164 = phoneNumber.E164()
+	prospect.PhoneCountry = phoneNumber.Region
+	prospect.PhoneLineType = phoneNumber.LineType.String()
+
+	return errors
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"encoding/json"
+	"fmt"
+	"github.com/martini-contrib/binding"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	CHALLENGE_URL           = "/prospects/challenge"
+	POW_CHALLENGE_FIELDNAME = "powchallenge"
+	POW_SOLUTION_FIELDNAME  = "powsolution"
+	POW_PRUNE_PERIOD        = 5 * time.Minute
+)
+
+type ChallengeResponse struct {
+	Code           int
+	Message        string
+	Challenge      string    `json:",omitempty"`
+	Difficulty     int       `json:",omitempty"`
+	ChallengeField string    `json:",omitempty"`
+	SolutionField  string    `json:",omitempty"`
+	ExpiresAt      time.Time `json:",omitempty"`
+	RequestId      string    `json:",omitempty"`
+}
+
+var proofOfWork *common.ProofOfWork
+
+// Issues a challenge for the appname query string parameter and the caller's ip address.  The
+// client finds a solution where SHA-256 of "<challenge>:<solution>" starts with difficulty zero bits.
+func getChallenge(res http.ResponseWriter, req *http.Request) (int, string) {
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	res.Header().Set(CACHE_CONTROL_HEADER, "no-store, no-cache, must-revalidate")
+
+	writeResponse := func(response ChallengeResponse) (int, string) {
+		response.RequestId = common.RequestIdFromContext(req.Context())
+		jsonStr, _ := json.Marshal(response)
+		return response.Code, string(jsonStr)
+	}
+
+	appName := req.URL.Query().Get("appname")
+	if len(appName) == 0 {
+		return writeResponse(ChallengeResponse{Code: http.StatusBadRequest, Message: "Missing required field(s): appname"})
+	} else if appNames != nil && !appNames[appName] && !applications.Get(appName).Registered {
+		return writeResponse(ChallengeResponse{Code: http.StatusBadRequest, Message: fmt.Sprintf("Invalid appname \"%s\" specified", appName)})
+	}
+
+	challenge, difficulty, expiresAt, err := proofOfWork.Issue(appName, processIpAddress(req))
+	if nil != err {
+		common.Logger(req.Context()).Error("Error issuing proof of work challenge", "app_name", appName, "error", err)
+		return writeResponse(ChallengeResponse{Code: http.StatusInternalServerError, Message: "Could not issue proof of work challenge due to server error"})
+	}
+
+	return writeResponse(ChallengeResponse{Code: http.StatusOK, Message: "Issued proof of work challenge", Challenge: challenge, Difficulty: difficulty,
+		ChallengeField: POW_CHALLENGE_FIELDNAME, SolutionField: POW_SOLUTION_FIELDNAME, ExpiresAt: expiresAt})
+}
+
+// Every browser submission counts towards the ip address's difficulty, whether or not it was solved.
+// Api key clients aren't asked for proof of work.
+func validateProofOfWork(application common.Application, errors binding.Errors, req *http.Request) binding.Errors {
+	if !application.ProofOfWork || isApiKeyRequired(application.AppName) {
+		return errors
+	}
+
+	if nil == proofOfWork {
+		common.Logger(req.Context()).Warn("Proof of work required but POW_SECRET isn't set, accepting submission", "app_name", application.AppName)
+		return errors
+	}
+
+	ipAddress := processIpAddress(req)
+	proofOfWork.RecordSubmission(ipAddress)
+
+	err := proofOfWork.Verify(req.FormValue(POW_CHALLENGE_FIELDNAME), req.FormValue(POW_SOLUTION_FIELDNAME), application.AppName, ipAddress)
+	switch err {
+	case nil:
+		return errors
+	case common.ErrMissingChallenge, common.ErrInvalidChallenge, common.ErrChallengeMismatch, common.ErrChallengeExpired, common.ErrInvalidSolution, common.ErrChallengeUsed:
+		common.Logger(req.Context()).Warn("Proof of work failed", "app_name", application.AppName, "reason", err.Error())
+		return addError(errors, []string{POW_CHALLENGE_FIELDNAME, POW_SOLUTION_FIELDNAME}, common.POW_ERROR, err.Error())
+	default:
+		common.Logger(req.Context()).Error("Error checking proof of work", "app_name", application.AppName, "error", err)
+		return errors
+	}
+}
+
+// Nonces of expired challenges and quiet ip addresses' submission counts are removed periodically
+func pruneProofOfWork() {
+	for range time.Tick(POW_PRUNE_PERIOD) {
+		err := proofOfWork.NonceStore.Prune()
+		if nil != err {
+			slog.Error("Error pruning used proof of work challenges", "error", err)
+		}
+
+		proofOfWork.Submissions.Prune()
+	}
+}
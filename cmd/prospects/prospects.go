@@ -2,17 +2,20 @@ package main
 
 import (
 	"bitbucket.org/padium/prospects"
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/go-martini/martini"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/martini-contrib/binding"
-	"github.com/martini-contrib/cors"
 	"github.com/martini-contrib/gzip"
 	"github.com/martini-contrib/secure"
 	"github.com/satori/go.uuid"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
@@ -20,21 +23,24 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
 const (
-	QUERY                = "INSERT INTO prospects.leads(lead_id, app_name, email, lead_source, feedback, referrer, page_referrer, first_name, last_name, phone_number, dob, gender, zip_code, language, user_agent, cookies, geolocation, ip_address, miscellaneous, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, POINT($17, $18), $19, $20, $21, $22) RETURNING id;"
+	QUERY                = "INSERT INTO prospects.leads(lead_id, app_name, email, lead_source, feedback, referrer, page_referrer, first_name, last_name, phone_number, dob, gender, zip_code, language, user_agent, cookies, geolocation, ip_address, miscellaneous, suspicious_origin, suspected_bot, email_canonical, phone_e164, phone_country, phone_line_type, created_at, updated_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, POINT($17, $18), $19, $20, $21, $22, $23, $24, $25, $26, $27, $28) RETURNING id;"
 	ID_QUERY             = "SELECT last_value, increment_by FROM prospects.leads_id_seq"
 	LEAD_SOURCE_QUERY    = "SELECT enum_range(NULL::prospects.lead_source) AS lead_sources"
-	VERIFY_LEAD_QUERY    = "UPDATE prospects.leads SET is_valid = true WHERE lead_source IN ('landing', 'email', 'phone', 'popup') AND lead_id = $1 AND (email = $2 OR phone_number = $3)"
-	EMAIL_REGEX          = "^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$"
+	VERIFY_LEAD_QUERY    = "UPDATE prospects.leads SET is_valid = true WHERE lead_source IN ('landing', 'email', 'phone', 'popup') AND lead_id = $1 AND (COALESCE(email_canonical, email) = $2 OR phone_number = $3)"
+	EMAIL_REGEX          = "^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+[.]([A-Za-z]+|xn--[A-Za-z0-9-]+)$"
 	UUID_REGEX           = "^[a-z0-9]{8}-[a-z0-9]{4}-[1-5][a-z0-9]{3}-[a-z0-9]{4}-[a-z0-9]{12}$"
 	REQUEST_URL          = "/prospects"
+	BATCH_REQUEST_URL    = "/prospects/batch"
+	LEADS_URL            = "/leads"
+	LEAD_URL             = "/leads/:id"
+	LEAD_ID_URL          = "/leads/lead_id/:leadid"
+	SNEEZERS_URL         = "/sneezers"
 	VERIFY_URL           = "/verify"
 	ROBOTS_TXT_URL       = "/robots.txt"
 	SITEMAP_XML_URL      = "/sitemap.xml"
@@ -58,15 +64,13 @@ const (
 )
 
 type CreateHandler func(http.ResponseWriter, *http.Request, ProspectForm) (int, string)
-type ErrorHandler func(binding.Errors, http.ResponseWriter)
+type ErrorHandler func(binding.Errors, http.ResponseWriter, *http.Request)
 type NotFoundHandler func(http.ResponseWriter, *http.Request) (int, string)
 
-var stringSizeLimit int
-var feedbackSizeLimit int
+var applications *common.ApplicationRegistry
 var appNames map[string]bool
 var uuidRegex *regexp.Regexp
 var emailRegex *regexp.Regexp
-var botDetection common.BotDetection
 var leadSources map[string]bool
 var gzipResponse bool
 var gzipCompressionLevel int
@@ -77,7 +81,143 @@ var verifyLeadRedirectUrls map[string]string
 
 type ProspectForm common.Prospect
 
-func (prospect ProspectForm) Validate(errors binding.Errors, req *http.Request) binding.Errors {
+// LogValue keeps prospects in logs to the fields common.Prospect allows, so personal data is redacted
+func (prospect ProspectForm) LogValue() slog.Value {
+	return common.Prospect(prospect).LogValue()
+}
+
+func (prospect *ProspectForm) UnmarshalJSON(data []byte) error {
+	//JSON field names mirror the form field names
+	var prospectJson struct {
+		LeadId        string          `json:"leadid"`
+		AppName       string          `json:"appname"`
+		PageReferrer  string          `json:"pagereferrer"`
+		FirstName     string          `json:"firstname"`
+		LastName      string          `json:"lastname"`
+		Email         string          `json:"email"`
+		LeadSource    string          `json:"leadsource"`
+		Feedback      string          `json:"feedback"`
+		PhoneNumber   string          `json:"phonenumber"`
+		DateOfBirth   string          `json:"dob"`
+		Gender        string          `json:"gender"`
+		ZipCode       string          `json:"zipcode"`
+		Language      string          `json:"language"`
+		Latitude      float64         `json:"latitude"`
+		Longitude     float64         `json:"longitude"`
+		Miscellaneous json.RawMessage `json:"miscellaneous"`
+	}
+
+	err := json.Unmarshal(data, &prospectJson)
+	if nil != err {
+		return err
+	}
+
+	prospect.LeadId = prospectJson.LeadId
+	prospect.AppName = prospectJson.AppName
+	prospect.PageReferrer = prospectJson.PageReferrer
+	prospect.FirstName = prospectJson.FirstName
+	prospect.LastName = prospectJson.LastName
+	prospect.Email = prospectJson.Email
+	prospect.LeadSource = prospectJson.LeadSource
+	prospect.Feedback = prospectJson.Feedback
+	prospect.PhoneNumber = prospectJson.PhoneNumber
+	prospect.DateOfBirth = prospectJson.DateOfBirth
+	prospect.Gender = prospectJson.Gender
+	prospect.ZipCode = prospectJson.ZipCode
+	prospect.Language = prospectJson.Language
+	prospect.Latitude = prospectJson.Latitude
+	prospect.Longitude = prospectJson.Longitude
+
+	//Miscellaneous is a nested object in JSON, but stored as a string
+	miscellaneous := bytes.TrimSpace(prospectJson.Miscellaneous)
+	if len(miscellaneous) > 0 && !bytes.Equal(miscellaneous, []byte("null")) {
+		var miscellaneousStr string
+		if json.Unmarshal(miscellaneous, &miscellaneousStr) == nil {
+			prospect.Miscellaneous = miscellaneousStr
+		} else {
+			var buffer bytes.Buffer
+			if json.Compact(&buffer, miscellaneous) == nil {
+				prospect.Miscellaneous = buffer.String()
+			} else {
+				prospect.Miscellaneous = string(miscellaneous)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate has a pointer receiver so robot detection can mark the prospect in shadow mode.  The
+// binding calls it on the prospect it later maps for the handlers.
+func (prospect *ProspectForm) Validate(errors binding.Errors, req *http.Request) binding.Errors {
+	application := applications.Get(prospect.AppName)
+	errors = prospect.validateProspect(application, errors, req)
+
+	if len(errors) == 0 {
+		errors = validateRequest(application, errors, req)
+		botVerdict := evaluateBotDetection(application, req, prospect.Email, false)
+		errors = prospect.applyBotVerdict(application, botVerdict, errors, req)
+	}
+
+	return errors
+}
+
+// Checks of the prospect's own fields, run for every item of a batch
+func (prospect *ProspectForm) validateProspect(application common.Application, errors binding.Errors, req *http.Request) binding.Errors {
+	errors = prospect.validateSizeLimits(application, errors)
+
+	if len(errors) == 0 {
+		errors = prospect.validateFields(application, errors)
+		errors = prospect.validatePhoneNumber(getPhoneRegion(application, prospect, req), errors)
+	}
+
+	return errors
+}
+
+// Checks of the request rather than the prospect.  Proof of work challenges can only be used once,
+// so a batch runs these once for each application rather than for every item.
+func validateRequest(application common.Application, errors binding.Errors, req *http.Request) binding.Errors {
+	errors = validateSubmitApiKey(application.AppName, errors, req)
+
+	if origin := req.Header.Get(ORIGIN_HEADER); len(origin) > 0 && application.OriginMismatch == common.RejectOrigin && !application.AllowsOrigin(origin) {
+		message := fmt.Sprintf("Origin \"%s\" is not allowed for appname \"%s\"", origin, application.AppName)
+		errors = addError(errors, []string{"origin"}, common.FORBIDDEN_ERROR, message)
+	}
+
+	return validateProofOfWork(application, errors, req)
+}
+
+// Form tokens are used up by robot detection too, so like the request checks a batch evaluates it
+// once for each application, without an email
+func evaluateBotDetection(application common.Application, req *http.Request, email string, batch bool) common.BotVerdict {
+	botVerdict := application.BotDetection.Evaluate(common.BotSignals{req, application.AppName, email, processIpAddress(req), isApiKeyRequired(application.AppName), batch})
+	recordBotVerdict(req.Context(), application.AppName, botVerdict)
+
+	return botVerdict
+}
+
+func (prospect *ProspectForm) applyBotVerdict(application common.Application, botVerdict common.BotVerdict, errors binding.Errors, req *http.Request) binding.Errors {
+	if !botVerdict.IsBot {
+		return errors
+	}
+
+	//Request fields are kept with the bot submission
+	populateRequestFields(req, prospect)
+	prospect.SuspectedBot = application.BotDetection.Shadow
+	prospect.BotVerdict = &botVerdict
+
+	if !application.BotDetection.Shadow {
+		message := "Go away spambot! We've alerted the authorities"
+		errors = addError(errors, []string{"spambot"}, common.BOT_ERROR, message)
+	}
+
+	return errors
+}
+
+func (prospect ProspectForm) validateSizeLimits(application common.Application, errors binding.Errors) binding.Errors {
+	stringSizeLimit := application.StringSizeLimit
+	feedbackSizeLimit := application.FeedbackSizeLimit
+
 	errors = validateSizeLimit(prospect.LeadId, "leadid", stringSizeLimit, errors)
 	errors = validateSizeLimit(prospect.AppName, "appname", stringSizeLimit, errors)
 	errors = validateSizeLimit(prospect.Referrer, "referrer", stringSizeLimit, errors)
@@ -97,97 +237,94 @@ func (prospect ProspectForm) Validate(errors binding.Errors, req *http.Request)
 	errors = validateSizeLimit(prospect.IpAddress, "ipaddress", stringSizeLimit, errors)
 	errors = validateSizeLimit(prospect.Miscellaneous, "miscellaneous", stringSizeLimit, errors)
 
-	if len(errors) == 0 {
-		if len(prospect.AppName) > 0 && appNames != nil && !appNames[prospect.AppName] {
-			message := fmt.Sprintf("Invalid appname \"%s\" specified", prospect.AppName)
-			errors = addError(errors, []string{"appname"}, binding.TypeError, message)
-		}
+	return errors
+}
 
-		if len(prospect.LeadId) > 0 && !uuidRegex.MatchString(prospect.LeadId) {
-			message := fmt.Sprintf("Invalid uuid \"%s\" format specified", prospect.LeadId)
-			errors = addError(errors, []string{"leadid"}, binding.TypeError, message)
-		}
+func (prospect ProspectForm) validateFields(application common.Application, errors binding.Errors) binding.Errors {
+	if len(prospect.AppName) > 0 && appNames != nil && !appNames[prospect.AppName] && !application.Registered {
+		message := fmt.Sprintf("Invalid appname \"%s\" specified", prospect.AppName)
+		errors = addError(errors, []string{"appname"}, binding.TypeError, message)
+	}
 
-		if !leadSources[prospect.LeadSource] {
-			message := fmt.Sprintf("Invalid lead source \"%s\" specified", prospect.LeadSource)
-			errors = addError(errors, []string{"leadsource"}, binding.TypeError, message)
-		}
+	if len(prospect.LeadId) > 0 && !uuidRegex.MatchString(prospect.LeadId) {
+		message := fmt.Sprintf("Invalid uuid \"%s\" format specified", prospect.LeadId)
+		errors = addError(errors, []string{"leadid"}, binding.TypeError, message)
+	}
 
-		if prospect.LeadSource == "landing" && len(prospect.Email) == 0 && len(prospect.PhoneNumber) == 0 {
-			errors = addError(errors, []string{"leadsource", "email", "phonenumber"}, binding.RequiredError, "Email address or Phone number required with landing lead source.")
-		}
+	if !leadSources[prospect.LeadSource] || !application.AllowsLeadSource(prospect.LeadSource) {
+		message := fmt.Sprintf("Invalid lead source \"%s\" specified", prospect.LeadSource)
+		errors = addError(errors, []string{"leadsource"}, binding.TypeError, message)
+	}
 
-		if prospect.LeadSource == "email" && len(prospect.Email) == 0 {
-			errors = addError(errors, []string{"leadsource", "email"}, binding.RequiredError, "Email address required with email lead source.")
-		}
+	if prospect.LeadSource == "landing" && len(prospect.Email) == 0 && len(prospect.PhoneNumber) == 0 {
+		errors = addError(errors, []string{"leadsource", "email", "phonenumber"}, binding.RequiredError, "Email address or Phone number required with landing lead source.")
+	}
 
-		if prospect.LeadSource == "popup" && len(prospect.Email) == 0 {
-			errors = addError(errors, []string{"leadsource", "email"}, binding.RequiredError, "Email address required with popup lead source.")
-		}
+	if prospect.LeadSource == "email" && len(prospect.Email) == 0 {
+		errors = addError(errors, []string{"leadsource", "email"}, binding.RequiredError, "Email address required with email lead source.")
+	}
 
-		if prospect.LeadSource == "phone" && len(prospect.PhoneNumber) == 0 {
-			errors = addError(errors, []string{"leadsource", "phonenumber"}, binding.RequiredError, "Phone number required with phone lead source.")
-		}
+	if prospect.LeadSource == "popup" && len(prospect.Email) == 0 {
+		errors = addError(errors, []string{"leadsource", "email"}, binding.RequiredError, "Email address required with popup lead source.")
+	}
 
-		if prospect.LeadSource == "feedback" && len(prospect.Feedback) == 0 {
-			errors = addError(errors, []string{"leadsource", "feedback"}, binding.RequiredError, "Feedback required with feedback lead source.")
-		}
+	if prospect.LeadSource == "phone" && len(prospect.PhoneNumber) == 0 {
+		errors = addError(errors, []string{"leadsource", "phonenumber"}, binding.RequiredError, "Phone number required with phone lead source.")
+	}
 
-		IsNotExtended := func(prospect ProspectForm) bool {
-			return len(prospect.FirstName) == 0 && len(prospect.LastName) == 0 && len(prospect.Gender) == 0 && len(prospect.DateOfBirth) == 0 && len(prospect.ZipCode) == 0 && len(prospect.Language) == 0 && len(prospect.Miscellaneous) == 0
-		}
+	if prospect.LeadSource == "feedback" && len(prospect.Feedback) == 0 {
+		errors = addError(errors, []string{"leadsource", "feedback"}, binding.RequiredError, "Feedback required with feedback lead source.")
+	}
 
-		if prospect.LeadSource == "extended" && IsNotExtended(prospect) {
-			errors = addError(errors, []string{"leadsource", "extended"}, binding.RequiredError, "First name, last name, gender, date of birth, zip code, language and/or miscellaneous is required with extended lead source.")
-		}
+	IsNotExtended := func(prospect ProspectForm) bool {
+		return len(prospect.FirstName) == 0 && len(prospect.LastName) == 0 && len(prospect.Gender) == 0 && len(prospect.DateOfBirth) == 0 && len(prospect.ZipCode) == 0 && len(prospect.Language) == 0 && len(prospect.Miscellaneous) == 0
+	}
 
-		if len(prospect.Email) > 0 && !emailRegex.MatchString(prospect.Email) {
-			message := fmt.Sprintf("Invalid email \"%s\" format specified", prospect.Email)
-			errors = addError(errors, []string{"email"}, binding.TypeError, message)
-		}
+	if prospect.LeadSource == "extended" && IsNotExtended(prospect) {
+		errors = addError(errors, []string{"leadsource", "extended"}, binding.RequiredError, "First name, last name, gender, date of birth, zip code, language and/or miscellaneous is required with extended lead source.")
+	}
 
-		if len(prospect.Miscellaneous) > 0 && !common.IsJSON(prospect.Miscellaneous) {
-			message := fmt.Sprintf("Invalid format specified for miscellaneous \"%s\"", prospect.Miscellaneous)
-			errors = addError(errors, []string{"miscellaneous"}, binding.TypeError, message)
-		}
+	if _, valid := getCanonicalEmail(prospect.Email); len(prospect.Email) > 0 && !valid {
+		message := fmt.Sprintf("Invalid email \"%s\" format specified", prospect.Email)
+		errors = addError(errors, []string{"email"}, binding.TypeError, message)
+	}
 
-		if len(prospect.DateOfBirth) > 0 {
-			dob, err := time.Parse(time.RFC3339, prospect.DateOfBirth)
-			var failed bool
+	if len(prospect.Miscellaneous) > 0 && !common.IsJSON(prospect.Miscellaneous) {
+		message := fmt.Sprintf("Invalid format specified for miscellaneous \"%s\"", prospect.Miscellaneous)
+		errors = addError(errors, []string{"miscellaneous"}, binding.TypeError, message)
+	}
 
-			if nil != err {
-				failed = true
-				log.Print(err)
-			} else {
-				age := common.GetAge(dob)
-				failed = age < 0 || age > 200
-			}
+	if len(prospect.DateOfBirth) > 0 {
+		dob, err := time.Parse(time.RFC3339, prospect.DateOfBirth)
+		var failed bool
 
-			if failed {
-				message := fmt.Sprintf("Invalid date of birth \"%s\" specified", prospect.DateOfBirth)
-				errors = addError(errors, []string{"dob"}, binding.TypeError, message)
-			}
+		if nil != err {
+			failed = true
+			slog.Info("Error parsing date of birth", "error", err)
+		} else {
+			age := common.GetAge(dob)
+			failed = age < 0 || age > 200
 		}
 
-		if len(prospect.Gender) > 0 && (prospect.Gender != "male" && prospect.Gender != "female") {
-			message := fmt.Sprintf("Invalid format specified for gender \"%s\", must be male or female", prospect.Gender)
-			errors = addError(errors, []string{"gender"}, binding.TypeError, message)
+		if failed {
+			message := fmt.Sprintf("Invalid date of birth \"%s\" specified", prospect.DateOfBirth)
+			errors = addError(errors, []string{"dob"}, binding.TypeError, message)
 		}
+	}
 
-		if prospect.Latitude > 90.0 || prospect.Latitude < -90.0 {
-			message := fmt.Sprintf("Invalid latitude \"%f\" specified", prospect.Latitude)
-			errors = addError(errors, []string{"latitude"}, binding.TypeError, message)
-		}
+	if len(prospect.Gender) > 0 && (prospect.Gender != "male" && prospect.Gender != "female") {
+		message := fmt.Sprintf("Invalid format specified for gender \"%s\", must be male or female", prospect.Gender)
+		errors = addError(errors, []string{"gender"}, binding.TypeError, message)
+	}
 
-		if prospect.Longitude > 180.0 || prospect.Longitude < -180.0 {
-			message := fmt.Sprintf("Invalid longitude \"%f\" specified", prospect.Longitude)
-			errors = addError(errors, []string{"longitude"}, binding.TypeError, message)
-		}
+	if prospect.Latitude > 90.0 || prospect.Latitude < -90.0 {
+		message := fmt.Sprintf("Invalid latitude \"%f\" specified", prospect.Latitude)
+		errors = addError(errors, []string{"latitude"}, binding.TypeError, message)
+	}
 
-		if botDetection.IsBot(req) {
-			message := "Go away spambot! We've alerted the authorities"
-			errors = addError(errors, []string{"spambot"}, common.BOT_ERROR, message)
-		}
+	if prospect.Longitude > 180.0 || prospect.Longitude < -180.0 {
+		message := fmt.Sprintf("Invalid longitude \"%f\" specified", prospect.Longitude)
+		errors = addError(errors, []string{"longitude"}, binding.TypeError, message)
 	}
 
 	return errors
@@ -201,6 +338,21 @@ func validateSizeLimit(field string, fieldName string, sizeLimit int, errors bin
 	return errors
 }
 
+// The address in the form leads are compared in, valid when it is well formed as typed and still is
+// once normalized
+func getCanonicalEmail(email string) (string, bool) {
+	if !emailRegex.MatchString(email) {
+		return "", false
+	}
+
+	canonicalEmail, err := common.GetCanonicalEmail(email)
+	if nil != err {
+		return "", false
+	}
+
+	return canonicalEmail, emailRegex.MatchString(canonicalEmail)
+}
+
 func addError(errors binding.Errors, fieldNames []string, classification string, message string) binding.Errors {
 	errors = append(errors, binding.Error{
 		FieldNames:     fieldNames,
@@ -210,6 +362,52 @@ func addError(errors binding.Errors, fieldNames []string, classification string,
 	return errors
 }
 
+func isJsonRequest(req *http.Request) bool {
+	return strings.Contains(req.Header.Get(CONTENT_TYPE_HEADER), "json")
+}
+
+func bindProspect(context martini.Context, req *http.Request) {
+	if isJsonRequest(req) {
+		exposeJsonFormValues(req)
+		context.Invoke(binding.Json(ProspectForm{}))
+	} else {
+		context.Invoke(binding.Form(ProspectForm{}))
+	}
+}
+
+// Makes top level JSON values available through req.FormValue so body based
+// checks like bot detection behave the same for JSON and form requests
+func exposeJsonFormValues(req *http.Request) {
+	if nil == req.Body {
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if nil != err {
+		common.Logger(req.Context()).Error("Error reading request body", "error", err)
+		return
+	}
+
+	var jsonValues map[string]interface{}
+	if nil != json.Unmarshal(body, &jsonValues) {
+		return
+	}
+
+	formValues := make(url.Values)
+	for key, value := range jsonValues {
+		switch value.(type) {
+		case string, float64, bool:
+			formValues.Set(key, fmt.Sprint(value))
+			break
+		}
+	}
+
+	req.Form = formValues
+	req.PostForm = formValues
+}
+
 func processIpAddressFromAddr(remoteAddr string) string {
 	ip, _, err := net.SplitHostPort(remoteAddr)
 	if err == nil {
@@ -271,7 +469,7 @@ func getNextId(db *sql.DB) int64 {
 	if -1 == lastValue {
 		err := db.QueryRow(ID_QUERY).Scan(&lastValue, &incrementBy)
 		if nil != err {
-			log.Print(err)
+			slog.Error("Error retrieving last sequence number", "error", err)
 		}
 	}
 
@@ -279,7 +477,7 @@ func getNextId(db *sql.DB) int64 {
 		lastValue += incrementBy
 		return lastValue
 	} else {
-		log.Print("Could not retrieve last sequence number from database.  Returning random value")
+		slog.Warn("Could not retrieve last sequence number from database.  Returning random value")
 		return 7 + rand.Int63n(int64(^uint64(0)>>1)-7)
 	}
 }
@@ -299,35 +497,80 @@ func getLeadSources(db *sql.DB) string {
 
 var asyncRequest bool
 var db *sql.DB
-var prospectBatchProcessor *common.BatchProcessor
+var prospectBatchProcessor *common.BatchProcessor[*ProspectForm]
+var prospectSpool *common.Spool
+
+// Spooled prospects are encoded as common.Prospect since ProspectForm only decodes form fields
+func encodeProspect(prospect *ProspectForm) ([]byte, error) {
+	return json.Marshal(common.Prospect(*prospect))
+}
+
+func decodeProspect(record []byte) (*ProspectForm, error) {
+	var prospect common.Prospect
+	err := json.Unmarshal(record, &prospect)
+	if nil != err {
+		return nil, err
+	}
+
+	prospectForm := ProspectForm(prospect)
+	return &prospectForm, nil
+}
 
-func processProspect(prospectBatch []interface{}, waitGroup *sync.WaitGroup) {
-	log.Printf("Starting batch processing of %d prospects", len(prospectBatch))
+// Data exceptions and integrity constraint violations fail the same way every time
+func classifyProspectError(err error) error {
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "22", "23":
+			return common.Permanent(err)
+		}
+	}
+
+	return err
+}
+
+func processProspect(ctx context.Context, prospectBatch []*ProspectForm) []error {
+	logger := common.Logger(ctx)
+	logger.Info("Starting batch processing of prospects", "count", len(prospectBatch))
+
+	if asyncCopy {
+		err := copyProspects(ctx, prospectBatch)
+		if nil == err {
+			return nil
+		}
+
+		logger.Error("Error copying prospects, falling back to inserting each prospect", "error", err)
+	}
 
-	defer waitGroup.Done()
+	errors := make([]error, len(prospectBatch))
+	failBatch := func(err error) []error {
+		for index := range errors {
+			errors[index] = err
+		}
+		return errors
+	}
 
-	transaction, err := db.Begin()
+	transaction, err := db.BeginTx(ctx, nil)
 	if nil != err {
-		log.Print("Error creating transaction")
-		log.Print(err)
+		logger.Error("Error creating transaction", "error", err)
+		return failBatch(err)
 	}
 
 	defer transaction.Rollback()
 	statement, err := transaction.Prepare(QUERY)
 	if nil != err {
-		log.Print("Error preparing SQL statement")
-		log.Print(err)
+		logger.Error("Error preparing SQL statement", "error", err)
+		return failBatch(err)
 	}
 
 	defer statement.Close()
 
+	//Savepoints keep one bad prospect from aborting the rest of the transaction
 	counter := 0
-	for _, prospectInterface := range prospectBatch {
-		prospect := prospectInterface.(*ProspectForm)
-		_, err = addProspect(db, prospect, statement)
+	for index, prospect := range prospectBatch {
+		_, err = addProspectWithSavepoint(db, transaction, prospect, statement)
 		if nil != err {
-			log.Printf("Error processing prospect %#v", prospect)
-			log.Print(err)
+			logger.Error("Error processing prospect", "prospect", prospect, "error", err)
+			errors[index] = classifyProspectError(err)
 			continue
 		}
 
@@ -336,44 +579,21 @@ func processProspect(prospectBatch []interface{}, waitGroup *sync.WaitGroup) {
 
 	err = transaction.Commit()
 	if nil != err {
-		log.Print("Error committing transaction")
-		log.Print(err)
-	} else {
-		log.Printf("Processed %d prospects", counter)
+		logger.Error("Error committing transaction", "error", err)
+		return failBatch(err)
 	}
+
+	logger.Info("Processed prospects", "count", counter)
+	return errors
 }
 
 func main() {
-	dbUrl := os.Getenv("DATABASE_URL")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	dbHost := common.GetenvWithDefault("DB_HOST", "localhost")
-	dbPort := common.GetenvWithDefault("DB_PORT", "5432")
-	dbMaxOpenConnsStr := common.GetenvWithDefault("DB_MAX_OPEN_CONNS", "10")
-	dbMaxIdleConnsStr := common.GetenvWithDefault("DB_MAX_IDLE_CONNS", "0")
+	var config ProspectsConfig
+	args := common.MustLoadConfig("prospects", &config)
+	common.SetupLogging("prospects", config.Log)
 
 	var err error
 
-	dbMaxOpenConns, err := strconv.Atoi(dbMaxOpenConnsStr)
-	if nil != err {
-		dbMaxOpenConns = 10
-		log.Printf("Error setting database maximum open connections from value: %s. Default to %d", dbMaxOpenConnsStr, dbMaxOpenConns)
-		log.Print(err)
-	}
-
-	dbMaxIdleConns, err := strconv.Atoi(dbMaxIdleConnsStr)
-	if nil != err {
-		dbMaxIdleConns = 0
-		log.Printf("Error setting database maximum idle connections from value: %s. Default to %d", dbMaxIdleConnsStr, dbMaxIdleConns)
-		log.Print(err)
-	}
-
-	dbCredentials := common.DatabaseCredentials{common.DB_DRIVER, dbUrl, dbUser, dbPassword, dbName, dbHost, dbPort, dbMaxOpenConns, dbMaxIdleConns}
-	if !dbCredentials.IsValid() {
-		log.Fatalf("Database credentials NOT set correctly. %#v", dbCredentials)
-	}
-
 	//Seed random number generator
 	log.Print("Seeding random number generator")
 	rand.Seed(time.Now().UTC().UnixNano())
@@ -381,42 +601,24 @@ func main() {
 	//Database connection
 	log.Print("Enabling database connectivity")
 
-	db = dbCredentials.GetDatabase()
+	db = config.Database.GetCredentials().GetDatabase()
 	defer db.Close()
 
-	//Get configurable string size limits
-	stringSizeLimitStr := common.GetenvWithDefault("STRING_SIZE_LIMIT", "500")
-	feedbackSizeLimitStr := common.GetenvWithDefault("FEEDBACK_SIZE_LIMIT", "3000")
-
-	stringSizeLimit, err = strconv.Atoi(stringSizeLimitStr)
-	if nil != err {
-		stringSizeLimit = 500
-		log.Printf("Error setting string size limit from value: %s. Default to %d", stringSizeLimitStr, stringSizeLimit)
-		log.Print(err)
-	} else {
-		log.Printf("String size limit set to %s", stringSizeLimitStr)
+	//Api key management
+	if len(args) > 0 && args[0] == "apikey" {
+		runApiKeyCommand(db, args[1:], config.ApiKeySigningSecret)
+		return
 	}
 
-	feedbackSizeLimit, err = strconv.Atoi(feedbackSizeLimitStr)
-	if nil != err {
-		feedbackSizeLimit = 10
-		log.Printf("Error setting feedback size limit from value: %s. Default to %d", feedbackSizeLimitStr, feedbackSizeLimit)
-		log.Print(err)
-	} else {
-		log.Printf("Feedback size limit set to %s", feedbackSizeLimitStr)
-	}
+	//Batch request size limit
+	batchSizeLimit = config.BatchSizeLimit
+	batchBodySizeLimit = config.BatchBodySizeLimit
+	log.Printf("Batch size limit set to %d prospects and %d bytes", batchSizeLimit, batchBodySizeLimit)
 
 	//Allowable Application names
-	appNamesStr := os.Getenv("APPLICATION_NAMES")
-	if len(appNamesStr) > 0 {
-		appNames = make(map[string]bool)
-
-		appNamesArr := strings.Split(appNamesStr, ",")
-		for _, appName := range appNamesArr {
-			appNames[appName] = true
-		}
-
-		log.Printf("Allowable application names: %s", appNamesStr)
+	appNames = getStringSet(config.AppNames)
+	if len(appNames) > 0 {
+		log.Printf("Allowable application names: %s", strings.Join(config.AppNames, ","))
 	} else {
 		log.Print("Any application name available")
 	}
@@ -452,65 +654,113 @@ func main() {
 		log.Fatalf("E-mail regex compilation failed for %s", EMAIL_REGEX)
 	}
 
-	//Robot detection field
-	botDetectionFieldLocationStr := common.GetenvWithDefault("BOTDETECT_FIELDLOCATION", "body")
-	botDetectionFieldName := common.GetenvWithDefault("BOTDETECT_FIELDNAME", "spambot")
-	botDetectionFieldValue := common.GetenvWithDefault("BOTDETECT_FIELDVALUE", "")
-	botDetectionMustMatchStr := common.GetenvWithDefault("BOTDETECT_MUSTMATCH", "true")
-	botDetectionPlayCoyStr := common.GetenvWithDefault("BOTDETECT_PLAYCOY", "true")
+	//Signed form tokens, verified by robot detection
+	if config.FormToken {
+		var nonceStore common.NonceStore = common.NewMemoryNonceStore()
+		if config.FormTokenStore == "postgres" {
+			nonceStore = common.NewPostgresNonceStore(db)
+		}
+
+		formTokens = common.NewFormTokens(config.FormTokenSecret, config.FormTokenMinAge, config.FormTokenMaxAge, nonceStore)
+		formTokenFieldName = config.FormTokenFieldName
+		go pruneFormTokens()
+
+		log.Printf("Form tokens enabled on %s, usable from %s to %s after issue in field %s", FORM_TOKEN_URL, config.FormTokenMinAge, config.FormTokenMaxAge, config.FormTokenFieldName)
+	} else {
+		log.Print("Form tokens disabled")
+	}
+
+	//Proof of work challenges, available to any application requiring them once a secret is set
+	if len(config.PowSecret) > 0 {
+		var nonceStore common.NonceStore = common.NewMemoryNonceStore()
+		if config.PowStore == "postgres" {
+			nonceStore = common.NewPostgresNonceStore(db)
+		}
+
+		proofOfWork = common.NewProofOfWork(config.PowSecret, config.PowDifficulty, config.PowMaxDifficulty, config.PowRateThreshold, config.PowMaxAge, nonceStore)
+		go pruneProofOfWork()
 
-	var botDetectionFieldLocation common.RequestLocation
+		log.Printf("Proof of work challenges enabled on %s, difficulty %d to %d bits, required by default: %t", CHALLENGE_URL, config.PowDifficulty, config.PowMaxDifficulty, config.Pow)
+	} else {
+		log.Print("Proof of work disabled")
+	}
 
-	switch botDetectionFieldLocationStr {
-	case "header":
+	//Robot detection field
+	botDetectionFieldLocation := common.Body
+	if config.BotDetectFieldLocation == "header" {
 		botDetectionFieldLocation = common.Header
-		break
-	case "body":
-		botDetectionFieldLocation = common.Body
-		break
-	default:
-		botDetectionFieldLocation = common.Body
-		log.Printf("Error with int input for field %s with value %s.  Defaulting to Body.", "BOTDETECT_FIELDLOCATION", botDetectionFieldLocationStr)
-		break
 	}
 
-	botDetectionMustMatch, err := strconv.ParseBool(botDetectionMustMatchStr)
-	if nil != err {
-		botDetectionMustMatch = true
-		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to true.", "BOTDETECT_MUSTMATCH", botDetectionMustMatchStr)
-		log.Print(err)
+	botDetection := common.BotDetection{
+		FieldLocation: botDetectionFieldLocation,
+		FieldName:     config.BotDetectFieldName,
+		FieldValue:    config.BotDetectFieldValue,
+		MustMatch:     config.BotDetectMustMatch,
+		PlayCoy:       config.BotDetectPlayCoy,
+		Shadow:        config.BotDetectShadow,
+		HoneypotScore: config.BotDetectHoneypotScore,
+		Threshold:     config.BotDetectThreshold,
+		Detectors:     getBotDetectors(config),
 	}
 
-	botDetectionPlayCoy, err := strconv.ParseBool(botDetectionPlayCoyStr)
-	if nil != err {
-		botDetectionPlayCoy = true
-		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to true.", "BOTDETECT_PLAYCOY", botDetectionPlayCoyStr)
-		log.Print(err)
+	log.Printf("Creating robot detection with field %s in %s, threshold %g and %d other detectors", botDetection.FieldName, config.BotDetectFieldLocation, botDetection.Threshold, len(botDetection.Detectors))
+
+	//Origins allowed to submit
+	originMismatch := common.RejectOrigin
+	if config.OriginMismatch == "flag" {
+		originMismatch = common.FlagOrigin
 	}
 
-	botDetection = common.BotDetection{botDetectionFieldLocation, botDetectionFieldName, botDetectionFieldValue, botDetectionMustMatch, botDetectionPlayCoy}
+	if len(config.AllowedOrigins) > 0 {
+		log.Printf("Allowed origins: %s, %s others", strings.Join(config.AllowedOrigins, ","), originMismatch)
+	} else {
+		log.Print("Any origin allowed unless restricted by application")
+	}
 
-	log.Printf("Creating robot detection with %#v", botDetection)
+	//Per application settings, the configuration is the default for anything not set in prospects.applications
+	log.Printf("String size limit set to %d", config.StringSizeLimit)
+	log.Printf("Feedback size limit set to %d", config.FeedbackSizeLimit)
 
-	//GZIP response compression
-	gzipCompressionLevelStr := common.GetenvWithDefault("GZIP_COMPRESSION_LEVEL", "6")
-	gzipCompressionLevel, err = strconv.Atoi(gzipCompressionLevelStr)
+	applications = common.NewApplicationRegistry(db, common.Application{StringSizeLimit: config.StringSizeLimit, FeedbackSizeLimit: config.FeedbackSizeLimit, AllowedOrigins: config.AllowedOrigins, BotDetection: botDetection, OriginMismatch: originMismatch,
+		IpRateLimit: common.RateLimit{config.RateLimitIp, config.RateLimitIpBurst}, LeadRateLimit: common.RateLimit{config.RateLimitLead, config.RateLimitLeadBurst}, ProofOfWork: config.Pow})
+	err = applications.Load()
 	if nil != err {
-		gzipCompressionLevel = 6
-		log.Printf("Error setting gzip compression level from value: %s. Default to %d", gzipCompressionLevelStr, gzipCompressionLevel)
+		log.Print("Error loading applications, using configured defaults for every application")
 		log.Print(err)
-	} else if gzipCompressionLevel < 1 || gzipCompressionLevel > 9 {
-		gzipCompressionLevel = 6
-		log.Printf("Error setting gzip compression level from value: %d. Default to %d", gzipCompressionLevelStr, gzipCompressionLevel)
 	}
 
-	gzipResponseStr := common.GetenvWithDefault("GZIP_RESPONSE", "true")
-	gzipResponse, err = strconv.ParseBool(gzipResponseStr)
+	//Phone numbers without a country code
+	log.Printf("Phone region set to %s", config.PhoneRegion)
+	defaultPhoneRegion = config.PhoneRegion
+
+	//Failed lead management
+	failedLeadsFile = config.FailedLeadsFile
+	if len(failedLeadsFile) > 0 {
+		log.Printf("Failed leads that can't be recorded in failed_leads are appended to %s", failedLeadsFile)
+	}
+
+	if len(args) > 0 && args[0] == "failedleads" {
+		runFailedLeadsCommand(db, args[1:])
+		return
+	}
+
+	//Bot submission management
+	if len(args) > 0 && args[0] == "botsubmissions" {
+		runBotSubmissionsCommand(db, args[1:])
+		return
+	}
+
+	applicationsListener, err := applications.Listen(config.Database.GetCredentials())
 	if nil != err {
-		gzipResponse = true
-		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to true.", "GZIP_RESPONSE", gzipResponseStr)
+		log.Print("Error listening for application changes, applications won't be reloaded")
 		log.Print(err)
+	} else {
+		defer applicationsListener.Close()
 	}
+
+	//GZIP response compression
+	gzipResponse = config.GzipResponse
+	gzipCompressionLevel = config.GzipCompressionLevel
 	if gzipResponse {
 		log.Printf("Gzip response encoding enabled with level %d", gzipCompressionLevel)
 	} else {
@@ -518,53 +768,63 @@ func main() {
 	}
 
 	//IP address location
-	ipAddressLocation = common.GetenvWithDefault("IP_ADDRESS_LOCATION", "normal")
+	ipAddressLocation = config.IpAddressLocation
 	log.Printf("IP_ADDRESS_LOCATION set to %s", ipAddressLocation)
 
-	//Asynchronous database writes
-	asyncRequest, err = strconv.ParseBool(common.GetenvWithDefault("ASYNC_REQUEST", "false"))
-	if nil != err {
-		asyncRequest = false
-		log.Printf("Error converting input for field ASYNC_REQUEST. Defaulting to false.")
-		log.Print(err)
+	//Rate limits
+	if config.RateLimitStore == "postgres" {
+		rateLimiter = common.NewPostgresRateLimiter(db)
+	} else {
+		rateLimiter = common.NewMemoryRateLimiter()
 	}
+	go pruneRateLimits()
 
-	asyncRequestSizeStr := common.GetenvWithDefault("ASYNC_REQUEST_SIZE", "100000")
-	asyncRequestSize, err := strconv.Atoi(asyncRequestSizeStr)
-	if nil != err {
-		asyncRequestSize = 100000
-		log.Printf("Error converting input for field ASYNC_REQUEST_SIZE. Defaulting to 100000.")
-		log.Print(err)
+	if config.RateLimitIp > 0 || config.RateLimitLead > 0 {
+		log.Printf("Rate limits set to %d per minute per ip address and %d per minute per lead id or email in %s", config.RateLimitIp, config.RateLimitLead, config.RateLimitStore)
 	} else {
-		log.Printf("ASYNC_REQUEST_SIZE set to %s", asyncRequestSizeStr)
+		log.Print("Rate limits disabled unless set by application")
 	}
 
-	asyncProcessIntervalStr := common.GetenvWithDefault("ASYNC_PROCESS_INTERVAL", "5")
-	asyncProcessInterval, err := strconv.Atoi(asyncProcessIntervalStr)
-	if nil != err {
-		asyncProcessInterval = 5
-		log.Printf("Error converting input for field ASYNC_PROCESS_INTERVAL. Defaulting to 5.")
-		log.Print(err)
-	} else {
-		log.Printf("ASYNC_PROCESS_INTERVAL set to %s", asyncProcessIntervalStr)
+	//Asynchronous database writes
+	asyncRequest = config.AsyncRequest
+	asyncCopy = config.AsyncCopy
+
+	//Prometheus metrics
+	metricsEnabled = config.Metrics
+	if metricsEnabled {
+		setupMetrics(db)
+		log.Printf("Metrics enabled on %s", METRICS_URL)
 	}
 
 	if asyncRequest {
-		prospectBatchProcessor = common.NewBatchProcessor(processProspect, asyncRequestSize, asyncProcessInterval, dbMaxOpenConns)
-		prospectBatchProcessor.Start()
-		log.Printf("Asynchronous requests enabled. Request queue size set to %d", asyncRequestSize)
-		log.Printf("Asynchronous process interval is %d seconds", asyncProcessInterval)
-	}
+		prospectBatchProcessor = common.NewBatchProcessor(processProspect, config.AsyncRequestSize, config.AsyncProcessInterval, config.Database.MaxOpenConns, config.AsyncMaxBatchSize, config.AsyncMaxLatency)
 
-	//robots.txt
-	robotsTxtResponseStr := common.GetenvWithDefault("ROBOTS_TXT", "false")
-	robotsTxtResponse, err = strconv.ParseBool(robotsTxtResponseStr)
-	if nil != err {
-		robotsTxtResponse = false
-		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to false.", "ROBOTS_TXT", robotsTxtResponseStr)
-		log.Print(err)
+		if len(config.AsyncSpoolDir) > 0 {
+			prospectSpool, err = common.NewSpool(config.AsyncSpoolDir, config.AsyncSpoolFsync, config.AsyncSpoolFsyncInterval, config.AsyncSpoolSegmentSize)
+			if nil != err {
+				log.Print(err)
+				log.Fatalf("Unable to open asynchronous request spool in %s", config.AsyncSpoolDir)
+			}
+
+			prospectBatchProcessor.EnableSpool(prospectSpool, encodeProspect, decodeProspect)
+			log.Printf("Asynchronous request spool enabled in %s with fsync policy %s", config.AsyncSpoolDir, config.AsyncSpoolFsync)
+		}
+
+		retryPolicy := common.RetryPolicy{MaxAttempts: config.AsyncRetryMaxAttempts, InitialBackoff: config.AsyncRetryBackoff, MaxBackoff: config.AsyncRetryMaxBackoff, Multiplier: 2}
+		prospectBatchProcessor.EnableDeadLetter(retryPolicy, deadLetterProspect)
+
+		if metricsEnabled {
+			prospectBatchProcessor.FlushObserver = observeFlushSize
+		}
+
+		prospectBatchProcessor.Start(context.Background())
+		log.Printf("Asynchronous requests enabled. Request queue size set to %d", config.AsyncRequestSize)
+		log.Printf("Asynchronous process interval is %d seconds", config.AsyncProcessInterval)
+		log.Printf("Asynchronous batches flush at %d prospects or after %s", config.AsyncMaxBatchSize, config.AsyncMaxLatency)
 	}
 
+	//robots.txt
+	robotsTxtResponse = config.RobotsTxt
 	if robotsTxtResponse {
 		log.Print("robots.txt support enabled")
 	} else {
@@ -572,14 +832,7 @@ func main() {
 	}
 
 	//sitemap.xml
-	sitemapXmlResponseStr := common.GetenvWithDefault("SITEMAP_XML", "false")
-	sitemapXmlResponse, err = strconv.ParseBool(sitemapXmlResponseStr)
-	if nil != err {
-		sitemapXmlResponse = false
-		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to false.", "SITEMAP_XML", sitemapXmlResponseStr)
-		log.Print(err)
-	}
-
+	sitemapXmlResponse = config.SitemapXml
 	if sitemapXmlResponse {
 		log.Print("sitemap.xml support enabled")
 	} else {
@@ -587,179 +840,207 @@ func main() {
 	}
 
 	//favicon.ico
-	faviconIcoResponseStr := common.GetenvWithDefault("FAVICON_ICO", "false")
-	faviconIcoResponse, err = strconv.ParseBool(faviconIcoResponseStr)
+	faviconIcoResponse = config.FaviconIco
+	if faviconIcoResponse {
+		log.Print("favicon.ico support enabled")
+	} else {
+		log.Print("favicon.ico support disabled")
+	}
+
+	//Verify leads, the urls were checked when the configuration loaded
+	verifyLeadRedirectUrls, _ = config.GetVerifyLeadRedirectUrls()
+	if len(verifyLeadRedirectUrls) > 0 {
+		for appName, verifyLeadRedirectUrl := range verifyLeadRedirectUrls {
+			log.Printf("Added lead verification redirect url: %s for app name %s", verifyLeadRedirectUrl, appName)
+		}
+	} else {
+		log.Print("No lead verification redirect urls configured")
+	}
+
+	//API keys
+	apiKeyAuthenticator = common.NewApiKeyAuthenticator(db, config.ApiKeyCacheSeconds, config.ApiKeySigningSecret)
+	if len(config.ApiKeySigningSecret) == 0 {
+		log.Print("API_KEY_SIGNING_SECRET not set, signed api key requests are refused")
+	}
+
+	apiKeysListener, err := apiKeyAuthenticator.Listen(config.Database.GetCredentials())
 	if nil != err {
-		faviconIcoResponse = false
-		log.Printf("Error converting boolean input for field %s with value %s. Defaulting to false.", "FAVICON_ICO", faviconIcoResponseStr)
+		log.Print("Error listening for api key changes, revoked keys stay cached for API_KEY_CACHE_SECONDS")
 		log.Print(err)
+	} else {
+		defer apiKeysListener.Close()
 	}
 
-	if faviconIcoResponse {
-		log.Print("favicon.ico support enabled")
+	apiKeyRequiredAppNames = getStringSet(config.ApiKeyRequiredApps)
+	if len(apiKeyRequiredAppNames) > 0 {
+		log.Printf("API key required for submissions to application names: %s", strings.Join(config.ApiKeyRequiredApps, ","))
 	} else {
-		log.Print("favicon.ico support disabled")
+		log.Print("No API key required for submissions")
 	}
 
-	//Verify leads
-	verifyLeadRedirectUrlsStr := os.Getenv("VERIFY_LEAD_REDIRECT_URLS")
-	if len(verifyLeadRedirectUrlsStr) > 0 {
-		verifyLeadRedirectUrls = make(map[string]string)
+	//Idempotency keys
+	if config.IdempotencyStore == "postgres" {
+		idempotencyStore = common.NewPostgresIdempotencyStore(db)
+	} else {
+		idempotencyStore = common.NewMemoryIdempotencyStore()
+	}
 
-		isUrl := func(val string) bool {
-			_, err := url.Parse(val)
-			return nil == err
-		}
+	idempotencyTtl = config.IdempotencyTtl
+	go pruneIdempotencyKeys()
 
-		verifyLeadRedirectUrlsArr := strings.Split(verifyLeadRedirectUrlsStr, ",")
-		for _, verifyLeadRedirectUrl := range verifyLeadRedirectUrlsArr {
-			nvp := strings.Split(verifyLeadRedirectUrl, "|")
+	log.Printf("Idempotency keys kept in %s for %s", config.IdempotencyStore, idempotencyTtl)
 
-			if len(nvp) == 2 && isUrl(nvp[1]) {
-				verifyLeadRedirectUrls[nvp[0]] = nvp[1]
-				log.Printf("Added lead verification redirect url: %s for app name %s", nvp[1], nvp[0])
-			} else {
-				log.Printf("Invalid lead verification redirect url specified %s", verifyLeadRedirectUrl)
-			}
-		}
+	//Read API
+	readApi = config.ReadApi
+	if readApi {
+		log.Print("Read API enabled")
 	} else {
-		log.Print("No lead verification redirect urls configured")
+		log.Print("Read API disabled")
 	}
 
+	//Readiness checks
+	readyTimeout = config.ReadyTimeout
+	readyQueueThreshold = config.ReadyQueueThreshold
+	readyDrainPeriod = config.ReadyDrainPeriod
+
+	//Martini reads MARTINI_ENV when loaded, so a value from a file or flag is applied here
+	martini.Env = config.MartiniEnv
+
+	//HTTP handlers
+	log.Print("Preparing HTTP handlers")
+	createHandler, errorHandler, notFoundHandler := setupHttpHandlers(db)
+	batchCreateHandler := setupBatchHttpHandler(db)
+
+	//HTTP server
+	server := setupHttpServer(config, createHandler, batchCreateHandler, errorHandler, notFoundHandler)
+
 	//Signal handler
-	signals := make(chan os.Signal)
+	shutdownComplete := make(chan bool)
+	requestsDrained := false
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 	signal.Notify(signals, syscall.SIGTERM)
 	go func() {
 		<-signals
 		log.Print("Shutting down...")
-		if nil != prospectBatchProcessor {
-			prospectBatchProcessor.Stop()
-			log.Print("Prospect batch processor shut down")
+		drainReadiness()
+
+		//Stop accepting connections and wait for in flight requests
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+
+		err := server.Shutdown(ctx)
+		if nil != err {
+			log.Print("Error waiting for in flight requests")
+			log.Print(err)
+		} else {
+			log.Print("HTTP server shut down")
+			requestsDrained = true
 		}
-		os.Exit(0)
-	}()
 
-	//HTTP handlers
-	log.Print("Preparing HTTP handlers")
-	createHandler, errorHandler, notFoundHandler := setupHttpHandlers(db)
+		close(shutdownComplete)
+	}()
 
-	//HTTP server
-	host := common.GetenvWithDefault("HOST", "")
-	port := common.GetenvWithDefault("PORT", "3000")
-	mode := common.GetenvWithDefault("MARTINI_ENV", "development")
+	log.Printf("Running HTTP server on %s in mode %s", config.GetAddr(), config.MartiniEnv)
+	err = server.ListenAndServe()
+	if http.ErrServerClosed != err {
+		log.Fatal(err)
+	}
 
-	log.Printf("Running HTTP server on %s:%s in mode %s", host, port, mode)
-	runHttpServer(createHandler, errorHandler, notFoundHandler)
-}
+	<-shutdownComplete
 
-func setupHttpHandlers(db *sql.DB) (CreateHandler, ErrorHandler, NotFoundHandler) {
-	createHandler := func(res http.ResponseWriter, req *http.Request, prospect ProspectForm) (int, string) {
-		prospect.IpAddress = processIpAddress(req)
-		prospect.Referrer = req.Referer()
-		prospect.UserAgent = req.UserAgent()
+	//Once no handlers are left to add events the channel can be closed, otherwise the
+	//processor is stopped with handlers that timed out still able to queue events
+	if nil != prospectBatchProcessor && requestsDrained {
+		prospectBatchProcessor.Close()
+		log.Print("Prospect batch processor shut down")
+	} else if nil != prospectBatchProcessor {
+		prospectBatchProcessor.Stop()
+		log.Print("Prospect batch processor stopped with requests still in flight")
+	}
 
-		var cookiesArr []string
-		for _, cookie := range req.Cookies() {
-			cookiesArr = append(cookiesArr, cookie.String())
+	if nil != prospectSpool {
+		err = prospectSpool.Close()
+		if nil != err {
+			log.Print(err)
 		}
-		prospect.Cookies = strings.Join(cookiesArr, ", ")
+		log.Print("Prospect spool closed")
+	}
 
-		if len(prospect.Cookies) > 0 {
-			prospect.Cookies = fmt.Sprintf("{%s}", prospect.Cookies)
-		}
+	log.Print("Closing database connections")
+}
 
-		if len(prospect.LeadId) <= 0 {
-			prospect.LeadId = uuid.NewV4().String()
-			log.Printf("Prospect lead id not provided. Generated one instead %s", prospect.LeadId)
-		}
+func setupHttpHandlers(db *sql.DB) (CreateHandler, ErrorHandler, NotFoundHandler) {
+	createHandler := func(res http.ResponseWriter, req *http.Request, prospect ProspectForm) (int, string) {
+		populateRequestFields(req, &prospect)
 
-		log.Printf("Received new prospect: %#v", prospect)
+		logger := common.Logger(req.Context())
+		logger.Info("Received new prospect", "prospect", prospect)
 
 		req.Close = true
 		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
 		var response common.Response
 
-		if asyncRequest && prospectBatchProcessor.Running {
-			prospectBatchProcessor.AddEvent(&prospect)
-			responseStr := "Successfully added prospect"
-			response = common.Response{Code: http.StatusAccepted, Message: responseStr}
-			log.Print(responseStr)
-		} else if asyncRequest && !prospectBatchProcessor.Running {
+		//A retry arriving while the original was validated isn't added twice
+		idempotencyKey, idempotentResponse := reserveIdempotencyKey(res, req)
+
+		if nil != idempotentResponse {
+			response = *idempotentResponse
+			if response.Code != http.StatusConflict {
+				recordSubmission(prospect.AppName, prospect.LeadSource, REPLAYED_OUTCOME)
+			}
+		} else if asyncRequest && prospectBatchProcessor.Running() {
+			err := prospectBatchProcessor.AddEvent(&prospect)
+			if nil != err {
+				responseStr := "Could not add prospect due to server error"
+				response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
+				logger.Error(responseStr, "error", err)
+				recordSubmission(prospect.AppName, prospect.LeadSource, DB_ERROR_OUTCOME)
+			} else {
+				responseStr := "Successfully added prospect"
+				response = common.Response{Code: http.StatusAccepted, Message: responseStr}
+				logger.Info(responseStr)
+				recordSubmission(prospect.AppName, prospect.LeadSource, ACCEPTED_OUTCOME)
+			}
+		} else if asyncRequest && !prospectBatchProcessor.Running() {
 			responseStr := "Could not add prospect due to server maintenance"
 			response = common.Response{Code: http.StatusServiceUnavailable, Message: responseStr}
-			log.Print(responseStr)
+			logger.Warn(responseStr)
+			recordSubmission(prospect.AppName, prospect.LeadSource, UNAVAILABLE_OUTCOME)
 		} else {
 			id, err := addProspect(db, &prospect, nil)
 			if nil != err {
 				responseStr := "Could not add prospect due to server error"
 				response = common.Response{Code: http.StatusInternalServerError, Message: responseStr}
-				log.Print(responseStr)
-				log.Print(err)
-				log.Printf("%d database connections opened", db.Stats().OpenConnections)
+				logger.Error(responseStr, "error", err, "open_connections", db.Stats().OpenConnections)
+				recordFailedLead(req.Context(), db, &prospect, SyncInsert, err)
+				recordSubmission(prospect.AppName, prospect.LeadSource, DB_ERROR_OUTCOME)
 			} else {
 				responseStr := "Successfully added prospect"
 				response = common.Response{Code: http.StatusCreated, Message: responseStr, Id: id}
-				log.Print(responseStr)
+				logger.Info(responseStr, "id", id)
+				recordSubmission(prospect.AppName, prospect.LeadSource, CREATED_OUTCOME)
 			}
 		}
 
+		if nil == idempotentResponse {
+			completeIdempotencyKey(req.Context(), idempotencyKey, response)
+		}
+
+		response.RequestId = common.RequestIdFromContext(req.Context())
 		jsonStr, _ := json.Marshal(response)
 		return response.Code, string(jsonStr)
 	}
 
-	errorHandler := func(errors binding.Errors, res http.ResponseWriter) {
+	errorHandler := func(errors binding.Errors, res http.ResponseWriter, req *http.Request) {
 		if len(errors) > 0 {
-			var fieldsMsg string
-
-			for _, err := range errors {
-				for _, field := range err.Fields() {
-					fieldsMsg += fmt.Sprintf("%s, ", field)
-				}
-
-				log.Printf("Error received. Message: %s, Kind: %s", err.Error(), err.Kind())
-			}
-
-			fieldsMsg = strings.TrimSuffix(fieldsMsg, ", ")
-
-			log.Printf("Error received. Fields: %s", fieldsMsg)
+			response := getErrorResponse(req.Context(), errors, req.FormValue("appname"))
+			response.RequestId = common.RequestIdFromContext(req.Context())
+			recordSubmission(req.FormValue("appname"), req.FormValue("leadsource"), getErrorOutcome(errors))
 
 			res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
-			var response common.Response
-
-			if errors.Has(binding.RequiredError) {
-				res.WriteHeader(http.StatusBadRequest)
-				responseStr := fmt.Sprintf("Missing required field(s): %s", fieldsMsg)
-				response = common.Response{Code: http.StatusBadRequest, Message: responseStr}
-			} else if errors.Has(binding.ContentTypeError) {
-				res.WriteHeader(http.StatusUnsupportedMediaType)
-				response = common.Response{Code: http.StatusUnsupportedMediaType, Message: "Invalid content type"}
-			} else if errors.Has(binding.DeserializationError) {
-				res.WriteHeader(http.StatusBadRequest)
-				response = common.Response{Code: http.StatusBadRequest, Message: "Deserialization error"}
-			} else if errors.Has(binding.TypeError) {
-				res.WriteHeader(http.StatusBadRequest)
-				response = common.Response{Code: http.StatusBadRequest, Message: errors[0].Error()}
-			} else if errors.Has(common.BOT_ERROR) {
-				if botDetection.PlayCoy && !asyncRequest {
-					res.WriteHeader(http.StatusCreated)
-					response = common.Response{Code: http.StatusCreated, Message: "Successfully added prospect", Id: getNextId(db)}
-					log.Printf("Robot detected: %s. Playing coy.", errors[0].Error())
-				} else if botDetection.PlayCoy && asyncRequest {
-					res.WriteHeader(http.StatusAccepted)
-					response = common.Response{Code: http.StatusAccepted, Message: "Successfully added prospect"}
-					log.Printf("Robot detected: %s. Playing coy.", errors[0].Error())
-				} else {
-					res.WriteHeader(http.StatusBadRequest)
-					response = common.Response{Code: http.StatusBadRequest, Message: errors[0].Error()}
-					log.Printf("Robot detected: %s. Rejecting message.", errors[0].Error())
-				}
-			} else {
-				res.WriteHeader(http.StatusBadRequest)
-				response = common.Response{Code: http.StatusBadRequest, Message: "Unknown error"}
-			}
+			res.WriteHeader(response.Code)
 
-			log.Print(response.Message)
 			jsonStr, _ := json.Marshal(response)
 			res.Write(jsonStr)
 		}
@@ -769,8 +1050,8 @@ func setupHttpHandlers(db *sql.DB) (CreateHandler, ErrorHandler, NotFoundHandler
 		req.Close = true
 		res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
 		responseStr := fmt.Sprintf("URL Not Found %s", req.URL)
-		response := common.Response{Code: http.StatusNotFound, Message: responseStr}
-		log.Print(responseStr)
+		response := common.Response{Code: http.StatusNotFound, Message: responseStr, RequestId: common.RequestIdFromContext(req.Context())}
+		common.Logger(req.Context()).Info(responseStr)
 		jsonStr, _ := json.Marshal(response)
 		return response.Code, string(jsonStr)
 	}
@@ -778,12 +1059,102 @@ func setupHttpHandlers(db *sql.DB) (CreateHandler, ErrorHandler, NotFoundHandler
 	return createHandler, errorHandler, notFoundHandler
 }
 
-func addProspect(db *sql.DB, prospect *ProspectForm, statement *sql.Stmt) (int64, error) {
+func populateRequestFields(req *http.Request, prospect *ProspectForm) {
+	prospect.IpAddress = processIpAddress(req)
+	prospect.Referrer = req.Referer()
+	prospect.UserAgent = req.UserAgent()
+
+	//Origins rejected by validation never get here, so any left over are flagged
+	if origin := req.Header.Get(ORIGIN_HEADER); len(origin) > 0 && !applications.Get(prospect.AppName).AllowsOrigin(origin) {
+		prospect.SuspiciousOrigin = origin
+		common.Logger(req.Context()).Warn("Flagging prospect from disallowed origin", "app_name", prospect.AppName, "origin", origin)
+	}
+
+	var cookiesArr []string
+	for _, cookie := range req.Cookies() {
+		cookiesArr = append(cookiesArr, cookie.String())
+	}
+	prospect.Cookies = strings.Join(cookiesArr, ", ")
+
+	if len(prospect.Cookies) > 0 {
+		prospect.Cookies = fmt.Sprintf("{%s}", prospect.Cookies)
+	}
+
+	if len(prospect.LeadId) <= 0 {
+		prospect.LeadId = uuid.NewV4().String()
+		common.Logger(req.Context()).Info("Prospect lead id not provided. Generated one instead", "lead_id", prospect.LeadId)
+	}
+}
+
+func getErrorResponse(ctx context.Context, errors binding.Errors, appName string) common.Response {
+	logger := common.Logger(ctx)
+	var fieldsMsg string
+
+	for _, err := range errors {
+		for _, field := range err.Fields() {
+			fieldsMsg += fmt.Sprintf("%s, ", field)
+		}
+
+		logger.Info("Error received", "message", err.Error(), "kind", err.Kind(), "fields", err.Fields())
+	}
+
+	fieldsMsg = strings.TrimSuffix(fieldsMsg, ", ")
+
+	var response common.Response
+
+	if errors.Has(binding.RequiredError) {
+		responseStr := fmt.Sprintf("Missing required field(s): %s", fieldsMsg)
+		response = common.Response{Code: http.StatusBadRequest, Message: responseStr}
+	} else if errors.Has(binding.ContentTypeError) {
+		response = common.Response{Code: http.StatusUnsupportedMediaType, Message: "Invalid content type"}
+	} else if errors.Has(binding.DeserializationError) {
+		response = common.Response{Code: http.StatusBadRequest, Message: "Deserialization error"}
+	} else if errors.Has(binding.TypeError) {
+		response = common.Response{Code: http.StatusBadRequest, Message: errors[0].Error()}
+	} else if errors.Has(common.AUTH_ERROR) {
+		response = common.Response{Code: http.StatusUnauthorized, Message: errors[0].Error()}
+	} else if errors.Has(common.FORBIDDEN_ERROR) {
+		response = common.Response{Code: http.StatusForbidden, Message: errors[0].Error()}
+	} else if errors.Has(common.POW_ERROR) {
+		response = common.Response{Code: http.StatusForbidden, Message: errors[0].Error()}
+	} else if errors.Has(common.BOT_ERROR) {
+		if applications.Get(appName).BotDetection.PlayCoy {
+			response = getCoyResponse()
+			logger.Info("Robot detected. Playing coy.", "app_name", appName, "reason", errors[0].Error())
+		} else {
+			response = common.Response{Code: http.StatusBadRequest, Message: errors[0].Error()}
+			logger.Info("Robot detected. Rejecting message.", "app_name", appName, "reason", errors[0].Error())
+		}
+	} else {
+		response = common.Response{Code: http.StatusBadRequest, Message: "Unknown error"}
+	}
+
+	logger.Info(response.Message, "app_name", appName, "code", response.Code)
+
+	return response
+}
+
+// A response that looks like the prospect was added
+func getCoyResponse() common.Response {
+	if asyncRequest {
+		return common.Response{Code: http.StatusAccepted, Message: "Successfully added prospect"}
+	}
+
+	return common.Response{Code: http.StatusCreated, Message: "Successfully added prospect", Id: getNextId(db)}
+}
+
+// Arguments for QUERY, in column order with latitude and longitude separate for POINT
+func getProspectArgs(prospect *ProspectForm) []interface{} {
 	var email sql.NullString
 	if len(prospect.Email) != 0 {
 		email = sql.NullString{prospect.Email, true}
 	}
 
+	var emailCanonical sql.NullString
+	if canonicalEmail, valid := getCanonicalEmail(prospect.Email); valid {
+		emailCanonical = sql.NullString{canonicalEmail, true}
+	}
+
 	var feedback sql.NullString
 	if len(prospect.Feedback) != 0 {
 		feedback = sql.NullString{prospect.Feedback, true}
@@ -804,6 +1175,15 @@ func addProspect(db *sql.DB, prospect *ProspectForm, statement *sql.Stmt) (int64
 		phoneNumber = sql.NullString{prospect.PhoneNumber, true}
 	}
 
+	var phoneE164 sql.NullString
+	var phoneCountry sql.NullString
+	var phoneLineType sql.NullString
+	if len(prospect.PhoneE164) != 0 {
+		phoneE164 = sql.NullString{prospect.PhoneE164, true}
+		phoneCountry = sql.NullString{prospect.PhoneCountry, len(prospect.PhoneCountry) != 0}
+		phoneLineType = sql.NullString{prospect.PhoneLineType, true}
+	}
+
 	var referrer sql.NullString
 	if len(prospect.Referrer) != 0 {
 		referrer = sql.NullString{prospect.Referrer, true}
@@ -861,61 +1241,92 @@ func addProspect(db *sql.DB, prospect *ProspectForm, statement *sql.Stmt) (int64
 		cookies = sql.NullString{prospect.Cookies, true}
 	}
 
+	var suspiciousOrigin sql.NullString
+	if len(prospect.SuspiciousOrigin) != 0 {
+		suspiciousOrigin = sql.NullString{prospect.SuspiciousOrigin, true}
+	}
+
+	return []interface{}{prospect.LeadId, prospect.AppName, email, prospect.LeadSource, feedback, referrer, pageReferrer, firstName, lastName, phoneNumber, dob, gender, zipCode, language, userAgent, cookies, latitude, longitude, ipAddress, miscellaneous, suspiciousOrigin, prospect.SuspectedBot, emailCanonical, phoneE164, phoneCountry, phoneLineType, time.Now(), time.Now()}
+}
+
+func addProspect(db *sql.DB, prospect *ProspectForm, statement *sql.Stmt) (int64, error) {
+	args := getProspectArgs(prospect)
+	defer recordInsertLatency("insert", time.Now())
+
 	var lastInsertId int64
 	var err error
 	if nil == statement {
-		err = db.QueryRow(QUERY, prospect.LeadId, prospect.AppName, email, prospect.LeadSource, feedback, referrer, pageReferrer, firstName, lastName, phoneNumber, dob, gender, zipCode, language, userAgent, cookies, latitude, longitude, ipAddress, miscellaneous, time.Now(), time.Now()).Scan(&lastInsertId)
+		err = db.QueryRow(QUERY, args...).Scan(&lastInsertId)
 	} else {
-		err = statement.QueryRow(prospect.LeadId, prospect.AppName, email, prospect.LeadSource, feedback, referrer, pageReferrer, firstName, lastName, phoneNumber, dob, gender, zipCode, language, userAgent, cookies, latitude, longitude, ipAddress, miscellaneous, time.Now(), time.Now()).Scan(&lastInsertId)
+		err = statement.QueryRow(args...).Scan(&lastInsertId)
 	}
 
 	if nil == err {
-		log.Printf("New prospect id = %d", lastInsertId)
+		slog.Debug("New prospect", "id", lastInsertId)
 	}
 
 	return lastInsertId, err
 }
 
-func runHttpServer(createHandler CreateHandler, errorHandler ErrorHandler, notFoundHandler NotFoundHandler) {
+// The application's redirect url, falling back to VERIFY_LEAD_REDIRECT_URLS
+func getVerifyRedirectUrl(appName string) string {
+	if verifyRedirectUrl := applications.Get(appName).VerifyRedirectUrl; len(verifyRedirectUrl) > 0 {
+		return verifyRedirectUrl
+	}
+
+	return verifyLeadRedirectUrls[appName]
+}
+
+// Takes the caller's request id or generates one, returns it in the response header and maps a
+// request carrying it in its context for later handlers
+func requestId(context martini.Context, res http.ResponseWriter, req *http.Request) {
+	id := common.GetRequestId(req.Header.Get(common.REQUEST_ID_HEADER))
+	res.Header().Set(common.REQUEST_ID_HEADER, id)
+	context.Map(req.WithContext(common.WithRequestId(req.Context(), id)))
+}
+
+func setupHttpServer(config ProspectsConfig, createHandler CreateHandler, batchCreateHandler BatchCreateHandler, errorHandler ErrorHandler, notFoundHandler NotFoundHandler) *http.Server {
 	martini_ := martini.Classic()
 
-	allowHeaders := []string{"Origin"}
-	if botDetection.FieldLocation == common.Header {
-		allowHeaders = append(allowHeaders, botDetection.FieldName)
-	}
+	allowHeaders := []string{ORIGIN_HEADER, CONTENT_TYPE_HEADER, common.API_KEY_HEADER, common.REQUEST_ID_HEADER, common.IDEMPOTENCY_KEY_HEADER}
 
 	//Allowable header names
-	headerNamesStr := os.Getenv("ALLOW_HEADERS")
-	if len(headerNamesStr) > 0 {
-		headerNamesArr := strings.Split(headerNamesStr, ",")
-		for _, headerName := range headerNamesArr {
-			allowHeaders = append(allowHeaders, headerName)
-		}
-	}
+	allowHeaders = append(allowHeaders, config.AllowHeaders...)
 
 	log.Printf("Allowable header names: %s", allowHeaders)
 
+	//Request ids are assigned before anything else so every handler can log them
+	martini_.Use(requestId)
+
+	//Health checks
+	healthz, readyz := setupHealthHttpHandlers(db)
+	martini_.Get(HEALTHZ_URL, healthz)
+	martini_.Head(HEALTHZ_URL, healthz)
+	martini_.Get(READYZ_URL, readyz)
+	martini_.Head(READYZ_URL, readyz)
+
+	//Request latency is measured around every other handler
+	if metricsEnabled {
+		martini_.Use(requestMetrics)
+		martini_.Get(METRICS_URL, metricsRegistry.ServeHTTP)
+	}
+
 	//GZIP responses
 	if gzipResponse {
 		martini_.Use(gzip.All(gzip.Options{CompressionLevel: gzipCompressionLevel}))
 	}
 
-	martini_.Use(cors.Allow(&cors.Options{
-		AllowOrigins:     []string{"*"},
+	martini_.Use(allowCors(CorsOptions{
 		AllowMethods:     []string{common.POST_METHOD, common.GET_METHOD, common.HEAD_METHOD},
 		AllowHeaders:     allowHeaders,
+		ExposeHeaders:    []string{common.REQUEST_ID_HEADER, common.IDEMPOTENT_REPLAYED_HEADER},
 		AllowCredentials: true,
 	}))
 
-	sslRedirect, err := strconv.ParseBool(common.GetenvWithDefault("SSL_REDIRECT", "false"))
-	if nil != err {
-		sslRedirect = false
-		log.Print(err)
-	}
-	log.Printf("Setting SSL redirect to %t", sslRedirect)
+	log.Printf("Setting SSL redirect to %t", config.SslRedirect)
 
 	martini_.Use(secure.Secure(secure.Options{
-		SSLRedirect:     sslRedirect,
+		SSLRedirect:     config.SslRedirect,
 		SSLProxyHeaders: map[string]string{"X-Forwarded-Proto": "https"},
 	}))
 
@@ -959,75 +1370,100 @@ func runHttpServer(createHandler CreateHandler, errorHandler ErrorHandler, notFo
 		martini_.Head(FAVICON_ICO_URL, getFaviconIco, errorHandler)
 	}
 
-	//Verify prospect
-	if len(verifyLeadRedirectUrls) > 0 {
-		notFoundText := `<!DOCTYPE html><html><head><meta charset="UTF-8"><title>Not found!</title></head>
+	//Verify prospect, redirect urls may be added to prospects.applications while running
+	notFoundText := `<!DOCTYPE html><html><head><meta charset="UTF-8"><title>Not found!</title></head>
                          <body><img src="http://media02.hongkiat.com/error_404_01/csstricks.jpg" alt="Not found css"></body></html>`
 
-		getSqlString := func(values *url.Values, fieldName string) sql.NullString {
-			value := values.Get(fieldName)
-			empty := len(value) <= 0
-			return sql.NullString{value, !empty}
-		}
+	getSqlString := func(values *url.Values, fieldName string) sql.NullString {
+		value := values.Get(fieldName)
+		empty := len(value) <= 0
+		return sql.NullString{value, !empty}
+	}
+
+	isValidUserId := func(val *sql.NullString) bool {
+		return val.Valid && uuidRegex.MatchString(val.String)
+	}
 
-		isValidUserId := func(val *sql.NullString) bool {
-			return val.Valid && uuidRegex.MatchString(val.String)
+	getCanonicalEmailString := func(val *sql.NullString) sql.NullString {
+		if !val.Valid {
+			return sql.NullString{}
 		}
 
-		isValidEmail := func(val *sql.NullString) bool {
-			return val.Valid && emailRegex.MatchString(val.String)
+		canonicalEmail, valid := getCanonicalEmail(val.String)
+		return sql.NullString{canonicalEmail, valid}
+	}
+
+	verifyProspect := func(res http.ResponseWriter, req *http.Request) (int, string) {
+		//Only applications with a redirect url send verification links
+		appName := req.URL.Query().Get("app_name")
+		verifyRedirectUrl := getVerifyRedirectUrl(appName)
+
+		if len(verifyRedirectUrl) == 0 {
+			res.Header().Set(CONTENT_TYPE_HEADER, HTML_CONTENT_TYPE)
+			return http.StatusNotFound, notFoundText
 		}
 
-		verifyProspect := func(res http.ResponseWriter, req *http.Request) (int, string) {
-			go func() {
-				values := req.URL.Query()
-				userId := getSqlString(&values, "userId")
-				email := getSqlString(&values, "email")
-				phoneNumber := getSqlString(&values, "phone_number")
-
-				if isValidUserId(&userId) && (isValidEmail(&email) || phoneNumber.Valid) {
-					res, err := db.Exec(VERIFY_LEAD_QUERY, userId, email, phoneNumber)
-					if nil != err {
-						log.Print(err)
+		logger := common.Logger(req.Context())
+		go func() {
+			values := req.URL.Query()
+			userId := getSqlString(&values, "userId")
+			email := getSqlString(&values, "email")
+			phoneNumber := getSqlString(&values, "phone_number")
+			canonicalEmail := getCanonicalEmailString(&email)
+
+			if isValidUserId(&userId) && (canonicalEmail.Valid || phoneNumber.Valid) {
+				res, err := db.Exec(VERIFY_LEAD_QUERY, userId, canonicalEmail, phoneNumber)
+				if nil != err {
+					logger.Error("Error verifying leads", "user_id", userId.String, "error", err)
+				} else {
+					count, _ := res.RowsAffected()
+					if count == 0 {
+						logger.Info("No leads verified after request", "user_id", userId.String, "email", email.String, "phone_number", phoneNumber.String)
 					} else {
-						count, _ := res.RowsAffected()
-						if count == 0 {
-							log.Printf("No leads verified after request %s", values)
-						} else {
-							log.Printf("Successfully verified %d leads after request %s", count, values)
-						}
+						logger.Info("Successfully verified leads after request", "count", count, "user_id", userId.String, "email", email.String, "phone_number", phoneNumber.String)
 					}
-				} else {
-					log.Printf("Invalid verification request received: %s", values)
 				}
-			}()
-
-			appName := req.URL.Query().Get("app_name")
-			verifyRedirectUrl := verifyLeadRedirectUrls[appName]
-
-			if len(verifyRedirectUrl) == 0 {
-				res.Header().Set(CONTENT_TYPE_HEADER, HTML_CONTENT_TYPE)
-				return http.StatusNotFound, notFoundText
 			} else {
+				logger.Warn("Invalid verification request received", "user_id", userId.String, "email", email.String, "phone_number", phoneNumber.String)
+			}
+		}()
 
-				verifyResponseText := fmt.Sprintf(`<!DOCTYPE html><html><head><meta charset="UTF-8"><title>Redirect in progress</title></head>
+		verifyResponseText := fmt.Sprintf(`<!DOCTYPE html><html><head><meta charset="UTF-8"><title>Redirect in progress</title></head>
                                                    <body><p>Please visit us <a href="%s">here</a></p></body></html>`, verifyRedirectUrl)
 
-				res.Header().Set(LOCATION_HEADER, verifyRedirectUrl)
-				res.Header().Set(CONTENT_TYPE_HEADER, HTML_CONTENT_TYPE)
-				res.Header().Set(CACHE_CONTROL_HEADER, "no-store, no-cache, must-revalidate")
-				res.Header().Set(EXPIRES_HEADER, "Thu, 01 Jan 1970 00:00:00 GMT")
-				return http.StatusMovedPermanently, verifyResponseText
-			}
-		}
-		martini_.Get(VERIFY_URL, verifyProspect, errorHandler)
-		martini_.Head(VERIFY_URL, verifyProspect, errorHandler)
+		res.Header().Set(LOCATION_HEADER, verifyRedirectUrl)
+		res.Header().Set(CONTENT_TYPE_HEADER, HTML_CONTENT_TYPE)
+		res.Header().Set(CACHE_CONTROL_HEADER, "no-store, no-cache, must-revalidate")
+		res.Header().Set(EXPIRES_HEADER, "Thu, 01 Jan 1970 00:00:00 GMT")
+		return http.StatusMovedPermanently, verifyResponseText
+	}
+	martini_.Get(VERIFY_URL, verifyProspect, errorHandler)
+	martini_.Head(VERIFY_URL, verifyProspect, errorHandler)
+
+	//Read API
+	if readApi {
+		requireReadScope := requireApiScope(common.ReadScope)
+		listLeads, getLead, getLeadsByLeadId, listSneezers := setupReadHttpHandlers(db)
+		martini_.Get(LEADS_URL, requireReadScope, listLeads)
+		martini_.Get(LEAD_URL, requireReadScope, getLead)
+		martini_.Get(LEAD_ID_URL, requireReadScope, getLeadsByLeadId)
+		martini_.Get(SNEEZERS_URL, requireReadScope, listSneezers)
+	}
+
+	//Form tokens
+	if nil != formTokens {
+		martini_.Get(FORM_TOKEN_URL, getFormToken)
+	}
+
+	//Proof of work challenges
+	if nil != proofOfWork {
+		martini_.Get(CHALLENGE_URL, getChallenge)
 	}
 
 	//Prospects
-	martini_.Post(REQUEST_URL, binding.Form(ProspectForm{}), errorHandler, createHandler)
+	martini_.Post(REQUEST_URL, hashSignedBody, replayIdempotentProspect, rateLimitIpAddress, bindProspect, recordBotProspect, errorHandler, rateLimitProspect, createHandler)
+	martini_.Post(BATCH_REQUEST_URL, hashSignedBody, batchCreateHandler)
 	martini_.NotFound(notFoundHandler)
 
-	//Event loop
-	martini_.Run()
+	return &http.Server{Addr: config.GetAddr(), Handler: martini_}
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	TEST_DRIVER     = "prospectstest"
+	TEST_APP_NAME   = "tremont"
+	TEST_LEAD_ID    = "0f8fad5b-d9cb-469f-a165-70867728950e"
+	TEST_IP_ADDRESS = "192.0.2.10"
+	TEST_ORIGIN     = "https://ridingwithziggy.com"
+)
+
+// A database/sql driver that answers every query with the next id, or the row set for queries
+// starting with a prefix, and remembers what it was asked, so handlers can run without Postgres
+type testDatabase struct {
+	mutex       sync.Mutex
+	queries     []string
+	queryArgs   [][]driver.Value
+	nextId      int64
+	rows        map[string][]driver.Value
+	failQueries []string
+	failCommit  bool
+}
+
+type testDriver struct{}
+type testConn struct{ database *testDatabase }
+type testStmt struct {
+	database *testDatabase
+	query    string
+}
+type testRows struct {
+	row  []driver.Value
+	done bool
+}
+
+var testDatabases = make(map[string]*testDatabase)
+var testDatabasesMutex sync.Mutex
+
+func init() {
+	sql.Register(TEST_DRIVER, testDriver{})
+}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testDatabasesMutex.Lock()
+	defer testDatabasesMutex.Unlock()
+	return testConn{testDatabases[name]}, nil
+}
+
+func (conn testConn) Prepare(query string) (driver.Stmt, error) {
+	return testStmt{conn.database, query}, nil
+}
+
+func (conn testConn) Close() error {
+	return nil
+}
+
+func (conn testConn) Begin() (driver.Tx, error) {
+	return conn, nil
+}
+
+func (conn testConn) Commit() error {
+	conn.database.mutex.Lock()
+	defer conn.database.mutex.Unlock()
+
+	if conn.database.failCommit {
+		return fmt.Errorf("test commit failure")
+	}
+	return nil
+}
+
+func (conn testConn) Rollback() error {
+	return nil
+}
+
+func (stmt testStmt) Close() error {
+	return nil
+}
+
+func (stmt testStmt) NumInput() int {
+	return -1
+}
+
+func (stmt testStmt) run(args []driver.Value) (*testRows, error) {
+	stmt.database.mutex.Lock()
+	defer stmt.database.mutex.Unlock()
+
+	stmt.database.queries = append(stmt.database.queries, stmt.query)
+	stmt.database.queryArgs = append(stmt.database.queryArgs, args)
+	for _, failQuery := range stmt.database.failQueries {
+		if strings.Contains(stmt.query, failQuery) {
+			return nil, fmt.Errorf("test query failure")
+		}
+	}
+
+	//A nil row is a query that finds nothing
+	for prefix, row := range stmt.database.rows {
+		if strings.HasPrefix(stmt.query, prefix) {
+			return &testRows{row, nil == row}, nil
+		}
+	}
+
+	stmt.database.nextId++
+	return &testRows{[]driver.Value{stmt.database.nextId}, false}, nil
+}
+
+func (stmt testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, err := stmt.run(args)
+	return driver.RowsAffected(1), err
+}
+
+func (stmt testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.run(args)
+}
+
+func (rows *testRows) Columns() []string {
+	columns := make([]string, len(rows.row))
+	for index := range columns {
+		columns[index] = fmt.Sprintf("column%d", index)
+	}
+	return columns
+}
+
+func (rows *testRows) Close() error {
+	return nil
+}
+
+func (rows *testRows) Next(dest []driver.Value) error {
+	if rows.done {
+		return io.EOF
+	}
+
+	rows.done = true
+	copy(dest, rows.row)
+	return nil
+}
+
+// Counts the queries starting with prefix, like "INSERT INTO prospects.leads"
+func (database *testDatabase) count(prefix string) int {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	count := 0
+	for _, query := range database.queries {
+		if strings.HasPrefix(query, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// The arguments of the last query starting with prefix
+func (database *testDatabase) lastArgs(prefix string) []driver.Value {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	for index := len(database.queries) - 1; index >= 0; index-- {
+		if strings.HasPrefix(database.queries[index], prefix) {
+			return database.queryArgs[index]
+		}
+	}
+	return nil
+}
+
+// Sets up the package state main would from config, with the test driver standing in for
+// the database, and returns the server's handler
+func newTestServer(t *testing.T, configure func(*ProspectsConfig)) (http.Handler, *testDatabase) {
+	t.Helper()
+
+	//The database settings are required though the test driver ignores them
+	t.Setenv("DATABASE_URL", "postgres://prospects@localhost/prospects")
+
+	var config ProspectsConfig
+	_, _, err := common.LoadConfig("prospects", &config, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	config.MartiniEnv = "test"
+	config.GzipResponse = false
+	if nil != configure {
+		configure(&config)
+	}
+
+	database := new(testDatabase)
+	testDatabasesMutex.Lock()
+	testDatabases[t.Name()] = database
+	testDatabasesMutex.Unlock()
+
+	db, err = sql.Open(TEST_DRIVER, t.Name())
+	if nil != err {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	batchSizeLimit = config.BatchSizeLimit
+	batchBodySizeLimit = config.BatchBodySizeLimit
+	appNames = getStringSet(config.AppNames)
+	leadSources = map[string]bool{"landing": true, "email": true, "phone": true, "extended": true, "feedback": true, "popup": true}
+	uuidRegex = regexp.MustCompile(UUID_REGEX)
+	emailRegex = regexp.MustCompile(EMAIL_REGEX)
+	ipAddressLocation = config.IpAddressLocation
+	gzipResponse = config.GzipResponse
+	defaultPhoneRegion = config.PhoneRegion
+	failedLeadsFile = config.FailedLeadsFile
+	metricsEnabled = false
+	formTokens = nil
+	proofOfWork = nil
+
+	botDetectionFieldLocation := common.Body
+	if config.BotDetectFieldLocation == "header" {
+		botDetectionFieldLocation = common.Header
+	}
+
+	botDetection := common.BotDetection{
+		FieldLocation: botDetectionFieldLocation,
+		FieldName:     config.BotDetectFieldName,
+		FieldValue:    config.BotDetectFieldValue,
+		MustMatch:     config.BotDetectMustMatch,
+		PlayCoy:       config.BotDetectPlayCoy,
+		Shadow:        config.BotDetectShadow,
+		HoneypotScore: config.BotDetectHoneypotScore,
+		Threshold:     config.BotDetectThreshold,
+		Detectors:     getBotDetectors(config),
+	}
+
+	originMismatch := common.RejectOrigin
+	if config.OriginMismatch == "flag" {
+		originMismatch = common.FlagOrigin
+	}
+
+	applications = common.NewApplicationRegistry(db, common.Application{StringSizeLimit: config.StringSizeLimit, FeedbackSizeLimit: config.FeedbackSizeLimit, AllowedOrigins: config.AllowedOrigins, BotDetection: botDetection, OriginMismatch: originMismatch,
+		IpRateLimit: common.RateLimit{config.RateLimitIp, config.RateLimitIpBurst}, LeadRateLimit: common.RateLimit{config.RateLimitLead, config.RateLimitLeadBurst}, ProofOfWork: config.Pow})
+
+	rateLimiter = common.NewMemoryRateLimiter()
+	velocityRateLimiter = common.NewMemoryRateLimiter()
+	idempotencyStore = common.NewMemoryIdempotencyStore()
+	idempotencyTtl = config.IdempotencyTtl
+	apiKeyAuthenticator = common.NewApiKeyAuthenticator(db, config.ApiKeyCacheSeconds, config.ApiKeySigningSecret)
+	apiKeyRequiredAppNames = getStringSet(config.ApiKeyRequiredApps)
+
+	readApi = config.ReadApi
+	asyncRequest = config.AsyncRequest
+	asyncCopy = false
+	prospectBatchProcessor = nil
+
+	createHandler, errorHandler, notFoundHandler := setupHttpHandlers(db)
+	batchCreateHandler := setupBatchHttpHandler(db)
+
+	return setupHttpServer(config, createHandler, batchCreateHandler, errorHandler, notFoundHandler).Handler, database
+}
+
+func doTestRequest(handler http.Handler, method string, url string, contentType string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.RemoteAddr = TEST_IP_ADDRESS + ":1234"
+	if len(contentType) > 0 {
+		req.Header.Set(CONTENT_TYPE_HEADER, contentType)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func getTestProspectJson(email string) string {
+	return fmt.Sprintf(`{"leadid": %q, "appname": %q, "leadsource": "landing", "email": %q}`, TEST_LEAD_ID, TEST_APP_NAME, email)
+}
+
+func TestCreateProspect(t *testing.T) {
+	handler, database := newTestServer(t, nil)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"json", JSON_CONTENT_TYPE, getTestProspectJson("lothos@example.com"), http.StatusCreated},
+		{"form", "application/x-www-form-urlencoded", "appname=tremont&leadsource=landing&email=lothos%40example.com", http.StatusCreated},
+		{"invalid email", JSON_CONTENT_TYPE, getTestProspectJson("lothos"), http.StatusBadRequest},
+		{"tagged email", JSON_CONTENT_TYPE, getTestProspectJson("Lothos.Ziggy+tremont@GMail.com"), http.StatusCreated},
+		{"punycode domain", JSON_CONTENT_TYPE, getTestProspectJson("lothos@xn--bcher-kva.de"), http.StatusCreated},
+		//Addresses are checked as typed, not only once normalized
+		{"internationalized domain", JSON_CONTENT_TYPE, getTestProspectJson("lothos@bücher.de"), http.StatusBadRequest},
+		{"email with spaces", JSON_CONTENT_TYPE, getTestProspectJson(" lothos@example.com"), http.StatusBadRequest},
+		{"missing lead source", JSON_CONTENT_TYPE, `{"appname": "tremont"}`, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inserts := database.count("INSERT INTO prospects.leads")
+
+			recorder := doTestRequest(handler, http.MethodPost, REQUEST_URL, test.contentType, test.body, nil)
+			if recorder.Code != test.code {
+				t.Fatalf("code = %d, want %d: %s", recorder.Code, test.code, recorder.Body)
+			}
+
+			wantInserted := 0
+			if test.code == http.StatusCreated {
+				wantInserted = 1
+			}
+
+			if inserted := database.count("INSERT INTO prospects.leads") - inserts; inserted != wantInserted {
+				t.Errorf("inserted %d leads, want %d", inserted, wantInserted)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RATE_LIMIT_PRUNE_PERIOD = 5 * time.Minute
+)
+
+var rateLimiter common.RateLimiter
+
+// Buckets are kept per application so each application's limits are separate.  Application names
+// that aren't allowed share one set of buckets, so changing the name doesn't get a fresh one.
+func getRateLimitKey(kind string, appName string, value string) string {
+	if !appNames[appName] && !applications.Get(appName).Registered {
+		appName = ""
+	}
+
+	return fmt.Sprintf("%s|%s|%s", kind, appName, value)
+}
+
+// Takes a token from the bucket for the value, when given.  Errors from the rate limiter let the
+// prospect through rather than losing it.
+func takeRateLimit(ctx context.Context, appName string, kind string, value string, rateLimit common.RateLimit) (bool, time.Duration) {
+	if len(value) == 0 || !rateLimit.Enabled() {
+		return true, 0
+	}
+
+	taken, wait, err := rateLimiter.Take(getRateLimitKey(kind, appName, value), rateLimit)
+	if nil != err {
+		common.Logger(ctx).Error("Error taking rate limit token", "kind", kind, "error", err)
+		return true, 0
+	}
+
+	if !taken {
+		common.Logger(ctx).Warn("Rate limit exceeded", "app_name", appName, "kind", kind, "retry_after", wait)
+	}
+
+	return taken, wait
+}
+
+// Charged before the submission is bound and validated, so invalid submissions count too
+func takeIpRateLimit(ctx context.Context, appName string, ipAddress string) (bool, time.Duration) {
+	return takeRateLimit(ctx, appName, "ip", ipAddress, applications.Get(appName).IpRateLimit)
+}
+
+// Charged once the prospect is valid, so invalid submissions can't use up a lead's tokens.  Both
+// buckets are charged even once one is empty, so retrying early doesn't get around the other.
+func takeLeadRateLimits(ctx context.Context, prospect *ProspectForm) (bool, time.Duration) {
+	rateLimit := applications.Get(prospect.AppName).LeadRateLimit
+
+	//Addresses delivered to the same mailbox share a limit, so tags and dots don't get around it
+	email, valid := getCanonicalEmail(prospect.Email)
+	if !valid {
+		email = strings.ToLower(prospect.Email)
+	}
+
+	leadAllowed, leadWait := takeRateLimit(ctx, prospect.AppName, "lead", prospect.LeadId, rateLimit)
+	emailAllowed, emailWait := takeRateLimit(ctx, prospect.AppName, "email", email, rateLimit)
+
+	return leadAllowed && emailAllowed, max(leadWait, emailWait)
+}
+
+// Whole seconds for the Retry-After header, rounded up so a retry isn't early
+func getRetryAfterSeconds(retryAfter time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(retryAfter.Seconds()))))
+}
+
+func getRateLimitResponse(ctx context.Context, appName string, retryAfter time.Duration) common.Response {
+	if applications.Get(appName).BotDetection.PlayCoy {
+		common.Logger(ctx).Info("Rate limit exceeded. Playing coy.", "app_name", appName)
+		return getCoyResponse()
+	}
+
+	responseStr := fmt.Sprintf("Too many submissions, retry after %s seconds", getRetryAfterSeconds(retryAfter))
+	common.Logger(ctx).Info(responseStr, "app_name", appName)
+	return common.Response{Code: http.StatusTooManyRequests, Message: responseStr}
+}
+
+func writeRateLimitResponse(res http.ResponseWriter, req *http.Request, appName string, leadSource string, retryAfter time.Duration) {
+	recordSubmission(appName, leadSource, RATE_LIMITED_OUTCOME)
+
+	response := getRateLimitResponse(req.Context(), appName, retryAfter)
+	response.RequestId = common.RequestIdFromContext(req.Context())
+
+	if response.Code == http.StatusTooManyRequests {
+		res.Header().Set(common.RETRY_AFTER_HEADER, getRetryAfterSeconds(retryAfter))
+	}
+
+	res.Header().Set(CONTENT_TYPE_HEADER, JSON_CONTENT_TYPE)
+	res.WriteHeader(response.Code)
+
+	jsonStr, _ := json.Marshal(response)
+	res.Write(jsonStr)
+}
+
+// Runs before binding, so submissions that fail validation still use up the ip address's tokens
+func rateLimitIpAddress(res http.ResponseWriter, req *http.Request) {
+	appName := req.FormValue("appname")
+
+	allowed, retryAfter := takeIpRateLimit(req.Context(), appName, processIpAddress(req))
+	if !allowed {
+		writeRateLimitResponse(res, req, appName, req.FormValue("leadsource"), retryAfter)
+	}
+}
+
+// Runs after the prospect validated, so invalid submissions don't use up a lead's tokens
+func rateLimitProspect(res http.ResponseWriter, req *http.Request, prospect ProspectForm) {
+	allowed, retryAfter := takeLeadRateLimits(req.Context(), &prospect)
+	if !allowed {
+		writeRateLimitResponse(res, req, prospect.AppName, prospect.LeadSource, retryAfter)
+	}
+}
+
+// Buckets that have refilled are removed periodically
+func pruneRateLimits() {
+	for range time.Tick(RATE_LIMIT_PRUNE_PERIOD) {
+		err := rateLimiter.Prune()
+		if nil != err {
+			slog.Error("Error pruning rate limits", "error", err)
+		}
+
+		velocityRateLimiter.Prune()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bitbucket.org/padium/prospects"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func getTestLeadJson(leadId string, email string) string {
+	return strings.Replace(getTestProspectJson(email), TEST_LEAD_ID, leadId, 1)
+}
+
+func TestRateLimitSubmissions(t *testing.T) {
+	const otherLeadId = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	const thirdLeadId = "16fd2706-8baf-433b-82eb-8c7fada847da"
+
+	valid := getTestProspectJson("lothos@example.com")
+	invalid := getTestProspectJson("lothos")
+
+	tests := []struct {
+		name    string
+		ip      int
+		lead    int
+		playCoy bool
+		bodies  []string
+		codes   []int
+	}{
+		{"under the ip limit", 2, 0, false, []string{valid, valid}, []int{http.StatusCreated, http.StatusCreated}},
+		{"ip limit", 2, 0, false, []string{valid, valid, valid}, []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests}},
+		{"invalid submissions charge the ip address", 2, 0, false, []string{invalid, invalid, valid}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusTooManyRequests}},
+		{"lead limit", 0, 1, false, []string{valid, valid}, []int{http.StatusCreated, http.StatusTooManyRequests}},
+		{"invalid submissions don't charge the lead", 0, 1, false, []string{invalid, invalid, valid}, []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusCreated}},
+		{"other leads", 0, 1, false, []string{getTestLeadJson(otherLeadId, "ziggy@example.com"), getTestLeadJson(thirdLeadId, "lothos@example.com")}, []int{http.StatusCreated, http.StatusCreated}},
+		{"same email for another lead", 0, 1, false, []string{valid, getTestLeadJson(otherLeadId, "lothos@example.com")}, []int{http.StatusCreated, http.StatusTooManyRequests}},
+		{"same mailbox for another lead", 0, 1, false, []string{getTestLeadJson(otherLeadId, "lothos.ziggy@gmail.com"), getTestLeadJson(thirdLeadId, "LothosZiggy+tremont@gmail.com")}, []int{http.StatusCreated, http.StatusTooManyRequests}},
+		{"playing coy", 1, 0, true, []string{valid, valid}, []int{http.StatusCreated, http.StatusCreated}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler, database := newTestServer(t, func(config *ProspectsConfig) {
+				config.RateLimitIp = test.ip
+				config.RateLimitLead = test.lead
+				config.BotDetectPlayCoy = test.playCoy
+			})
+
+			created := 0
+			for index, body := range test.bodies {
+				recorder := doTestRequest(handler, http.MethodPost, REQUEST_URL, JSON_CONTENT_TYPE, body, nil)
+				if recorder.Code != test.codes[index] {
+					t.Fatalf("submission %d code = %d, want %d: %s", index, recorder.Code, test.codes[index], recorder.Body)
+				}
+
+				retryAfter := recorder.Header().Get(common.RETRY_AFTER_HEADER)
+				//A token refills every 60 / limit seconds
+				if recorder.Code == http.StatusTooManyRequests && retryAfter != fmt.Sprint(60/max(test.ip, test.lead)) {
+					t.Errorf("submission %d %s = %q, want %d", index, common.RETRY_AFTER_HEADER, retryAfter, 60/max(test.ip, test.lead))
+				} else if recorder.Code != http.StatusTooManyRequests && len(retryAfter) > 0 {
+					t.Errorf("submission %d %s = %q, want none", index, common.RETRY_AFTER_HEADER, retryAfter)
+				}
+
+				if recorder.Code == http.StatusCreated {
+					created++
+				}
+			}
+
+			//Playing coy looks like success without adding anything
+			if test.playCoy {
+				created--
+			}
+
+			if inserted := database.count("INSERT INTO prospects.leads"); inserted != created {
+				t.Errorf("inserted %d leads, want %d", inserted, created)
+			}
+		})
+	}
+}
+
+func TestRateLimitBatch(t *testing.T) {
+	handler, database := newTestServer(t, func(config *ProspectsConfig) {
+		config.RateLimitIp = 3
+		config.RateLimitLead = 1
+		config.BotDetectPlayCoy = false
+	})
+
+	items := []string{
+		getTestProspectJson("lothos@example.com"),
+		getTestProspectJson("lothos@example.com"),
+		getTestProspectJson("lothos"),
+		getTestProspectJson("ziggy@example.com"),
+	}
+
+	recorder := doTestRequest(handler, http.MethodPost, BATCH_REQUEST_URL, JSON_CONTENT_TYPE, "["+strings.Join(items, ",")+"]", nil)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("code = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+
+	//The lead's second item is over its own limit, and every item takes an ip address token so the fourth is over that one
+	expected := []int{http.StatusCreated, http.StatusTooManyRequests, http.StatusBadRequest, http.StatusTooManyRequests}
+	codes := getTestBatchCodes(decodeTestBatchResponse(t, recorder.Body.String()))
+	if fmt.Sprint(codes) != fmt.Sprint(expected) {
+		t.Errorf("item codes = %v, want %v", codes, expected)
+	}
+
+	if retryAfter := recorder.Header().Get(common.RETRY_AFTER_HEADER); retryAfter != "60" {
+		t.Errorf("%s = %q, want 60", common.RETRY_AFTER_HEADER, retryAfter)
+	}
+
+	if inserted := database.count("INSERT INTO prospects.leads"); inserted != 1 {
+		t.Errorf("inserted %d leads, want 1", inserted)
+	}
+}
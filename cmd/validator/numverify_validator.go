@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 type NumVerifyValidator struct {
@@ -32,8 +34,13 @@ func (validator NumVerifyValidator) Validate(prospect common.Prospect) (bool, bo
 		return isValid, wasProcessed, miscellaneous
 	}
 
-	url := fmt.Sprintf(URL, validator.ApiKey, prospect.PhoneNumber)
-	body, responseCode, _, err = common.MakeHttpGetRequest(url)
+	//Numbers parsed at submission are sent with their country calling code, so NumVerify doesn't guess
+	requestUrl := fmt.Sprintf(URL, validator.ApiKey, url.QueryEscape(prospect.PhoneNumber))
+	if len(prospect.PhoneE164) > 0 {
+		requestUrl = fmt.Sprintf(URL, validator.ApiKey, strings.TrimPrefix(prospect.PhoneE164, "+"))
+	}
+
+	body, responseCode, _, err = common.MakeHttpGetRequest(requestUrl)
 	if nil != err {
 		return isValid, wasProcessed, miscellaneous
 	} else {
@@ -5,8 +5,7 @@ import (
 	"database/sql"
 	_ "github.com/lib/pq"
 	"log"
-	"os"
-	"strconv"
+	"log/slog"
 	"time"
 )
 
@@ -70,8 +69,7 @@ func process(db *sql.DB, prospects []common.Prospect, validators []Validator) {
 		if IsProcessed(&prospect, validators) {
 			err = statement.QueryRow(prospect.WasProcessed, prospect.IsValid, prospect.Miscellaneous, time.Now(), prospect.Id).Scan(&unused)
 			if nil != err && sql.ErrNoRows != err {
-				log.Printf("Error processing %#v", prospect)
-				log.Print(err)
+				slog.Error("Error processing prospect", "prospect", prospect, "error", err)
 			}
 			counter++
 		}
@@ -86,60 +84,26 @@ func process(db *sql.DB, prospects []common.Prospect, validators []Validator) {
 	}
 }
 
-func main() {
-	dbUrl := os.Getenv("DATABASE_URL")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
-	dbHost := common.GetenvWithDefault("DB_HOST", "localhost")
-	dbPort := common.GetenvWithDefault("DB_PORT", "5432")
-	dbMaxOpenConnsStr := common.GetenvWithDefault("DB_MAX_OPEN_CONNS", "10")
-	dbMaxIdleConnsStr := common.GetenvWithDefault("DB_MAX_IDLE_CONNS", "0")
-	processAmtStr := common.GetenvWithDefault("PROCESS_AMT", "3")
-	fullContactApiKey := os.Getenv("FULLCONTACT_APIKEY")
-	numVerifyApiKey := os.Getenv("NUMVERIFY_APIKEY")
-
-	if len(fullContactApiKey) <= 0 {
-		log.Fatal("FullContact API key not set")
-	}
-
-	if len(numVerifyApiKey) <= 0 {
-		log.Fatal("NumVerify API key not set")
-	}
-
-	dbMaxOpenConns, err := strconv.Atoi(dbMaxOpenConnsStr)
-	if nil != err {
-		dbMaxOpenConns = 10
-		log.Printf("Error setting database maximum open connections from value: %s. Default to %d", dbMaxOpenConnsStr, dbMaxOpenConns)
-		log.Print(err)
-	}
-
-	dbMaxIdleConns, err := strconv.Atoi(dbMaxIdleConnsStr)
-	if nil != err {
-		dbMaxIdleConns = 0
-		log.Printf("Error setting database maximum idle connections from value: %s. Default to %d", dbMaxIdleConnsStr, dbMaxIdleConns)
-		log.Print(err)
-	}
+type ValidatorConfig struct {
+	ProcessAmt        int    `config:"PROCESS_AMT" default:"3" min:"1"`
+	FullContactApiKey string `config:"FULLCONTACT_APIKEY" required:"true" secret:"true"`
+	NumVerifyApiKey   string `config:"NUMVERIFY_APIKEY" required:"true" secret:"true"`
+	Database          common.DatabaseConfig
+	Log               common.LogConfig
+}
 
-	processAmt, err := strconv.Atoi(processAmtStr)
-	if nil != err {
-		processAmt = 3
-		log.Printf("Error setting process amount from value: %s. Default to %d", processAmtStr, processAmt)
-		log.Print(err)
-	}
+func main() {
+	var config ValidatorConfig
+	common.MustLoadConfig("validator", &config)
+	common.SetupLogging("validator", config.Log)
 
 	//Database connection
 	log.Print("Enabling database connectivity")
 
-	dbCredentials := common.DatabaseCredentials{common.DB_DRIVER, dbUrl, dbUser, dbPassword, dbName, dbHost, dbPort, dbMaxOpenConns, dbMaxIdleConns}
-	if !dbCredentials.IsValid() {
-		log.Fatalf("Database credentials NOT set correctly. %#v", dbCredentials)
-	}
-
-	db := dbCredentials.GetDatabase()
+	db := config.Database.GetCredentials().GetDatabase()
 	defer db.Close()
 
-	prospects, err := common.GetProspects(db, FROM_QUERY, processAmt)
+	prospects, err := common.GetProspects(db, FROM_QUERY, config.ProcessAmt)
 	if nil != err {
 		log.Fatal(err)
 	} else {
@@ -147,8 +111,8 @@ func main() {
 	}
 
 	var validators []Validator
-	validators = append(validators, FullContactValidator{fullContactApiKey})
-	validators = append(validators, NumVerifyValidator{numVerifyApiKey})
+	validators = append(validators, FullContactValidator{config.FullContactApiKey})
+	validators = append(validators, NumVerifyValidator{config.NumVerifyApiKey})
 
 	process(db, prospects, validators)
 }
@@ -42,14 +42,30 @@ type Prospect struct {
 	Longitude     float64 `form:"longitude"`
 	IpAddress     string
 	Miscellaneous string `form:"miscellaneous"`
+	//Derived from Email at submission, so addresses delivered to the same mailbox are equal
+	EmailCanonical string
+	//Origin the application doesn't allow, when flagged rather than rejected
+	SuspiciousOrigin string
+	//Robot detection flagged the prospect in shadow mode
+	SuspectedBot bool
+	//Robot detection's verdict on a bot submission, until it is recorded
+	BotVerdict *BotVerdict `json:"-"`
+	//Parsed from PhoneNumber at submission
+	PhoneE164     string
+	PhoneCountry  string
+	PhoneLineType string
 	WasProcessed  bool
 	IsValid       bool
+	RepliedTo     bool
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
 }
 
 type Response struct {
-	Code    int
-	Message string
-	Id      int64 `json:",omitempty"`
+	Code      int
+	Message   string
+	Id        int64  `json:",omitempty"`
+	RequestId string `json:",omitempty"`
 }
 
 func IsJSON(str string) bool {
@@ -101,7 +117,7 @@ func MakeHttpGetRequest(url string) ([]byte, int, map[string][]string, error) {
 
 func GetProspects(db *sql.DB, query string, args ...interface{}) ([]Prospect, error) {
 	const (
-		QUERY = "SELECT id, lead_id, lead_source, app_name, email, phone_number, miscellaneous, was_processed, is_valid "
+		QUERY = "SELECT id, lead_id, lead_source, app_name, email, phone_number, phone_e164, phone_country, phone_line_type, miscellaneous, was_processed, is_valid "
 	)
 
 	rows, err := db.Query(QUERY+query, args...)
@@ -117,6 +133,9 @@ func GetProspects(db *sql.DB, query string, args ...interface{}) ([]Prospect, er
 		appName       string
 		email         sql.NullString
 		phoneNumber   sql.NullString
+		phoneE164     sql.NullString
+		phoneCountry  sql.NullString
+		phoneLineType sql.NullString
 		miscellaneous sql.NullString
 		wasProcessed  bool
 		isValid       bool
@@ -125,9 +144,9 @@ func GetProspects(db *sql.DB, query string, args ...interface{}) ([]Prospect, er
 	var prospects []Prospect
 
 	for rows.Next() {
-		err := rows.Scan(&id, &leadId, &leadSource, &appName, &email, &phoneNumber, &miscellaneous, &wasProcessed, &isValid)
+		err := rows.Scan(&id, &leadId, &leadSource, &appName, &email, &phoneNumber, &phoneE164, &phoneCountry, &phoneLineType, &miscellaneous, &wasProcessed, &isValid)
 		if nil != err {
-			continue
+			return nil, err
 		}
 
 		var prospect Prospect
@@ -138,6 +157,9 @@ func GetProspects(db *sql.DB, query string, args ...interface{}) ([]Prospect, er
 		prospect.AppName = appName
 		prospect.Email = email.String
 		prospect.PhoneNumber = phoneNumber.String
+		prospect.PhoneE164 = phoneE164.String
+		prospect.PhoneCountry = phoneCountry.String
+		prospect.PhoneLineType = phoneLineType.String
 		prospect.Miscellaneous = miscellaneous.String
 		prospect.WasProcessed = wasProcessed
 		prospect.IsValid = isValid
@@ -153,6 +175,86 @@ func GetProspects(db *sql.DB, query string, args ...interface{}) ([]Prospect, er
 	return prospects, nil
 }
 
+func GetFullProspects(db *sql.DB, query string, args ...interface{}) ([]Prospect, error) {
+	const (
+		QUERY = "SELECT id, lead_id, app_name, email, email_canonical, lead_source, feedback, referrer, page_referrer, first_name, last_name, phone_number, dob, gender, zip_code, language, user_agent, cookies, geolocation[0], geolocation[1], host(ip_address), miscellaneous, suspicious_origin, suspected_bot, phone_e164, phone_country, phone_line_type, was_processed, is_valid, replied_to, created_at, updated_at "
+	)
+
+	rows, err := db.Query(QUERY+query, args...)
+	if nil != err {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		email            sql.NullString
+		emailCanonical   sql.NullString
+		feedback         sql.NullString
+		referrer         sql.NullString
+		pageReferrer     sql.NullString
+		firstName        sql.NullString
+		lastName         sql.NullString
+		phoneNumber      sql.NullString
+		dob              sql.NullString
+		gender           sql.NullString
+		zipCode          sql.NullString
+		language         sql.NullString
+		userAgent        sql.NullString
+		cookies          sql.NullString
+		latitude         sql.NullFloat64
+		longitude        sql.NullFloat64
+		ipAddress        sql.NullString
+		miscellaneous    sql.NullString
+		suspiciousOrigin sql.NullString
+		phoneE164        sql.NullString
+		phoneCountry     sql.NullString
+		phoneLineType    sql.NullString
+	)
+
+	prospects := make([]Prospect, 0)
+
+	for rows.Next() {
+		var prospect Prospect
+
+		err := rows.Scan(&prospect.Id, &prospect.LeadId, &prospect.AppName, &email, &emailCanonical, &prospect.LeadSource, &feedback, &referrer, &pageReferrer, &firstName, &lastName, &phoneNumber, &dob, &gender, &zipCode, &language, &userAgent, &cookies, &latitude, &longitude, &ipAddress, &miscellaneous, &suspiciousOrigin, &prospect.SuspectedBot, &phoneE164, &phoneCountry, &phoneLineType, &prospect.WasProcessed, &prospect.IsValid, &prospect.RepliedTo, &prospect.CreatedAt, &prospect.UpdatedAt)
+		if nil != err {
+			return nil, err
+		}
+
+		prospect.Email = email.String
+		prospect.EmailCanonical = emailCanonical.String
+		prospect.Feedback = feedback.String
+		prospect.Referrer = referrer.String
+		prospect.PageReferrer = pageReferrer.String
+		prospect.FirstName = firstName.String
+		prospect.LastName = lastName.String
+		prospect.PhoneNumber = phoneNumber.String
+		prospect.DateOfBirth = dob.String
+		prospect.Gender = gender.String
+		prospect.ZipCode = zipCode.String
+		prospect.Language = language.String
+		prospect.UserAgent = userAgent.String
+		prospect.Cookies = cookies.String
+		prospect.Latitude = latitude.Float64
+		prospect.Longitude = longitude.Float64
+		prospect.IpAddress = ipAddress.String
+		prospect.Miscellaneous = miscellaneous.String
+		prospect.SuspiciousOrigin = suspiciousOrigin.String
+		prospect.PhoneE164 = phoneE164.String
+		prospect.PhoneCountry = phoneCountry.String
+		prospect.PhoneLineType = phoneLineType.String
+
+		prospects = append(prospects, prospect)
+	}
+
+	err = rows.Err()
+	if nil != err {
+		return prospects, err
+	}
+
+	return prospects, nil
+}
+
 func GetScheme(request *http.Request) string {
 	prot := request.Header.Get(XFP_HEADER)
 	if len(prot) > 0 {
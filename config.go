@@ -0,0 +1,487 @@
+package common
+
+import (
+	"bufio"
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONFIG_FILE_ENV    = "CONFIG_FILE"
+	CONFIG_FILE_FLAG   = "config"
+	PRINT_CONFIG_FLAG  = "print-config"
+	MASKED_CONFIG      = "xxxxx"
+	CONFIG_LIST_SEP    = ","
+	CONFIG_ONEOF_SEP   = "|"
+	CONFIG_TAG         = "config"
+	CONFIG_DEFAULT_TAG = "default"
+)
+
+// Configuration structs describe each setting with field tags:
+//
+//	config:"NAME"    environment variable and file key, the flag is the lower cased name with dashes
+//	flag:"name"      flag name when it differs
+//	default:"value"  used when no source sets the value
+//	required:"true"  must be set by some source
+//	secret:"true"    masked by PrintConfig
+//	min:"n" max:"n"  inclusive bounds for numbers and durations
+//	oneof:"a|b"      allowed values
+//	unit:"ms"        unit of a duration given as a plain number, like the older integer settings
+//	usage:"text"     flag help
+//
+// Nested and embedded structs are walked so shared settings like DatabaseConfig can be reused.
+// Values are taken from defaults, then the config file, then the environment, then flags.  An
+// environment variable set to an empty string still overrides the file, leaving the setting empty.
+type ConfigValidator interface {
+	Validate() error
+}
+
+type configField struct {
+	name  string
+	field reflect.StructField
+	value reflect.Value
+}
+
+type configFlag struct {
+	value *string
+}
+
+func (configFlag_ configFlag) String() string {
+	if nil == configFlag_.value {
+		return ""
+	}
+	return *configFlag_.value
+}
+
+func (configFlag_ configFlag) Set(value string) error {
+	*configFlag_.value = value
+	return nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// MustLoadConfig loads the configuration from the command line arguments and exits on any error.
+// With --print-config the effective configuration is printed and the command exits.  Arguments
+// after the flags, like subcommands, are returned.
+func MustLoadConfig(command string, config interface{}) []string {
+	args, printConfig, err := LoadConfig(command, config, os.Args[1:])
+	if flag.ErrHelp == err {
+		os.Exit(0)
+	} else if nil != err {
+		log.Fatalf("Invalid %s configuration: %s", command, err)
+	}
+
+	if printConfig {
+		PrintConfig(os.Stdout, config)
+		os.Exit(0)
+	}
+
+	return args
+}
+
+// LoadConfig fills config, a pointer to a tagged struct, and validates every field so that
+// all problems are reported together rather than defaulted away
+func LoadConfig(command string, config interface{}, args []string) ([]string, bool, error) {
+	fields, err := getConfigFields(config)
+	if nil != err {
+		return nil, false, err
+	}
+
+	flagSet := flag.NewFlagSet(command, flag.ContinueOnError)
+	configFile := flagSet.String(CONFIG_FILE_FLAG, os.Getenv(CONFIG_FILE_ENV), "Configuration file of KEY=value lines")
+	printConfig := flagSet.Bool(PRINT_CONFIG_FLAG, false, "Print the effective configuration with secrets masked and exit")
+
+	flagValues := make(map[string]*string)
+	for _, configField_ := range fields {
+		flagValue := new(string)
+		flagValues[configField_.name] = flagValue
+		flagSet.Var(configFlag{flagValue}, getFlagName(configField_), getUsage(configField_))
+	}
+
+	err = flagSet.Parse(args)
+	if nil != err {
+		return nil, false, err
+	}
+
+	setFlags := make(map[string]bool)
+	flagSet.Visit(func(flag_ *flag.Flag) {
+		setFlags[flag_.Name] = true
+	})
+
+	var fileValues map[string]string
+	if len(*configFile) > 0 {
+		fileValues, err = readConfigFile(*configFile)
+		if nil != err {
+			return nil, false, err
+		}
+	}
+
+	var errs []error
+	known := make(map[string]bool)
+	for _, configField_ := range fields {
+		known[configField_.name] = true
+
+		value, exists := configField_.field.Tag.Lookup(CONFIG_DEFAULT_TAG)
+		if fileValue, fileExists := fileValues[configField_.name]; fileExists {
+			value, exists = fileValue, true
+		}
+		if envValue, envExists := os.LookupEnv(configField_.name); envExists {
+			value, exists = envValue, true
+		}
+		if setFlags[getFlagName(configField_)] {
+			value, exists = *flagValues[configField_.name], true
+		}
+
+		if !exists || len(value) == 0 {
+			if configField_.field.Tag.Get("required") == "true" {
+				errs = append(errs, fmt.Errorf("%s is required", configField_.name))
+			}
+			continue
+		}
+
+		err = setConfigValue(configField_, value)
+		if nil != err {
+			errs = append(errs, fmt.Errorf("%s: %s", configField_.name, err))
+		}
+	}
+
+	for name := range fileValues {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("unknown setting %s in %s", name, *configFile))
+		}
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, validateConfig(reflect.ValueOf(config))...)
+	}
+
+	return flagSet.Args(), *printConfig, errors.Join(errs...)
+}
+
+// PrintConfig writes each setting as NAME=value, the same form the environment takes
+func PrintConfig(writer io.Writer, config interface{}) {
+	fields, err := getConfigFields(config)
+	if nil != err {
+		fmt.Fprintln(writer, err)
+		return
+	}
+
+	for _, configField_ := range fields {
+		value := formatConfigValue(configField_.value)
+		if configField_.field.Tag.Get("secret") == "true" {
+			value = maskConfigValue(value)
+		}
+
+		fmt.Fprintf(writer, "%s=%s\n", configField_.name, value)
+	}
+}
+
+func getConfigFields(config interface{}) ([]configField, error) {
+	value := reflect.ValueOf(config)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("configuration must be a pointer to a struct, not %T", config)
+	}
+
+	var fields []configField
+	var walk func(reflect.Value)
+	walk = func(structValue reflect.Value) {
+		for index := 0; index < structValue.NumField(); index++ {
+			field := structValue.Type().Field(index)
+			if !field.IsExported() {
+				continue
+			}
+
+			name := field.Tag.Get(CONFIG_TAG)
+			if len(name) == 0 && field.Type.Kind() == reflect.Struct {
+				walk(structValue.Field(index))
+			} else if len(name) > 0 {
+				fields = append(fields, configField{name, field, structValue.Field(index)})
+			}
+		}
+	}
+	walk(value.Elem())
+
+	return fields, nil
+}
+
+func getFlagName(configField_ configField) string {
+	if flagName := configField_.field.Tag.Get("flag"); len(flagName) > 0 {
+		return flagName
+	}
+
+	return strings.Replace(strings.ToLower(configField_.name), "_", "-", -1)
+}
+
+func getUsage(configField_ configField) string {
+	usage := configField_.field.Tag.Get("usage")
+	if len(usage) == 0 {
+		usage = configField_.name
+	}
+
+	if defaultValue, exists := configField_.field.Tag.Lookup(CONFIG_DEFAULT_TAG); exists && len(defaultValue) > 0 {
+		usage += fmt.Sprintf(" (default %s)", defaultValue)
+	}
+
+	return usage
+}
+
+func parseConfigValue(field reflect.StructField, fieldType reflect.Type, value string) (reflect.Value, error) {
+	result := reflect.New(fieldType).Elem()
+
+	if reflect.PointerTo(fieldType).Implements(textUnmarshalerType) {
+		err := result.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(value))
+		return result, err
+	}
+
+	switch {
+	case fieldType == durationType:
+		//Plain numbers keep their documented unit so existing settings still work
+		if number, err := strconv.ParseInt(value, 10, 64); nil == err {
+			unit, err := getDurationUnit(field.Tag.Get("unit"))
+			if nil != err {
+				return result, err
+			}
+			result.SetInt(number * int64(unit))
+			return result, nil
+		}
+
+		duration, err := time.ParseDuration(value)
+		if nil != err {
+			return result, fmt.Errorf("invalid duration %q", value)
+		}
+		result.SetInt(int64(duration))
+	case fieldType.Kind() == reflect.String:
+		result.SetString(value)
+	case fieldType.Kind() == reflect.Bool:
+		boolean, err := strconv.ParseBool(value)
+		if nil != err {
+			return result, fmt.Errorf("invalid boolean %q", value)
+		}
+		result.SetBool(boolean)
+	case fieldType.Kind() >= reflect.Int && fieldType.Kind() <= reflect.Int64:
+		number, err := strconv.ParseInt(value, 10, fieldType.Bits())
+		if nil != err {
+			return result, fmt.Errorf("invalid integer %q", value)
+		}
+		result.SetInt(number)
+	case fieldType.Kind() == reflect.Float32 || fieldType.Kind() == reflect.Float64:
+		number, err := strconv.ParseFloat(value, fieldType.Bits())
+		if nil != err {
+			return result, fmt.Errorf("invalid number %q", value)
+		}
+		result.SetFloat(number)
+	case fieldType.Kind() == reflect.Slice:
+		for _, item := range strings.Split(value, CONFIG_LIST_SEP) {
+			item = strings.TrimSpace(item)
+			if len(item) == 0 {
+				continue
+			}
+
+			itemValue, err := parseConfigValue(field, fieldType.Elem(), item)
+			if nil != err {
+				return result, err
+			}
+			result = reflect.Append(result, itemValue)
+		}
+	default:
+		return result, fmt.Errorf("unsupported type %s", fieldType)
+	}
+
+	return result, nil
+}
+
+func getDurationUnit(unit string) (time.Duration, error) {
+	switch unit {
+	case "ms":
+		return time.Millisecond, nil
+	case "s", "":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	default:
+		return 0, fmt.Errorf("unknown duration unit %q", unit)
+	}
+}
+
+func getConfigNumber(value reflect.Value) (float64, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), true
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), true
+	default:
+		return 0, false
+	}
+}
+
+func setConfigValue(configField_ configField, value string) error {
+	field := configField_.field
+
+	parsed, err := parseConfigValue(field, field.Type, value)
+	if nil != err {
+		return err
+	}
+
+	if oneOf := field.Tag.Get("oneof"); len(oneOf) > 0 {
+		allowed := strings.Split(oneOf, CONFIG_ONEOF_SEP)
+
+		values := []string{value}
+		if field.Type.Kind() == reflect.Slice {
+			values = strings.Split(value, CONFIG_LIST_SEP)
+		}
+
+		for _, item := range values {
+			found := false
+			for _, allowedValue := range allowed {
+				found = found || strings.TrimSpace(item) == allowedValue
+			}
+
+			if !found {
+				return fmt.Errorf("%q is not one of %s", item, strings.Join(allowed, ", "))
+			}
+		}
+	}
+
+	if number, isNumber := getConfigNumber(parsed); isNumber {
+		for _, bound := range []string{"min", "max"} {
+			boundStr := field.Tag.Get(bound)
+			if len(boundStr) == 0 {
+				continue
+			}
+
+			boundValue, err := parseConfigValue(field, field.Type, boundStr)
+			if nil != err {
+				return fmt.Errorf("invalid %s bound %q", bound, boundStr)
+			}
+			limit, _ := getConfigNumber(boundValue)
+
+			if (bound == "min" && number < limit) || (bound == "max" && number > limit) {
+				return fmt.Errorf("%s is out of range, %s is %s", value, bound, boundStr)
+			}
+		}
+	}
+
+	configField_.value.Set(parsed)
+	return nil
+}
+
+// Calls Validate on the config and every nested struct that has it, for checks across fields.
+// Embedded structs aren't visited since their Validate is promoted to the outer struct.
+func validateConfig(value reflect.Value) []error {
+	var errs []error
+
+	if validator, ok := value.Interface().(ConfigValidator); ok {
+		if err := validator.Validate(); nil != err {
+			errs = append(errs, err)
+		}
+	}
+
+	if value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+
+	if value.Kind() == reflect.Struct {
+		for index := 0; index < value.NumField(); index++ {
+			field := value.Type().Field(index)
+			if field.IsExported() && !field.Anonymous && field.Type.Kind() == reflect.Struct && len(field.Tag.Get(CONFIG_TAG)) == 0 {
+				errs = append(errs, validateConfig(value.Field(index).Addr())...)
+			}
+		}
+	}
+
+	return errs
+}
+
+func formatConfigValue(value reflect.Value) string {
+	if textMarshaler, ok := value.Interface().(encoding.TextMarshaler); ok {
+		text, err := textMarshaler.MarshalText()
+		if nil == err {
+			return string(text)
+		}
+	}
+
+	if stringer, ok := value.Interface().(fmt.Stringer); ok {
+		return stringer.String()
+	}
+
+	if value.Kind() == reflect.Slice {
+		var items []string
+		for index := 0; index < value.Len(); index++ {
+			items = append(items, formatConfigValue(value.Index(index)))
+		}
+		return strings.Join(items, CONFIG_LIST_SEP)
+	}
+
+	return fmt.Sprint(value.Interface())
+}
+
+// Urls keep everything but the password, anything else secret is masked entirely
+func maskConfigValue(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+
+	if parsed, err := url.Parse(value); nil == err && nil != parsed.User && len(parsed.Scheme) > 0 {
+		return parsed.Redacted()
+	}
+
+	return MASKED_CONFIG
+}
+
+// Reads a configuration file of KEY=value lines, the form PrintConfig writes and the environment
+// takes.  Keys are setting names, values run to the end of the line with surrounding whitespace
+// and one pair of matching quotes removed, and lists are comma separated.  Blank lines and lines
+// starting with # are skipped.
+func readConfigFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if nil != err {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || len(key) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, lineNumber)
+		} else if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("%s:%d: %s is set more than once", path, lineNumber, key)
+		}
+
+		values[key] = unquoteConfigValue(strings.TrimSpace(value))
+	}
+
+	return values, scanner.Err()
+}
+
+func unquoteConfigValue(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if unquoted, err := strconv.Unquote(value); nil == err {
+				return unquoted
+			}
+		}
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
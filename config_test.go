@@ -0,0 +1,250 @@
+package common
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNestedConfig struct {
+	Level string `config:"TEST_CONFIG_LEVEL" default:"info" oneof:"debug|info|warn"`
+}
+
+type testConfig struct {
+	Name     string        `config:"TEST_CONFIG_NAME" default:"tremont"`
+	Count    int           `config:"TEST_CONFIG_COUNT" default:"10" min:"1" max:"100"`
+	Ratio    float64       `config:"TEST_CONFIG_RATIO" default:"0.5" min:"0" max:"1"`
+	Timeout  time.Duration `config:"TEST_CONFIG_TIMEOUT" default:"250" unit:"ms" min:"1ms"`
+	Enabled  bool          `config:"TEST_CONFIG_ENABLED" default:"true"`
+	Modes    []string      `config:"TEST_CONFIG_MODES" default:"json" oneof:"json|text"`
+	Password string        `config:"TEST_CONFIG_PASSWORD" secret:"true"`
+	Required string        `config:"TEST_CONFIG_REQUIRED" required:"true"`
+	Nested   testNestedConfig
+}
+
+var errTestConfigInvalid = errors.New("count must be more than the ratio")
+
+type testValidatedConfig struct {
+	testConfig
+}
+
+func (config testValidatedConfig) Validate() error {
+	if float64(config.Count) <= config.Ratio {
+		return errTestConfigInvalid
+	}
+	return nil
+}
+
+func writeTestConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "prospects.conf")
+	err := os.WriteFile(path, []byte(contents), 0600)
+	if nil != err {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		args     []string
+		expected string
+		count    int
+	}{
+		{"default", "", nil, nil, "tremont", 10},
+		{"file over default", "TEST_CONFIG_NAME=laconia\nTEST_CONFIG_COUNT=20\n", nil, nil, "laconia", 20},
+		{"env over file", "TEST_CONFIG_NAME=laconia\n", map[string]string{"TEST_CONFIG_NAME": "paulding"}, nil, "paulding", 10},
+		{"empty env over file", "TEST_CONFIG_NAME=laconia\n", map[string]string{"TEST_CONFIG_NAME": ""}, nil, "", 10},
+		{"empty env over default", "", map[string]string{"TEST_CONFIG_NAME": ""}, nil, "", 10},
+		{"flag over env", "TEST_CONFIG_NAME=laconia\n", map[string]string{"TEST_CONFIG_NAME": "paulding"}, []string{"--test-config-name", "ziggy", "--test-config-count=30"}, "ziggy", 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TEST_CONFIG_REQUIRED", "yes")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			args := test.args
+			if len(test.file) > 0 {
+				args = append([]string{"--config", writeTestConfigFile(t, test.file)}, args...)
+			}
+
+			var config testConfig
+			_, _, err := LoadConfig("test", &config, args)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if config.Name != test.expected {
+				t.Errorf("Name = %q, want %q", config.Name, test.expected)
+			}
+			if config.Count != test.count {
+				t.Errorf("Count = %d, want %d", config.Count, test.count)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValues(t *testing.T) {
+	t.Setenv("TEST_CONFIG_REQUIRED", "yes")
+	t.Setenv("TEST_CONFIG_TIMEOUT", "2s")
+	t.Setenv("TEST_CONFIG_MODES", "json, text")
+
+	var config testConfig
+	args, _, err := LoadConfig("test", &config, []string{"--test-config-enabled=false", "--test-config-level", "debug", "replay"})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if config.Timeout != 2*time.Second {
+		t.Errorf("Timeout = %s, want 2s", config.Timeout)
+	}
+	if config.Enabled {
+		t.Error("Enabled = true, want false")
+	}
+	if !reflect.DeepEqual(config.Modes, []string{"json", "text"}) {
+		t.Errorf("Modes = %q, want [json text]", config.Modes)
+	}
+	if config.Nested.Level != "debug" {
+		t.Errorf("Nested.Level = %q, want debug", config.Nested.Level)
+	}
+	if !reflect.DeepEqual(args, []string{"replay"}) {
+		t.Errorf("args = %q, want [replay]", args)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		file   string
+		errors []string
+	}{
+		{"valid", nil, "", nil},
+		{"required", map[string]string{"TEST_CONFIG_REQUIRED": ""}, "", []string{"TEST_CONFIG_REQUIRED is required"}},
+		{"invalid integer", map[string]string{"TEST_CONFIG_COUNT": "ten"}, "", []string{`TEST_CONFIG_COUNT: invalid integer "ten"`}},
+		{"below min", map[string]string{"TEST_CONFIG_COUNT": "0"}, "", []string{"TEST_CONFIG_COUNT: 0 is out of range, min is 1"}},
+		{"above max", map[string]string{"TEST_CONFIG_RATIO": "1.5"}, "", []string{"TEST_CONFIG_RATIO: 1.5 is out of range, max is 1"}},
+		{"duration below min", map[string]string{"TEST_CONFIG_TIMEOUT": "0"}, "", []string{"TEST_CONFIG_TIMEOUT: 0 is out of range, min is 1ms"}},
+		{"invalid duration", map[string]string{"TEST_CONFIG_TIMEOUT": "soon"}, "", []string{`TEST_CONFIG_TIMEOUT: invalid duration "soon"`}},
+		{"not oneof", map[string]string{"TEST_CONFIG_LEVEL": "trace"}, "", []string{`TEST_CONFIG_LEVEL: "trace" is not one of debug, info, warn`}},
+		{"list item not oneof", map[string]string{"TEST_CONFIG_MODES": "json,yaml"}, "", []string{`TEST_CONFIG_MODES: "yaml" is not one of json, text`}},
+		{"unknown file setting", nil, "TEST_CONFIG_COLOR=blue\n", []string{"unknown setting TEST_CONFIG_COLOR"}},
+		{"every error", map[string]string{"TEST_CONFIG_COUNT": "ten", "TEST_CONFIG_LEVEL": "trace"}, "", []string{"TEST_CONFIG_COUNT", "TEST_CONFIG_LEVEL"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TEST_CONFIG_REQUIRED", "yes")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			var args []string
+			if len(test.file) > 0 {
+				args = []string{"--config", writeTestConfigFile(t, test.file)}
+			}
+
+			var config testConfig
+			_, _, err := LoadConfig("test", &config, args)
+			if len(test.errors) == 0 {
+				if nil != err {
+					t.Errorf("LoadConfig error = %v, want nil", err)
+				}
+				return
+			} else if nil == err {
+				t.Fatalf("LoadConfig error = nil, want %q", test.errors)
+			}
+
+			for _, expected := range test.errors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("LoadConfig error = %q, want it to contain %q", err, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidator(t *testing.T) {
+	t.Setenv("TEST_CONFIG_REQUIRED", "yes")
+	t.Setenv("TEST_CONFIG_COUNT", "1")
+	t.Setenv("TEST_CONFIG_RATIO", "1")
+
+	var config testValidatedConfig
+	_, _, err := LoadConfig("test", &config, nil)
+	if !errors.Is(err, errTestConfigInvalid) {
+		t.Errorf("LoadConfig error = %v, want %v", err, errTestConfigInvalid)
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected map[string]string
+		err      string
+	}{
+		{"values", "# Comment\n\nTEST_CONFIG_NAME=laconia\n  TEST_CONFIG_COUNT = 20  \n", map[string]string{"TEST_CONFIG_NAME": "laconia", "TEST_CONFIG_COUNT": "20"}, ""},
+		{"quoted", "TEST_CONFIG_NAME=\"riding # with ziggy\"\nTEST_CONFIG_PASSWORD='p=ss'\n", map[string]string{"TEST_CONFIG_NAME": "riding # with ziggy", "TEST_CONFIG_PASSWORD": "p=ss"}, ""},
+		{"unquoted hash and equals", "TEST_CONFIG_PASSWORD=p#ss=word\n", map[string]string{"TEST_CONFIG_PASSWORD": "p#ss=word"}, ""},
+		{"empty value", "TEST_CONFIG_NAME=\n", map[string]string{"TEST_CONFIG_NAME": ""}, ""},
+		{"list", "TEST_CONFIG_MODES=json,text\n", map[string]string{"TEST_CONFIG_MODES": "json,text"}, ""},
+		{"missing equals", "TEST_CONFIG_NAME laconia\n", nil, "prospects.conf:1: expected KEY=value"},
+		{"missing key", "# Comment\n=laconia\n", nil, "prospects.conf:2: expected KEY=value"},
+		{"duplicate key", "TEST_CONFIG_NAME=laconia\nTEST_CONFIG_NAME=paulding\n", nil, "prospects.conf:2: TEST_CONFIG_NAME is set more than once"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := readConfigFile(writeTestConfigFile(t, test.contents))
+			if len(test.err) > 0 {
+				if nil == err || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("readConfigFile error = %v, want %q", err, test.err)
+				}
+				return
+			} else if nil != err {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(values, test.expected) {
+				t.Errorf("readConfigFile() = %q, want %q", values, test.expected)
+			}
+		})
+	}
+}
+
+func TestPrintConfigMasksSecrets(t *testing.T) {
+	t.Setenv("TEST_CONFIG_REQUIRED", "yes")
+	t.Setenv("TEST_CONFIG_PASSWORD", "hunter2")
+
+	var config testConfig
+	_, _, err := LoadConfig("test", &config, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var printed strings.Builder
+	PrintConfig(&printed, &config)
+
+	if !strings.Contains(printed.String(), "TEST_CONFIG_PASSWORD="+MASKED_CONFIG+"\n") || strings.Contains(printed.String(), "hunter2") {
+		t.Errorf("PrintConfig() = %q, want the password masked", printed.String())
+	}
+
+	//What PrintConfig writes reads back as a configuration file
+	values, err := readConfigFile(writeTestConfigFile(t, printed.String()))
+	if nil != err {
+		t.Fatal(err)
+	} else if values["TEST_CONFIG_MODES"] != "json" || values["TEST_CONFIG_TIMEOUT"] != "250ms" {
+		t.Errorf("readConfigFile(PrintConfig()) = %q", values)
+	}
+}
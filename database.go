@@ -2,8 +2,20 @@ package common
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/lib/pq"
 	"log"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	LISTENER_MIN_BACKOFF = 10 * time.Second
+	LISTENER_MAX_BACKOFF = time.Minute
+	LISTENER_PING_PERIOD = 90 * time.Second
 )
 
 type DatabaseCredentials struct {
@@ -18,6 +30,32 @@ type DatabaseCredentials struct {
 	MaxIdleConns int
 }
 
+// DatabaseConfig is the database configuration shared by every command
+type DatabaseConfig struct {
+	Url          string `config:"DATABASE_URL" secret:"true" usage:"Database url, takes precedence over the DB_ settings"`
+	User         string `config:"DB_USER"`
+	Password     string `config:"DB_PASSWORD" secret:"true"`
+	Name         string `config:"DB_NAME"`
+	Host         string `config:"DB_HOST" default:"localhost"`
+	Port         int    `config:"DB_PORT" default:"5432" min:"1" max:"65535"`
+	MaxOpenConns int    `config:"DB_MAX_OPEN_CONNS" default:"10" min:"1"`
+	MaxIdleConns int    `config:"DB_MAX_IDLE_CONNS" default:"0" min:"0"`
+}
+
+func (dbConfig DatabaseConfig) GetCredentials() DatabaseCredentials {
+	return DatabaseCredentials{DB_DRIVER, dbConfig.Url, dbConfig.User, dbConfig.Password, dbConfig.Name, dbConfig.Host, strconv.Itoa(dbConfig.Port), dbConfig.MaxOpenConns, dbConfig.MaxIdleConns}
+}
+
+func (dbConfig DatabaseConfig) Validate() error {
+	if !dbConfig.GetCredentials().IsValid() {
+		return errors.New("DATABASE_URL or DB_USER, DB_PASSWORD and DB_NAME must be set")
+	} else if dbConfig.MaxIdleConns > dbConfig.MaxOpenConns {
+		return fmt.Errorf("DB_MAX_IDLE_CONNS %d exceeds DB_MAX_OPEN_CONNS %d", dbConfig.MaxIdleConns, dbConfig.MaxOpenConns)
+	}
+
+	return nil
+}
+
 func (dbCred DatabaseCredentials) IsValid() bool {
 	result := false
 
@@ -49,6 +87,24 @@ func (dbCred DatabaseCredentials) GetString(useUrlArr ...bool) string {
 	return dbInfo
 }
 
+// String is safe to log, the password is masked in both the url and the connection string
+func (dbCred DatabaseCredentials) String() string {
+	if len(dbCred.Url) > 0 {
+		dbUrl, err := url.Parse(dbCred.Url)
+		if nil != err {
+			return REDACTED
+		}
+		return dbUrl.Redacted()
+	}
+
+	redacted := dbCred
+	if len(redacted.Password) > 0 {
+		redacted.Password = "xxxxx"
+	}
+
+	return redacted.GetString(false)
+}
+
 func (dbCred DatabaseCredentials) GetDriver() string {
 	return dbCred.Driver
 }
@@ -57,7 +113,7 @@ func (dbCred DatabaseCredentials) GetDatabase() *sql.DB {
 	db, err := sql.Open(dbCred.GetDriver(), dbCred.GetString())
 
 	if nil != err {
-		log.Printf("Error opening configured database: %s", dbCred.GetString())
+		log.Printf("Error opening configured database: %s", dbCred)
 		log.Print(err)
 	} else {
 		db.SetMaxOpenConns(dbCred.MaxOpenConns)
@@ -65,10 +121,45 @@ func (dbCred DatabaseCredentials) GetDatabase() *sql.DB {
 
 		err = db.Ping()
 		if nil != err {
-			log.Printf("Error connecting to database: %s", dbCred.GetString())
+			log.Printf("Error connecting to database: %s", dbCred)
 			log.Print(err)
 		}
 	}
 
 	return db
 }
+
+// Calls handle with every notification sent to channel, and with nil after the listener reconnects
+// since notifications may have been missed in between
+func listenForNotifications(dbCredentials DatabaseCredentials, channel string, handle func(*pq.Notification)) (*pq.Listener, error) {
+	eventCallback := func(event pq.ListenerEventType, err error) {
+		if nil != err {
+			slog.Error("Error with listener", "channel", channel, "error", err)
+		}
+	}
+
+	listener := pq.NewListener(dbCredentials.GetString(), LISTENER_MIN_BACKOFF, LISTENER_MAX_BACKOFF, eventCallback)
+
+	err := listener.Listen(channel)
+	if nil != err {
+		listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			select {
+			case notification, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+
+				handle(notification)
+			case <-time.After(LISTENER_PING_PERIOD):
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return listener, nil
+}
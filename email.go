@@ -0,0 +1,224 @@
+package common
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	ACE_PREFIX            = "xn--"
+	MAX_DOMAIN_SIZE       = 253
+	MAX_LABEL_SIZE        = 63
+	MAX_LOCAL_PART_SIZE   = 64
+	PUNYCODE_BASE         = 36
+	PUNYCODE_TMIN         = 1
+	PUNYCODE_TMAX         = 26
+	PUNYCODE_SKEW         = 38
+	PUNYCODE_DAMP         = 700
+	PUNYCODE_INITIAL_N    = 128
+	PUNYCODE_INITIAL_BIAS = 72
+)
+
+var (
+	ErrMissingAt      = errors.New("E-mail address has no @")
+	ErrEmptyLocalPart = errors.New("E-mail address has nothing before the @")
+	ErrLocalPartSize  = errors.New("E-mail address has too much before the @")
+	ErrInvalidDomain  = errors.New("E-mail address has an invalid domain")
+)
+
+// emailProvider describes how a mail provider delivers variations of an address to one mailbox
+type emailProvider struct {
+	//Domain the provider's aliases are stored as
+	Domain string
+	//Dots in the local part are ignored
+	IgnoreDots bool
+	//Anything after the separator in the local part is a tag the mailbox ignores
+	TagSeparator string
+}
+
+var emailProviders = map[string]emailProvider{
+	"gmail.com":      {"gmail.com", true, "+"},
+	"googlemail.com": {"gmail.com", true, "+"},
+	"outlook.com":    {"outlook.com", false, "+"},
+	"hotmail.com":    {"hotmail.com", false, "+"},
+	"live.com":       {"live.com", false, "+"},
+	"msn.com":        {"msn.com", false, "+"},
+	"icloud.com":     {"icloud.com", false, "+"},
+	"me.com":         {"me.com", false, "+"},
+	"mac.com":        {"mac.com", false, "+"},
+	"fastmail.com":   {"fastmail.com", false, "+"},
+	"protonmail.com": {"protonmail.com", false, "+"},
+	"proton.me":      {"proton.me", false, "+"},
+	"pm.me":          {"pm.me", false, "+"},
+}
+
+// GetCanonicalEmail returns the form an e-mail address is compared in, so addresses delivered to the
+// same mailbox are equal.  The address is lower cased, its domain converted to punycode, and the
+// dots and tags a known provider ignores are removed, so Foo.Bar+promo@GMail.com is foobar@gmail.com.
+func GetCanonicalEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return "", ErrMissingAt
+	}
+
+	domain, err := GetCanonicalDomain(email[at+1:])
+	if nil != err {
+		return "", err
+	}
+
+	//Mail servers nearly all ignore case in the local part, although they're allowed not to
+	localPart := strings.ToLower(email[:at])
+	if provider, exists := emailProviders[domain]; exists {
+		domain = provider.Domain
+
+		if len(provider.TagSeparator) > 0 {
+			if tag := strings.Index(localPart, provider.TagSeparator); tag >= 0 {
+				localPart = localPart[:tag]
+			}
+		}
+
+		if provider.IgnoreDots {
+			localPart = strings.Replace(localPart, ".", "", -1)
+		}
+	}
+
+	if len(localPart) == 0 {
+		return "", ErrEmptyLocalPart
+	} else if len(localPart) > MAX_LOCAL_PART_SIZE {
+		return "", ErrLocalPartSize
+	}
+
+	return localPart + "@" + domain, nil
+}
+
+// GetCanonicalDomain lower cases a domain and converts internationalized labels to punycode, so
+// bücher.de is xn--bcher-kva.de.  Only the ideographic full stops are mapped, not the rest of UTS 46.
+func GetCanonicalDomain(domain string) (string, error) {
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+
+	if len(domain) == 0 {
+		return "", ErrInvalidDomain
+	}
+
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if len(label) == 0 {
+			return "", ErrInvalidDomain
+		}
+
+		if !isAscii(label) {
+			label = ACE_PREFIX + encodePunycode(label)
+		}
+
+		if len(label) > MAX_LABEL_SIZE {
+			return "", ErrInvalidDomain
+		}
+
+		labels[i] = label
+	}
+
+	domain = strings.Join(labels, ".")
+	if len(domain) > MAX_DOMAIN_SIZE {
+		return "", ErrInvalidDomain
+	}
+
+	return domain, nil
+}
+
+func isAscii(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if value[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Punycode encoding of a single label, without the xn-- prefix, as described in RFC 3492
+func encodePunycode(label string) string {
+	runes := []rune(label)
+
+	var output []byte
+	for _, char := range runes {
+		if char < 0x80 {
+			output = append(output, byte(char))
+		}
+	}
+
+	basicCount := len(output)
+	if basicCount > 0 {
+		output = append(output, '-')
+	}
+
+	n := PUNYCODE_INITIAL_N
+	delta := 0
+	bias := PUNYCODE_INITIAL_BIAS
+	for handled := basicCount; handled < len(runes); {
+		//Next smallest code point not yet handled
+		next := -1
+		for _, char := range runes {
+			if int(char) >= n && (next < 0 || int(char) < next) {
+				next = int(char)
+			}
+		}
+
+		delta += (next - n) * (handled + 1)
+		n = next
+
+		for _, char := range runes {
+			if int(char) < n {
+				delta++
+			} else if int(char) == n {
+				q := delta
+				for k := PUNYCODE_BASE; ; k += PUNYCODE_BASE {
+					t := min(max(k-bias, PUNYCODE_TMIN), PUNYCODE_TMAX)
+					if q < t {
+						break
+					}
+					output = append(output, getPunycodeDigit(t+(q-t)%(PUNYCODE_BASE-t)))
+					q = (q - t) / (PUNYCODE_BASE - t)
+				}
+
+				output = append(output, getPunycodeDigit(q))
+				bias = adaptPunycodeBias(delta, handled+1, handled == basicCount)
+				delta = 0
+				handled++
+			}
+		}
+
+		delta++
+		n++
+	}
+
+	return string(output)
+}
+
+func getPunycodeDigit(digit int) byte {
+	if digit < 26 {
+		return byte('a' + digit)
+	}
+
+	return byte('0' + digit - 26)
+}
+
+func adaptPunycodeBias(delta int, pointCount int, isFirst bool) int {
+	if isFirst {
+		delta /= PUNYCODE_DAMP
+	} else {
+		delta /= 2
+	}
+
+	delta += delta / pointCount
+
+	k := 0
+	for delta > ((PUNYCODE_BASE-PUNYCODE_TMIN)*PUNYCODE_TMAX)/2 {
+		delta /= PUNYCODE_BASE - PUNYCODE_TMIN
+		k += PUNYCODE_BASE
+	}
+
+	return k + (PUNYCODE_BASE-PUNYCODE_TMIN+1)*delta/(delta+PUNYCODE_SKEW)
+}
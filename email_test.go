@@ -0,0 +1,106 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodePunycode(t *testing.T) {
+	tests := []struct {
+		label    string
+		punycode string
+	}{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"españa", "espaa-rta"},
+		{"ñandú", "and-6ma2c"},
+		{"ü", "tda"},
+		{"テスト", "zckzah"},
+		{"中国", "fiqs8s"},
+		{"пример", "e1afmkfd"},
+	}
+
+	for _, test := range tests {
+		if punycode := encodePunycode(test.label); punycode != test.punycode {
+			t.Errorf("encodePunycode(%q) = %q, want %q", test.label, punycode, test.punycode)
+		}
+	}
+}
+
+func TestGetCanonicalDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		domain string
+		want   string
+		err    error
+	}{
+		{"ascii", "example.com", "example.com", nil},
+		{"upper case", "Example.COM", "example.com", nil},
+		{"trailing dot", "example.com.", "example.com", nil},
+		{"internationalized label", "bücher.de", "xn--bcher-kva.de", nil},
+		{"upper case internationalized label", "BÜCHER.de", "xn--bcher-kva.de", nil},
+		{"internationalized top level domain", "例え.テスト", "xn--r8jz45g.xn--zckzah", nil},
+		{"ideographic full stops", "bücher。de", "xn--bcher-kva.de", nil},
+		{"fullwidth full stop", "example．com", "example.com", nil},
+		{"already punycode", "xn--bcher-kva.de", "xn--bcher-kva.de", nil},
+		{"empty", "", "", ErrInvalidDomain},
+		{"only a dot", ".", "", ErrInvalidDomain},
+		{"empty label", "example..com", "", ErrInvalidDomain},
+		{"leading dot", ".example.com", "", ErrInvalidDomain},
+		{"longest label", strings.Repeat("a", MAX_LABEL_SIZE) + ".com", strings.Repeat("a", MAX_LABEL_SIZE) + ".com", nil},
+		{"label too long", strings.Repeat("a", MAX_LABEL_SIZE+1) + ".com", "", ErrInvalidDomain},
+		{"punycode label too long", strings.Repeat("bücher", 10) + ".com", "", ErrInvalidDomain},
+		{"domain too long", strings.Repeat(strings.Repeat("a", 60)+".", 5) + "com", "", ErrInvalidDomain},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domain, err := GetCanonicalDomain(test.domain)
+			if err != test.err || domain != test.want {
+				t.Errorf("GetCanonicalDomain(%q) = %q, %v, want %q, %v", test.domain, domain, err, test.want, test.err)
+			}
+		})
+	}
+}
+
+func TestGetCanonicalEmail(t *testing.T) {
+	tests := []struct {
+		name  string
+		email string
+		want  string
+		err   error
+	}{
+		{"plain", "jane@example.com", "jane@example.com", nil},
+		{"case and whitespace", " Jane.Doe@Example.COM ", "jane.doe@example.com", nil},
+		{"unknown provider keeps dots and tags", "jane.doe+promo@example.com", "jane.doe+promo@example.com", nil},
+		{"internationalized domain", "Jane@Bücher.de", "jane@xn--bcher-kva.de", nil},
+		{"gmail dots and tag", "Foo.Bar+promo@GMail.com", "foobar@gmail.com", nil},
+		{"gmail tag with dots", "foo+a.b@gmail.com", "foo@gmail.com", nil},
+		{"googlemail alias", "foo.bar@googlemail.com", "foobar@gmail.com", nil},
+		{"outlook keeps dots", "foo.bar+news@outlook.com", "foo.bar@outlook.com", nil},
+		{"hotmail tag", "foo+news@hotmail.com", "foo@hotmail.com", nil},
+		{"icloud tag", "foo+news@icloud.com", "foo@icloud.com", nil},
+		{"proton tag", "foo+news@proton.me", "foo@proton.me", nil},
+		{"yahoo keeps dashes and tags", "Foo.Bar-news+promo@Yahoo.com", "foo.bar-news+promo@yahoo.com", nil},
+		{"gmail subdomain isn't gmail", "foo.bar+news@mail.gmail.com", "foo.bar+news@mail.gmail.com", nil},
+		{"last at separates the domain", `"a@b"@example.com`, `"a@b"@example.com`, nil},
+		{"missing at", "jane.example.com", "", ErrMissingAt},
+		{"empty local part", "@example.com", "", ErrEmptyLocalPart},
+		{"only a tag", "+promo@gmail.com", "", ErrEmptyLocalPart},
+		{"only dots", "...@gmail.com", "", ErrEmptyLocalPart},
+		{"longest local part", strings.Repeat("a", MAX_LOCAL_PART_SIZE) + "@example.com", strings.Repeat("a", MAX_LOCAL_PART_SIZE) + "@example.com", nil},
+		{"local part too long", strings.Repeat("a", MAX_LOCAL_PART_SIZE+1) + "@example.com", "", ErrLocalPartSize},
+		{"local part shortened by its tag", strings.Repeat("a", MAX_LOCAL_PART_SIZE) + "+promo@gmail.com", strings.Repeat("a", MAX_LOCAL_PART_SIZE) + "@gmail.com", nil},
+		{"invalid domain", "jane@example..com", "", ErrInvalidDomain},
+		{"empty domain", "jane@", "", ErrInvalidDomain},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			email, err := GetCanonicalEmail(test.email)
+			if err != test.err || email != test.want {
+				t.Errorf("GetCanonicalEmail(%q) = %q, %v, want %q, %v", test.email, email, err, test.want, test.err)
+			}
+		})
+	}
+}
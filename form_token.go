@@ -0,0 +1,252 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FORM_TOKEN_DETECTOR     = "form_token"
+	NONCE_SIZE              = 16
+	USE_FORM_TOKEN_QUERY    = "INSERT INTO prospects.used_form_tokens(nonce, expires_at) VALUES($1, $2) ON CONFLICT (nonce) DO NOTHING"
+	PRUNE_FORM_TOKENS_QUERY = "DELETE FROM prospects.used_form_tokens WHERE expires_at < $1"
+)
+
+var (
+	ErrMissingFormToken  = errors.New("Form token missing")
+	ErrInvalidFormToken  = errors.New("Form token invalid")
+	ErrFormTokenMismatch = errors.New("Form token issued for another application or ip address")
+	ErrFormTokenTooNew   = errors.New("Form token submitted too soon after it was issued")
+	ErrFormTokenExpired  = errors.New("Form token expired")
+	ErrFormTokenUsed     = errors.New("Form token already used")
+)
+
+// NonceStore remembers used nonces until they expire.  Use is false when the nonce was already used.
+type NonceStore interface {
+	Use(nonce string, expiresAt time.Time) (bool, error)
+	Prune() error
+}
+
+// MemoryNonceStore keeps nonces in memory, so a token could be used once on every server
+type MemoryNonceStore struct {
+	nonces map[string]time.Time
+	mutex  sync.Mutex
+}
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	memoryNonceStore := new(MemoryNonceStore)
+	memoryNonceStore.nonces = make(map[string]time.Time)
+	return memoryNonceStore
+}
+
+func (memoryNonceStore *MemoryNonceStore) Use(nonce string, expiresAt time.Time) (bool, error) {
+	memoryNonceStore.mutex.Lock()
+	defer memoryNonceStore.mutex.Unlock()
+
+	if _, exists := memoryNonceStore.nonces[nonce]; exists {
+		return false, nil
+	}
+
+	memoryNonceStore.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+func (memoryNonceStore *MemoryNonceStore) Prune() error {
+	now := time.Now()
+
+	memoryNonceStore.mutex.Lock()
+	defer memoryNonceStore.mutex.Unlock()
+
+	for nonce, expiresAt := range memoryNonceStore.nonces {
+		if now.After(expiresAt) {
+			delete(memoryNonceStore.nonces, nonce)
+		}
+	}
+
+	return nil
+}
+
+// PostgresNonceStore keeps nonces in prospects.used_form_tokens so every server shares them
+type PostgresNonceStore struct {
+	Db *sql.DB
+}
+
+func NewPostgresNonceStore(db *sql.DB) *PostgresNonceStore {
+	postgresNonceStore := new(PostgresNonceStore)
+	postgresNonceStore.Db = db
+	return postgresNonceStore
+}
+
+func (postgresNonceStore *PostgresNonceStore) Use(nonce string, expiresAt time.Time) (bool, error) {
+	result, err := postgresNonceStore.Db.Exec(USE_FORM_TOKEN_QUERY, nonce, expiresAt)
+	if nil != err {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+func (postgresNonceStore *PostgresNonceStore) Prune() error {
+	_, err := postgresNonceStore.Db.Exec(PRUNE_FORM_TOKENS_QUERY, time.Now())
+	return err
+}
+
+// Signed tokens are "<base64 fields separated by |>.<base64 HMAC-SHA256 of the encoded fields>"
+func encodeSignedToken(secret []byte, fields ...string) string {
+	encodedPayload := base64.RawURLEncoding.EncodeToString([]byte(strings.Join(fields, "|")))
+	return encodedPayload + "." + signPayload(secret, encodedPayload)
+}
+
+// Returns the fields of a token with a valid signature and the expected number of fields
+func decodeSignedToken(secret []byte, token string, fieldCount int) ([]string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signPayload(secret, parts[0]))) {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if nil != err {
+		return nil, false
+	}
+
+	fields := strings.Split(string(payload), "|")
+	return fields, len(fields) == fieldCount
+}
+
+func signPayload(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Random hex nonce making each signed token unique
+func getNonce() (string, error) {
+	nonce := make([]byte, NONCE_SIZE)
+	_, err := rand.Read(nonce)
+	if nil != err {
+		return "", err
+	}
+
+	return hex.EncodeToString(nonce), nil
+}
+
+func getUnixMillis(timeVal time.Time) string {
+	return strconv.FormatInt(timeVal.UnixNano()/int64(time.Millisecond), 10)
+}
+
+func parseUnixMillis(millisStr string) (time.Time, error) {
+	millis, err := strconv.ParseInt(millisStr, 10, 64)
+	if nil != err {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, millis*int64(time.Millisecond)), nil
+}
+
+// FormTokens issues and verifies signed single use tokens for a form.  A token's fields are the
+// application name, issue time in milliseconds, ip address and a random nonce.
+type FormTokens struct {
+	Secret     []byte
+	MinAge     time.Duration
+	MaxAge     time.Duration
+	NonceStore NonceStore
+}
+
+func NewFormTokens(secret string, minAge time.Duration, maxAge time.Duration, nonceStore NonceStore) *FormTokens {
+	formTokens := new(FormTokens)
+
+	formTokens.Secret = []byte(secret)
+	formTokens.MinAge = minAge
+	formTokens.MaxAge = maxAge
+	formTokens.NonceStore = nonceStore
+
+	return formTokens
+}
+
+// Issue returns a token for the application name and ip address along with when it expires
+func (formTokens *FormTokens) Issue(appName string, ipAddress string) (string, time.Time, error) {
+	nonce, err := getNonce()
+	if nil != err {
+		return "", time.Time{}, err
+	}
+
+	issuedAt := time.Now()
+	return encodeSignedToken(formTokens.Secret, appName, getUnixMillis(issuedAt), ipAddress, nonce), issuedAt.Add(formTokens.MaxAge), nil
+}
+
+// Verify checks the signature, that the token was issued for the application name and ip address,
+// its age and, last so only otherwise valid tokens are used up, that it wasn't used before
+func (formTokens *FormTokens) Verify(token string, appName string, ipAddress string) error {
+	if len(token) == 0 {
+		return ErrMissingFormToken
+	}
+
+	fields, valid := decodeSignedToken(formTokens.Secret, token, 4)
+	if !valid {
+		return ErrInvalidFormToken
+	}
+
+	issuedAt, err := parseUnixMillis(fields[1])
+	if nil != err {
+		return ErrInvalidFormToken
+	}
+
+	if fields[0] != appName || fields[2] != ipAddress {
+		return ErrFormTokenMismatch
+	}
+
+	age := time.Since(issuedAt)
+	if age < formTokens.MinAge {
+		return ErrFormTokenTooNew
+	} else if age > formTokens.MaxAge {
+		return ErrFormTokenExpired
+	}
+
+	unused, err := formTokens.NonceStore.Use(fields[3], issuedAt.Add(formTokens.MaxAge))
+	if nil != err {
+		return err
+	} else if !unused {
+		return ErrFormTokenUsed
+	}
+
+	return nil
+}
+
+// FormTokenDetector scores submissions without a valid, unused form token.  Errors from the nonce
+// store don't count against the submission.
+type FormTokenDetector struct {
+	FormTokens *FormTokens
+	FieldName  string
+	Score      float64
+}
+
+func (formTokenDetector FormTokenDetector) Name() string {
+	return FORM_TOKEN_DETECTOR
+}
+
+func (formTokenDetector FormTokenDetector) Detect(signals BotSignals) (float64, string) {
+	if signals.Trusted {
+		return 0, ""
+	}
+
+	err := formTokenDetector.FormTokens.Verify(signals.Request.FormValue(formTokenDetector.FieldName), signals.AppName, signals.IpAddress)
+	switch err {
+	case nil:
+		return 0, ""
+	case ErrMissingFormToken, ErrInvalidFormToken, ErrFormTokenMismatch, ErrFormTokenTooNew, ErrFormTokenExpired, ErrFormTokenUsed:
+		return formTokenDetector.Score, err.Error()
+	default:
+		Logger(signals.Request.Context()).Error("Error checking form token", "app_name", signals.AppName, "error", err)
+		return 0, ""
+	}
+}
@@ -0,0 +1,166 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_SECRET     = "test secret"
+	TEST_APP_NAME   = "tremont"
+	TEST_IP_ADDRESS = "192.0.2.10"
+)
+
+func getTestFormToken(secret string, appName string, issuedAt time.Time, ipAddress string, nonce string) string {
+	return encodeSignedToken([]byte(secret), appName, getUnixMillis(issuedAt), ipAddress, nonce)
+}
+
+func TestSignedTokenRoundTrip(t *testing.T) {
+	secret := []byte(TEST_SECRET)
+	token := encodeSignedToken(secret, "a", "b|c", "d")
+
+	tests := []struct {
+		name       string
+		secret     []byte
+		token      string
+		fieldCount int
+		valid      bool
+	}{
+		{"valid", secret, token, 4, true},
+		{"wrong field count", secret, token, 3, false},
+		{"wrong secret", []byte("other secret"), token, 4, false},
+		{"tampered payload", secret, "x" + token, 4, false},
+		{"tampered signature", secret, token + "x", 4, false},
+		{"missing signature", secret, strings.Split(token, ".")[0], 4, false},
+		{"extra part", secret, token + ".x", 4, false},
+		{"empty", secret, "", 4, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields, valid := decodeSignedToken(test.secret, test.token, test.fieldCount)
+			if valid != test.valid {
+				t.Fatalf("decodeSignedToken valid = %t, want %t", valid, test.valid)
+			}
+
+			//The separator inside a field splits it, which the field count catches
+			if valid && strings.Join(fields, "|") != "a|b|c|d" {
+				t.Errorf("decodeSignedToken fields = %q, want [a b c d]", fields)
+			}
+		})
+	}
+}
+
+func TestFormTokenIssueVerify(t *testing.T) {
+	formTokens := NewFormTokens(TEST_SECRET, 0, time.Hour, NewMemoryNonceStore())
+
+	token, expiresAt, err := formTokens.Issue(TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if until := time.Until(expiresAt); until <= 59*time.Minute || until > time.Hour {
+		t.Errorf("Issue expires in %s, want an hour", until)
+	}
+
+	err = formTokens.Verify(token, TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Fatalf("Verify = %v, want nil", err)
+	}
+
+	err = formTokens.Verify(token, TEST_APP_NAME, TEST_IP_ADDRESS)
+	if ErrFormTokenUsed != err {
+		t.Errorf("Verify of a used token = %v, want %v", err, ErrFormTokenUsed)
+	}
+}
+
+func TestFormTokenVerify(t *testing.T) {
+	now := time.Now()
+	valid := getTestFormToken(TEST_SECRET, TEST_APP_NAME, now.Add(-time.Minute), TEST_IP_ADDRESS, "nonce")
+
+	tests := []struct {
+		name      string
+		token     string
+		appName   string
+		ipAddress string
+		err       error
+	}{
+		{"valid", valid, TEST_APP_NAME, TEST_IP_ADDRESS, nil},
+		{"missing", "", TEST_APP_NAME, TEST_IP_ADDRESS, ErrMissingFormToken},
+		{"garbage", "not a token", TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidFormToken},
+		{"wrong secret", getTestFormToken("other secret", TEST_APP_NAME, now.Add(-time.Minute), TEST_IP_ADDRESS, "nonce"), TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidFormToken},
+		{"bad issue time", encodeSignedToken([]byte(TEST_SECRET), TEST_APP_NAME, "yesterday", TEST_IP_ADDRESS, "nonce"), TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidFormToken},
+		{"too few fields", encodeSignedToken([]byte(TEST_SECRET), TEST_APP_NAME, getUnixMillis(now), TEST_IP_ADDRESS), TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidFormToken},
+		{"other application", valid, "other", TEST_IP_ADDRESS, ErrFormTokenMismatch},
+		{"other ip address", valid, TEST_APP_NAME, "192.0.2.11", ErrFormTokenMismatch},
+		{"too new", getTestFormToken(TEST_SECRET, TEST_APP_NAME, now, TEST_IP_ADDRESS, "nonce"), TEST_APP_NAME, TEST_IP_ADDRESS, ErrFormTokenTooNew},
+		{"expired", getTestFormToken(TEST_SECRET, TEST_APP_NAME, now.Add(-2*time.Hour), TEST_IP_ADDRESS, "nonce"), TEST_APP_NAME, TEST_IP_ADDRESS, ErrFormTokenExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formTokens := NewFormTokens(TEST_SECRET, 2*time.Second, time.Hour, NewMemoryNonceStore())
+
+			err := formTokens.Verify(test.token, test.appName, test.ipAddress)
+			if test.err != err {
+				t.Errorf("Verify = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// Tokens refused for any other reason aren't used up
+func TestFormTokenVerifyUsesOnlyValidTokens(t *testing.T) {
+	formTokens := NewFormTokens(TEST_SECRET, 0, time.Hour, NewMemoryNonceStore())
+	token := getTestFormToken(TEST_SECRET, TEST_APP_NAME, time.Now(), TEST_IP_ADDRESS, "nonce")
+
+	err := formTokens.Verify(token, "other", TEST_IP_ADDRESS)
+	if ErrFormTokenMismatch != err {
+		t.Fatalf("Verify = %v, want %v", err, ErrFormTokenMismatch)
+	}
+
+	err = formTokens.Verify(token, TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Errorf("Verify after a mismatch = %v, want nil", err)
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	memoryNonceStore := NewMemoryNonceStore()
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		nonce     string
+		expiresAt time.Time
+		unused    bool
+	}{
+		{"first use", "a", now.Add(-time.Minute), true},
+		{"reused", "a", now.Add(time.Minute), false},
+		{"other nonce", "b", now.Add(time.Minute), true},
+	}
+
+	for _, test := range tests {
+		unused, err := memoryNonceStore.Use(test.nonce, test.expiresAt)
+		if nil != err {
+			t.Fatal(err)
+		} else if unused != test.unused {
+			t.Errorf("%s: Use(%q) = %t, want %t", test.name, test.nonce, unused, test.unused)
+		}
+	}
+
+	//Pruning forgets only expired nonces
+	err := memoryNonceStore.Prune()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if unused, _ := memoryNonceStore.Use("a", now.Add(time.Minute)); !unused {
+		t.Error("Use of a pruned nonce = false, want true")
+	}
+
+	if unused, _ := memoryNonceStore.Use("b", now.Add(time.Minute)); unused {
+		t.Error("Use of an unexpired nonce after pruning = true, want false")
+	}
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER     = "Idempotency-Key"
+	IDEMPOTENT_REPLAYED_HEADER = "Idempotent-Replayed"
+	IDEMPOTENCY_PENDING_TTL    = time.Minute
+	RESERVE_IDEMPOTENCY_QUERY  = "INSERT INTO prospects.idempotency_keys(idempotency_key, expires_at, created_at, updated_at) VALUES($1, $2, $3, $4) ON CONFLICT (idempotency_key) DO UPDATE SET response_code = NULL, response_message = NULL, response_id = NULL, expires_at = EXCLUDED.expires_at, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at WHERE idempotency_keys.expires_at < EXCLUDED.created_at"
+	IDEMPOTENCY_QUERY          = "SELECT response_code, response_message, response_id FROM prospects.idempotency_keys WHERE idempotency_key = $1 AND expires_at >= $2"
+	COMPLETE_IDEMPOTENCY_QUERY = "UPDATE prospects.idempotency_keys SET response_code = $1, response_message = $2, response_id = $3, expires_at = $4, updated_at = $5 WHERE idempotency_key = $6"
+	RELEASE_IDEMPOTENCY_QUERY  = "DELETE FROM prospects.idempotency_keys WHERE idempotency_key = $1 AND response_code IS NULL"
+	PRUNE_IDEMPOTENCY_QUERY    = "DELETE FROM prospects.idempotency_keys WHERE expires_at < $1"
+)
+
+// IdempotencyStore remembers the response to each submission sent with an idempotency key.  A key
+// is reserved while its submission is in progress, for at most IDEMPOTENCY_PENDING_TTL so a server
+// stopping midway doesn't block retries, then completed with the response or released on failure.
+type IdempotencyStore interface {
+	// Get returns whether the key exists and its response, nil while the submission is in progress
+	Get(key string) (bool, *Response, error)
+	// Reserve claims the key, otherwise returns its response like Get
+	Reserve(key string) (bool, *Response, error)
+	Complete(key string, response Response, expiresAt time.Time) error
+	Release(key string) error
+	Prune() error
+}
+
+type idempotencyEntry struct {
+	response  *Response
+	expiresAt time.Time
+}
+
+// MemoryIdempotencyStore keeps responses in memory, so a retry reaching another server is added again
+type MemoryIdempotencyStore struct {
+	entries map[string]idempotencyEntry
+	mutex   sync.Mutex
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	memoryIdempotencyStore := new(MemoryIdempotencyStore)
+	memoryIdempotencyStore.entries = make(map[string]idempotencyEntry)
+	return memoryIdempotencyStore
+}
+
+func (memoryIdempotencyStore *MemoryIdempotencyStore) get(key string) (bool, *Response) {
+	entry, exists := memoryIdempotencyStore.entries[key]
+	if !exists || time.Now().After(entry.expiresAt) {
+		return false, nil
+	}
+
+	return true, entry.response
+}
+
+func (memoryIdempotencyStore *MemoryIdempotencyStore) Get(key string) (bool, *Response, error) {
+	memoryIdempotencyStore.mutex.Lock()
+	defer memoryIdempotencyStore.mutex.Unlock()
+
+	exists, response := memoryIdempotencyStore.get(key)
+	return exists, response, nil
+}
+
+func (memoryIdempotencyStore *MemoryIdempotencyStore) Reserve(key string) (bool, *Response, error) {
+	memoryIdempotencyStore.mutex.Lock()
+	defer memoryIdempotencyStore.mutex.Unlock()
+
+	if exists, response := memoryIdempotencyStore.get(key); exists {
+		return false, response, nil
+	}
+
+	memoryIdempotencyStore.entries[key] = idempotencyEntry{nil, time.Now().Add(IDEMPOTENCY_PENDING_TTL)}
+	return true, nil, nil
+}
+
+func (memoryIdempotencyStore *MemoryIdempotencyStore) Complete(key string, response Response, expiresAt time.Time) error {
+	memoryIdempotencyStore.mutex.Lock()
+	defer memoryIdempotencyStore.mutex.Unlock()
+
+	memoryIdempotencyStore.entries[key] = idempotencyEntry{&response, expiresAt}
+	return nil
+}
+
+func (memoryIdempotencyStore *MemoryIdempotencyStore) Release(key string) error {
+	memoryIdempotencyStore.mutex.Lock()
+	defer memoryIdempotencyStore.mutex.Unlock()
+
+	if entry, exists := memoryIdempotencyStore.entries[key]; exists && nil == entry.response {
+		delete(memoryIdempotencyStore.entries, key)
+	}
+
+	return nil
+}
+
+func (memoryIdempotencyStore *MemoryIdempotencyStore) Prune() error {
+	now := time.Now()
+
+	memoryIdempotencyStore.mutex.Lock()
+	defer memoryIdempotencyStore.mutex.Unlock()
+
+	for key, entry := range memoryIdempotencyStore.entries {
+		if now.After(entry.expiresAt) {
+			delete(memoryIdempotencyStore.entries, key)
+		}
+	}
+
+	return nil
+}
+
+// PostgresIdempotencyStore keeps responses in prospects.idempotency_keys so every server shares them
+type PostgresIdempotencyStore struct {
+	Db *sql.DB
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB) *PostgresIdempotencyStore {
+	postgresIdempotencyStore := new(PostgresIdempotencyStore)
+	postgresIdempotencyStore.Db = db
+	return postgresIdempotencyStore
+}
+
+func (postgresIdempotencyStore *PostgresIdempotencyStore) Get(key string) (bool, *Response, error) {
+	var (
+		code    sql.NullInt64
+		message sql.NullString
+		id      sql.NullInt64
+	)
+
+	err := postgresIdempotencyStore.Db.QueryRow(IDEMPOTENCY_QUERY, key, time.Now()).Scan(&code, &message, &id)
+	if sql.ErrNoRows == err {
+		return false, nil, nil
+	} else if nil != err {
+		return false, nil, err
+	}
+
+	if !code.Valid {
+		return true, nil, nil
+	}
+
+	return true, &Response{Code: int(code.Int64), Message: message.String, Id: id.Int64}, nil
+}
+
+// Expired keys are taken over in place, so they don't need pruning first
+func (postgresIdempotencyStore *PostgresIdempotencyStore) Reserve(key string) (bool, *Response, error) {
+	now := time.Now()
+
+	result, err := postgresIdempotencyStore.Db.Exec(RESERVE_IDEMPOTENCY_QUERY, key, now.Add(IDEMPOTENCY_PENDING_TTL), now, now)
+	if nil != err {
+		return false, nil, err
+	}
+
+	count, err := result.RowsAffected()
+	if nil != err {
+		return false, nil, err
+	} else if count > 0 {
+		return true, nil, nil
+	}
+
+	_, response, err := postgresIdempotencyStore.Get(key)
+	return false, response, err
+}
+
+func (postgresIdempotencyStore *PostgresIdempotencyStore) Complete(key string, response Response, expiresAt time.Time) error {
+	var id sql.NullInt64
+	if response.Id > 0 {
+		id = sql.NullInt64{response.Id, true}
+	}
+
+	_, err := postgresIdempotencyStore.Db.Exec(COMPLETE_IDEMPOTENCY_QUERY, response.Code, response.Message, id, expiresAt, time.Now(), key)
+	return err
+}
+
+func (postgresIdempotencyStore *PostgresIdempotencyStore) Release(key string) error {
+	_, err := postgresIdempotencyStore.Db.Exec(RELEASE_IDEMPOTENCY_QUERY, key)
+	return err
+}
+
+func (postgresIdempotencyStore *PostgresIdempotencyStore) Prune() error {
+	_, err := postgresIdempotencyStore.Db.Exec(PRUNE_IDEMPOTENCY_QUERY, time.Now())
+	return err
+}
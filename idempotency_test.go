@@ -0,0 +1,149 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	IDEMPOTENCY_GET_STEP = iota
+	IDEMPOTENCY_RESERVE_STEP
+	IDEMPOTENCY_COMPLETE_STEP
+	IDEMPOTENCY_RELEASE_STEP
+)
+
+type idempotencyStep struct {
+	step      int
+	key       string
+	response  *Response
+	expiresAt time.Time
+	//Whether Get found the key or Reserve claimed it
+	found bool
+	//Response Get or Reserve returned
+	want *Response
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	created := &Response{Code: 201, Message: "Successfully added prospect", Id: 7}
+	later := time.Now().Add(time.Hour)
+	earlier := time.Now().Add(-time.Second)
+
+	tests := []struct {
+		name  string
+		steps []idempotencyStep
+	}{
+		{"unknown key", []idempotencyStep{
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: false},
+		}},
+		{"reserve", []idempotencyStep{
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_GET_STEP, key: "b", found: false},
+		}},
+		{"reserve while in progress", []idempotencyStep{
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: false},
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "b", found: true},
+		}},
+		{"complete", []idempotencyStep{
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_COMPLETE_STEP, key: "a", response: created, expiresAt: later},
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: true, want: created},
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: false, want: created},
+		}},
+		{"release", []idempotencyStep{
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_RELEASE_STEP, key: "a"},
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: false},
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+		}},
+		{"release after complete", []idempotencyStep{
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_COMPLETE_STEP, key: "a", response: created, expiresAt: later},
+			{step: IDEMPOTENCY_RELEASE_STEP, key: "a"},
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: true, want: created},
+		}},
+		{"release unknown key", []idempotencyStep{
+			{step: IDEMPOTENCY_RELEASE_STEP, key: "a"},
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+		}},
+		{"expired response", []idempotencyStep{
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_COMPLETE_STEP, key: "a", response: created, expiresAt: earlier},
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: false},
+			{step: IDEMPOTENCY_RESERVE_STEP, key: "a", found: true},
+			{step: IDEMPOTENCY_GET_STEP, key: "a", found: true},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			memoryIdempotencyStore := NewMemoryIdempotencyStore()
+
+			for index, step := range test.steps {
+				var (
+					found    bool
+					response *Response
+					err      error
+				)
+
+				switch step.step {
+				case IDEMPOTENCY_GET_STEP:
+					found, response, err = memoryIdempotencyStore.Get(step.key)
+				case IDEMPOTENCY_RESERVE_STEP:
+					found, response, err = memoryIdempotencyStore.Reserve(step.key)
+				case IDEMPOTENCY_COMPLETE_STEP:
+					err = memoryIdempotencyStore.Complete(step.key, *step.response, step.expiresAt)
+				case IDEMPOTENCY_RELEASE_STEP:
+					err = memoryIdempotencyStore.Release(step.key)
+				}
+
+				if nil != err {
+					t.Fatalf("step %d: %v", index, err)
+				}
+
+				if found != step.found || !reflect.DeepEqual(response, step.want) {
+					t.Errorf("step %d on %q = %t, %+v, want %t, %+v", index, step.key, found, response, step.found, step.want)
+				}
+			}
+		})
+	}
+}
+
+// A completed response is a copy, so changing the original afterwards doesn't change replays
+func TestMemoryIdempotencyStoreCompleteCopies(t *testing.T) {
+	memoryIdempotencyStore := NewMemoryIdempotencyStore()
+
+	response := Response{Code: 201, Message: "Successfully added prospect", Id: 7}
+	err := memoryIdempotencyStore.Complete("a", response, time.Now().Add(time.Hour))
+	if nil != err {
+		t.Fatal(err)
+	}
+	response.Id = 8
+
+	_, stored, _ := memoryIdempotencyStore.Get("a")
+	if nil == stored || stored.Id != 7 {
+		t.Errorf("Get after changing the completed response = %+v, want Id 7", stored)
+	}
+}
+
+func TestMemoryIdempotencyStorePrune(t *testing.T) {
+	memoryIdempotencyStore := NewMemoryIdempotencyStore()
+	response := Response{Code: 201}
+
+	memoryIdempotencyStore.Complete("expired", response, time.Now().Add(-time.Second))
+	memoryIdempotencyStore.Complete("current", response, time.Now().Add(time.Hour))
+	memoryIdempotencyStore.Reserve("pending")
+
+	err := memoryIdempotencyStore.Prune()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	for key, exists := range map[string]bool{"expired": false, "current": true, "pending": true} {
+		if _, kept := memoryIdempotencyStore.entries[key]; kept != exists {
+			t.Errorf("Prune kept %q = %t, want %t", key, kept, exists)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"github.com/satori/go.uuid"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	REQUEST_ID_HEADER     = "X-Request-ID"
+	REQUEST_ID_LOG_KEY    = "request_id"
+	MAX_REQUEST_ID_LENGTH = 128
+	REDACTED              = "[REDACTED]"
+)
+
+type requestIdKey struct{}
+
+var requestIdRegex = regexp.MustCompile("^[A-Za-z0-9._:-]+$")
+
+// Log attribute keys whose values are personal data, with how each is masked
+var redactors = map[string]func(string) string{
+	"email":        RedactEmail,
+	"phone_number": RedactPhoneNumber,
+	"phonenumber":  RedactPhoneNumber,
+	"dob":          RedactAll,
+	"ip_address":   RedactIpAddress,
+	"ipaddress":    RedactIpAddress,
+}
+
+// LogConfig is the logging configuration shared by every command
+type LogConfig struct {
+	Format string     `config:"LOG_FORMAT" default:"json" oneof:"json|text"`
+	Level  slog.Level `config:"LOG_LEVEL" default:"info" usage:"debug, info, warn or error"`
+	Redact bool       `config:"LOG_REDACT" default:"true" usage:"Mask email, phone number, date of birth and ip address in logs"`
+}
+
+// SetupLogging makes a structured logger the default for both slog and the log package, so
+// existing log.Printf calls are emitted in the same format
+func SetupLogging(command string, logConfig LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{Level: logConfig.Level}
+	if logConfig.Redact {
+		options.ReplaceAttr = redactAttr
+	}
+
+	var handler slog.Handler
+	if logConfig.Format == "text" {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+
+	logger := slog.New(handler).With("command", command)
+	slog.SetDefault(logger)
+
+	return logger
+}
+
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if redactor, exists := redactors[strings.ToLower(attr.Key)]; exists && attr.Value.Kind() == slog.KindString {
+		attr.Value = slog.StringValue(redactor(attr.Value.String()))
+	}
+
+	return attr
+}
+
+func RedactAll(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+
+	return REDACTED
+}
+
+// Keeps the first character and domain, "j***@example.com"
+func RedactEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return RedactAll(email)
+	}
+
+	return email[:1] + "***" + email[at:]
+}
+
+// Keeps the last two digits
+func RedactPhoneNumber(phoneNumber string) string {
+	var digits []rune
+	for _, character := range phoneNumber {
+		if character >= '0' && character <= '9' {
+			digits = append(digits, character)
+		}
+	}
+
+	if len(digits) <= 2 {
+		return RedactAll(phoneNumber)
+	}
+
+	return strings.Repeat("*", len(digits)-2) + string(digits[len(digits)-2:])
+}
+
+// Keeps the network, the /24 for IPv4 and /48 for IPv6
+func RedactIpAddress(ipAddress string) string {
+	ip := net.ParseIP(ipAddress)
+	if nil == ip {
+		return RedactAll(ipAddress)
+	}
+
+	if ipv4 := ip.To4(); nil != ipv4 {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// LogValue logs what identifies a prospect.  Email, phone number, date of birth and ip address
+// are redacted by the handler and names, feedback and miscellaneous are left out.
+func (prospect Prospect) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int64("id", prospect.Id),
+		slog.String("lead_id", prospect.LeadId),
+		slog.String("app_name", prospect.AppName),
+		slog.String("lead_source", prospect.LeadSource),
+		slog.String("email", prospect.Email),
+		slog.String("phone_number", prospect.PhoneNumber),
+		slog.String("dob", prospect.DateOfBirth),
+		slog.String("ip_address", prospect.IpAddress),
+		slog.String("suspicious_origin", prospect.SuspiciousOrigin),
+		slog.Bool("suspected_bot", prospect.SuspectedBot),
+	)
+}
+
+// GetRequestId returns a usable request id from the header or generates one
+func GetRequestId(headerValue string) string {
+	if len(headerValue) > 0 && len(headerValue) <= MAX_REQUEST_ID_LENGTH && requestIdRegex.MatchString(headerValue) {
+		return headerValue
+	}
+
+	return uuid.NewV4().String()
+}
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// Logger returns the default logger with the request id of the context, if any
+func Logger(ctx context.Context) *slog.Logger {
+	if requestId := RequestIdFromContext(ctx); len(requestId) > 0 {
+		return slog.Default().With(REQUEST_ID_LOG_KEY, requestId)
+	}
+
+	return slog.Default()
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+	METRICS_LABEL_SEP    = "\xff"
+)
+
+var DefaultLatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metric is anything that can write itself in the Prometheus text exposition format
+type Metric interface {
+	WriteMetric(writer *bufio.Writer)
+}
+
+// MetricsRegistry holds every metric exposed by a process and serves them for scraping
+type MetricsRegistry struct {
+	metrics []Metric
+	mutex   sync.Mutex
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return new(MetricsRegistry)
+}
+
+func (metricsRegistry *MetricsRegistry) Register(metric Metric) {
+	metricsRegistry.mutex.Lock()
+	defer metricsRegistry.mutex.Unlock()
+
+	metricsRegistry.metrics = append(metricsRegistry.metrics, metric)
+}
+
+func (metricsRegistry *MetricsRegistry) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	metricsRegistry.mutex.Lock()
+	metrics := append([]Metric(nil), metricsRegistry.metrics...)
+	metricsRegistry.mutex.Unlock()
+
+	res.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+
+	writer := bufio.NewWriter(res)
+	for _, metric := range metrics {
+		metric.WriteMetric(writer)
+	}
+	writer.Flush()
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return strings.Replace(value, "\n", "\\n", -1)
+}
+
+func formatLabels(labelNames []string, labelValues []string, extra ...string) string {
+	var pairs []string
+	for index, labelName := range labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labelName, escapeLabelValue(labelValues[index])))
+	}
+
+	for index := 0; index+1 < len(extra); index += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[index], escapeLabelValue(extra[index+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func writeHeader(writer *bufio.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n", name, strings.Replace(help, "\n", " ", -1))
+	fmt.Fprintf(writer, "# TYPE %s %s\n", name, metricType)
+}
+
+// Label values are joined into a single map key and split again when written
+type labeledValues[V any] struct {
+	values map[string]V
+	mutex  sync.Mutex
+}
+
+func (labeled *labeledValues[V]) get(labelValues []string, create func() V) V {
+	key := strings.Join(labelValues, METRICS_LABEL_SEP)
+
+	labeled.mutex.Lock()
+	defer labeled.mutex.Unlock()
+
+	if nil == labeled.values {
+		labeled.values = make(map[string]V)
+	}
+
+	value, exists := labeled.values[key]
+	if !exists {
+		value = create()
+		labeled.values[key] = value
+	}
+
+	return value
+}
+
+func (labeled *labeledValues[V]) sorted() ([][]string, []V) {
+	labeled.mutex.Lock()
+	defer labeled.mutex.Unlock()
+
+	keys := make([]string, 0, len(labeled.values))
+	for key := range labeled.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labelValues := make([][]string, len(keys))
+	values := make([]V, len(keys))
+	for index, key := range keys {
+		labelValues[index] = strings.Split(key, METRICS_LABEL_SEP)
+		values[index] = labeled.values[key]
+	}
+
+	return labelValues, values
+}
+
+type counterValue struct {
+	value float64
+	mutex sync.Mutex
+}
+
+// CounterVec is a monotonically increasing count per combination of label values
+type CounterVec struct {
+	Name       string
+	Help       string
+	LabelNames []string
+	counters   labeledValues[*counterValue]
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{Name: name, Help: help, LabelNames: labelNames}
+}
+
+func (counterVec *CounterVec) Add(value float64, labelValues ...string) {
+	counter := counterVec.counters.get(labelValues, func() *counterValue { return new(counterValue) })
+
+	counter.mutex.Lock()
+	counter.value += value
+	counter.mutex.Unlock()
+}
+
+func (counterVec *CounterVec) Inc(labelValues ...string) {
+	counterVec.Add(1, labelValues...)
+}
+
+func (counterVec *CounterVec) WriteMetric(writer *bufio.Writer) {
+	writeHeader(writer, counterVec.Name, counterVec.Help, "counter")
+
+	labelValues, counters := counterVec.counters.sorted()
+	for index, counter := range counters {
+		counter.mutex.Lock()
+		value := counter.value
+		counter.mutex.Unlock()
+
+		fmt.Fprintf(writer, "%s%s %s\n", counterVec.Name, formatLabels(counterVec.LabelNames, labelValues[index]), formatValue(value))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+	mutex  sync.Mutex
+}
+
+// HistogramVec counts observations into cumulative buckets per combination of label values
+type HistogramVec struct {
+	Name       string
+	Help       string
+	LabelNames []string
+	Buckets    []float64
+	histograms labeledValues[*histogramValue]
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	return &HistogramVec{Name: name, Help: help, LabelNames: labelNames, Buckets: buckets}
+}
+
+func (histogramVec *HistogramVec) Observe(value float64, labelValues ...string) {
+	histogram := histogramVec.histograms.get(labelValues, func() *histogramValue {
+		return &histogramValue{counts: make([]uint64, len(histogramVec.Buckets))}
+	})
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for index, bucket := range histogramVec.Buckets {
+		if value <= bucket {
+			histogram.counts[index]++
+		}
+	}
+
+	histogram.count++
+	histogram.sum += value
+}
+
+func (histogramVec *HistogramVec) WriteMetric(writer *bufio.Writer) {
+	writeHeader(writer, histogramVec.Name, histogramVec.Help, "histogram")
+
+	labelValues, histograms := histogramVec.histograms.sorted()
+	for index, histogram := range histograms {
+		histogram.mutex.Lock()
+		counts := append([]uint64(nil), histogram.counts...)
+		count := histogram.count
+		sum := histogram.sum
+		histogram.mutex.Unlock()
+
+		for bucketIndex, bucket := range histogramVec.Buckets {
+			fmt.Fprintf(writer, "%s_bucket%s %d\n", histogramVec.Name, formatLabels(histogramVec.LabelNames, labelValues[index], "le", formatValue(bucket)), counts[bucketIndex])
+		}
+
+		fmt.Fprintf(writer, "%s_bucket%s %d\n", histogramVec.Name, formatLabels(histogramVec.LabelNames, labelValues[index], "le", "+Inf"), count)
+		fmt.Fprintf(writer, "%s_sum%s %s\n", histogramVec.Name, formatLabels(histogramVec.LabelNames, labelValues[index]), formatValue(sum))
+		fmt.Fprintf(writer, "%s_count%s %d\n", histogramVec.Name, formatLabels(histogramVec.LabelNames, labelValues[index]), count)
+	}
+}
+
+// ValueFunc reads its value when scraped, for values owned elsewhere like queue depth
+type ValueFunc struct {
+	Name string
+	Help string
+	Type string
+	Func func() float64
+}
+
+func NewGaugeFunc(name string, help string, valueFunc func() float64) *ValueFunc {
+	return &ValueFunc{Name: name, Help: help, Type: "gauge", Func: valueFunc}
+}
+
+func NewCounterFunc(name string, help string, valueFunc func() float64) *ValueFunc {
+	return &ValueFunc{Name: name, Help: help, Type: "counter", Func: valueFunc}
+}
+
+func (valueFunc *ValueFunc) WriteMetric(writer *bufio.Writer) {
+	writeHeader(writer, valueFunc.Name, valueFunc.Help, valueFunc.Type)
+	fmt.Fprintf(writer, "%s %s\n", valueFunc.Name, formatValue(valueFunc.Func()))
+}
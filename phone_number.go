@@ -0,0 +1,365 @@
+package common
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	PHONE_MIN_DIGITS = 7
+	PHONE_MAX_DIGITS = 15
+)
+
+var (
+	ErrPhoneNumberCharacters = errors.New("Phone number has characters other than digits and separators")
+	ErrPhoneNumberRegion     = errors.New("Phone number has no country calling code and no region to assume")
+	ErrPhoneNumberLength     = errors.New("Phone number has too few or too many digits")
+	ErrInvalidPhoneNumber    = errors.New("Phone number isn't valid for its country")
+)
+
+var (
+	phoneExtensionRegex  = regexp.MustCompile(`(?i)^(.*?)[\s,]*(?:;\s*ext=|ext\.?|extension|x|#)\s*(\d{1,7})#?$`)
+	phoneCharactersRegex = regexp.MustCompile(`^\+?[\d\s().\-/]+$`)
+)
+
+// LineType is the kind of line a phone number belongs to, as far as its prefix tells
+type LineType int
+
+const (
+	FixedLine LineType = 1 << iota
+	Mobile
+	FixedLineOrMobile
+	TollFree
+	PremiumRate
+	UnknownLineType
+)
+
+func (lineType LineType) String() string {
+	switch lineType {
+	case FixedLine:
+		return "fixed_line"
+	case Mobile:
+		return "mobile"
+	case FixedLineOrMobile:
+		return "fixed_line_or_mobile"
+	case TollFree:
+		return "toll_free"
+	case PremiumRate:
+		return "premium_rate"
+	default:
+		return "unknown"
+	}
+}
+
+// PhoneNumber is a parsed phone number.  Region is empty for country calling codes without
+// metadata, whose numbers are only checked for length.
+type PhoneNumber struct {
+	CountryCode    int
+	Region         string
+	NationalNumber string
+	Extension      string
+	LineType       LineType
+}
+
+// E164 is the number as + followed by the country calling code and national number, without extension
+func (phoneNumber PhoneNumber) E164() string {
+	return "+" + strconv.Itoa(phoneNumber.CountryCode) + phoneNumber.NationalNumber
+}
+
+// phoneRegion holds enough of a numbering plan to validate numbers and tell their line type.  Line
+// types are told by the prefix of the national significant number, in the order toll free, premium
+// rate, mobile then fixed line.
+type phoneRegion struct {
+	Region      string
+	CountryCode int
+	TrunkPrefix string
+	//Matches every valid national significant number, without the trunk prefix
+	Pattern     *regexp.Regexp
+	Mobile      []string
+	FixedLine   []string
+	TollFree    []string
+	PremiumRate []string
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Regions that can't tell mobile numbers from fixed lines by prefix, such as the NANP, don't list mobile prefixes
+func (phoneRegion phoneRegion) getLineType(nationalNumber string) LineType {
+	switch {
+	case hasAnyPrefix(nationalNumber, phoneRegion.TollFree):
+		return TollFree
+	case hasAnyPrefix(nationalNumber, phoneRegion.PremiumRate):
+		return PremiumRate
+	case hasAnyPrefix(nationalNumber, phoneRegion.Mobile):
+		return Mobile
+	case hasAnyPrefix(nationalNumber, phoneRegion.FixedLine):
+		return FixedLine
+	case len(phoneRegion.Mobile) == 0:
+		return FixedLineOrMobile
+	default:
+		return UnknownLineType
+	}
+}
+
+func (phoneRegion phoneRegion) matches(nationalNumber string) bool {
+	return phoneRegion.Pattern.MatchString(nationalNumber)
+}
+
+func newPhonePattern(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^(?:" + pattern + ")$")
+}
+
+// Regions sharing a country calling code are listed most specific first, the first matching a
+// number is its region
+var phoneRegions = []phoneRegion{
+	{"CA", 1, "1", newPhonePattern(`(?:204|226|236|249|250|263|289|306|343|354|365|367|368|382|403|416|418|428|431|437|438|450|468|474|506|514|519|548|579|581|584|587|604|613|639|647|672|683|705|709|742|753|778|780|782|807|819|825|867|873|879|902|905)[2-9]\d{6}`), nil, nil, nil, nil},
+	{"US", 1, "1", newPhonePattern(`[2-9]\d{2}[2-9]\d{6}`), nil, nil, []string{"800", "833", "844", "855", "866", "877", "888"}, []string{"900"}},
+	{"GB", 44, "0", newPhonePattern(`[1-9]\d{8,9}`), []string{"71", "72", "73", "74", "75", "77", "78", "79"}, []string{"1", "2"}, []string{"800", "808"}, []string{"9"}},
+	{"IE", 353, "0", newPhonePattern(`[1-9]\d{6,9}`), []string{"8"}, []string{"1", "2", "4", "5", "6", "7", "9"}, []string{"1800"}, []string{"15"}},
+	{"FR", 33, "0", newPhonePattern(`[1-9]\d{8}`), []string{"6", "7"}, []string{"1", "2", "3", "4", "5"}, []string{"80"}, []string{"89"}},
+	{"DE", 49, "0", newPhonePattern(`[1-9]\d{5,12}`), []string{"15", "16", "17"}, []string{"2", "3", "4", "5", "6", "7", "8", "9"}, []string{"800"}, []string{"900"}},
+	{"NL", 31, "0", newPhonePattern(`[1-9]\d{8}`), []string{"6"}, []string{"1", "2", "3", "4", "5", "7"}, []string{"800"}, []string{"90"}},
+	{"BE", 32, "0", newPhonePattern(`4\d{8}|[1-9]\d{7}`), []string{"4"}, []string{"1", "2", "3", "5", "6", "7", "8", "9"}, []string{"800"}, []string{"90"}},
+	{"CH", 41, "0", newPhonePattern(`[1-9]\d{8}`), []string{"7"}, []string{"2", "3", "4", "5", "6", "8"}, []string{"800"}, []string{"90"}},
+	{"AT", 43, "0", newPhonePattern(`[1-9]\d{3,12}`), []string{"6"}, []string{"1", "2", "3", "4", "5", "7"}, []string{"800"}, []string{"9"}},
+	{"IT", 39, "", newPhonePattern(`0\d{5,10}|3\d{8,9}|8[09]\d{6,7}`), []string{"3"}, []string{"0"}, []string{"80"}, []string{"89"}},
+	{"ES", 34, "", newPhonePattern(`[5-9]\d{8}`), []string{"6", "7"}, []string{"8", "9"}, []string{"900"}, []string{"80"}},
+	{"PT", 351, "", newPhonePattern(`[2-9]\d{8}`), []string{"9"}, []string{"2"}, []string{"800"}, []string{"6"}},
+	{"SE", 46, "0", newPhonePattern(`[1-9]\d{6,9}`), []string{"7"}, []string{"1", "2", "3", "4", "5", "6", "8"}, []string{"20"}, []string{"9"}},
+	{"NO", 47, "", newPhonePattern(`[2-9]\d{7}`), []string{"4", "9"}, []string{"2", "3", "5", "6", "7"}, []string{"80"}, nil},
+	{"DK", 45, "", newPhonePattern(`[2-9]\d{7}`), nil, nil, []string{"80"}, []string{"90"}},
+	{"PL", 48, "", newPhonePattern(`[1-9]\d{8}`), []string{"45", "5", "60", "66", "69", "72", "73", "78", "79", "88"}, []string{"1", "2", "3", "4", "6", "7", "8"}, []string{"800"}, []string{"70"}},
+	{"KZ", 7, "8", newPhonePattern(`[67]\d{9}`), []string{"70", "747", "75", "76", "77"}, []string{"6", "71", "72"}, nil, nil},
+	{"RU", 7, "8", newPhonePattern(`[3489]\d{9}`), []string{"9"}, []string{"3", "4", "8"}, []string{"800"}, []string{"809"}},
+	{"AU", 61, "0", newPhonePattern(`[23478]\d{8}|1(?:800\d{6}|300\d{6}|3\d{4}|900\d{6})`), []string{"4"}, []string{"2", "3", "7", "8"}, []string{"1800"}, []string{"190"}},
+	{"NZ", 64, "0", newPhonePattern(`2\d{7,9}|[3-9]\d{7}|508\d{6}|800\d{6,7}|900\d{5,6}`), []string{"2"}, []string{"3", "4", "6", "7", "9"}, []string{"800", "508"}, []string{"900"}},
+	{"JP", 81, "0", newPhonePattern(`[1-9]\d{8,9}`), []string{"70", "80", "90"}, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9"}, []string{"120", "800"}, []string{"990"}},
+	{"KR", 82, "0", newPhonePattern(`[1-9]\d{7,9}`), []string{"1"}, []string{"2", "3", "4", "5", "6"}, []string{"80"}, nil},
+	{"CN", 86, "0", newPhonePattern(`1[3-9]\d{9}|[2-9]\d{8,10}`), []string{"1"}, []string{"2", "3", "4", "5", "6", "7", "8", "9"}, []string{"800"}, nil},
+	{"HK", 852, "", newPhonePattern(`[2-9]\d{7}|800\d{6}`), []string{"5", "6", "7", "9"}, []string{"2", "3"}, []string{"800"}, nil},
+	{"SG", 65, "", newPhonePattern(`[689]\d{7}|1800\d{7}`), []string{"8", "9"}, []string{"6"}, []string{"1800", "800"}, nil},
+	{"IN", 91, "0", newPhonePattern(`[1-9]\d{9}`), []string{"6", "7", "8", "9"}, []string{"1", "2", "3", "4", "5"}, nil, nil},
+	{"MX", 52, "", newPhonePattern(`[1-9]\d{9}`), nil, nil, []string{"800"}, []string{"900"}},
+	{"BR", 55, "0", newPhonePattern(`[1-9][1-9](?:9\d{8}|[2-5]\d{7})|800\d{6,7}`), nil, nil, []string{"800"}, nil},
+	{"ZA", 27, "0", newPhonePattern(`[1-8]\d{8}`), []string{"6", "7", "81", "82", "83", "84"}, []string{"1", "2", "3", "4", "5"}, []string{"80"}, []string{"86"}},
+}
+
+func getPhoneRegion(region string) (phoneRegion, bool) {
+	for _, phoneRegion := range phoneRegions {
+		if phoneRegion.Region == region {
+			return phoneRegion, true
+		}
+	}
+
+	return phoneRegion{}, false
+}
+
+// IsPhoneRegion is true for the ISO 3166 region codes numbers can be parsed in
+func IsPhoneRegion(region string) bool {
+	_, exists := getPhoneRegion(region)
+	return exists
+}
+
+// Country calling codes are one to three digits and none is the prefix of another, so the length
+// follows from the first two digits
+func getCountryCodeSize(digits string) int {
+	switch {
+	case strings.HasPrefix(digits, "1"), strings.HasPrefix(digits, "7"):
+		return 1
+	case len(digits) < 2:
+		return 0
+	}
+
+	switch digits[:2] {
+	case "20", "27", "30", "31", "32", "33", "34", "36", "39", "40", "41", "43", "44", "45", "46", "47", "48", "49",
+		"51", "52", "53", "54", "55", "56", "57", "58", "60", "61", "62", "63", "64", "65", "66",
+		"81", "82", "84", "86", "90", "91", "92", "93", "94", "95", "98":
+		return 2
+	default:
+		return 3
+	}
+}
+
+// The national number and its region for a country calling code.  A number still carrying the
+// trunk prefix, like +44 (0)20 7946 0018, is accepted too.
+func getNationalNumber(countryCode int, digits string) (string, phoneRegion, bool) {
+	for _, stripTrunkPrefix := range []bool{false, true} {
+		for _, phoneRegion := range phoneRegions {
+			if phoneRegion.CountryCode != countryCode {
+				continue
+			}
+
+			nationalNumber := digits
+			if stripTrunkPrefix {
+				if len(phoneRegion.TrunkPrefix) == 0 || !strings.HasPrefix(digits, phoneRegion.TrunkPrefix) {
+					continue
+				}
+				nationalNumber = digits[len(phoneRegion.TrunkPrefix):]
+			}
+
+			if phoneRegion.matches(nationalNumber) {
+				return nationalNumber, phoneRegion, true
+			}
+		}
+	}
+
+	return "", phoneRegion{}, false
+}
+
+func getDigits(value string) string {
+	return strings.Map(func(char rune) rune {
+		if char >= '0' && char <= '9' {
+			return char
+		}
+		return -1
+	}, value)
+}
+
+// ParsePhoneNumber parses a number in international format, or national format in the default
+// region, with an optional extension such as "ext. 12" or "x12".  International numbers start with
+// +, with 00, or with 011 in the NANP.  Numbers of countries without metadata are only checked for
+// length.
+func ParsePhoneNumber(number string, defaultRegion string) (PhoneNumber, error) {
+	var phoneNumber PhoneNumber
+
+	number = strings.TrimPrefix(strings.TrimSpace(number), "tel:")
+	if match := phoneExtensionRegex.FindStringSubmatch(number); nil != match {
+		number = match[1]
+		phoneNumber.Extension = match[2]
+	}
+
+	if !phoneCharactersRegex.MatchString(number) {
+		return phoneNumber, ErrPhoneNumberCharacters
+	}
+
+	digits := getDigits(number)
+	defaultPhoneRegion, hasDefault := getPhoneRegion(defaultRegion)
+
+	//Digits after an international prefix start with the country calling code
+	international := strings.HasPrefix(number, "+")
+	if !international && hasDefault {
+		internationalPrefix := "00"
+		if defaultPhoneRegion.CountryCode == 1 {
+			internationalPrefix = "011"
+		}
+
+		if strings.HasPrefix(digits, internationalPrefix) {
+			digits = digits[len(internationalPrefix):]
+			international = true
+		}
+	}
+
+	if len(digits) < PHONE_MIN_DIGITS || len(digits) > PHONE_MAX_DIGITS {
+		return phoneNumber, ErrPhoneNumberLength
+	}
+
+	if !international {
+		if !hasDefault {
+			return phoneNumber, ErrPhoneNumberRegion
+		}
+
+		//Numbers written with the country calling code but without a + are accepted too
+		nationalNumber, phoneRegion, valid := getNationalNumber(defaultPhoneRegion.CountryCode, digits)
+		countryCode := strconv.Itoa(defaultPhoneRegion.CountryCode)
+		if !valid && strings.HasPrefix(digits, countryCode) {
+			nationalNumber, phoneRegion, valid = getNationalNumber(defaultPhoneRegion.CountryCode, digits[len(countryCode):])
+		}
+
+		if !valid {
+			return phoneNumber, ErrInvalidPhoneNumber
+		}
+
+		phoneNumber.CountryCode = phoneRegion.CountryCode
+		phoneNumber.Region = phoneRegion.Region
+		phoneNumber.NationalNumber = nationalNumber
+		phoneNumber.LineType = phoneRegion.getLineType(nationalNumber)
+		return phoneNumber, nil
+	}
+
+	countryCodeSize := getCountryCodeSize(digits)
+	countryCode, _ := strconv.Atoi(digits[:countryCodeSize])
+	nationalNumber := digits[countryCodeSize:]
+	if countryCode == 0 {
+		return phoneNumber, ErrInvalidPhoneNumber
+	}
+
+	phoneNumber.CountryCode = countryCode
+	if regionNumber, phoneRegion, valid := getNationalNumber(countryCode, nationalNumber); valid {
+		phoneNumber.Region = phoneRegion.Region
+		phoneNumber.NationalNumber = regionNumber
+		phoneNumber.LineType = phoneRegion.getLineType(regionNumber)
+		return phoneNumber, nil
+	}
+
+	for _, phoneRegion := range phoneRegions {
+		if phoneRegion.CountryCode == countryCode {
+			return phoneNumber, ErrInvalidPhoneNumber
+		}
+	}
+
+	phoneNumber.NationalNumber = nationalNumber
+	phoneNumber.LineType = UnknownLineType
+	return phoneNumber, nil
+}
+
+var (
+	zipCodeRegions = []struct {
+		Region string
+		Regex  *regexp.Regexp
+	}{
+		{"US", regexp.MustCompile(`^\d{5}-\d{4}$`)},
+		{"CA", regexp.MustCompile(`^[ABCEGHJ-NPRSTVXY]\d[ABCEGHJ-NPRSTV-Z] ?\d[ABCEGHJ-NPRSTV-Z]\d$`)},
+		{"GB", regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+		{"IE", regexp.MustCompile(`^(?:[AC-FHKNPRTV-Y]\d{2}|D6W) ?[0-9AC-FHKNPRTV-Y]{4}$`)},
+		{"NL", regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+		{"PL", regexp.MustCompile(`^\d{2}-\d{3}$`)},
+		{"PT", regexp.MustCompile(`^\d{4}-\d{3}$`)},
+		{"JP", regexp.MustCompile(`^\d{3}-\d{4}$`)},
+	}
+	//Languages spoken as a first language in a single region with metadata
+	languageRegions = map[string]string{"ja": "JP", "ko": "KR", "pl": "PL", "sv": "SE", "da": "DK", "nb": "NO", "nn": "NO", "no": "NO"}
+)
+
+// GetRegionFromZipCode returns the region of a postal code in a format only one region uses, so
+// plain five digit codes, used by the US and much of Europe, give none
+func GetRegionFromZipCode(zipCode string) string {
+	zipCode = strings.ToUpper(strings.TrimSpace(zipCode))
+	for _, zipCodeRegion := range zipCodeRegions {
+		if zipCodeRegion.Regex.MatchString(zipCode) {
+			return zipCodeRegion.Region
+		}
+	}
+
+	return ""
+}
+
+// GetRegionFromLanguage returns the first region with metadata named by the language tags of an
+// Accept-Language header, such as GB for "en-GB,en;q=0.8"
+func GetRegionFromLanguage(acceptLanguage string) string {
+	for _, languageRange := range strings.Split(acceptLanguage, ",") {
+		tag := strings.TrimSpace(strings.SplitN(languageRange, ";", 2)[0])
+		subtags := strings.Split(strings.Replace(tag, "_", "-", -1), "-")
+
+		for _, subtag := range subtags[1:] {
+			if region := strings.ToUpper(subtag); len(region) == 2 && IsPhoneRegion(region) {
+				return region
+			}
+		}
+
+		if region, exists := languageRegions[strings.ToLower(subtags[0])]; exists {
+			return region
+		}
+	}
+
+	return ""
+}
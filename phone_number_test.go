@@ -0,0 +1,144 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestParsePhoneNumber(t *testing.T) {
+	tests := []struct {
+		name          string
+		number        string
+		defaultRegion string
+		e164          string
+		region        string
+		extension     string
+		lineType      LineType
+		err           error
+	}{
+		//National numbers in the default region
+		{"us national", "(415) 555-2671", "US", "+14155552671", "US", "", FixedLineOrMobile, nil},
+		{"us dotted", "415.555.2671", "US", "+14155552671", "US", "", FixedLineOrMobile, nil},
+		{"canadian area code", "(416) 555-0123", "US", "+14165550123", "CA", "", FixedLineOrMobile, nil},
+		{"us toll free", "1-800-555-0199", "US", "+18005550199", "US", "", TollFree, nil},
+		{"gb mobile", "07911 123456", "GB", "+447911123456", "GB", "", Mobile, nil},
+		{"gb toll free", "0800 123 4567", "GB", "+448001234567", "GB", "", TollFree, nil},
+		{"fr mobile", "06 12 34 56 78", "FR", "+33612345678", "FR", "", Mobile, nil},
+		{"de fixed line", "030 123456", "DE", "+4930123456", "DE", "", FixedLine, nil},
+		{"country code without plus", "44 20 7946 0018", "GB", "+442079460018", "GB", "", FixedLine, nil},
+
+		//Trunk prefixes
+		{"nanp trunk prefix", "1 (415) 555-2671", "US", "+14155552671", "US", "", FixedLineOrMobile, nil},
+		{"ru trunk prefix", "8 (912) 345-67-89", "RU", "+79123456789", "RU", "", Mobile, nil},
+		{"international with trunk prefix", "+44 (0)20 7946 0018", "", "+442079460018", "GB", "", FixedLine, nil},
+		{"it keeps its leading zero", "06 6988 1234", "IT", "+390669881234", "IT", "", FixedLine, nil},
+		{"it leading zero international", "+39 06 6988 1234", "", "+390669881234", "IT", "", FixedLine, nil},
+
+		//International numbers
+		{"plus", "+1 415 555 2671", "", "+14155552671", "US", "", FixedLineOrMobile, nil},
+		{"plus in another region", "+33 6 12 34 56 78", "US", "+33612345678", "FR", "", Mobile, nil},
+		{"nanp international prefix", "011 44 20 7946 0018", "US", "+442079460018", "GB", "", FixedLine, nil},
+		{"international prefix", "0044 7911 123456", "FR", "+447911123456", "GB", "", Mobile, nil},
+		{"shared country code", "+7 701 234 5678", "", "+77012345678", "KZ", "", Mobile, nil},
+		{"premium rate", "+44 909 879 0000", "", "+449098790000", "GB", "", PremiumRate, nil},
+		{"mobile", "+39 312 345 6789", "", "+393123456789", "IT", "", Mobile, nil},
+		{"tel uri", "tel:+14155552671", "", "+14155552671", "US", "", FixedLineOrMobile, nil},
+		{"country without metadata", "+372 5123 4567", "", "+37251234567", "", "", UnknownLineType, nil},
+
+		//Extensions
+		{"ext.", "+1 415 555 2671 ext. 12", "", "+14155552671", "US", "12", FixedLineOrMobile, nil},
+		{"extension", "(415) 555-2671 extension 7", "US", "+14155552671", "US", "7", FixedLineOrMobile, nil},
+		{"x", "(415) 555-2671 x123", "US", "+14155552671", "US", "123", FixedLineOrMobile, nil},
+		{"upper case x", "(415) 555-2671X123", "US", "+14155552671", "US", "123", FixedLineOrMobile, nil},
+		{"rfc 3966", "+44 20 7946 0018;ext=5", "", "+442079460018", "GB", "5", FixedLine, nil},
+		{"hash", "415-555-2671 #9#", "US", "+14155552671", "US", "9", FixedLineOrMobile, nil},
+		{"comma", "415-555-2671, ext 44", "US", "+14155552671", "US", "44", FixedLineOrMobile, nil},
+
+		//Errors
+		{"letters", "555-CALL-NOW", "US", "", "", "", 0, ErrPhoneNumberCharacters},
+		{"extension too long", "415-555-2671 x12345678", "US", "", "", "", 0, ErrPhoneNumberCharacters},
+		{"no region", "4155552671", "", "", "", "", 0, ErrPhoneNumberRegion},
+		{"unknown region", "4155552671", "XX", "", "", "", 0, ErrPhoneNumberRegion},
+		{"too short", "555-267", "US", "", "", "", 0, ErrPhoneNumberLength},
+		{"too short international", "+44 12", "", "", "", "", 0, ErrPhoneNumberLength},
+		{"too long", "+44 1234 567890 123456", "", "", "", "", 0, ErrPhoneNumberLength},
+		{"empty", "", "US", "", "", "", 0, ErrPhoneNumberCharacters},
+		{"nanp area code starting with 1", "+1 123 456 7890", "", "", "", "", 0, ErrInvalidPhoneNumber},
+		{"nanp exchange starting with 1", "(415) 155-2671", "US", "", "", "", 0, ErrInvalidPhoneNumber},
+		{"fr too short", "+33 6 12 34 56 7", "", "", "", "", 0, ErrInvalidPhoneNumber},
+		{"gb national too short", "020 7946 00", "GB", "", "", "", 0, ErrInvalidPhoneNumber},
+		{"country code zero", "+000 1234567", "", "", "", "", 0, ErrInvalidPhoneNumber},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			phoneNumber, err := ParsePhoneNumber(test.number, test.defaultRegion)
+			if err != test.err {
+				t.Fatalf("ParsePhoneNumber(%q, %q) error = %v, want %v", test.number, test.defaultRegion, err, test.err)
+			} else if nil != err {
+				return
+			}
+
+			if e164 := phoneNumber.E164(); e164 != test.e164 {
+				t.Errorf("E164() = %q, want %q", e164, test.e164)
+			}
+
+			if phoneNumber.Region != test.region {
+				t.Errorf("Region = %q, want %q", phoneNumber.Region, test.region)
+			}
+
+			if phoneNumber.Extension != test.extension {
+				t.Errorf("Extension = %q, want %q", phoneNumber.Extension, test.extension)
+			}
+
+			if phoneNumber.LineType != test.lineType {
+				t.Errorf("LineType = %s, want %s", phoneNumber.LineType, test.lineType)
+			}
+		})
+	}
+}
+
+func TestGetRegionFromZipCode(t *testing.T) {
+	tests := []struct {
+		zipCode string
+		region  string
+	}{
+		{"94103-1234", "US"},
+		{"94103", ""},
+		{"k1a 0b1", "CA"},
+		{"SW1A 1AA", "GB"},
+		{"D02 X285", "IE"},
+		{"1012 AB", "NL"},
+		{"00-950", "PL"},
+		{"1100-148", "PT"},
+		{"100-0001", "JP"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if region := GetRegionFromZipCode(test.zipCode); region != test.region {
+			t.Errorf("GetRegionFromZipCode(%q) = %q, want %q", test.zipCode, region, test.region)
+		}
+	}
+}
+
+func TestGetRegionFromLanguage(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		region         string
+	}{
+		{"en-GB,en;q=0.8", "GB"},
+		{"en_au", "AU"},
+		{"zh-Hant-HK", "HK"},
+		{"ja", "JP"},
+		{"en,fr-CH;q=0.5", "CH"},
+		{"en-ZZ,de-AT", "AT"},
+		{"en", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if region := GetRegionFromLanguage(test.acceptLanguage); region != test.region {
+			t.Errorf("GetRegionFromLanguage(%q) = %q, want %q", test.acceptLanguage, region, test.region)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package common
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	POW_ERROR              = "ProofOfWorkError"
+	RATE_COUNTER_LIFETIME  = time.Minute
+	RATE_COUNTER_MIN_COUNT = 0.01
+)
+
+var (
+	ErrMissingChallenge  = errors.New("Proof of work challenge missing")
+	ErrInvalidChallenge  = errors.New("Proof of work challenge invalid")
+	ErrChallengeMismatch = errors.New("Proof of work challenge issued for another application or ip address")
+	ErrChallengeExpired  = errors.New("Proof of work challenge expired")
+	ErrInvalidSolution   = errors.New("Proof of work solution invalid")
+	ErrChallengeUsed     = errors.New("Proof of work challenge already used")
+)
+
+// LeadingZeroBits counts the zero bits at the start of the hash
+func LeadingZeroBits(hash []byte) int {
+	count := 0
+	for _, hashByte := range hash {
+		if hashByte != 0 {
+			return count + bits.LeadingZeros8(hashByte)
+		}
+		count += 8
+	}
+
+	return count
+}
+
+func hashSolution(challenge string, solution string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(challenge + ":" + solution))
+}
+
+// IsSolution is true when SHA-256 of "<challenge>:<solution>" starts with difficulty zero bits
+func IsSolution(challenge string, solution string, difficulty int) bool {
+	hash := hashSolution(challenge, solution)
+	return LeadingZeroBits(hash[:]) >= difficulty
+}
+
+// Solve finds the smallest decimal counter solving the challenge, what a client does in its own
+// language.  Each extra bit of difficulty doubles the expected work.
+func Solve(challenge string, difficulty int) string {
+	for counter := uint64(0); ; counter++ {
+		solution := strconv.FormatUint(counter, 10)
+		if IsSolution(challenge, solution, difficulty) {
+			return solution
+		}
+	}
+}
+
+type decayingCount struct {
+	count     float64
+	updatedAt time.Time
+}
+
+// RateCounter estimates submissions a minute per key.  Counts decay exponentially with a lifetime
+// of a minute, so a steady rate settles on that many a minute without keeping every submission.
+type RateCounter struct {
+	counts map[string]*decayingCount
+	mutex  sync.Mutex
+}
+
+func NewRateCounter() *RateCounter {
+	rateCounter := new(RateCounter)
+	rateCounter.counts = make(map[string]*decayingCount)
+	return rateCounter
+}
+
+func (counter *decayingCount) decay(now time.Time) {
+	counter.count *= math.Exp(-now.Sub(counter.updatedAt).Seconds() / RATE_COUNTER_LIFETIME.Seconds())
+	counter.updatedAt = now
+}
+
+// Add counts amount more for the key and returns its rate
+func (rateCounter *RateCounter) Add(key string, amount float64) float64 {
+	now := time.Now()
+
+	rateCounter.mutex.Lock()
+	defer rateCounter.mutex.Unlock()
+
+	counter, exists := rateCounter.counts[key]
+	if !exists {
+		if amount == 0 {
+			return 0
+		}
+		counter = &decayingCount{updatedAt: now}
+		rateCounter.counts[key] = counter
+	}
+
+	counter.decay(now)
+	counter.count += amount
+	return counter.count
+}
+
+// Rate returns the key's rate without counting anything
+func (rateCounter *RateCounter) Rate(key string) float64 {
+	return rateCounter.Add(key, 0)
+}
+
+// Prune removes keys that have decayed to almost nothing
+func (rateCounter *RateCounter) Prune() {
+	now := time.Now()
+
+	rateCounter.mutex.Lock()
+	defer rateCounter.mutex.Unlock()
+
+	for key, counter := range rateCounter.counts {
+		counter.decay(now)
+		if counter.count < RATE_COUNTER_MIN_COUNT {
+			delete(rateCounter.counts, key)
+		}
+	}
+}
+
+// ProofOfWork issues and verifies signed single use hash puzzles.  A challenge's fields are the
+// application name, issue time in milliseconds, ip address, difficulty and a random nonce.  The
+// difficulty starts at BaseDifficulty bits and gains a bit each time the ip address's recent
+// submissions a minute double past RateThreshold, up to MaxDifficulty.
+type ProofOfWork struct {
+	Secret         []byte
+	BaseDifficulty int
+	MaxDifficulty  int
+	RateThreshold  float64
+	MaxAge         time.Duration
+	NonceStore     NonceStore
+	Submissions    *RateCounter
+}
+
+func NewProofOfWork(secret string, baseDifficulty int, maxDifficulty int, rateThreshold float64, maxAge time.Duration, nonceStore NonceStore) *ProofOfWork {
+	proofOfWork := new(ProofOfWork)
+
+	proofOfWork.Secret = []byte(secret)
+	proofOfWork.BaseDifficulty = baseDifficulty
+	proofOfWork.MaxDifficulty = maxDifficulty
+	proofOfWork.RateThreshold = rateThreshold
+	proofOfWork.MaxAge = maxAge
+	proofOfWork.NonceStore = nonceStore
+	proofOfWork.Submissions = NewRateCounter()
+
+	return proofOfWork
+}
+
+// Difficulty for the ip address's next challenge
+func (proofOfWork *ProofOfWork) Difficulty(ipAddress string) int {
+	difficulty := proofOfWork.BaseDifficulty
+
+	rate := proofOfWork.Submissions.Rate(ipAddress)
+	if proofOfWork.RateThreshold > 0 && rate > proofOfWork.RateThreshold {
+		difficulty += int(math.Ceil(math.Log2(rate / proofOfWork.RateThreshold)))
+	}
+
+	if difficulty > proofOfWork.MaxDifficulty {
+		difficulty = proofOfWork.MaxDifficulty
+	}
+
+	return difficulty
+}
+
+// RecordSubmission counts a submission from the ip address towards its difficulty
+func (proofOfWork *ProofOfWork) RecordSubmission(ipAddress string) {
+	proofOfWork.Submissions.Add(ipAddress, 1)
+}
+
+// Issue returns a challenge for the application name and ip address along with its difficulty and
+// when it expires
+func (proofOfWork *ProofOfWork) Issue(appName string, ipAddress string) (string, int, time.Time, error) {
+	nonce, err := getNonce()
+	if nil != err {
+		return "", 0, time.Time{}, err
+	}
+
+	issuedAt := time.Now()
+	difficulty := proofOfWork.Difficulty(ipAddress)
+	challenge := encodeSignedToken(proofOfWork.Secret, appName, getUnixMillis(issuedAt), ipAddress, strconv.Itoa(difficulty), nonce)
+
+	return challenge, difficulty, issuedAt.Add(proofOfWork.MaxAge), nil
+}
+
+// Verify checks the signature, that the challenge was issued for the application name and ip
+// address, its age, the solution against the difficulty the challenge was issued with and, last so
+// only solved challenges are used up, that it wasn't used before
+func (proofOfWork *ProofOfWork) Verify(challenge string, solution string, appName string, ipAddress string) error {
+	if len(challenge) == 0 {
+		return ErrMissingChallenge
+	}
+
+	fields, valid := decodeSignedToken(proofOfWork.Secret, challenge, 5)
+	if !valid {
+		return ErrInvalidChallenge
+	}
+
+	issuedAt, err := parseUnixMillis(fields[1])
+	if nil != err {
+		return ErrInvalidChallenge
+	}
+
+	difficulty, err := strconv.Atoi(fields[3])
+	if nil != err {
+		return ErrInvalidChallenge
+	}
+
+	if fields[0] != appName || fields[2] != ipAddress {
+		return ErrChallengeMismatch
+	}
+
+	if time.Since(issuedAt) > proofOfWork.MaxAge {
+		return ErrChallengeExpired
+	}
+
+	if !IsSolution(challenge, solution, difficulty) {
+		return ErrInvalidSolution
+	}
+
+	unused, err := proofOfWork.NonceStore.Use(fields[4], issuedAt.Add(proofOfWork.MaxAge))
+	if nil != err {
+		return err
+	} else if !unused {
+		return ErrChallengeUsed
+	}
+
+	return nil
+}
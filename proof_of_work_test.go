@@ -0,0 +1,216 @@
+package common
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestProofOfWork() *ProofOfWork {
+	return NewProofOfWork(TEST_SECRET, 4, 12, 2, time.Minute, NewMemoryNonceStore())
+}
+
+func getTestChallenge(secret string, appName string, issuedAt time.Time, ipAddress string, difficulty int) string {
+	return encodeSignedToken([]byte(secret), appName, getUnixMillis(issuedAt), ipAddress, strconv.Itoa(difficulty), "nonce")
+}
+
+// A solution that doesn't solve the challenge at the difficulty
+func getWrongSolution(challenge string, difficulty int) string {
+	for counter := 0; ; counter++ {
+		solution := strconv.Itoa(counter)
+		if !IsSolution(challenge, solution, difficulty) {
+			return solution
+		}
+	}
+}
+
+// A solution with at least easier zero bits but fewer than difficulty
+func getEasierSolution(challenge string, easier int, difficulty int) string {
+	for counter := 0; ; counter++ {
+		solution := strconv.Itoa(counter)
+		if IsSolution(challenge, solution, easier) && !IsSolution(challenge, solution, difficulty) {
+			return solution
+		}
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		hash  []byte
+		count int
+	}{
+		{[]byte{0x80}, 0},
+		{[]byte{0x01}, 7},
+		{[]byte{0x00, 0x40}, 9},
+		{[]byte{0x00, 0x00, 0xff}, 16},
+		{[]byte{0x00, 0x00}, 16},
+		{nil, 0},
+	}
+
+	for _, test := range tests {
+		if count := LeadingZeroBits(test.hash); count != test.count {
+			t.Errorf("LeadingZeroBits(%x) = %d, want %d", test.hash, count, test.count)
+		}
+	}
+}
+
+func TestProofOfWorkIssueSolveVerify(t *testing.T) {
+	proofOfWork := newTestProofOfWork()
+
+	challenge, difficulty, expiresAt, err := proofOfWork.Issue(TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if difficulty != proofOfWork.BaseDifficulty {
+		t.Errorf("Issue difficulty = %d, want %d", difficulty, proofOfWork.BaseDifficulty)
+	}
+
+	if until := time.Until(expiresAt); until <= 59*time.Second || until > time.Minute {
+		t.Errorf("Issue expires in %s, want a minute", until)
+	}
+
+	solution := Solve(challenge, difficulty)
+	if !IsSolution(challenge, solution, difficulty) {
+		t.Fatalf("Solve returned %q, which doesn't solve the challenge", solution)
+	}
+
+	err = proofOfWork.Verify(challenge, solution, TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Fatalf("Verify = %v, want nil", err)
+	}
+
+	err = proofOfWork.Verify(challenge, solution, TEST_APP_NAME, TEST_IP_ADDRESS)
+	if ErrChallengeUsed != err {
+		t.Errorf("Verify of a used challenge = %v, want %v", err, ErrChallengeUsed)
+	}
+}
+
+func TestProofOfWorkVerify(t *testing.T) {
+	now := time.Now()
+	valid := getTestChallenge(TEST_SECRET, TEST_APP_NAME, now, TEST_IP_ADDRESS, 4)
+	expired := getTestChallenge(TEST_SECRET, TEST_APP_NAME, now.Add(-2*time.Minute), TEST_IP_ADDRESS, 4)
+	harder := getTestChallenge(TEST_SECRET, TEST_APP_NAME, now, TEST_IP_ADDRESS, 8)
+
+	tests := []struct {
+		name      string
+		challenge string
+		solution  string
+		appName   string
+		ipAddress string
+		err       error
+	}{
+		{"solved", valid, Solve(valid, 4), TEST_APP_NAME, TEST_IP_ADDRESS, nil},
+		{"missing", "", "0", TEST_APP_NAME, TEST_IP_ADDRESS, ErrMissingChallenge},
+		{"garbage", "not a challenge", "0", TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidChallenge},
+		{"wrong secret", getTestChallenge("other secret", TEST_APP_NAME, now, TEST_IP_ADDRESS, 4), "0", TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidChallenge},
+		{"form token", getTestFormToken(TEST_SECRET, TEST_APP_NAME, now, TEST_IP_ADDRESS, "nonce"), "0", TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidChallenge},
+		{"bad difficulty", encodeSignedToken([]byte(TEST_SECRET), TEST_APP_NAME, getUnixMillis(now), TEST_IP_ADDRESS, "hard", "nonce"), "0", TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidChallenge},
+		{"other application", valid, Solve(valid, 4), "other", TEST_IP_ADDRESS, ErrChallengeMismatch},
+		{"other ip address", valid, Solve(valid, 4), TEST_APP_NAME, "192.0.2.11", ErrChallengeMismatch},
+		{"expired", expired, Solve(expired, 4), TEST_APP_NAME, TEST_IP_ADDRESS, ErrChallengeExpired},
+		{"wrong solution", valid, getWrongSolution(valid, 4), TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidSolution},
+		{"solved at a lower difficulty", harder, getEasierSolution(harder, 4, 8), TEST_APP_NAME, TEST_IP_ADDRESS, ErrInvalidSolution},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proofOfWork := newTestProofOfWork()
+
+			err := proofOfWork.Verify(test.challenge, test.solution, test.appName, test.ipAddress)
+			if test.err != err {
+				t.Errorf("Verify = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// Challenges refused for any other reason aren't used up
+func TestProofOfWorkVerifyUsesOnlySolvedChallenges(t *testing.T) {
+	proofOfWork := newTestProofOfWork()
+	challenge := getTestChallenge(TEST_SECRET, TEST_APP_NAME, time.Now(), TEST_IP_ADDRESS, 4)
+
+	err := proofOfWork.Verify(challenge, getWrongSolution(challenge, 4), TEST_APP_NAME, TEST_IP_ADDRESS)
+	if ErrInvalidSolution != err {
+		t.Fatalf("Verify = %v, want %v", err, ErrInvalidSolution)
+	}
+
+	err = proofOfWork.Verify(challenge, Solve(challenge, 4), TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Errorf("Verify after a wrong solution = %v, want nil", err)
+	}
+}
+
+func TestProofOfWorkDifficulty(t *testing.T) {
+	tests := []struct {
+		name        string
+		submissions int
+		difficulty  int
+	}{
+		{"no submissions", 0, 4},
+		{"at the threshold", 2, 4},
+		{"over the threshold", 3, 5},
+		{"over twice the threshold", 5, 6},
+		{"over four times the threshold", 9, 7},
+		{"capped", 10000, 12},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proofOfWork := newTestProofOfWork()
+			for iter := 0; iter < test.submissions; iter++ {
+				proofOfWork.RecordSubmission(TEST_IP_ADDRESS)
+			}
+
+			if difficulty := proofOfWork.Difficulty(TEST_IP_ADDRESS); difficulty != test.difficulty {
+				t.Errorf("Difficulty after %d submissions = %d, want %d", test.submissions, difficulty, test.difficulty)
+			}
+
+			//Other ip addresses aren't affected
+			if difficulty := proofOfWork.Difficulty("192.0.2.11"); difficulty != proofOfWork.BaseDifficulty {
+				t.Errorf("Difficulty of another ip address = %d, want %d", difficulty, proofOfWork.BaseDifficulty)
+			}
+		})
+	}
+}
+
+// Issued challenges carry the difficulty, and a solution at the base difficulty isn't enough
+func TestProofOfWorkIssueScalesDifficulty(t *testing.T) {
+	proofOfWork := newTestProofOfWork()
+	for iter := 0; iter < 9; iter++ {
+		proofOfWork.RecordSubmission(TEST_IP_ADDRESS)
+	}
+
+	challenge, difficulty, _, err := proofOfWork.Issue(TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Fatal(err)
+	} else if difficulty != 7 {
+		t.Fatalf("Issue difficulty = %d, want 7", difficulty)
+	}
+
+	err = proofOfWork.Verify(challenge, getEasierSolution(challenge, proofOfWork.BaseDifficulty, difficulty), TEST_APP_NAME, TEST_IP_ADDRESS)
+	if ErrInvalidSolution != err {
+		t.Errorf("Verify of an easier solution = %v, want %v", err, ErrInvalidSolution)
+	}
+
+	err = proofOfWork.Verify(challenge, Solve(challenge, difficulty), TEST_APP_NAME, TEST_IP_ADDRESS)
+	if nil != err {
+		t.Errorf("Verify = %v, want nil", err)
+	}
+}
+
+func TestRateCounterPrune(t *testing.T) {
+	rateCounter := NewRateCounter()
+	rateCounter.Add("active", 1)
+	rateCounter.counts["quiet"] = &decayingCount{count: 1, updatedAt: time.Now().Add(-10 * time.Minute)}
+
+	rateCounter.Prune()
+
+	if _, exists := rateCounter.counts["quiet"]; exists {
+		t.Error("Prune kept a key that decayed to almost nothing")
+	}
+
+	if _, exists := rateCounter.counts["active"]; !exists {
+		t.Error("Prune removed a recently counted key")
+	}
+}
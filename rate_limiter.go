@@ -0,0 +1,152 @@
+package common
+
+import (
+	"database/sql"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	RETRY_AFTER_HEADER     = "Retry-After"
+	TAKE_RATE_LIMIT_QUERY  = "SELECT prospects.take_rate_limit_token($1, $2, $3)"
+	PRUNE_RATE_LIMIT_QUERY = "DELETE FROM prospects.rate_limits WHERE full_at < NOW()"
+)
+
+// RateLimit is a token bucket refilled PerMinute times a minute holding at most Burst tokens.
+// A PerMinute of zero disables the limit and a Burst of zero holds a minute's worth.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+func (rateLimit RateLimit) Enabled() bool {
+	return rateLimit.PerMinute > 0
+}
+
+func (rateLimit RateLimit) getBurst() float64 {
+	if rateLimit.Burst > 0 {
+		return float64(rateLimit.Burst)
+	}
+
+	return float64(rateLimit.PerMinute)
+}
+
+func (rateLimit RateLimit) getRate() float64 {
+	return float64(rateLimit.PerMinute) / time.Minute.Seconds()
+}
+
+// Time for the bucket to refill from tokens to the needed amount
+func (rateLimit RateLimit) getRefillTime(tokens float64, needed float64) time.Duration {
+	if tokens >= needed {
+		return 0
+	}
+
+	return time.Duration(math.Ceil((needed - tokens) / rateLimit.getRate() * float64(time.Second)))
+}
+
+// RateLimiter takes tokens from buckets named by key.  Take reports whether a token was taken and,
+// when it wasn't, how long until one will be available.
+type RateLimiter interface {
+	Take(key string, rateLimit RateLimit) (bool, time.Duration, error)
+	Prune() error
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time
+}
+
+// MemoryRateLimiter keeps buckets in memory, so limits are per server
+type MemoryRateLimiter struct {
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	memoryRateLimiter := new(MemoryRateLimiter)
+	memoryRateLimiter.buckets = make(map[string]*tokenBucket)
+	return memoryRateLimiter
+}
+
+func (memoryRateLimiter *MemoryRateLimiter) Take(key string, rateLimit RateLimit) (bool, time.Duration, error) {
+	if !rateLimit.Enabled() {
+		return true, 0, nil
+	}
+
+	now := time.Now()
+	burst := rateLimit.getBurst()
+
+	memoryRateLimiter.mutex.Lock()
+	defer memoryRateLimiter.mutex.Unlock()
+
+	bucket, exists := memoryRateLimiter.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: burst, updatedAt: now}
+		memoryRateLimiter.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*rateLimit.getRate())
+	bucket.updatedAt = now
+
+	taken := bucket.tokens >= 1
+	if taken {
+		bucket.tokens--
+	}
+
+	bucket.fullAt = now.Add(rateLimit.getRefillTime(bucket.tokens, burst))
+
+	return taken, rateLimit.getRefillTime(bucket.tokens, 1), nil
+}
+
+// Prune forgets buckets that have refilled, since a new bucket starts full anyway
+func (memoryRateLimiter *MemoryRateLimiter) Prune() error {
+	now := time.Now()
+
+	memoryRateLimiter.mutex.Lock()
+	defer memoryRateLimiter.mutex.Unlock()
+
+	for key, bucket := range memoryRateLimiter.buckets {
+		if now.After(bucket.fullAt) {
+			delete(memoryRateLimiter.buckets, key)
+		}
+	}
+
+	return nil
+}
+
+// PostgresRateLimiter keeps buckets in prospects.rate_limits so every server shares the limits
+type PostgresRateLimiter struct {
+	Db *sql.DB
+}
+
+func NewPostgresRateLimiter(db *sql.DB) *PostgresRateLimiter {
+	postgresRateLimiter := new(PostgresRateLimiter)
+	postgresRateLimiter.Db = db
+	return postgresRateLimiter
+}
+
+func (postgresRateLimiter *PostgresRateLimiter) Take(key string, rateLimit RateLimit) (bool, time.Duration, error) {
+	if !rateLimit.Enabled() {
+		return true, 0, nil
+	}
+
+	//The function returns the tokens available before taking one
+	var tokens float64
+	err := postgresRateLimiter.Db.QueryRow(TAKE_RATE_LIMIT_QUERY, key, rateLimit.getBurst(), rateLimit.getRate()).Scan(&tokens)
+	if nil != err {
+		return true, 0, err
+	}
+
+	if tokens >= 1 {
+		return true, rateLimit.getRefillTime(tokens-1, 1), nil
+	}
+
+	return false, rateLimit.getRefillTime(tokens, 1), nil
+}
+
+func (postgresRateLimiter *PostgresRateLimiter) Prune() error {
+	_, err := postgresRateLimiter.Db.Exec(PRUNE_RATE_LIMIT_QUERY)
+	return err
+}
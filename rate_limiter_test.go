@@ -0,0 +1,117 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitRefillTime(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit RateLimit
+		tokens    float64
+		needed    float64
+		refill    time.Duration
+	}{
+		{"enough tokens", RateLimit{60, 0}, 2, 1, 0},
+		{"one token at one a second", RateLimit{60, 0}, 0, 1, time.Second},
+		{"half a token", RateLimit{60, 0}, 0.5, 1, 500 * time.Millisecond},
+		{"full bucket", RateLimit{30, 10}, 4, 10, 12 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if refill := test.rateLimit.getRefillTime(test.tokens, test.needed); refill != test.refill {
+				t.Errorf("getRefillTime(%g, %g) = %s, want %s", test.tokens, test.needed, refill, test.refill)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiterTake(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit RateLimit
+		takes     int
+		allowed   int
+	}{
+		{"disabled", RateLimit{0, 1}, 5, 5},
+		{"burst", RateLimit{60, 3}, 5, 3},
+		{"minute's worth without burst", RateLimit{2, 0}, 5, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rateLimiter := NewMemoryRateLimiter()
+
+			allowed := 0
+			var lastWait time.Duration
+			for take := 0; take < test.takes; take++ {
+				taken, wait, err := rateLimiter.Take("ip|tremont|192.0.2.10", test.rateLimit)
+				if nil != err {
+					t.Fatal(err)
+				}
+
+				if taken {
+					allowed++
+				}
+				lastWait = wait
+			}
+
+			if allowed != test.allowed {
+				t.Errorf("took %d tokens, want %d", allowed, test.allowed)
+			}
+
+			if test.rateLimit.Enabled() && (lastWait <= 0 || lastWait > time.Minute/time.Duration(test.rateLimit.PerMinute)) {
+				t.Errorf("wait after the bucket emptied = %s, want up to one token's refill", lastWait)
+			}
+
+			//Other keys have their own bucket
+			if taken, _, _ := rateLimiter.Take("ip|tremont|192.0.2.11", test.rateLimit); !taken {
+				t.Error("Take for another key was refused")
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiterRefill(t *testing.T) {
+	rateLimiter := NewMemoryRateLimiter()
+	rateLimit := RateLimit{PerMinute: 6000, Burst: 1}
+
+	if taken, _, _ := rateLimiter.Take("lead", rateLimit); !taken {
+		t.Fatal("first Take was refused")
+	}
+
+	taken, wait, _ := rateLimiter.Take("lead", rateLimit)
+	if taken {
+		t.Fatal("Take from an empty bucket succeeded")
+	}
+
+	time.Sleep(wait)
+
+	if taken, _, _ := rateLimiter.Take("lead", rateLimit); !taken {
+		t.Errorf("Take after waiting %s was refused", wait)
+	}
+}
+
+func TestMemoryRateLimiterPrune(t *testing.T) {
+	rateLimiter := NewMemoryRateLimiter()
+
+	rateLimiter.Take("fast", RateLimit{PerMinute: 6000, Burst: 1})
+	rateLimiter.Take("slow", RateLimit{PerMinute: 1, Burst: 1})
+
+	time.Sleep(20 * time.Millisecond)
+
+	err := rateLimiter.Prune()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if _, exists := rateLimiter.buckets["fast"]; exists {
+		t.Error("refilled bucket wasn't pruned")
+	}
+
+	if _, exists := rateLimiter.buckets["slow"]; !exists {
+		t.Error("bucket still refilling was pruned")
+	}
+}
@@ -64,7 +64,7 @@ func (urlset *UrlSet) AddUrl(newUrl Url) error {
 		err = fmt.Errorf("Invalid priority %f", newUrl.Priority)
 	}
 
-	if "" == string(newUrl.ChangeFrequency) {
+	if "" == newUrl.ChangeFrequency.String() {
 		err = fmt.Errorf("Invalid change frequency: %d", newUrl.ChangeFrequency)
 	}
 
@@ -0,0 +1,464 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SPOOL_SEGMENT_EXTENSION    = ".seg"
+	SPOOL_TEMPORARY_EXTENSION  = ".tmp"
+	SPOOL_QUARANTINE_EXTENSION = ".quarantine"
+	SPOOL_HEADER_SIZE          = 8
+	SPOOL_MAX_RECORD_SIZE      = 64 * 1024 * 1024
+)
+
+var ErrSpoolClosed = errors.New("Spool is closed")
+
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = 1 << iota
+	SyncInterval
+	SyncNever
+)
+
+func (syncPolicy SyncPolicy) String() string {
+	switch syncPolicy {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	default:
+		return ""
+	}
+}
+
+func ParseSyncPolicy(syncPolicyStr string) (SyncPolicy, error) {
+	switch syncPolicyStr {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return SyncInterval, fmt.Errorf("Invalid sync policy \"%s\" specified", syncPolicyStr)
+	}
+}
+
+func (syncPolicy *SyncPolicy) UnmarshalText(text []byte) error {
+	var err error
+	*syncPolicy, err = ParseSyncPolicy(string(text))
+	return err
+}
+
+// Spool is an append-only write-ahead log split into numbered segment files.  Records are
+// appended to the active segment, which is sealed by Rotate so it can be read back with
+// ReadSegment and removed with RemoveSegment once its records are safely committed.
+type Spool struct {
+	Directory    string
+	Policy       SyncPolicy
+	SyncInterval time.Duration
+	SegmentSize  int64
+	file         *os.File
+	writer       *bufio.Writer
+	size         int64
+	sequence     uint64
+	buffered     bool
+	unsynced     bool
+	closed       bool
+	mutex        sync.Mutex
+	done         chan bool
+}
+
+func segmentSequence(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, SPOOL_SEGMENT_EXTENSION) {
+		return 0, false
+	}
+
+	sequence, err := strconv.ParseUint(strings.TrimSuffix(name, SPOOL_SEGMENT_EXTENSION), 10, 64)
+	return sequence, nil == err
+}
+
+func NewSpool(directory string, policy SyncPolicy, syncInterval time.Duration, segmentSize int64) (*Spool, error) {
+	spool := new(Spool)
+
+	spool.Directory = directory
+	spool.Policy = policy
+	spool.SyncInterval = syncInterval
+	spool.SegmentSize = segmentSize
+
+	err := os.MkdirAll(directory, 0700)
+	if nil != err {
+		return nil, err
+	}
+
+	//Segments left behind by a previous run are replayed, so new records start a new segment
+	segments, err := spool.Segments()
+	if nil != err {
+		return nil, err
+	}
+
+	if len(segments) > 0 {
+		spool.sequence = segments[len(segments)-1]
+		slog.Info("Found spooled segments to replay", "count", len(segments), "directory", directory)
+	}
+
+	if SyncInterval == policy {
+		spool.done = make(chan bool)
+		go spool.syncLoop()
+	}
+
+	return spool, nil
+}
+
+func (spool *Spool) segmentPath(sequence uint64) string {
+	return filepath.Join(spool.Directory, fmt.Sprintf("%020d%s", sequence, SPOOL_SEGMENT_EXTENSION))
+}
+
+func (spool *Spool) quarantinePath(sequence uint64) string {
+	return filepath.Join(spool.Directory, fmt.Sprintf("%020d%s", sequence, SPOOL_QUARANTINE_EXTENSION))
+}
+
+// A created or renamed file only survives a crash once its directory is synced too
+func (spool *Spool) syncDirectory() error {
+	if SyncNever == spool.Policy {
+		return nil
+	}
+
+	directory, err := os.Open(spool.Directory)
+	if nil != err {
+		return err
+	}
+
+	err = directory.Sync()
+	closeErr := directory.Close()
+	if nil == err {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Segments returns the sequence numbers of every sealed segment in ascending order
+func (spool *Spool) Segments() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(spool.Directory)
+	if nil != err {
+		return nil, err
+	}
+
+	spool.mutex.Lock()
+	var activeSequence uint64
+	if nil != spool.file {
+		activeSequence = spool.sequence
+	}
+	spool.mutex.Unlock()
+
+	var segments []uint64
+	for _, entry := range entries {
+		sequence, ok := segmentSequence(entry.Name())
+		if ok && sequence != activeSequence {
+			segments = append(segments, sequence)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (spool *Spool) openSegment() error {
+	spool.sequence++
+
+	file, err := os.OpenFile(spool.segmentPath(spool.sequence), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if nil != err {
+		return err
+	}
+
+	err = spool.syncDirectory()
+	if nil != err {
+		file.Close()
+		return err
+	}
+
+	spool.file = file
+	spool.writer = bufio.NewWriter(file)
+	spool.size = 0
+
+	return nil
+}
+
+func (spool *Spool) flush(sync bool) error {
+	if nil == spool.file {
+		return nil
+	}
+
+	if spool.buffered {
+		err := spool.writer.Flush()
+		if nil != err {
+			return err
+		}
+
+		spool.buffered = false
+		spool.unsynced = true
+	}
+
+	if sync && spool.unsynced {
+		err := spool.file.Sync()
+		if nil != err {
+			return err
+		}
+
+		spool.unsynced = false
+	}
+
+	return nil
+}
+
+func (spool *Spool) seal() error {
+	if nil == spool.file {
+		return nil
+	}
+
+	err := spool.flush(SyncNever != spool.Policy)
+	closeErr := spool.file.Close()
+	spool.file = nil
+	spool.writer = nil
+
+	if nil == err {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Records are framed by their size and CRC-32 checksum, both big endian
+func writeRecord(writer io.Writer, record []byte) error {
+	var header [SPOOL_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(record))
+
+	_, err := writer.Write(header[:])
+	if nil == err {
+		_, err = writer.Write(record)
+	}
+
+	return err
+}
+
+// Append writes a record to the active segment, rotating it once it exceeds the segment size
+func (spool *Spool) Append(record []byte) error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	if spool.closed {
+		return ErrSpoolClosed
+	}
+
+	if nil == spool.file {
+		err := spool.openSegment()
+		if nil != err {
+			return err
+		}
+	}
+
+	err := writeRecord(spool.writer, record)
+	if nil != err {
+		return err
+	}
+
+	spool.size += int64(SPOOL_HEADER_SIZE + len(record))
+	spool.buffered = true
+
+	//Records must reach the kernel before the request is acknowledged
+	err = spool.flush(SyncAlways == spool.Policy)
+	if nil != err {
+		return err
+	}
+
+	if spool.size >= spool.SegmentSize {
+		err = spool.seal()
+	}
+
+	return err
+}
+
+// Rotate seals the active segment so its records become visible to Segments
+func (spool *Spool) Rotate() error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	return spool.seal()
+}
+
+// ReadSegment returns every intact record of a sealed segment, and the bytes of anything damaged.
+// A record failing its checksum is stepped over by its size, so the records after it are still
+// read.  A torn record at the end of a segment, left by a crash mid write, or an impossible size
+// ends the segment, and the rest of it is returned as damaged.
+func (spool *Spool) ReadSegment(sequence uint64) ([][]byte, []byte, error) {
+	contents, err := os.ReadFile(spool.segmentPath(sequence))
+	if nil != err {
+		return nil, nil, err
+	}
+
+	var (
+		records [][]byte
+		damaged []byte
+	)
+
+	for offset := 0; offset < len(contents); {
+		if len(contents)-offset < SPOOL_HEADER_SIZE {
+			slog.Warn("Truncated record header in spool segment", "segment", sequence, "offset", offset)
+			damaged = append(damaged, contents[offset:]...)
+			break
+		}
+
+		size := binary.BigEndian.Uint32(contents[offset : offset+4])
+		checksum := binary.BigEndian.Uint32(contents[offset+4 : offset+8])
+		if size > SPOOL_MAX_RECORD_SIZE || int(size) > len(contents)-offset-SPOOL_HEADER_SIZE {
+			slog.Warn("Invalid or truncated record in spool segment", "segment", sequence, "offset", offset, "size", size)
+			damaged = append(damaged, contents[offset:]...)
+			break
+		}
+
+		end := offset + SPOOL_HEADER_SIZE + int(size)
+		record := contents[offset+SPOOL_HEADER_SIZE : end]
+		if crc32.ChecksumIEEE(record) != checksum {
+			slog.Warn("Checksum mismatch in spool segment", "segment", sequence, "offset", offset)
+			damaged = append(damaged, contents[offset:end]...)
+		} else {
+			records = append(records, record)
+		}
+
+		offset = end
+	}
+
+	return records, damaged, nil
+}
+
+// Quarantine appends data that can't be replayed, such as damaged or undecodable records as they
+// were framed in the segment, to the segment's quarantine file.  Quarantine files are never replayed
+// or removed, so they can be inspected and repaired by hand.
+func (spool *Spool) Quarantine(sequence uint64, data []byte) error {
+	file, err := os.OpenFile(spool.quarantinePath(sequence), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if nil != err {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if nil == err && SyncNever != spool.Policy {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if nil == err {
+		err = closeErr
+	}
+
+	if nil == err {
+		err = spool.syncDirectory()
+	}
+
+	return err
+}
+
+func (spool *Spool) RemoveSegment(sequence uint64) error {
+	return os.Remove(spool.segmentPath(sequence))
+}
+
+// ReplaceSegment rewrites a sealed segment with only the given records, such as those that
+// couldn't be committed yet.  The new segment is written beside the old and renamed over it, so
+// a crash leaves one or the other.
+func (spool *Spool) ReplaceSegment(sequence uint64, records [][]byte) error {
+	path := spool.segmentPath(sequence)
+	temporaryPath := path + SPOOL_TEMPORARY_EXTENSION
+
+	file, err := os.OpenFile(temporaryPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if nil != err {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		err = writeRecord(writer, record)
+		if nil != err {
+			break
+		}
+	}
+
+	if nil == err {
+		err = writer.Flush()
+	}
+
+	if nil == err && SyncNever != spool.Policy {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if nil == err {
+		err = closeErr
+	}
+
+	if nil != err {
+		os.Remove(temporaryPath)
+		return err
+	}
+
+	err = os.Rename(temporaryPath, path)
+	if nil != err {
+		return err
+	}
+
+	return spool.syncDirectory()
+}
+
+func (spool *Spool) syncLoop() {
+	ticker := time.NewTicker(spool.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			spool.mutex.Lock()
+			err := spool.flush(true)
+			spool.mutex.Unlock()
+
+			if nil != err {
+				slog.Error("Error syncing spool", "error", err)
+			}
+		case <-spool.done:
+			return
+		}
+	}
+}
+
+func (spool *Spool) Close() error {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+
+	if spool.closed {
+		return nil
+	}
+
+	spool.closed = true
+	if nil != spool.done {
+		close(spool.done)
+	}
+
+	return spool.seal()
+}
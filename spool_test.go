@@ -0,0 +1,367 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestSpool(t *testing.T, segmentSize int64) *Spool {
+	t.Helper()
+
+	spool, err := NewSpool(t.TempDir(), SyncAlways, time.Second, segmentSize)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		spool.Close()
+	})
+
+	return spool
+}
+
+func appendRecords(t *testing.T, spool *Spool, records [][]byte) {
+	t.Helper()
+
+	for _, record := range records {
+		err := spool.Append(record)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	err := spool.Rotate()
+	if nil != err {
+		t.Fatal(err)
+	}
+}
+
+func getFramedRecord(record []byte) []byte {
+	framed := make([]byte, SPOOL_HEADER_SIZE, SPOOL_HEADER_SIZE+len(record))
+	binary.BigEndian.PutUint32(framed[0:4], uint32(len(record)))
+	binary.BigEndian.PutUint32(framed[4:8], crc32.ChecksumIEEE(record))
+	return append(framed, record...)
+}
+
+func TestWriteRecord(t *testing.T) {
+	tests := []struct {
+		name   string
+		record []byte
+		header []byte
+	}{
+		{"empty", []byte{}, []byte{0, 0, 0, 0, 0, 0, 0, 0}},
+		{"text", []byte("hello"), []byte{0, 0, 0, 5, 0x36, 0x10, 0xa6, 0x86}},
+		{"binary", []byte{0, 0xff, 0x10}, append([]byte{0, 0, 0, 3}, binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE([]byte{0, 0xff, 0x10}))...)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			err := writeRecord(&buffer, test.record)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			expected := append(append([]byte{}, test.header...), test.record...)
+			if !bytes.Equal(buffer.Bytes(), expected) {
+				t.Errorf("writeRecord(%q) wrote %x, want %x", test.record, buffer.Bytes(), expected)
+			}
+		})
+	}
+}
+
+func TestSpoolRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]byte
+	}{
+		{"single", [][]byte{[]byte(`{"AppName":"tremont"}`)}},
+		{"several", [][]byte{[]byte("one"), []byte("two"), []byte("three")}},
+		{"empty record", [][]byte{[]byte("before"), {}, []byte("after")}},
+		{"binary", [][]byte{{0, 1, 2, 0xff}, bytes.Repeat([]byte{0xaa}, 4096)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, 1<<20)
+			appendRecords(t, spool, test.records)
+
+			segments, err := spool.Segments()
+			if nil != err {
+				t.Fatal(err)
+			} else if len(segments) != 1 {
+				t.Fatalf("Segments() = %v, want one segment", segments)
+			}
+
+			records, _, err := spool.ReadSegment(segments[0])
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if len(records) != len(test.records) {
+				t.Fatalf("ReadSegment() returned %d records, want %d", len(records), len(test.records))
+			}
+
+			for index := range records {
+				if !bytes.Equal(records[index], test.records[index]) {
+					t.Errorf("record %d = %q, want %q", index, records[index], test.records[index])
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolReadSegmentDamage(t *testing.T) {
+	first := getFramedRecord([]byte("first"))
+	second := getFramedRecord([]byte("second"))
+	third := getFramedRecord([]byte("third"))
+
+	corrupted := append([]byte{}, second...)
+	corrupted[len(corrupted)-1] ^= 0xff
+
+	oversized := make([]byte, SPOOL_HEADER_SIZE)
+	binary.BigEndian.PutUint32(oversized[0:4], SPOOL_MAX_RECORD_SIZE+1)
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name     string
+		contents []byte
+		expected [][]byte
+		damaged  []byte
+	}{
+		{"intact", join(first, second), [][]byte{[]byte("first"), []byte("second")}, nil},
+		{"torn header", join(first, second[:5]), [][]byte{[]byte("first")}, second[:5]},
+		{"torn record", join(first, second[:len(second)-2]), [][]byte{[]byte("first")}, second[:len(second)-2]},
+		{"checksum mismatch", join(first, corrupted), [][]byte{[]byte("first")}, corrupted},
+		{"checksum mismatch mid segment", join(first, corrupted, third), [][]byte{[]byte("first"), []byte("third")}, corrupted},
+		{"oversized record", join(first, oversized, third), [][]byte{[]byte("first")}, join(oversized, third)},
+		{"damaged first record", join(corrupted, first), [][]byte{[]byte("first")}, corrupted},
+		{"empty segment", []byte{}, nil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, 1<<20)
+
+			err := os.WriteFile(spool.segmentPath(1), test.contents, 0600)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			records, damaged, err := spool.ReadSegment(1)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(records, test.expected) {
+				t.Errorf("ReadSegment() = %q, want %q", records, test.expected)
+			}
+
+			if !bytes.Equal(damaged, test.damaged) {
+				t.Errorf("ReadSegment() damaged = %x, want %x", damaged, test.damaged)
+			}
+		})
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	spool := newTestSpool(t, 1<<20)
+	appendRecords(t, spool, [][]byte{[]byte("one")})
+
+	for _, data := range [][]byte{[]byte("damaged"), []byte("undecodable")} {
+		err := spool.Quarantine(1, data)
+		if nil != err {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := os.ReadFile(spool.quarantinePath(1))
+	if nil != err {
+		t.Fatal(err)
+	} else if string(contents) != "damagedundecodable" {
+		t.Errorf("quarantine file holds %q, want %q", contents, "damagedundecodable")
+	}
+
+	//Quarantine files aren't segments to replay
+	segments, err := spool.Segments()
+	if nil != err {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(segments, []uint64{1}) {
+		t.Errorf("Segments() = %v, want [1]", segments)
+	}
+}
+
+func TestSpoolRotatesAtSegmentSize(t *testing.T) {
+	tests := []struct {
+		name        string
+		segmentSize int64
+		records     int
+		segments    int
+	}{
+		{"one segment", 1 << 20, 10, 1},
+		{"record per segment", 1, 3, 3},
+		{"two records per segment", int64(2 * (SPOOL_HEADER_SIZE + 4)), 5, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, test.segmentSize)
+
+			var records [][]byte
+			for iter := 0; iter < test.records; iter++ {
+				records = append(records, []byte("abcd"))
+			}
+			appendRecords(t, spool, records)
+
+			segments, err := spool.Segments()
+			if nil != err {
+				t.Fatal(err)
+			} else if len(segments) != test.segments {
+				t.Fatalf("Segments() = %v, want %d segments", segments, test.segments)
+			}
+
+			count := 0
+			for index, segment := range segments {
+				if index > 0 && segment <= segments[index-1] {
+					t.Errorf("Segments() = %v, not in ascending order", segments)
+				}
+
+				segmentRecords, _, err := spool.ReadSegment(segment)
+				if nil != err {
+					t.Fatal(err)
+				}
+				count += len(segmentRecords)
+			}
+
+			if count != test.records {
+				t.Errorf("segments hold %d records, want %d", count, test.records)
+			}
+		})
+	}
+}
+
+func TestSpoolActiveSegmentHidden(t *testing.T) {
+	spool := newTestSpool(t, 1<<20)
+
+	err := spool.Append([]byte("unsealed"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	segments, err := spool.Segments()
+	if nil != err {
+		t.Fatal(err)
+	} else if len(segments) != 0 {
+		t.Errorf("Segments() = %v before Rotate, want none", segments)
+	}
+}
+
+func TestSpoolReplaceSegment(t *testing.T) {
+	tests := []struct {
+		name     string
+		records  [][]byte
+		replaced [][]byte
+	}{
+		{"keep one", [][]byte{[]byte("one"), []byte("two"), []byte("three")}, [][]byte{[]byte("two")}},
+		{"keep all", [][]byte{[]byte("one"), []byte("two")}, [][]byte{[]byte("one"), []byte("two")}},
+		{"keep none", [][]byte{[]byte("one")}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spool := newTestSpool(t, 1<<20)
+			appendRecords(t, spool, test.records)
+
+			segments, err := spool.Segments()
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			err = spool.ReplaceSegment(segments[0], test.replaced)
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			records, _, err := spool.ReadSegment(segments[0])
+			if nil != err {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(records, test.replaced) {
+				t.Errorf("ReadSegment() after ReplaceSegment = %q, want %q", records, test.replaced)
+			}
+
+			afterSegments, err := spool.Segments()
+			if nil != err {
+				t.Fatal(err)
+			} else if !reflect.DeepEqual(afterSegments, segments) {
+				t.Errorf("Segments() after ReplaceSegment = %v, want %v", afterSegments, segments)
+			}
+		})
+	}
+}
+
+func TestSpoolReopenContinuesSequence(t *testing.T) {
+	directory := t.TempDir()
+
+	spool, err := NewSpool(directory, SyncAlways, time.Second, 1)
+	if nil != err {
+		t.Fatal(err)
+	}
+	appendRecords(t, spool, [][]byte{[]byte("one"), []byte("two")})
+	spool.Close()
+
+	reopened, err := NewSpool(directory, SyncAlways, time.Second, 1)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	appendRecords(t, reopened, [][]byte{[]byte("three")})
+
+	segments, err := reopened.Segments()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	var records [][]byte
+	for _, segment := range segments {
+		segmentRecords, _, err := reopened.ReadSegment(segment)
+		if nil != err {
+			t.Fatal(err)
+		}
+		records = append(records, segmentRecords...)
+	}
+
+	expected := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("records after reopening = %q, want %q", records, expected)
+	}
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected SyncPolicy
+		valid    bool
+	}{
+		{"always", SyncAlways, true},
+		{"interval", SyncInterval, true},
+		{"never", SyncNever, true},
+		{"sometimes", SyncInterval, false},
+	}
+
+	for _, test := range tests {
+		syncPolicy, err := ParseSyncPolicy(test.value)
+		if syncPolicy != test.expected || (nil == err) != test.valid {
+			t.Errorf("ParseSyncPolicy(%q) = %s, %v", test.value, syncPolicy, err)
+		}
+	}
+}
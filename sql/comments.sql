@@ -4,19 +4,41 @@ COMMENT ON SCHEMA prospects IS 'Prospects schema holds all objects for applicati
 
 COMMENT ON TYPE gender IS 'Gender type between male or female';
 
+COMMENT ON TYPE api_scope IS 'Scope an api key is permitted to use, submit, read or admin';
+
+COMMENT ON TYPE insert_path IS 'Path a lead was inserted through, a single synchronous request, a batch request or the asynchronous queue';
+
 COMMENT ON TYPE lead_source IS 'Source lead was generated from';
 
+COMMENT ON TYPE phone_line_type IS 'Kind of line a phone number belongs to, as far as its prefix tells, fixed line, mobile, either where the numbering plan does not say, toll free, premium rate or unknown';
+
+COMMENT ON TYPE match_rule IS 'Reason a lead was assigned to a person, a new person, a matching e-mail address, phone number or name and zip code, or a manual merge or unmerge';
+
+COMMENT ON TABLE persons IS 'Table holds the canonical person each lead belongs to, assigned by the deduper across lead ids, e-mail addresses and applications';
+COMMENT ON COLUMN persons.id IS 'Primary key id of the person, the canonical person_id.';
+COMMENT ON COLUMN persons.merged_into IS 'Person this person was merged into, after which it has no leads.';
+COMMENT ON COLUMN persons.is_manual IS 'Determines if the person was changed by a manual merge or unmerge, after which the deduper no longer merges it automatically.';
+COMMENT ON COLUMN persons.created_at IS 'Timestamp of person creation.';
+COMMENT ON COLUMN persons.updated_at IS 'Timestamp of last time person was updated.';
+COMMENT ON CONSTRAINT persons_pkey ON persons IS 'Primary key constraint for persons id column.';
+COMMENT ON CONSTRAINT persons_merged_into_fkey ON persons IS 'Foreign key constraint for the person a person was merged into.';
+COMMENT ON CONSTRAINT persons_check ON persons IS 'Check constraint used to enforce that a person is not merged into itself.';
+
 COMMENT ON TABLE leads IS 'Leads table provides unnormalized data for every data point a potential customer is willing to provide. A lead can use multiple rows to provide different data, depending on the interface workflow they''ve chosen.';
 
 COMMENT ON COLUMN leads.id IS 'Primary key id of the current lead''s interaction.';
 COMMENT ON COLUMN leads.lead_id IS 'Unique id (uuid) of the lead.';
 COMMENT ON COLUMN leads.app_name IS 'Application name that lead is for.';
-COMMENT ON COLUMN leads.email IS 'E-mail address of the lead.';
+COMMENT ON COLUMN leads.email IS 'E-mail address of the lead, as it was typed.';
+COMMENT ON COLUMN leads.email_canonical IS 'Canonical e-mail address of the lead.  Lower cased, with a punycode domain and without the dots and tags a known provider ignores, so addresses delivered to the same mailbox are equal.';
 COMMENT ON COLUMN leads.lead_source IS 'Source lead was generated from.';
 COMMENT ON COLUMN leads.feedback IS 'Feedback provided by lead.';
 COMMENT ON COLUMN leads.first_name IS 'First name of lead.';
 COMMENT ON COLUMN leads.last_name IS 'Last name of lead.';
-COMMENT ON COLUMN leads.phone_number IS 'Phone number of lead.';
+COMMENT ON COLUMN leads.phone_number IS 'Phone number of lead, as it was typed.';
+COMMENT ON COLUMN leads.phone_e164 IS 'Phone number of lead in E.164 format, parsed at submission.';
+COMMENT ON COLUMN leads.phone_country IS 'ISO 3166 region of the phone number, NULL for country calling codes without metadata.';
+COMMENT ON COLUMN leads.phone_line_type IS 'Line type of the phone number, as far as its prefix tells.';
 COMMENT ON COLUMN leads.gender IS 'Gender of lead.';
 COMMENT ON COLUMN leads.language IS 'Language setting of lead.';
 COMMENT ON COLUMN leads.dob IS 'Date of birth of the lead.';
@@ -28,6 +50,9 @@ COMMENT ON COLUMN leads.cookies IS 'Available cookies of lead.';
 COMMENT ON COLUMN leads.geolocation IS 'Latitude and Longtiude of lead.';
 COMMENT ON COLUMN leads.ip_address IS 'IP address of lead.';
 COMMENT ON COLUMN leads.miscellaneous IS 'Adhoc miscellaneous data that can be provided.';
+COMMENT ON COLUMN leads.suspicious_origin IS 'Origin the lead was submitted from when the application does not allow it and flags rather than rejects.';
+COMMENT ON COLUMN leads.suspected_bot IS 'Determines if robot detection flagged the lead in shadow mode.';
+COMMENT ON COLUMN leads.person_id IS 'Canonical person the lead belongs to.  NULL until the deduper has matched the lead.';
 COMMENT ON COLUMN leads.was_processed IS 'Determines if lead information verification was attempted or not.';
 COMMENT ON COLUMN leads.is_valid IS 'Determines if lead was determined to be valid or not.';
 COMMENT ON COLUMN leads.replied_to IS 'Determines if lead was replied to or not.';
@@ -40,8 +65,13 @@ COMMENT ON CONSTRAINT leads_check1 ON leads IS 'Check constraint used to enforce
 COMMENT ON CONSTRAINT leads_check2 ON leads IS 'Check constraint used to enforce that a given lead with a phone source has a phone number.';
 COMMENT ON CONSTRAINT leads_check3 ON leads IS 'Check constraint used to enforce that a given lead with a feedback source has feedback.';
 COMMENT ON CONSTRAINT leads_check4 ON leads IS 'Check constraint used to enforce that a given lead with a extended source has an extended field.';
+COMMENT ON CONSTRAINT leads_check5 ON leads IS 'Check constraint used to enforce that a phone number country and line type come with an E.164 phone number.';
 COMMENT ON CONSTRAINT leads_email_check ON leads IS 'Check constraint used to enforce correct e-mail address format.';
+COMMENT ON CONSTRAINT leads_email_canonical_check ON leads IS 'Check constraint used to enforce correct canonical e-mail address format.';
+COMMENT ON CONSTRAINT leads_phone_e164_check ON leads IS 'Check constraint used to enforce E.164 phone number format.';
+COMMENT ON CONSTRAINT leads_phone_country_check ON leads IS 'Check constraint used to enforce a two letter region code.';
 COMMENT ON CONSTRAINT leads_geolocation_check ON leads IS 'Check constraint used to enforce correct values for latitude and longitude.';
+COMMENT ON CONSTRAINT leads_person_id_fkey ON leads IS 'Foreign key constraint for the person the lead belongs to.';
 
 COMMENT ON SEQUENCE leads_id_seq IS 'Primary key sequence for leads table.  Values are obfuscated since they''re used on public interfaces';
 
@@ -52,7 +82,8 @@ COMMENT ON RULE "_RETURN" ON sneezers IS 'Internal rule for sneezers view';
 COMMENT ON COLUMN sneezers.id IS 'Primary key of current lead''s interaction';
 COMMENT ON COLUMN sneezers.lead_id IS 'Unique id (uuid) of sneezer';
 COMMENT ON COLUMN sneezers.app_name IS 'Application name that sneezer is accessing';
-COMMENT ON COLUMN sneezers.email IS 'E-mail address of sneezer';
+COMMENT ON COLUMN sneezers.email IS 'Latest e-mail address of sneezer, as it was typed';
+COMMENT ON COLUMN sneezers.email_canonical IS 'Canonical e-mail address of sneezer, that the sneezer is grouped by';
 COMMENT ON COLUMN sneezers.lead_source IS 'Source lead was generated from';
 COMMENT ON COLUMN sneezers.feedback IS 'Feedback provided by sneezer';
 COMMENT ON COLUMN sneezers.first_name IS 'First name of sneezer';
@@ -70,11 +101,43 @@ COMMENT ON COLUMN sneezers.replied_to IS 'Determines if sneezer was replied to o
 COMMENT ON COLUMN sneezers.created_at IS 'Timestamp of sneezer creation';
 COMMENT ON COLUMN sneezers.updated_at IS 'Timestamp of last time sneezer was updated.';
 
+COMMENT ON VIEW person_sneezers IS 'Person sneezers aggregate relevant data, for a particular person and application, from the leads table, into a single row, however many lead ids and e-mail addresses the person used.  Leads the deduper has not matched to a person yet are a row of their own';
+
+COMMENT ON RULE "_RETURN" ON person_sneezers IS 'Internal rule for person_sneezers view';
+
+COMMENT ON COLUMN person_sneezers.id IS 'Primary key of person''s latest interaction';
+COMMENT ON COLUMN person_sneezers.person_id IS 'Canonical person id of sneezer, NULL until the deduper matches the lead';
+COMMENT ON COLUMN person_sneezers.lead_id IS 'Unique id (uuid) of sneezer''s latest interaction';
+COMMENT ON COLUMN person_sneezers.lead_ids IS 'Every unique id (uuid) the sneezer used';
+COMMENT ON COLUMN person_sneezers.app_name IS 'Application name that sneezer is accessing';
+COMMENT ON COLUMN person_sneezers.email IS 'Latest e-mail address of sneezer';
+COMMENT ON COLUMN person_sneezers.email_canonical IS 'Latest canonical e-mail address of sneezer';
+COMMENT ON COLUMN person_sneezers.lead_source IS 'Source lead was generated from';
+COMMENT ON COLUMN person_sneezers.feedback IS 'Feedback provided by sneezer';
+COMMENT ON COLUMN person_sneezers.first_name IS 'First name of sneezer';
+COMMENT ON COLUMN person_sneezers.last_name IS 'Last name of sneezer';
+COMMENT ON COLUMN person_sneezers.phone_number IS 'Latest phone number of sneezer';
+COMMENT ON COLUMN person_sneezers.dob IS 'Date of birth of sneezer';
+COMMENT ON COLUMN person_sneezers.gender IS 'Gender of sneezer';
+COMMENT ON COLUMN person_sneezers.zip_code IS 'Zip code of sneezer';
+COMMENT ON COLUMN person_sneezers.language IS 'Language setting of sneezer';
+COMMENT ON COLUMN person_sneezers.user_agent IS 'User agent of web browser used by sneezer';
+COMMENT ON COLUMN person_sneezers.miscellaneous IS 'Adhoc miscellaneous data that can be provided.';
+COMMENT ON COLUMN person_sneezers.was_processed IS 'Determines if sneezer information verification was attempted or not.';
+COMMENT ON COLUMN person_sneezers.is_valid IS 'Determines if sneezer was determined to be valid or not.';
+COMMENT ON COLUMN person_sneezers.replied_to IS 'Determines if sneezer was replied to or not, under any of their lead ids.';
+COMMENT ON COLUMN person_sneezers.created_at IS 'Timestamp of sneezer creation';
+COMMENT ON COLUMN person_sneezers.updated_at IS 'Timestamp of last time sneezer was updated.';
+
 COMMENT ON INDEX l_lead_id_idx IS 'Index for unique id generated by lead, that can span multiple rows.  This helps for querying all the data points that a lead has provided';
 COMMENT ON INDEX l_app_name_idx IS 'Index for application name.  This helps for querying all data points for a particular application';
 COMMENT ON INDEX l_email_idx IS 'Index for lead e-mail addresses.  This helps querying all data points for a particular e-mail address';
+COMMENT ON INDEX l_email_canonical_idx IS 'Index for canonical lead e-mail addresses.  This helps querying all data points for a mailbox, however the address was typed';
+COMMENT ON INDEX l_phone_e164_idx IS 'Index for lead phone numbers in E.164 format.  This helps querying all data points for a phone number, however it was typed';
 COMMENT ON INDEX l_referrer_idx IS 'Index for page referrers. This helps querying all data points for the web pages that referred us to a particular landing page containing the interacting form.';
 COMMENT ON INDEX l_misc_idx IS 'Index for miscellaneous jsonb field.  This will allow for any future potential data we want to add that isn''t currently modeled but yet we would want to search for.';
+COMMENT ON INDEX l_person_id_idx IS 'Index for the canonical person.  This helps querying all data points a person has provided under any lead id.';
+COMMENT ON INDEX l_unmatched_idx IS 'Partial index for leads the deduper has not matched to a person yet.';
 
 COMMENT ON TABLE imap_markers IS 'Table is used to track prospects received via e-mail';
 COMMENT ON COLUMN imap_markers.app_name IS 'Application name that lead is for.';
@@ -100,3 +163,158 @@ COMMENT ON CONSTRAINT mailer_queries_check ON mailer_queries IS 'Check constrain
 COMMENT ON CONSTRAINT mailer_queries_check1 ON mailer_queries IS 'Check constraint used to enforce that a update_status_identifer doesn''t exist without an update_status_query.';
 COMMENT ON CONSTRAINT mailer_queries_email_template_url_check ON mailer_queries IS 'Check constraint used to enforce that an email template url is on an http/https uri.';
 COMMENT ON CONSTRAINT mailer_queries_source_email_address_check ON mailer_queries IS 'Check constraint used to enforce that the source e-mail address is an the proper format.';
+
+COMMENT ON TABLE api_keys IS 'Table is used to authenticate api keys and map them to application names and scopes';
+COMMENT ON COLUMN api_keys.id IS 'Primary key id of the api key.';
+COMMENT ON COLUMN api_keys.key_id IS 'Public identifier of the api key, sent as the prefix of the key.';
+COMMENT ON COLUMN api_keys.key_hash IS 'SHA-256 hash of the full api key.  The key itself is never stored.';
+COMMENT ON COLUMN api_keys.description IS 'Description of who or what the api key was issued to.';
+COMMENT ON COLUMN api_keys.app_names IS 'Application names the api key may act on.  * allows every application.';
+COMMENT ON COLUMN api_keys.scopes IS 'Scopes the api key is permitted to use.';
+COMMENT ON COLUMN api_keys.is_active IS 'Determines if the api key can still be used or was revoked.';
+COMMENT ON COLUMN api_keys.created_at IS 'Timestamp of api key creation.';
+COMMENT ON COLUMN api_keys.updated_at IS 'Timestamp of last time api key was updated.';
+COMMENT ON CONSTRAINT api_keys_pkey ON api_keys IS 'Primary key constraint for api_keys id column.';
+COMMENT ON CONSTRAINT api_keys_key_id_key ON api_keys IS 'Unique constraint for api_keys key_id column.';
+COMMENT ON CONSTRAINT api_keys_app_names_check ON api_keys IS 'Check constraint used to enforce that an api key has at least one application name.';
+COMMENT ON CONSTRAINT api_keys_scopes_check ON api_keys IS 'Check constraint used to enforce that an api key has at least one scope.';
+COMMENT ON FUNCTION notify_api_keys_changed() IS 'Trigger function that notifies running servers of a revoked or changed api key.';
+COMMENT ON TRIGGER api_keys_changed ON api_keys IS 'Trigger used to evict cached api keys in running servers.';
+
+COMMENT ON TABLE failed_leads IS 'Table is used to keep leads that could not be inserted into the leads table so they can be fixed and replayed';
+COMMENT ON COLUMN failed_leads.id IS 'Primary key id of the failed lead.';
+COMMENT ON COLUMN failed_leads.lead_id IS 'Unique id generated by lead, if it was a valid uuid.';
+COMMENT ON COLUMN failed_leads.app_name IS 'Application name that lead is for.';
+COMMENT ON COLUMN failed_leads.payload IS 'Submitted lead as it would have been inserted.';
+COMMENT ON COLUMN failed_leads.insert_path IS 'Path the lead was being inserted through when it failed.';
+COMMENT ON COLUMN failed_leads.error_code IS 'Postgres SQLSTATE error code, if the database rejected the lead.';
+COMMENT ON COLUMN failed_leads.error_message IS 'Error message of the failed insert.';
+COMMENT ON COLUMN failed_leads.replayed_id IS 'Id of the leads row created when the failed lead was replayed.';
+COMMENT ON COLUMN failed_leads.replayed_at IS 'Timestamp of when the failed lead was replayed.';
+COMMENT ON COLUMN failed_leads.created_at IS 'Timestamp of the failed insert.';
+COMMENT ON COLUMN failed_leads.updated_at IS 'Timestamp of last time failed lead was updated.';
+COMMENT ON CONSTRAINT failed_leads_pkey ON failed_leads IS 'Primary key constraint for failed_leads id column.';
+COMMENT ON CONSTRAINT failed_leads_replayed_id_fkey ON failed_leads IS 'Foreign key constraint for the leads row created by a replay.';
+COMMENT ON CONSTRAINT failed_leads_check ON failed_leads IS 'Check constraint used to enforce that replayed id and replayed timestamp are set together.';
+COMMENT ON INDEX fl_app_name_idx IS 'Index for listing failed leads by application name.';
+COMMENT ON INDEX fl_unreplayed_idx IS 'Partial index for failed leads that have not been replayed yet.';
+
+COMMENT ON TYPE request_location IS 'Location of a field in a request, a header or the body';
+
+COMMENT ON TYPE origin_mismatch IS 'Handling of submissions from an origin the application does not allow, rejected or flagged';
+
+COMMENT ON TABLE applications IS 'Table holds the settings of each application name.  NULL settings take the server wide defaults from the environment.  Changes are sent to running servers through the prospects_applications notification channel.';
+COMMENT ON COLUMN applications.app_name IS 'Application name the settings are for.';
+COMMENT ON COLUMN applications.string_size_limit IS 'Maximum size of string fields submitted for the application.';
+COMMENT ON COLUMN applications.feedback_size_limit IS 'Maximum size of feedback submitted for the application.';
+COMMENT ON COLUMN applications.lead_sources IS 'Lead sources the application accepts.  NULL accepts every lead source.';
+COMMENT ON COLUMN applications.allowed_origins IS 'Origins allowed to submit leads for the application from a browser.  NULL takes ALLOWED_ORIGINS.';
+COMMENT ON COLUMN applications.verify_redirect_url IS 'Url leads are redirected to after verifying.';
+COMMENT ON COLUMN applications.botdetect_field_location IS 'Whether the robot detection field is a header or in the body.';
+COMMENT ON COLUMN applications.botdetect_field_name IS 'Name of the robot detection field.';
+COMMENT ON COLUMN applications.botdetect_field_value IS 'Value of the robot detection field.';
+COMMENT ON COLUMN applications.botdetect_must_match IS 'Determines if the robot detection field must match the value or must differ from it.';
+COMMENT ON COLUMN applications.botdetect_play_coy IS 'Determines if detected robots are told their lead was added.';
+COMMENT ON COLUMN applications.botdetect_threshold IS 'Robot detection score at which a submission is a robot.';
+COMMENT ON COLUMN applications.botdetect_shadow IS 'Determines if detected robots are added as suspected bots rather than discarded.';
+COMMENT ON COLUMN applications.origin_mismatch IS 'Determines if submissions from other origins are rejected or flagged as suspicious.';
+COMMENT ON COLUMN applications.ip_rate_limit IS 'Submissions a minute allowed per ip address, 0 for no limit.';
+COMMENT ON COLUMN applications.ip_rate_burst IS 'Submissions allowed at once per ip address, 0 for a minute worth.';
+COMMENT ON COLUMN applications.lead_rate_limit IS 'Submissions a minute allowed per lead id and per email, 0 for no limit.';
+COMMENT ON COLUMN applications.lead_rate_burst IS 'Submissions allowed at once per lead id and per email, 0 for a minute worth.';
+COMMENT ON COLUMN applications.pow_required IS 'Determines if browser submissions must solve a proof of work challenge.  NULL takes POW.';
+COMMENT ON COLUMN applications.phone_region IS 'ISO 3166 region phone numbers without a country calling code are parsed in.  NULL infers it from the submission, then takes PHONE_REGION.';
+COMMENT ON COLUMN applications.is_active IS 'Determines if the settings are used or the application falls back to the defaults.';
+COMMENT ON COLUMN applications.created_at IS 'Timestamp of application creation.';
+COMMENT ON COLUMN applications.updated_at IS 'Timestamp of last time application was updated.';
+COMMENT ON CONSTRAINT applications_pkey ON applications IS 'Primary key constraint for applications app_name column.';
+COMMENT ON CONSTRAINT applications_string_size_limit_check ON applications IS 'Check constraint used to enforce a positive string size limit.';
+COMMENT ON CONSTRAINT applications_feedback_size_limit_check ON applications IS 'Check constraint used to enforce a positive feedback size limit.';
+COMMENT ON CONSTRAINT applications_verify_redirect_url_check ON applications IS 'Check constraint used to enforce correct verify redirect url format.';
+COMMENT ON CONSTRAINT applications_botdetect_threshold_check ON applications IS 'Check constraint used to enforce a non negative robot detection threshold.';
+COMMENT ON CONSTRAINT applications_ip_rate_limit_check ON applications IS 'Check constraint used to enforce a non negative ip rate limit.';
+COMMENT ON CONSTRAINT applications_ip_rate_burst_check ON applications IS 'Check constraint used to enforce a non negative ip rate burst.';
+COMMENT ON CONSTRAINT applications_lead_rate_limit_check ON applications IS 'Check constraint used to enforce a non negative lead rate limit.';
+COMMENT ON CONSTRAINT applications_lead_rate_burst_check ON applications IS 'Check constraint used to enforce a non negative lead rate burst.';
+COMMENT ON CONSTRAINT applications_phone_region_check ON applications IS 'Check constraint used to enforce a two letter region code.';
+COMMENT ON FUNCTION notify_applications_changed() IS 'Trigger function that notifies running servers of a changed application.';
+COMMENT ON TRIGGER applications_changed ON applications IS 'Trigger used to reload applications in running servers.';
+
+COMMENT ON TABLE rate_limits IS 'Table is used to share submission rate limit token buckets between servers when RATE_LIMIT_STORE is postgres.';
+COMMENT ON COLUMN rate_limits.bucket_key IS 'Kind, application name and ip address, lead id or email the bucket limits.';
+COMMENT ON COLUMN rate_limits.tokens IS 'Tokens left in the bucket as of updated_at.';
+COMMENT ON COLUMN rate_limits.full_at IS 'Timestamp the bucket will be full again, after which it can be removed.';
+COMMENT ON COLUMN rate_limits.updated_at IS 'Timestamp of last time a token was taken.';
+COMMENT ON CONSTRAINT rate_limits_pkey ON rate_limits IS 'Primary key constraint for rate_limits bucket_key column.';
+COMMENT ON INDEX rl_full_at_idx IS 'Index used to remove refilled buckets.';
+COMMENT ON FUNCTION take_rate_limit_token(VARCHAR, DOUBLE PRECISION, DOUBLE PRECISION) IS 'Refills a bucket and takes a token when one is available, returning the tokens available before taking.';
+
+COMMENT ON TABLE bot_submissions IS 'Table is used to keep submissions robot detection flagged so false positives can be audited and promoted into the leads table';
+COMMENT ON COLUMN bot_submissions.id IS 'Primary key id of the bot submission.';
+COMMENT ON COLUMN bot_submissions.lead_id IS 'Unique id generated by lead, if it was a valid uuid.';
+COMMENT ON COLUMN bot_submissions.app_name IS 'Application name that lead is for.';
+COMMENT ON COLUMN bot_submissions.payload IS 'Submitted lead as it would have been inserted.';
+COMMENT ON COLUMN bot_submissions.headers IS 'Request headers, without credentials and cookies.';
+COMMENT ON COLUMN bot_submissions.ip_address IS 'IP address of submission.';
+COMMENT ON COLUMN bot_submissions.score IS 'Total robot detection score.';
+COMMENT ON COLUMN bot_submissions.detectors IS 'Detectors that contributed to the score.';
+COMMENT ON COLUMN bot_submissions.reasons IS 'Score and reason of each contributing detector.';
+COMMENT ON COLUMN bot_submissions.is_shadow IS 'Determines if the lead was still added, marked as a suspected bot, in shadow mode.';
+COMMENT ON COLUMN bot_submissions.promoted_id IS 'Id of the leads row created or unmarked when the submission was promoted.';
+COMMENT ON COLUMN bot_submissions.promoted_at IS 'Timestamp of when the submission was promoted.';
+COMMENT ON COLUMN bot_submissions.created_at IS 'Timestamp of the submission.';
+COMMENT ON COLUMN bot_submissions.updated_at IS 'Timestamp of last time bot submission was updated.';
+COMMENT ON CONSTRAINT bot_submissions_pkey ON bot_submissions IS 'Primary key constraint for bot_submissions id column.';
+COMMENT ON CONSTRAINT bot_submissions_promoted_id_fkey ON bot_submissions IS 'Foreign key constraint for the leads row of a promotion.';
+COMMENT ON CONSTRAINT bot_submissions_check ON bot_submissions IS 'Check constraint used to enforce that promoted id and promoted timestamp are set together.';
+COMMENT ON INDEX bs_app_name_idx IS 'Index for listing bot submissions by application name.';
+COMMENT ON INDEX bs_detectors_idx IS 'Index for listing bot submissions by contributing detector.';
+COMMENT ON INDEX bs_unpromoted_idx IS 'Partial index for bot submissions that have not been promoted yet.';
+
+COMMENT ON TABLE used_form_tokens IS 'Table is used to share used form token and proof of work challenge nonces between servers when FORM_TOKEN_STORE or POW_STORE is postgres, so each is only accepted once.';
+COMMENT ON COLUMN used_form_tokens.nonce IS 'Random nonce of the used form token or proof of work challenge.';
+COMMENT ON COLUMN used_form_tokens.expires_at IS 'Timestamp the form token or proof of work challenge expires, after which it can be removed.';
+COMMENT ON CONSTRAINT used_form_tokens_pkey ON used_form_tokens IS 'Primary key constraint for used_form_tokens nonce column.';
+COMMENT ON INDEX uft_expires_at_idx IS 'Index used to remove expired nonces.';
+
+COMMENT ON TABLE idempotency_keys IS 'Table is used to share responses to submissions sent with an Idempotency-Key header or submissionid between servers when IDEMPOTENCY_STORE is postgres, so a retried submission is answered with the original response rather than added again.';
+COMMENT ON COLUMN idempotency_keys.idempotency_key IS 'Application name and idempotency key sent by the client.';
+COMMENT ON COLUMN idempotency_keys.response_code IS 'HTTP status code of the original response.  NULL while the submission is in progress.';
+COMMENT ON COLUMN idempotency_keys.response_message IS 'Message of the original response.';
+COMMENT ON COLUMN idempotency_keys.response_id IS 'Id of the lead added by the original submission, NULL when added asynchronously.';
+COMMENT ON COLUMN idempotency_keys.expires_at IS 'Timestamp the response stops being replayed, after which it can be removed.';
+COMMENT ON COLUMN idempotency_keys.created_at IS 'Timestamp of the original submission.';
+COMMENT ON COLUMN idempotency_keys.updated_at IS 'Timestamp of last time the idempotency key was updated.';
+COMMENT ON CONSTRAINT idempotency_keys_pkey ON idempotency_keys IS 'Primary key constraint for idempotency_keys idempotency_key column.';
+COMMENT ON CONSTRAINT idempotency_keys_check ON idempotency_keys IS 'Check constraint that a response is only kept once its submission completed.';
+COMMENT ON INDEX ik_expires_at_idx IS 'Index used to remove expired idempotency keys.';
+
+COMMENT ON TABLE lead_match_keys IS 'Table holds the normalized keys the deduper matches each lead on';
+COMMENT ON COLUMN lead_match_keys.lead_row_id IS 'Id of the leads row the key was taken from.';
+COMMENT ON COLUMN lead_match_keys.match_rule IS 'Kind of key, an e-mail address, phone number or zip code.';
+COMMENT ON COLUMN lead_match_keys.match_key IS 'Normalized e-mail address, phone number or zip code.';
+COMMENT ON COLUMN lead_match_keys.full_name IS 'Normalized first and last name compared within a zip code.';
+COMMENT ON COLUMN lead_match_keys.created_at IS 'Timestamp of key creation.';
+COMMENT ON CONSTRAINT lead_match_keys_pkey ON lead_match_keys IS 'Primary key constraint for lead_match_keys lead_row_id and match_rule columns.';
+COMMENT ON CONSTRAINT lead_match_keys_lead_row_id_fkey ON lead_match_keys IS 'Foreign key constraint for the leads row the key was taken from.';
+COMMENT ON CONSTRAINT lead_match_keys_match_rule_check ON lead_match_keys IS 'Check constraint used to enforce that keys are only kept for matching rules.';
+COMMENT ON CONSTRAINT lead_match_keys_check ON lead_match_keys IS 'Check constraint used to enforce that name and zip code keys have a name.';
+COMMENT ON INDEX lmk_match_key_idx IS 'Index for finding leads with the same key.';
+
+COMMENT ON TABLE merge_decisions IS 'Table records every assignment of a lead to a person, automatic or manual, so merges can be reviewed and undone';
+COMMENT ON COLUMN merge_decisions.id IS 'Primary key id of the decision.';
+COMMENT ON COLUMN merge_decisions.lead_row_id IS 'Id of the leads row assigned.';
+COMMENT ON COLUMN merge_decisions.person_id IS 'Person the lead was assigned to.';
+COMMENT ON COLUMN merge_decisions.previous_person_id IS 'Person the lead belonged to before, NULL when first matched.';
+COMMENT ON COLUMN merge_decisions.matched_id IS 'Id of the leads row the lead matched, if matched automatically.';
+COMMENT ON COLUMN merge_decisions.match_rule IS 'Reason the lead was assigned to the person.';
+COMMENT ON COLUMN merge_decisions.similarity IS 'Jaro-Winkler similarity of the names for name and zip code matches.';
+COMMENT ON COLUMN merge_decisions.created_at IS 'Timestamp of the decision.';
+COMMENT ON CONSTRAINT merge_decisions_pkey ON merge_decisions IS 'Primary key constraint for merge_decisions id column.';
+COMMENT ON CONSTRAINT merge_decisions_lead_row_id_fkey ON merge_decisions IS 'Foreign key constraint for the leads row assigned.';
+COMMENT ON CONSTRAINT merge_decisions_person_id_fkey ON merge_decisions IS 'Foreign key constraint for the person assigned.';
+COMMENT ON CONSTRAINT merge_decisions_previous_person_id_fkey ON merge_decisions IS 'Foreign key constraint for the previous person.';
+COMMENT ON CONSTRAINT merge_decisions_matched_id_fkey ON merge_decisions IS 'Foreign key constraint for the leads row matched.';
+COMMENT ON CONSTRAINT merge_decisions_similarity_check ON merge_decisions IS 'Check constraint used to enforce that similarity is between 0 and 1.';
+COMMENT ON INDEX md_lead_row_id_idx IS 'Index for the decisions about a leads row.';
+COMMENT ON INDEX md_person_id_idx IS 'Index for the decisions about a person.';
@@ -6,14 +6,33 @@ SET search_path TO prospects,public;
 
 CREATE TYPE gender AS ENUM ('male', 'female');
 
+CREATE TYPE api_scope AS ENUM ('submit', 'read', 'admin');
+
+CREATE TYPE insert_path AS ENUM ('sync', 'batch', 'async');
+
 CREATE TYPE lead_source AS ENUM ('landing', 'email', 'phone', 'extended', 'feedback', 'pinterest', 'facebook', 'instagram', 'twitter', 'google', 'snapchat', 'youtube', 'popup');
 
+CREATE TYPE phone_line_type AS ENUM ('fixed_line', 'mobile', 'fixed_line_or_mobile', 'toll_free', 'premium_rate', 'unknown');
+
+CREATE TYPE match_rule AS ENUM ('new', 'email', 'phone', 'name_zip', 'merge', 'unmerge');
+
+CREATE TABLE persons
+(
+    id SERIAL8 NOT NULL PRIMARY KEY,
+    merged_into INT8 NULL REFERENCES persons(id),
+    is_manual BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK(merged_into IS NULL OR merged_into <> id)
+);
+
 CREATE TABLE leads
 (
     id SERIAL8 NOT NULL PRIMARY KEY,
     lead_id UUID NOT NULL,
     app_name VARCHAR NOT NULL,
     email VARCHAR NULL,
+    email_canonical VARCHAR NULL,
     lead_source LEAD_SOURCE NOT NULL,
     feedback VARCHAR NULL,
     referrer VARCHAR NULL,
@@ -21,6 +40,9 @@ CREATE TABLE leads
     first_name VARCHAR NULL,
     last_name VARCHAR NULL,
     phone_number VARCHAR NULL,
+    phone_e164 VARCHAR NULL,
+    phone_country VARCHAR NULL,
+    phone_line_type PHONE_LINE_TYPE NULL,
     dob DATE NULL,
     gender GENDER NULL,
     zip_code VARCHAR NULL,
@@ -30,18 +52,25 @@ CREATE TABLE leads
     geolocation POINT NULL,
     ip_address INET NULL,
     miscellaneous JSONB NULL,
+    suspicious_origin VARCHAR NULL,
+    suspected_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    person_id INT8 NULL REFERENCES persons(id),
     is_valid BOOLEAN NOT NULL DEFAULT FALSE,
     was_processed BOOLEAN NOT NULL DEFAULT FALSE,
     replied_to BOOLEAN NOT NULL DEFAULT FALSE,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL,
-    CHECK(email ~* '^[A-Za-z0-9._%-]+@[A-Za-z0-9.-]+[.][A-Za-z]+$'),
+    CHECK(email ~* '^[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+[.]([A-Za-z]+|xn--[A-Za-z0-9-]+)$'),
+    CHECK(email_canonical ~ '^[a-z0-9._%+-]+@[a-z0-9.-]+[.]([a-z]+|xn--[a-z0-9-]+)$'),
+    CHECK(phone_e164 ~ '^\+[1-9][0-9]{6,14}$'),
+    CHECK(phone_country ~ '^[A-Z]{2}$'),
     CHECK(geolocation[0] >= -90.0 AND geolocation[0] <= 90.0 AND geolocation[1] >= -180.0 AND geolocation[1] <= 180.0),
     CHECK(lead_source <> 'landing' OR (lead_source = 'landing' AND (email IS NOT NULL OR phone_number IS NOT NULL))),
     CHECK(lead_source <> 'phone' OR (lead_source = 'phone' AND phone_number IS NOT NULL)),
     CHECK(lead_source <> 'email' OR (lead_source = 'email' AND email IS NOT NULL)),
     CHECK(lead_source <> 'feedback' OR (lead_source = 'feedback' AND feedback IS NOT NULL)),
-    CHECK(lead_source <> 'extended' OR (lead_source = 'extended' AND (first_name IS NOT NULL OR last_name IS NOT NULL OR dob IS NOT NULL OR gender IS NOT NULL OR zip_code IS NOT NULL OR language IS NOT NULL OR miscellaneous IS NOT NULL)))
+    CHECK(lead_source <> 'extended' OR (lead_source = 'extended' AND (first_name IS NOT NULL OR last_name IS NOT NULL OR dob IS NOT NULL OR gender IS NOT NULL OR zip_code IS NOT NULL OR language IS NOT NULL OR miscellaneous IS NOT NULL))),
+    CHECK(phone_e164 IS NOT NULL OR (phone_country IS NULL AND phone_line_type IS NULL))
 );
 
 ALTER SEQUENCE leads_id_seq INCREMENT BY 7 START WITH 31337 RESTART WITH 31337;
@@ -51,7 +80,8 @@ AS
 SELECT MAX(id) AS id,
        lead_id,
        app_name,
-       email,
+       (ARRAY_AGG(email ORDER BY id DESC))[1] AS email,
+       COALESCE(email_canonical, email) AS email_canonical,
        replied_to,
        MAX(lead_source) AS lead_source,
        MAX(feedback) AS feedback,
@@ -70,7 +100,36 @@ SELECT MAX(id) AS id,
        MAX(updated_at) AS updated_at
 FROM leads
 WHERE is_valid = TRUE AND was_processed = TRUE
-GROUP BY lead_id, app_name, email, replied_to;
+GROUP BY lead_id, app_name, COALESCE(email_canonical, email), replied_to;
+
+CREATE OR REPLACE VIEW person_sneezers
+AS
+SELECT MAX(id) AS id,
+       MAX(person_id) AS person_id,
+       (ARRAY_AGG(lead_id ORDER BY id DESC))[1] AS lead_id,
+       ARRAY_AGG(DISTINCT lead_id) AS lead_ids,
+       app_name,
+       (ARRAY_AGG(email ORDER BY id DESC) FILTER (WHERE email IS NOT NULL))[1] AS email,
+       (ARRAY_AGG(email_canonical ORDER BY id DESC) FILTER (WHERE email_canonical IS NOT NULL))[1] AS email_canonical,
+       BOOL_OR(replied_to) AS replied_to,
+       MAX(lead_source) AS lead_source,
+       MAX(feedback) AS feedback,
+       MAX(first_name) AS first_name,
+       MAX(last_name) AS last_name,
+       (ARRAY_AGG(phone_number ORDER BY id DESC) FILTER (WHERE phone_number IS NOT NULL))[1] AS phone_number,
+       MAX(dob) AS dob,
+       MAX(gender) AS gender,
+       MAX(zip_code) AS zip_code,
+       MAX(language) AS language,
+       MAX(user_agent) AS user_agent,
+       JSON_AGG(miscellaneous) AS miscellaneous,
+       BOOL_OR(was_processed) AS was_processed,
+       BOOL_OR(is_valid) AS is_valid,
+       MAX(created_at) AS created_at,
+       MAX(updated_at) AS updated_at
+FROM leads
+WHERE is_valid = TRUE AND was_processed = TRUE
+GROUP BY COALESCE(person_id, -id), app_name;
 
 CREATE INDEX l_lead_id_idx ON leads(lead_id);
 
@@ -78,10 +137,18 @@ CREATE INDEX l_app_name_idx ON leads(app_name);
 
 CREATE INDEX l_email_idx ON leads(email);
 
+CREATE INDEX l_email_canonical_idx ON leads(email_canonical);
+
+CREATE INDEX l_phone_e164_idx ON leads(phone_e164);
+
 CREATE INDEX l_referrer_idx ON leads(page_referrer);
 
 CREATE INDEX l_misc_idx ON leads USING GIN(miscellaneous);
 
+CREATE INDEX l_person_id_idx ON leads(person_id);
+
+CREATE INDEX l_unmatched_idx ON leads(id) WHERE person_id IS NULL;
+
 CREATE TABLE imap_markers
 (
     app_name VARCHAR NOT NULL PRIMARY KEY,
@@ -108,3 +175,219 @@ CREATE TABLE mailer_queries
     CHECK(email_template_url ~* 'https?:\/\/.+'),
     CHECK(update_status_query IS NULL OR (update_status_query IS NOT NULL AND update_status_identifer IS NOT NULL))
 );
+
+CREATE TABLE api_keys
+(
+    id SERIAL8 NOT NULL PRIMARY KEY,
+    key_id VARCHAR NOT NULL UNIQUE,
+    key_hash VARCHAR NOT NULL,
+    description VARCHAR NULL,
+    app_names VARCHAR[] NOT NULL,
+    scopes API_SCOPE[] NOT NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK(array_length(app_names, 1) > 0),
+    CHECK(array_length(scopes, 1) > 0)
+);
+
+CREATE OR REPLACE FUNCTION notify_api_keys_changed() RETURNS TRIGGER
+AS $$
+BEGIN
+    PERFORM pg_notify('prospects_api_keys', OLD.key_id);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER api_keys_changed AFTER UPDATE OR DELETE ON api_keys
+FOR EACH ROW EXECUTE PROCEDURE notify_api_keys_changed();
+
+CREATE TABLE failed_leads
+(
+    id SERIAL8 NOT NULL PRIMARY KEY,
+    lead_id UUID NULL,
+    app_name VARCHAR NOT NULL,
+    payload JSONB NOT NULL,
+    insert_path INSERT_PATH NOT NULL,
+    error_code VARCHAR NULL,
+    error_message VARCHAR NOT NULL,
+    replayed_id INT8 NULL REFERENCES leads(id),
+    replayed_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK((replayed_id IS NULL AND replayed_at IS NULL) OR (replayed_id IS NOT NULL AND replayed_at IS NOT NULL))
+);
+
+CREATE INDEX fl_app_name_idx ON failed_leads(app_name);
+
+CREATE INDEX fl_unreplayed_idx ON failed_leads(id) WHERE replayed_at IS NULL;
+
+CREATE TYPE request_location AS ENUM ('header', 'body');
+
+CREATE TYPE origin_mismatch AS ENUM ('reject', 'flag');
+
+CREATE TABLE applications
+(
+    app_name VARCHAR NOT NULL PRIMARY KEY,
+    string_size_limit INT NULL,
+    feedback_size_limit INT NULL,
+    lead_sources LEAD_SOURCE[] NULL,
+    allowed_origins VARCHAR[] NULL,
+    verify_redirect_url VARCHAR NULL,
+    botdetect_field_location REQUEST_LOCATION NULL,
+    botdetect_field_name VARCHAR NULL,
+    botdetect_field_value VARCHAR NULL,
+    botdetect_must_match BOOLEAN NULL,
+    botdetect_play_coy BOOLEAN NULL,
+    botdetect_threshold DOUBLE PRECISION NULL,
+    botdetect_shadow BOOLEAN NULL,
+    origin_mismatch ORIGIN_MISMATCH NULL,
+    ip_rate_limit INT NULL,
+    ip_rate_burst INT NULL,
+    lead_rate_limit INT NULL,
+    lead_rate_burst INT NULL,
+    pow_required BOOLEAN NULL,
+    phone_region VARCHAR NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK(string_size_limit IS NULL OR string_size_limit > 0),
+    CHECK(feedback_size_limit IS NULL OR feedback_size_limit > 0),
+    CHECK(verify_redirect_url IS NULL OR verify_redirect_url ~* 'https?:\/\/.+'),
+    CHECK(botdetect_threshold IS NULL OR botdetect_threshold >= 0),
+    CHECK(ip_rate_limit IS NULL OR ip_rate_limit >= 0),
+    CHECK(ip_rate_burst IS NULL OR ip_rate_burst >= 0),
+    CHECK(lead_rate_limit IS NULL OR lead_rate_limit >= 0),
+    CHECK(lead_rate_burst IS NULL OR lead_rate_burst >= 0),
+    CHECK(phone_region IS NULL OR phone_region ~ '^[A-Z]{2}$')
+);
+
+CREATE OR REPLACE FUNCTION notify_applications_changed() RETURNS TRIGGER
+AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('prospects_applications', OLD.app_name);
+    ELSE
+        PERFORM pg_notify('prospects_applications', NEW.app_name);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER applications_changed AFTER INSERT OR UPDATE OR DELETE ON applications
+FOR EACH ROW EXECUTE PROCEDURE notify_applications_changed();
+
+CREATE TABLE rate_limits
+(
+    bucket_key VARCHAR NOT NULL PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    full_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX rl_full_at_idx ON rate_limits(full_at);
+
+CREATE OR REPLACE FUNCTION take_rate_limit_token(key_name VARCHAR, burst DOUBLE PRECISION, refill_rate DOUBLE PRECISION) RETURNS DOUBLE PRECISION
+AS $$
+DECLARE
+    available DOUBLE PRECISION;
+    remaining DOUBLE PRECISION;
+BEGIN
+    INSERT INTO prospects.rate_limits(bucket_key, tokens, full_at, updated_at) VALUES(key_name, burst, clock_timestamp(), clock_timestamp())
+    ON CONFLICT (bucket_key) DO NOTHING;
+
+    SELECT LEAST(burst, tokens + EXTRACT(EPOCH FROM clock_timestamp() - updated_at) * refill_rate) INTO available
+    FROM prospects.rate_limits WHERE bucket_key = key_name FOR UPDATE;
+
+    remaining := available;
+    IF available >= 1 THEN
+        remaining := available - 1;
+    END IF;
+
+    UPDATE prospects.rate_limits
+    SET tokens = remaining,
+        full_at = clock_timestamp() + (burst - remaining) / refill_rate * INTERVAL '1 second',
+        updated_at = clock_timestamp()
+    WHERE bucket_key = key_name;
+
+    RETURN available;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TABLE bot_submissions
+(
+    id SERIAL8 NOT NULL PRIMARY KEY,
+    lead_id UUID NULL,
+    app_name VARCHAR NOT NULL,
+    payload JSONB NOT NULL,
+    headers JSONB NOT NULL,
+    ip_address INET NULL,
+    score DOUBLE PRECISION NOT NULL,
+    detectors VARCHAR[] NOT NULL,
+    reasons VARCHAR[] NOT NULL,
+    is_shadow BOOLEAN NOT NULL,
+    promoted_id INT8 NULL REFERENCES leads(id),
+    promoted_at TIMESTAMP NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK((promoted_id IS NULL AND promoted_at IS NULL) OR (promoted_id IS NOT NULL AND promoted_at IS NOT NULL))
+);
+
+CREATE INDEX bs_app_name_idx ON bot_submissions(app_name);
+
+CREATE INDEX bs_detectors_idx ON bot_submissions USING GIN(detectors);
+
+CREATE INDEX bs_unpromoted_idx ON bot_submissions(id) WHERE promoted_at IS NULL;
+
+CREATE TABLE used_form_tokens
+(
+    nonce VARCHAR NOT NULL PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX uft_expires_at_idx ON used_form_tokens(expires_at);
+
+CREATE TABLE idempotency_keys
+(
+    idempotency_key VARCHAR NOT NULL PRIMARY KEY,
+    response_code INT NULL,
+    response_message VARCHAR NULL,
+    response_id BIGINT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP NOT NULL,
+    CHECK(response_code IS NOT NULL OR (response_message IS NULL AND response_id IS NULL))
+);
+
+CREATE INDEX ik_expires_at_idx ON idempotency_keys(expires_at);
+
+CREATE TABLE lead_match_keys
+(
+    lead_row_id INT8 NOT NULL REFERENCES leads(id),
+    match_rule MATCH_RULE NOT NULL,
+    match_key VARCHAR NOT NULL,
+    full_name VARCHAR NULL,
+    created_at TIMESTAMP NOT NULL,
+    PRIMARY KEY(lead_row_id, match_rule),
+    CHECK(match_rule IN ('email', 'phone', 'name_zip')),
+    CHECK(match_rule <> 'name_zip' OR full_name IS NOT NULL)
+);
+
+CREATE INDEX lmk_match_key_idx ON lead_match_keys(match_rule, match_key);
+
+CREATE TABLE merge_decisions
+(
+    id SERIAL8 NOT NULL PRIMARY KEY,
+    lead_row_id INT8 NOT NULL REFERENCES leads(id),
+    person_id INT8 NOT NULL REFERENCES persons(id),
+    previous_person_id INT8 NULL REFERENCES persons(id),
+    matched_id INT8 NULL REFERENCES leads(id),
+    match_rule MATCH_RULE NOT NULL,
+    similarity DOUBLE PRECISION NULL,
+    created_at TIMESTAMP NOT NULL,
+    CHECK(similarity IS NULL OR (similarity >= 0 AND similarity <= 1))
+);
+
+CREATE INDEX md_lead_row_id_idx ON merge_decisions(lead_row_id);
+
+CREATE INDEX md_person_id_idx ON merge_decisions(person_id);